@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"reddit-clone/logging"
+	"reddit-clone/tracing"
+	"time"
+)
+
+// accessEntryKey holds the *accessEntry for the request being served.
+type accessEntryKey struct{}
+
+// accessEntry collects what handlers report about a request for its access
+// log record.
+type accessEntry struct {
+	err error
+}
+
+// SetLogger sets the logger for access logs. It must be called before the
+// API serves requests.
+func (api *API) SetLogger(l *slog.Logger) {
+	api.logger = logging.OrDiscard(l)
+}
+
+// accessLog writes one record per request once it has been served. Server
+// errors are logged at error level with the underlying error, which is not
+// shown to the client.
+func (api *API) accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		entry := &accessEntry{}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), accessEntryKey{}, entry)))
+
+		level := slog.LevelInfo
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("route", routeSlotFrom(r.Context()).name()),
+			slog.Int("status", rec.status),
+			slog.Int64("bytes", rec.bytes),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("remote", r.RemoteAddr),
+		}
+		if span := tracing.FromContext(r.Context()); span != nil {
+			attrs = append(attrs, slog.String("trace_id", span.TraceID().String()))
+		}
+		if user := r.Header.Get("X-Username"); user != "" {
+			attrs = append(attrs, slog.String("user", user))
+		}
+		if rec.status >= 500 {
+			level = slog.LevelError
+			if entry.err != nil {
+				attrs = append(attrs, slog.String("error", entry.err.Error()))
+			}
+		}
+		api.logger.LogAttrs(r.Context(), level, "request", attrs...)
+	})
+}
+
+// noteError records err for the access log and on the current span.
+func noteError(r *http.Request, err error) {
+	tracing.FromContext(r.Context()).SetError(err)
+	if entry, ok := r.Context().Value(accessEntryKey{}).(*accessEntry); ok {
+		entry.err = err
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"reddit-clone/engine"
+	"strconv"
+	"time"
+)
+
+// defaultStatsDays is how many days of growth the stats cover by default.
+const defaultStatsDays = 30
+
+// adminRoutes registers the admin API. Every route requires the admin
+// token, and the user named by X-Username to have the admin role.
+func (api *API) adminRoutes() {
+	rt := api.router
+	rt.Handle("GET", "/api/v1/admin/stats", "getSiteStats", api.adminOnly(api.getSiteStats)).
+		Doc("Site totals and daily growth").Returns(SiteStatsResponse{}).WithQuery("days").AdminOnly()
+	rt.Handle("GET", "/api/v1/admin/users/{username}", "getUserHistory", api.adminOnly(api.getUserHistory)).
+		Doc("Look up a user with their content history").Returns(AdminUserResponse{}).AdminOnly()
+	rt.Handle("PUT", "/api/v1/admin/users/{username}/suspension", "suspendUser", api.adminOnly(api.suspendUser)).
+		Doc("Suspend a user site-wide").Accepts(SuspendRequest{}).AdminOnly()
+	rt.Handle("DELETE", "/api/v1/admin/users/{username}/suspension", "unsuspendUser", api.adminOnly(api.unsuspendUser)).
+		Doc("Lift a suspension").AdminOnly()
+	rt.Handle("PUT", "/api/v1/admin/users/{username}/username", "renameUser", api.adminOnly(api.renameUser)).
+		Doc("Force a username change").Accepts(RenameRequest{}).Returns(UserResponse{}).AdminOnly()
+	rt.Handle("PUT", "/api/v1/admin/users/{username}/admin", "grantAdmin", api.adminOnly(api.grantAdmin)).
+		Doc("Give a user the admin role").AdminOnly()
+	rt.Handle("DELETE", "/api/v1/admin/users/{username}/admin", "revokeAdmin", api.adminOnly(api.revokeAdmin)).
+		Doc("Take the admin role away").AdminOnly()
+	rt.Handle("PUT", "/api/v1/admin/r/{name}/name", "renameSubreddit", api.adminOnly(api.renameSubreddit)).
+		Doc("Force a subreddit name change").Accepts(RenameRequest{}).Returns(SubredditResponse{}).AdminOnly()
+	rt.Handle("PUT", "/api/v1/admin/messages/{id}/removal", "removeMessage", api.adminOnly(api.removeMessage)).
+		Doc("Remove a private message").Accepts(ModerationRequest{}).AdminOnly()
+	rt.Handle("DELETE", "/api/v1/admin/messages/{id}/removal", "restoreMessage", api.adminOnly(api.restoreMessage)).
+		Doc("Restore a removed message, or deliver one held for review").AdminOnly()
+	rt.Handle("GET", "/api/v1/admin/filters", "listSiteWordFilters", api.adminOnly(api.listWordFilters)).
+		Doc("List the word filters that apply across the site").Returns([]WordFilterResponse{}).AdminOnly()
+	rt.Handle("POST", "/api/v1/admin/filters", "addSiteWordFilter", api.adminOnly(api.addWordFilter)).
+		Doc("Filter a word, wildcard or regex in every post, comment and message").
+		Accepts(WordFilterRequest{}).Returns(WordFilterResponse{}).AdminOnly()
+	rt.Handle("DELETE", "/api/v1/admin/filters/{filter}", "removeSiteWordFilter", api.adminOnly(api.removeWordFilter)).
+		Doc("Remove a site-wide word filter").AdminOnly()
+	rt.Handle("GET", "/api/v1/admin/modqueue", "getSiteModQueue", api.adminOnly(api.getModQueue)).
+		Doc("List everything held for review across the site, newest first").Returns(ModQueueResponse{}).AdminOnly()
+	rt.Handle("GET", "/api/v1/admin/export", "exportData", api.adminOnly(api.exportData)).
+		Doc("Export users, subreddits, posts, comments, votes and messages as NDJSON").AdminOnly()
+	rt.Handle("POST", "/api/v1/admin/import", "importData", api.adminOnly(api.importData)).
+		Doc("Import an NDJSON export or a Pushshift dump, giving everything new IDs").
+		Returns(ImportResponse{}).WithQuery("format").AdminOnly().LimitBody(maxImportBytes)
+	rt.Handle("GET", "/api/v1/admin/vote-rings", "getVoteRings", api.adminOnly(api.getVoteRings)).
+		Doc("Find groups of accounts that vote together").Returns(VoteRingReportResponse{}).AdminOnly()
+	rt.Handle("PUT", "/api/v1/admin/vote-rings/{ring}/discount", "discountVoteRing", api.adminOnly(api.discountVoteRing)).
+		Doc("Leave a vote ring's votes out of scores and karma").Returns(VoteRingResponse{}).AdminOnly()
+	rt.Handle("DELETE", "/api/v1/admin/vote-rings/{ring}/discount", "restoreVoteRing", api.adminOnly(api.restoreVoteRing)).
+		Doc("Count a vote ring's votes again").Returns(VoteRingResponse{}).AdminOnly()
+}
+
+// maxImportBytes bounds the body of an import, which may be a whole site.
+const maxImportBytes = 256 << 20
+
+func (api *API) getSiteStats(w http.ResponseWriter, r *http.Request) {
+	days, err := statsDays(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Cache-Control", cachePrivate)
+	writeJSON(w, r, siteStatsResponse(api.engine.SiteStats(r.Context(), days)))
+}
+
+// statsDays reads the days query parameter.
+func statsDays(r *http.Request) (int, error) {
+	v := r.URL.Query().Get("days")
+	if v == "" {
+		return defaultStatsDays, nil
+	}
+	days, err := strconv.Atoi(v)
+	if err != nil || days < 1 || days > 366 {
+		return 0, badRequest("days must be between 1 and 366")
+	}
+	return days, nil
+}
+
+func (api *API) getUserHistory(w http.ResponseWriter, r *http.Request) {
+	user, err := api.engine.LookupUserContext(r.Context(), pathParam(r, "username"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Cache-Control", cachePrivate)
+	writeJSON(w, r, api.adminUser(r, user))
+}
+
+// adminUser builds a user's admin view.
+func (api *API) adminUser(r *http.Request, user *engine.User) *AdminUserResponse {
+	history := api.engine.UserHistory(r.Context(), user)
+	m := api.newMapper(r)
+	return mapOne(r.Context(), api.engine, user, func(u *engine.User) *AdminUserResponse { return m.adminUser(u, history) })
+}
+
+func (api *API) suspendUser(w http.ResponseWriter, r *http.Request) {
+	var req SuspendRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	until, err := suspensionEnd(req.Duration)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	api.adminUserAction(w, r, func(actor, user *engine.User) error {
+		return api.engine.SuspendUser(r.Context(), actor, user, req.Reason, until)
+	})
+}
+
+// suspensionEnd converts a duration such as "72h" to the time a suspension
+// ends. An empty duration means an indefinite suspension.
+func suspensionEnd(duration string) (time.Time, error) {
+	if duration == "" {
+		return time.Time{}, nil
+	}
+	d, err := time.ParseDuration(duration)
+	if err != nil || d <= 0 {
+		return time.Time{}, badRequest("duration must be a positive Go duration such as 72h")
+	}
+	return time.Now().Add(d), nil
+}
+
+func (api *API) unsuspendUser(w http.ResponseWriter, r *http.Request) {
+	api.adminUserAction(w, r, func(actor, user *engine.User) error {
+		return api.engine.UnsuspendUser(r.Context(), actor, user)
+	})
+}
+
+func (api *API) grantAdmin(w http.ResponseWriter, r *http.Request) {
+	api.adminUserAction(w, r, func(actor, user *engine.User) error {
+		return api.engine.GrantAdmin(r.Context(), actor, user)
+	})
+}
+
+func (api *API) revokeAdmin(w http.ResponseWriter, r *http.Request) {
+	api.adminUserAction(w, r, func(actor, user *engine.User) error {
+		return api.engine.RevokeAdmin(r.Context(), actor, user)
+	})
+}
+
+// adminUserAction resolves the actor and the "{username}" path parameter
+// and applies fn to them.
+func (api *API) adminUserAction(w http.ResponseWriter, r *http.Request, fn func(actor, user *engine.User) error) {
+	actor, err := api.actor(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	user, err := api.engine.LookupUserContext(r.Context(), pathParam(r, "username"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := fn(actor, user); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (api *API) renameUser(w http.ResponseWriter, r *http.Request) {
+	var req RenameRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	actor, err := api.actor(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	user, err := api.engine.LookupUserContext(r.Context(), pathParam(r, "username"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := api.engine.RenameUser(r.Context(), actor, user, req.Name); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, mapOne(r.Context(), api.engine, user, api.newMapper(r).user))
+}
+
+func (api *API) renameSubreddit(w http.ResponseWriter, r *http.Request) {
+	var req RenameRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	actor, err := api.actor(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	subreddit, err := api.engine.LookupSubRedditContext(r.Context(), pathParam(r, "name"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := api.engine.RenameSubReddit(r.Context(), actor, subreddit, req.Name); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, mapOne(r.Context(), api.engine, subreddit, api.newMapper(r).subreddit))
+}
+
+func (api *API) removeMessage(w http.ResponseWriter, r *http.Request) {
+	var req ModerationRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	api.moderateMessage(w, r, func(actor *engine.User, message *engine.Message) error {
+		return api.engine.RemoveMessage(r.Context(), actor, message, req.Reason)
+	})
+}
+
+func (api *API) restoreMessage(w http.ResponseWriter, r *http.Request) {
+	api.moderateMessage(w, r, func(actor *engine.User, message *engine.Message) error {
+		return api.engine.RestoreMessage(r.Context(), actor, message)
+	})
+}
+
+func (api *API) moderateMessage(w http.ResponseWriter, r *http.Request, fn func(actor *engine.User, message *engine.Message) error) {
+	actor, err := api.actor(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	id, err := strconv.Atoi(pathParam(r, "id"))
+	if err != nil {
+		writeError(w, r, badRequest("invalid message ID"))
+		return
+	}
+	message, err := api.engine.LookupMessage(r.Context(), id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := fn(actor, message); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (api *API) exportData(w http.ResponseWriter, r *http.Request) {
+	actor, err := api.actor(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="export.ndjson"`)
+	w.Header().Set("Cache-Control", cachePrivate)
+	if err := api.engine.Export(r.Context(), actor, w); err != nil {
+		noteError(r, err)
+	}
+}
+
+// importData reads the body in the format named by the format query
+// parameter, "ndjson" (the default) or "pushshift", gzipped if the
+// Content-Encoding says so.
+func (api *API) importData(w http.ResponseWriter, r *http.Request) {
+	actor, err := api.actor(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	body := io.Reader(r.Body)
+	switch r.Header.Get("Content-Encoding") {
+	case "", "identity":
+	case "gzip":
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			writeError(w, r, importError(err))
+			return
+		}
+		defer gz.Close()
+		body = gz
+	default:
+		writeError(w, r, &apiError{status: http.StatusUnsupportedMediaType, code: codeUnsupportedMedia, msg: "Content-Encoding must be gzip or none"})
+		return
+	}
+	snap, skipped, err := readImport(body, r.URL.Query().Get("format"))
+	if err != nil {
+		writeError(w, r, importError(err))
+		return
+	}
+	result, err := api.engine.Import(r.Context(), actor, snap)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, importResponse(result, skipped))
+}
+
+// readImport decodes an import in the given format. skipped counts the
+// lines of a Pushshift dump that could not be imported, by reason.
+func readImport(r io.Reader, format string) (snap *engine.Snapshot, skipped map[string]int, err error) {
+	switch format {
+	case "", "ndjson":
+		snap, err = engine.ReadNDJSON(r)
+	case "pushshift":
+		var stats engine.PushshiftStats
+		snap, stats, err = engine.ReadPushshift(r)
+		skipped = stats.Skipped
+	default:
+		err = badRequest("format must be ndjson or pushshift")
+	}
+	return snap, skipped, err
+}
+
+// importError converts an error from reading an import's body.
+func importError(err error) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return bodyError(err)
+	}
+	if errors.Is(err, gzip.ErrHeader) || errors.Is(err, gzip.ErrChecksum) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return badRequest("invalid gzip body: " + err.Error())
+	}
+	return err
+}
+
+func (api *API) getVoteRings(w http.ResponseWriter, r *http.Request) {
+	report := api.engine.DetectVoteRings(r.Context(), engine.DefaultVoteRingOptions())
+	w.Header().Set("Cache-Control", cachePrivate)
+	writeJSON(w, r, mapOne(r.Context(), api.engine, report, api.newMapper(r).voteRingReport))
+}
+
+func (api *API) discountVoteRing(w http.ResponseWriter, r *http.Request) {
+	api.voteRingAction(w, r, api.engine.DiscountVoteRing)
+}
+
+func (api *API) restoreVoteRing(w http.ResponseWriter, r *http.Request) {
+	api.voteRingAction(w, r, api.engine.RestoreVoteRing)
+}
+
+// voteRingAction runs an admin action on the vote ring named in the path
+// and writes the ring as it is afterwards.
+func (api *API) voteRingAction(w http.ResponseWriter, r *http.Request, fn func(context.Context, *engine.User, string, engine.VoteRingOptions) (engine.VoteRing, error)) {
+	actor, err := api.actor(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	ring, err := fn(r.Context(), actor, pathParam(r, "ring"), engine.DefaultVoteRingOptions())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, mapOne(r.Context(), api.engine, ring, api.newMapper(r).voteRing))
+}
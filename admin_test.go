@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reddit-clone/engine"
+	"strings"
+	"testing"
+)
+
+// TestExportImport exports a site through the admin API, imports it into
+// an empty one and checks that the copy exports identically apart from the
+// header, then imports a Pushshift dump on top.
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+	f := newFixture(t)
+	e, alice, bob, post := f.e, f.alice, f.bob, f.post
+	e.CreateReply(ctx, bob, post, f.comment, "You're welcome")
+	e.CastVote(alice, post, 1)
+	e.BanUser(ctx, bob, alice, f.news, "Spam")
+
+	export := newAPIClient(t, newTestAPI(e)).do("GET", "/api/v1/admin/export", "bob", "")
+	if export.Code != http.StatusOK {
+		t.Fatalf("export: status %d\n%s", export.Code, export.Body)
+	}
+
+	// The importing site needs an admin. Registering alice first keeps the
+	// IDs the same, so the copy can be compared line by line; both are
+	// merged with the imported users of the same name.
+	copied := engine.NewRedditEngine()
+	copied.RegisterAccount("alice")
+	admin, _ := copied.RegisterAccount("bob")
+	copied.GrantAdmin(ctx, nil, admin)
+	c := newAPIClient(t, newTestAPI(copied))
+	var res ImportResponse
+	c.mustDo("POST", "/api/v1/admin/import", "bob", export.Body.String(), &res)
+	if res.Users != 0 || res.MergedUsers != 2 || res.Posts != 1 || res.Comments != 2 || res.Votes != 1 || res.Messages != 1 {
+		t.Errorf("import counts: %+v", res)
+	}
+	again := c.mustDo("GET", "/api/v1/admin/export", "bob", "", nil).Body.String()
+	if body := export.Body.String(); again[strings.Index(again, "\n"):] != body[strings.Index(body, "\n"):] {
+		t.Errorf("re-export differs:\n%s\nwant\n%s", again, body)
+	}
+
+	truncated := export.Body.String()[:export.Body.Len()-10]
+	if rec := c.do("POST", "/api/v1/admin/import", "bob", truncated); rec.Code != http.StatusBadRequest {
+		t.Errorf("truncated import: status %d, want 400", rec.Code)
+	}
+
+	dump := strings.Join([]string{
+		`{"id":"p1","author":"spez","subreddit":"news","created_utc":1134028003,"score":7,"title":"Dumped","selftext":"","is_self":false,"url":"https://example.com/"}`,
+		`{"id":"c2","author":"[deleted]","link_id":"t3_p1","parent_id":"t1_c1","created_utc":"1134028200","score":1,"body":"[removed]"}`,
+		`{"id":"c1","author":"alice","link_id":"t3_p1","parent_id":"t3_p1","created_utc":1134028100.5,"score":2,"body":"Neat"}`,
+		`{"id":"c3","author":"alice","link_id":"t3_gone","parent_id":"t3_gone","created_utc":1134028100,"score":2,"body":"Lost"}`,
+	}, "\n")
+	res = ImportResponse{}
+	c.mustDo("POST", "/api/v1/admin/import?format=pushshift", "bob", dump, &res)
+	if res.Posts != 1 || res.Comments != 2 || res.MergedSubreddits != 1 || res.Skipped["post not in dump"] != 1 {
+		t.Errorf("pushshift counts: %+v", res)
+	}
+	dumped, _ := copied.LookupPost(2)
+	if dumped.Content != "https://example.com/" || dumped.Author.Username != "spez" || len(dumped.Comments) != 1 {
+		t.Fatalf("dumped post: %+v", dumped)
+	}
+	if reply := dumped.Comments[0].Replies; len(reply) != 1 || !reply[0].Removed || reply[0].Author.Username != engine.PushshiftDeletedUser {
+		t.Errorf("removed reply by a deleted user not kept in place: %+v", reply)
+	}
+}
+
+// TestAdminToken checks that the admin API and an admin's moderation powers
+// need the admin token, not just an admin's username.
+func TestAdminToken(t *testing.T) {
+	f := newFixture(t)
+	c := newAPIClient(t, newTestAPI(f.e))
+
+	for _, auth := range []string{"", "Bearer guess", "Basic " + testAdminToken} {
+		rec := c.do("GET", "/api/v1/admin/stats", "bob", "", "Authorization", auth)
+		if rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("admin request with Authorization %q: status %d, WWW-Authenticate %q", auth, rec.Code, rec.Header().Get("WWW-Authenticate"))
+		}
+	}
+	if rec := c.do("PUT", "/api/v1/posts/1/removal", "bob", `{"reason":"Spam"}`, "Authorization", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("admin removing a post without the token: status %d, want 401", rec.Code)
+	}
+	if rec := c.do("GET", "/api/v1/admin/stats", "alice", ""); rec.Code != http.StatusForbidden {
+		t.Errorf("non-admin with the token: status %d, want 403", rec.Code)
+	}
+	c.mustDo("GET", "/api/v1/admin/stats", "bob", "", nil)
+
+	// UserResponse must not tell who the admins are.
+	if rec := c.mustDo("GET", "/api/v1/users/bob", "", "", nil); strings.Contains(rec.Body.String(), "admin") {
+		t.Errorf("user profile reveals the admin role: %s", rec.Body)
+	}
+
+	disabled := newAPIClient(t, NewAPI(f.e))
+	if rec := disabled.do("GET", "/api/v1/admin/stats", "bob", ""); rec.Code != http.StatusForbidden {
+		t.Errorf("admin request to a server without an admin token: status %d, want 403", rec.Code)
+	}
+}
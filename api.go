@@ -2,301 +2,559 @@ package main
 
 import (
 	"encoding/json"
+	"log/slog"
 	"net/http"
 	"reddit-clone/engine"
-	"strings"
+	"reddit-clone/logging"
+	"reddit-clone/tracing"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 type API struct {
-	engine *engine.RedditEngine
+	engine      *engine.RedditEngine
+	router      *Router
+	idempotency *idempotencyStore
+	responses   *responseCache
+	listings    *listingCache
+	metrics     *apiMetrics
+	logger      *slog.Logger
+	tracer      *tracing.Tracer
+	sessions    *sessions
+	adminToken  string
+	ready       atomic.Bool
+	// replica is set when replication is enabled.
+	replica *replicator
 }
 
 func NewAPI(e *engine.RedditEngine) *API {
-	return &API{engine: e}
+	api := &API{engine: e, router: NewRouter(), idempotency: newIdempotencyStore(defaultIdempotencyWindow), responses: newResponseCache(e), listings: newListingCache(e), logger: logging.Discard(), sessions: newSessions("")}
+	api.router.NotFound = func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, &apiError{status: http.StatusNotFound, code: codeNotFound, msg: "no such route"})
+	}
+	api.router.MethodNotAllowed = func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, &apiError{status: http.StatusMethodNotAllowed, code: codeMethodNotAllowed, msg: "method not allowed"})
+	}
+	api.metrics = newAPIMetrics(api)
+	api.routes()
+	api.moderationRoutes()
+	api.adminRoutes()
+	api.legacyRoutes()
+	return api
+}
+
+// routes registers the versioned, resource-oriented API under /api/v1.
+func (api *API) routes() {
+	rt := api.router
+	rt.Handle("GET", "/api/v1/users", "listUsers", api.getAllUsers).
+		Doc("List users").ReturnsPage(UserResponse{})
+	rt.Handle("POST", "/api/v1/users", "createUser", api.createUser).
+		Doc("Register a user, or log in if the username exists").
+		Accepts(CreateUserRequest{}).Returns(UserResponse{})
+	rt.Handle("GET", "/api/v1/users/{username}", "getUser", api.getUser).
+		Doc("Get a user").Returns(UserResponse{})
+	rt.Handle("GET", "/api/v1/users/{username}/messages", "listMessages", api.getMessages).
+		Doc("List messages sent to a user").ReturnsPage(MessageResponse{})
+	rt.Handle("POST", "/api/v1/users/{username}/messages", "sendMessage", api.sendMessage).
+		Doc("Send a message to a user").Accepts(SendMessageRequest{}).Returns(MessageResponse{})
+
+	rt.Handle("GET", "/api/v1/r", "listSubreddits", api.getAllSubreddits).
+		Doc("List subreddits").ReturnsPage(SubredditResponse{}).WithQuery("expand", "viewer")
+	rt.Handle("POST", "/api/v1/r", "createSubreddit", api.createSubreddit).
+		Doc("Create a subreddit; the user in X-Username, if any, becomes its moderator").
+		Accepts(CreateSubredditRequest{}).Returns(SubredditResponse{})
+	rt.Handle("GET", "/api/v1/r/{name}", "getSubreddit", api.getSubreddit).
+		Doc("Get a subreddit").Returns(SubredditResponse{}).WithQuery("expand", "viewer")
+	rt.Handle("GET", "/api/v1/r/{name}/posts", "getFeed", api.getFeed).
+		Doc("List a subreddit's posts, newest first").ReturnsPage(PostResponse{}).WithQuery("expand", "viewer")
+	rt.Handle("POST", "/api/v1/r/{name}/posts", "submitPost", api.submitPost).
+		Doc("Submit a post").Accepts(SubmitPostRequest{}).Returns(PostResponse{})
+	rt.Handle("PUT", "/api/v1/r/{name}/members/{username}", "joinSubreddit", api.joinSubreddit).
+		Doc("Join a subreddit")
+	rt.Handle("DELETE", "/api/v1/r/{name}/members/{username}", "leaveSubreddit", api.leaveSubreddit).
+		Doc("Leave a subreddit")
+
+	rt.Handle("GET", "/api/v1/posts", "listPosts", api.getAllPosts).
+		Doc("List all posts, newest first").ReturnsPage(PostResponse{}).WithQuery("expand", "viewer")
+	rt.Handle("GET", "/api/v1/posts/{id}", "getPost", api.getPost).
+		Doc("Get a post").Returns(PostResponse{}).WithQuery("expand", "viewer")
+	rt.Handle("GET", "/api/v1/posts/{id}/comments", "listComments", api.getComments).
+		Doc("List a post's comments").ReturnsPage(CommentResponse{}).WithQuery("expand")
+	rt.Handle("POST", "/api/v1/posts/{id}/comments", "createComment", api.createComment).
+		Doc("Comment on a post, or reply to one of its comments").Accepts(CreateCommentRequest{}).Returns(CommentResponse{})
+	rt.Handle("GET", "/api/v1/posts/{id}/reposts", "listReposts", api.getReposts).
+		Doc("List earlier posts, in any subreddit, that a post repeats, newest first").ReturnsPage(RepostResponse{})
+	rt.Handle("POST", "/api/v1/posts/{id}/votes", "vote", api.vote).
+		Doc("Vote on a post").Accepts(VoteRequest{}).Returns(PostResponse{})
+
+	rt.Handle("GET", "/api/openapi.json", "openapi", api.openAPI).
+		Doc("This OpenAPI document")
+	rt.Handle("GET", "/api/docs", "explorer", api.explorer).
+		Doc("Interactive API explorer")
 }
 
 func (api *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	switch {
-	case r.Method == "POST" && r.URL.Path == "/api/user":
-		api.createUser(w, r)
-	case r.Method == "POST" && r.URL.Path == "/api/subreddit":
-		api.createSubreddit(w, r)
-	case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/submit"):
-		api.submitPost(w, r)
-	case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/comment"):
-		api.createComment(w, r)
-	case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/vote"):
-		api.vote(w, r)
-	case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/getusers"):
-		api.getAllUsers(w, r)
-	case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/getsubreddits"):
-		api.getAllSubreddits(w, r)
-	case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/getposts"):
-		api.getAllPosts(w, r)
-	case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/join"):
-        api.joinSubreddit(w, r)
-    case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/leave"):
-        api.leaveSubreddit(w, r)
-    case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/feed"):
-        api.getFeed(w, r)
-	default:
-		http.NotFound(w, r)
+	limit := int64(maxBodyBytes)
+	if route := api.router.Lookup(r); route != nil && route.BodyLimit > 0 {
+		limit = route.BodyLimit
 	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	r = withRouteSlot(r)
+	r = r.WithContext(engine.WithClientIP(r.Context(), remoteIP(r)))
+	api.traceRequests(api.metrics.middleware(withRequestID(api.accessLog(api.idempotency.middleware(api.router))))).ServeHTTP(w, r)
 }
 
-
 func (api *API) createSubreddit(w http.ResponseWriter, r *http.Request) {
-	var subredditData struct {
-		Name string `json:"name"`
+	var subredditData CreateSubredditRequest
+	if err := decodeJSON(r, &subredditData); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	var subreddit *engine.SubReddit
+	var err error
+	if creator := api.engine.GetUserByUsernameContext(r.Context(), r.Header.Get("X-Username")); creator != nil {
+		subreddit, err = api.engine.CreateModeratedSubReddit(r.Context(), creator, subredditData.Name)
+	} else {
+		subreddit, err = api.engine.CreateSubRedditContext(r.Context(), subredditData.Name)
 	}
-	if err := json.NewDecoder(r.Body).Decode(&subredditData); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
-	subreddit := api.engine.CreateSubReddit(subredditData.Name)
-	json.NewEncoder(w).Encode(subreddit)
+	writeJSON(w, r, mapOne(r.Context(), api.engine, subreddit, api.newMapper(r).subreddit))
+}
+
+func (api *API) getSubreddit(w http.ResponseWriter, r *http.Request) {
+	subreddit, err := api.engine.LookupSubRedditContext(r.Context(), pathParam(r, "name"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	var version uint64
+	var modified time.Time
+	api.engine.ViewContext(r.Context(), func() { version, modified = subreddit.Version, subreddit.UpdatedAt })
+	if checkFresh(w, r, etagFor(r, "subreddit", subreddit.ID, version), modified, cachePolicy(r, cacheRevalidate)) {
+		return
+	}
+	writeJSON(w, r, mapOne(r.Context(), api.engine, subreddit, api.newMapper(r).subreddit))
 }
 
 func (api *API) submitPost(w http.ResponseWriter, r *http.Request) {
-    parts := strings.Split(r.URL.Path, "/")
-    if len(parts) < 4 {
-        http.Error(w, "Invalid URL", http.StatusBadRequest)
-        return
-    }
-    subredditName := parts[2]
-    var postData struct {
-        Title    string `json:"title"`
-        Content  string `json:"content"`
-        Username string `json:"username"`
-    }
-    if err := json.NewDecoder(r.Body).Decode(&postData); err != nil {
-        http.Error(w, err.Error(), http.StatusBadRequest)
-        return
-    }
-
-    subreddit := api.engine.GetSubRedditByName(subredditName)
-    if subreddit == nil {
-        http.Error(w, "Subreddit not found", http.StatusNotFound)
-        return
-    }
-
-    user := api.engine.GetUserByUsername(postData.Username)
-    if user == nil {
-        http.Error(w, "User not found", http.StatusNotFound)
-        return
-    }
-
-    post := api.engine.CreatePost(user, subreddit, postData.Title, postData.Content)
-    json.NewEncoder(w).Encode(post)
+	var postData SubmitPostRequest
+	if err := decodeJSON(r, &postData); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	subreddit, err := api.engine.LookupSubRedditContext(r.Context(), pathParam(r, "name"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	user, err := api.engine.LookupUserContext(r.Context(), postData.Username)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	post, err := api.engine.CreatePostContext(r.Context(), user, subreddit, postData.Title, postData.Content)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	// Reposts the subreddit warns about are returned with the new post.
+	reposts := api.engine.Reposts(r.Context(), post)
+	m := api.newMapper(r)
+	writeJSON(w, r, mapOne(r.Context(), api.engine, post, func(post *engine.Post) *PostResponse {
+		resp := m.post(post)
+		for _, repost := range reposts {
+			if repost.Flagged {
+				resp.PreviouslyPosted = append(resp.PreviouslyPosted, *m.repost(repost))
+			}
+		}
+		return resp
+	}))
 }
 
+func (api *API) getReposts(w http.ResponseWriter, r *http.Request) {
+	post, err := api.postFromPath(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	p, err := parsePageParams(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	reposts := paginate(api.engine.Reposts(r.Context(), post), func(r engine.Repost) int { return r.Post.ID }, true, p)
+	writePage(w, r, mapPage(r.Context(), api.engine, reposts, api.newMapper(r).repost), p.Limit)
+}
 
-func (api *API) createComment(w http.ResponseWriter, r *http.Request) {
-	parts := strings.Split(r.URL.Path, "/")
-    if len(parts) < 4 {
-        http.Error(w, "Invalid URL", http.StatusBadRequest)
-        return
-    }
-    postIDStr := parts[2]
-    
-    postID, err := strconv.Atoi(postIDStr)
-    if err != nil {
-        http.Error(w, "Invalid post ID", http.StatusBadRequest)
-        return
-    }
+func (api *API) getPost(w http.ResponseWriter, r *http.Request) {
+	post, err := api.postFromPath(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	etag, fresh := api.postNotModified(w, r, post)
+	if fresh {
+		return
+	}
+	api.serveCached(w, r, responseKey{kind: cachedPost, id: post.ID, etag: etag}, func(w http.ResponseWriter) {
+		writeJSON(w, r, mapOne(r.Context(), api.engine, post, api.newMapper(r).post))
+	})
+}
 
-	var commentData struct {
-		Content  string `json:"content"`
-		Username string `json:"username"`
+func (api *API) getComments(w http.ResponseWriter, r *http.Request) {
+	post, err := api.postFromPath(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
 	}
-	if err := json.NewDecoder(r.Body).Decode(&commentData); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	etag, fresh := api.postNotModified(w, r, post)
+	if fresh {
 		return
 	}
+	api.serveCached(w, r, responseKey{kind: cachedComments, id: post.ID, etag: etag}, func(w http.ResponseWriter) {
+		p, err := parsePageParams(r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		comments := paginate(api.engine.GetCommentsContext(r.Context(), post), commentID, false, p)
+		writePage(w, r, mapPage(r.Context(), api.engine, comments, api.newMapper(r).comment), p.Limit)
+	})
+}
 
-	user := api.engine.GetUserByUsername(commentData.Username)
-	if user == nil {
-		http.Error(w, "User not found", http.StatusNotFound)
+func (api *API) createComment(w http.ResponseWriter, r *http.Request) {
+	post, err := api.postFromPath(r)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
 
-	post := api.engine.GetPostByID(postID)
-    if post == nil {
-        http.Error(w, "Post not found", http.StatusNotFound)
-        return
-    }
+	var commentData CreateCommentRequest
+	if err := decodeJSON(r, &commentData); err != nil {
+		writeError(w, r, err)
+		return
+	}
 
-	comment := api.engine.CreateComment(user, post, commentData.Content)
-	json.NewEncoder(w).Encode(comment)
+	user, err := api.engine.LookupUserContext(r.Context(), commentData.Username)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	var comment *engine.Comment
+	if commentData.ParentID != 0 {
+		var parent *engine.Comment
+		if parent, err = api.engine.LookupComment(r.Context(), post, commentData.ParentID); err == nil {
+			comment, err = api.engine.CreateReply(r.Context(), user, post, parent, commentData.Content)
+		}
+	} else {
+		comment, err = api.engine.CreateCommentContext(r.Context(), user, post, commentData.Content)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, mapOne(r.Context(), api.engine, comment, api.newMapper(r).comment))
 }
 
 func (api *API) vote(w http.ResponseWriter, r *http.Request) {
-    parts := strings.Split(r.URL.Path, "/")
-    if len(parts) < 4 {
-        http.Error(w, "Invalid URL", http.StatusBadRequest)
-        return
-    }
-    postID := parts[2]
-
-    var voteData struct {
-        Upvote bool `json:"upvote"`
-    }
-    if err := json.NewDecoder(r.Body).Decode(&voteData); err != nil {
-        http.Error(w, err.Error(), http.StatusBadRequest)
-        return
-    }
-
-    postIDInt, err := strconv.Atoi(postID)
-    if err != nil {
-        http.Error(w, "Invalid post ID", http.StatusBadRequest)
-        return
-    }
-
-    post := api.engine.GetPostByID(postIDInt)
-    if post == nil {
-        http.Error(w, "Post not found", http.StatusNotFound)
-        return
-    }
-
-    api.engine.Vote(post, voteData.Upvote)
-    w.WriteHeader(http.StatusOK)
+	var voteData VoteRequest
+	if err := decodeJSON(r, &voteData); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	post, err := api.postFromPath(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// Votes without a username are anonymous and cannot be changed later,
+	// as with the original API.
+	if voteData.Username == "" {
+		api.engine.VoteContext(r.Context(), post, voteData.Upvote)
+		writeJSON(w, r, mapOne(r.Context(), api.engine, post, api.newMapper(r).post))
+		return
+	}
+
+	user, err := api.engine.LookupUserContext(r.Context(), voteData.Username)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	direction := -1
+	if voteData.Upvote {
+		direction = 1
+	}
+	if voteData.Direction != nil {
+		direction = *voteData.Direction
+	}
+	ctx := r.Context()
+	if voteData.Ref != "" {
+		ctx = engine.WithVoteRef(ctx, voteData.Ref)
+	}
+	if err := api.engine.CastVoteContext(ctx, user, post, direction); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	m := api.newMapper(r)
+	m.viewer = user
+	writeJSON(w, r, mapOne(r.Context(), api.engine, post, m.post))
 }
 
 func (api *API) getAllUsers(w http.ResponseWriter, r *http.Request) {
-	users := make([]*engine.User, 0, len(api.engine.Users))
-	for _, user := range api.engine.Users {
-		users = append(users, user)
+	if api.listingNotModified(w, r, cacheListing) {
+		return
 	}
-	json.NewEncoder(w).Encode(users)
+	p, err := parsePageParams(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	users := paginate(api.engine.GetAllUsersContext(r.Context()), userID, false, p)
+	writePage(w, r, mapPage(r.Context(), api.engine, users, api.newMapper(r).user), p.Limit)
 }
 
 func (api *API) getAllSubreddits(w http.ResponseWriter, r *http.Request) {
-    subreddits := make([]*engine.SubReddit, 0, len(api.engine.SubReddits))
-    for _, subreddit := range api.engine.SubReddits {
-        subreddits = append(subreddits, subreddit)
-    }
-    json.NewEncoder(w).Encode(subreddits)
+	if api.listingNotModified(w, r, cacheListing) {
+		return
+	}
+	p, err := parsePageParams(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	subreddits := paginate(api.engine.GetAllSubRedditsContext(r.Context()), subredditID, false, p)
+	writePage(w, r, mapPage(r.Context(), api.engine, subreddits, api.newMapper(r).subreddit), p.Limit)
 }
 
 func (api *API) getAllPosts(w http.ResponseWriter, r *http.Request) {
-    allPosts := make([]*engine.Post, 0)
-    
-    for _, subreddit := range api.engine.SubReddits {
-        allPosts = append(allPosts, subreddit.Posts...)
-    }
-    
-    json.NewEncoder(w).Encode(allPosts)
+	if api.listingNotModified(w, r, cacheFeed) {
+		return
+	}
+	// The listing's ETag changes with every mutation anywhere, so the cached
+	// page is kept until a post changes instead.
+	api.serveCached(w, r, responseKey{kind: cachedPosts}, func(w http.ResponseWriter) {
+		p, err := parsePageParams(r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		posts := paginate(newestFirst(api.engine.GetAllPostsContext(r.Context())), postID, true, p)
+		writePage(w, r, mapPage(r.Context(), api.engine, posts, api.newMapper(r).post), p.Limit)
+	})
 }
 
 func (api *API) createUser(w http.ResponseWriter, r *http.Request) {
-    var userData struct {
-        Username string `json:"username"`
-    }
-    if err := json.NewDecoder(r.Body).Decode(&userData); err != nil {
-        http.Error(w, err.Error(), http.StatusBadRequest)
-        return
-    }
-    
-    if api.engine.UserExists(userData.Username) {
-        // User exists, return the existing user (login)
-        user := api.engine.GetUserByUsername(userData.Username)
-        json.NewEncoder(w).Encode(user)
-    } else {
-        // User doesn't exist, create a new user (register)
-        user := api.engine.RegisterAccount(userData.Username)
-        json.NewEncoder(w).Encode(user)
-    }
+	var userData CreateUserRequest
+	if err := decodeJSON(r, &userData); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if api.engine.UserExistsContext(r.Context(), userData.Username) {
+		// User exists, return the existing user (login)
+		user := api.engine.GetUserByUsernameContext(r.Context(), userData.Username)
+		api.engine.RecordLogin(r.Context(), user)
+		writeJSON(w, r, mapOne(r.Context(), api.engine, user, api.newMapper(r).user))
+	} else {
+		// User doesn't exist, create a new user (register)
+		user, err := api.engine.RegisterAccountContext(r.Context(), userData.Username)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeJSON(w, r, mapOne(r.Context(), api.engine, user, api.newMapper(r).user))
+	}
+}
+
+func (api *API) getUser(w http.ResponseWriter, r *http.Request) {
+	user, err := api.engine.LookupUserContext(r.Context(), pathParam(r, "username"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	var version uint64
+	var modified time.Time
+	api.engine.ViewContext(r.Context(), func() { version, modified = user.Version, user.UpdatedAt })
+	etag := etagFor(r, "user", user.ID, version)
+	if checkFresh(w, r, etag, modified, cachePolicy(r, cacheRevalidate)) {
+		return
+	}
+	api.serveCached(w, r, responseKey{kind: cachedUser, id: user.ID, etag: etag}, func(w http.ResponseWriter) {
+		writeJSON(w, r, mapOne(r.Context(), api.engine, user, api.newMapper(r).user))
+	})
+}
+
+func (api *API) getMessages(w http.ResponseWriter, r *http.Request) {
+	user, err := api.engine.LookupUserContext(r.Context(), pathParam(r, "username"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if api.listingNotModified(w, r, cachePrivate) {
+		return
+	}
+	p, err := parsePageParams(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	messages := paginate(api.engine.GetMessagesContext(r.Context(), user), messageID, false, p)
+	writePage(w, r, mapPage(r.Context(), api.engine, messages, api.newMapper(r).message), p.Limit)
+}
+
+func (api *API) sendMessage(w http.ResponseWriter, r *http.Request) {
+	var messageData SendMessageRequest
+	if err := decodeJSON(r, &messageData); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	to, err := api.engine.LookupUserContext(r.Context(), pathParam(r, "username"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	from, err := api.engine.LookupUserContext(r.Context(), messageData.From)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	message, err := api.engine.SendMessageContext(r.Context(), from, to, messageData.Content)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, mapOne(r.Context(), api.engine, message, api.newMapper(r).message))
 }
 
 func (api *API) joinSubreddit(w http.ResponseWriter, r *http.Request) {
-    parts := strings.Split(r.URL.Path, "/")
-    if len(parts) < 4 {
-        http.Error(w, "Invalid URL", http.StatusBadRequest)
-        return
-    }
-    subredditName := parts[2]
-    var userData struct {
-        Username string `json:"username"`
-    }
-    if err := json.NewDecoder(r.Body).Decode(&userData); err != nil {
-        http.Error(w, err.Error(), http.StatusBadRequest)
-        return
-    }
-
-    user := api.engine.GetUserByUsername(userData.Username)
-    if user == nil {
-        http.Error(w, "User not found", http.StatusNotFound)
-        return
-    }
-
-    subreddit := api.engine.GetSubRedditByName(subredditName)
-    if subreddit == nil {
-        http.Error(w, "Subreddit not found", http.StatusNotFound)
-        return
-    }
-
-    err := api.engine.JoinSubReddit(user, subreddit)
-    if err != nil {
-        http.Error(w, err.Error(), http.StatusBadRequest)
-        return
-    }
-
-    w.WriteHeader(http.StatusOK)
+	user, subreddit, err := api.membershipFromPath(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if err := api.engine.JoinSubRedditContext(r.Context(), user, subreddit); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
 }
 
 func (api *API) leaveSubreddit(w http.ResponseWriter, r *http.Request) {
-    parts := strings.Split(r.URL.Path, "/")
-    if len(parts) < 4 {
-        http.Error(w, "Invalid URL", http.StatusBadRequest)
-        return
-    }
-    subredditName := parts[2]
-    var userData struct {
-        Username string `json:"username"`
-    }
-    if err := json.NewDecoder(r.Body).Decode(&userData); err != nil {
-        http.Error(w, err.Error(), http.StatusBadRequest)
-        return
-    }
-
-    user := api.engine.GetUserByUsername(userData.Username)
-    if user == nil {
-        http.Error(w, "User not found", http.StatusNotFound)
-        return
-    }
-
-    subreddit := api.engine.GetSubRedditByName(subredditName)
-    if subreddit == nil {
-        http.Error(w, "Subreddit not found", http.StatusNotFound)
-        return
-    }
-
-    err := api.engine.LeaveSubReddit(user, subreddit)
-    if err != nil {
-        http.Error(w, err.Error(), http.StatusBadRequest)
-        return
-    }
-
-    w.WriteHeader(http.StatusOK)
+	user, subreddit, err := api.membershipFromPath(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if err := api.engine.LeaveSubRedditContext(r.Context(), user, subreddit); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
 }
 
 func (api *API) getFeed(w http.ResponseWriter, r *http.Request) {
-    parts := strings.Split(r.URL.Path, "/")
-    if len(parts) < 4 {
-        http.Error(w, "Invalid URL", http.StatusBadRequest)
-        return
-    }
-    subredditName := parts[2]
-
-    subreddit := api.engine.GetSubRedditByName(subredditName)
-    if subreddit == nil {
-        http.Error(w, "Subreddit not found", http.StatusNotFound)
-        return
-    }
-
-    posts := api.engine.GetFeed(subreddit)
-
-    json.NewEncoder(w).Encode(posts)
+	subreddit, err := api.engine.LookupSubRedditContext(r.Context(), pathParam(r, "name"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	var version uint64
+	var modified time.Time
+	api.engine.ViewContext(r.Context(), func() { version, modified = subreddit.Version, subreddit.UpdatedAt })
+	etag := etagFor(r, "feed", subreddit.ID, version)
+	if checkFresh(w, r, etag, modified, cachePolicy(r, cacheFeed)) {
+		return
+	}
+
+	api.serveCached(w, r, responseKey{kind: cachedFeed, id: subreddit.ID, etag: etag}, func(w http.ResponseWriter) {
+		p, err := parsePageParams(r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		posts := paginate(newestFirst(api.engine.GetFeedContext(r.Context(), subreddit)), postID, true, p)
+		writePage(w, r, mapPage(r.Context(), api.engine, posts, api.newMapper(r).post), p.Limit)
+	})
+}
+
+// postNotModified handles conditional requests for a post and its comments.
+// It returns the post's current ETag and whether the client's copy is
+// fresh.
+func (api *API) postNotModified(w http.ResponseWriter, r *http.Request, post *engine.Post) (string, bool) {
+	var version uint64
+	var modified time.Time
+	api.engine.ViewContext(r.Context(), func() { version, modified = post.Version, post.UpdatedAt })
+	etag := etagFor(r, "post", post.ID, version)
+	return etag, checkFresh(w, r, etag, modified, cachePolicy(r, cacheRevalidate))
+}
+
+// listingNotModified handles conditional requests for listings that span
+// the whole engine, using its global revision.
+func (api *API) listingNotModified(w http.ResponseWriter, r *http.Request, policy string) bool {
+	version, modified := api.engine.Revision()
+	kind := strings.TrimPrefix(r.URL.Path, "/api/")
+	return checkFresh(w, r, etagFor(r, kind, 0, version), modified, cachePolicy(r, policy))
+}
+
+// postFromPath resolves the "{id}" path parameter to a post.
+func (api *API) postFromPath(r *http.Request) (*engine.Post, error) {
+	postID, err := strconv.Atoi(pathParam(r, "id"))
+	if err != nil {
+		return nil, badRequest("invalid post ID")
+	}
+	return api.engine.LookupPostContext(r.Context(), postID)
+}
+
+// membershipFromPath resolves the "{name}" and "{username}" path parameters
+// used by the membership routes.
+func (api *API) membershipFromPath(r *http.Request) (*engine.User, *engine.SubReddit, error) {
+	user, err := api.engine.LookupUserContext(r.Context(), pathParam(r, "username"))
+	if err != nil {
+		return nil, nil, err
+	}
+	subreddit, err := api.engine.LookupSubRedditContext(r.Context(), pathParam(r, "name"))
+	if err != nil {
+		return nil, nil, err
+	}
+	return user, subreddit, nil
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, v any) {
+	_, span := tracing.Start(r.Context(), "encode json")
+	defer span.End()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// newestFirst reverses posts, which the engine returns in creation order.
+func newestFirst(posts []*engine.Post) []*engine.Post {
+	reversed := make([]*engine.Post, len(posts))
+	for i, post := range posts {
+		reversed[len(posts)-1-i] = post
+	}
+	return reversed
 }
 
+func userID(u *engine.User) int            { return u.ID }
+func subredditID(sr *engine.SubReddit) int { return sr.ID }
+func postID(p *engine.Post) int            { return p.ID }
+func commentID(c *engine.Comment) int      { return c.ID }
+func messageID(m *engine.Message) int      { return m.ID }
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// legacyRoutes keeps the pre-v1 paths working while clients migrate. Each
+// one is served by the same handler as its /api/v1 successor, and responses
+// carry a Deprecation header pointing at the new route. Listings return
+// every item, as they did before paging, unless a page is asked for.
+func (api *API) legacyRoutes() {
+	rt := api.router
+	rt.Handle("POST", "/api/user", "legacyCreateUser", api.createUser).
+		DeprecatedBy("/api/v1/users").Accepts(CreateUserRequest{}).Returns(UserResponse{})
+	rt.Handle("POST", "/api/subreddit", "legacyCreateSubreddit", api.createSubreddit).
+		DeprecatedBy("/api/v1/r").Accepts(CreateSubredditRequest{}).Returns(SubredditResponse{})
+	rt.Handle("GET", "/api/getusers", "legacyListUsers", unpagedByDefault(api.getAllUsers)).
+		DeprecatedBy("/api/v1/users").ReturnsPage(UserResponse{})
+	rt.Handle("GET", "/api/getsubreddits", "legacyListSubreddits", unpagedByDefault(api.getAllSubreddits)).
+		DeprecatedBy("/api/v1/r").ReturnsPage(SubredditResponse{})
+	rt.Handle("GET", "/api/getposts", "legacyListPosts", unpagedByDefault(api.getAllPosts)).
+		DeprecatedBy("/api/v1/posts").ReturnsPage(PostResponse{})
+
+	rt.Handle("POST", "/api/{name}/submit", "legacySubmitPost", api.submitPost).
+		DeprecatedBy("/api/v1/r/{name}/posts").Accepts(SubmitPostRequest{}).Returns(PostResponse{})
+	rt.Handle("GET", "/api/{name}/feed", "legacyGetFeed", unpagedByDefault(api.getFeed)).
+		DeprecatedBy("/api/v1/r/{name}/posts").ReturnsPage(PostResponse{})
+	rt.Handle("POST", "/api/{name}/join", "legacyJoinSubreddit", usernameFromBody(api.joinSubreddit)).
+		DeprecatedBy("/api/v1/r/{name}/members/{username}").Accepts(MembershipRequest{})
+	rt.Handle("POST", "/api/{name}/leave", "legacyLeaveSubreddit", usernameFromBody(api.leaveSubreddit)).
+		DeprecatedBy("/api/v1/r/{name}/members/{username}").Accepts(MembershipRequest{})
+
+	rt.Handle("POST", "/api/{id}/comment", "legacyCreateComment", api.createComment).
+		DeprecatedBy("/api/v1/posts/{id}/comments").Accepts(CreateCommentRequest{}).Returns(CommentResponse{})
+	rt.Handle("POST", "/api/{id}/vote", "legacyVote", api.vote).
+		DeprecatedBy("/api/v1/posts/{id}/votes").Accepts(VoteRequest{}).Returns(PostResponse{})
+}
+
+// usernameFromBody adapts the legacy join/leave routes, which send the
+// username in the JSON body, to handlers that read it from the path.
+func usernameFromBody(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, r, bodyError(err))
+			return
+		}
+		var userData MembershipRequest
+		if err := json.Unmarshal(body, &userData); err != nil {
+			writeError(w, r, bodyError(err))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next(w, withPathParam(r, "username", userData.Username))
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"reddit-clone/engine"
+	"strings"
+	"testing"
+)
+
+// TestAuditChain checks that privileged actions are audited with who did
+// them and from where, that the hash chain verifies, including from the
+// mirrored copy, and that editing, dropping or reordering entries is caught
+// at the first entry affected.
+func TestAuditChain(t *testing.T) {
+	f := newFixture(t)
+	var mirror bytes.Buffer
+	f.e.SetAuditWriter(&mirror)
+	c := newAPIClient(t, newTestAPI(f.e))
+	c.mustDo("POST", "/api/v1/r", "alice", `{"name":"science"}`, nil)
+	c.mustDo("PUT", "/api/v1/r/news/bans/alice", "bob", `{"reason":"Spam"}`, nil)
+	c.do("PUT", "/api/v1/r/news/moderators/alice", "alice", "", "X-Request-ID", "denied")
+
+	entries := f.e.AuditLog(context.Background(), engine.AuditFilter{})
+	if err := engine.VerifyAudit(entries); err != nil {
+		t.Fatal(err)
+	}
+	var verified AuditVerifyResponse
+	c.mustDo("GET", "/api/v1/admin/audit/verify", "bob", "", &verified)
+	if !verified.Valid || verified.Entries != len(entries) {
+		t.Errorf("verify endpoint: %+v with %d entries", verified, len(entries))
+	}
+
+	// Creating a subreddit audits its first moderator, acting as themselves.
+	created := entries[len(entries)-2]
+	if created.Action != engine.AuditModeratorAdd || created.Actor != "alice" || created.Target != "alice" {
+		t.Errorf("subreddit creation audited as %+v", created)
+	}
+	ban := entries[len(entries)-1]
+	if ban.Action != engine.AuditUserBan || ban.Actor != "bob" || ban.Reason != "Spam" || ban.IP == "" || ban.RequestID == "" {
+		t.Errorf("ban audited as %+v", ban)
+	}
+	for _, a := range entries {
+		if a.RequestID == "denied" {
+			t.Errorf("a refused action was audited: %+v", a)
+		}
+	}
+
+	// The mirrored copy verifies on its own.
+	var mirrored []engine.AuditEntry
+	dec := json.NewDecoder(&mirror)
+	for dec.More() {
+		var a engine.AuditEntry
+		if err := dec.Decode(&a); err != nil {
+			t.Fatal(err)
+		}
+		mirrored = append(mirrored, a)
+	}
+	if len(mirrored) != 2 || mirrored[1].Hash != ban.Hash {
+		t.Errorf("mirrored %d entries", len(mirrored))
+	}
+
+	tamper := func(what string, change func([]engine.AuditEntry) []engine.AuditEntry, want string) {
+		t.Helper()
+		copied := append([]engine.AuditEntry(nil), entries...)
+		if err := engine.VerifyAudit(change(copied)); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: %v, want an error containing %q", what, err, want)
+		}
+	}
+	tamper("edited reason", func(es []engine.AuditEntry) []engine.AuditEntry {
+		es[1].Reason = "edited"
+		return es
+	}, "audit entry 2: contents do not match")
+	tamper("dropped entry", func(es []engine.AuditEntry) []engine.AuditEntry {
+		return append(es[:1], es[2:]...)
+	}, "audit entry 3: out of sequence at position 2")
+	tamper("renumbered after a drop", func(es []engine.AuditEntry) []engine.AuditEntry {
+		es = append(es[:1], es[2:]...)
+		for i := range es {
+			es[i].ID = i + 1
+		}
+		return es
+	}, "audit entry 2: previous hash does not match")
+
+	// The actor is whoever the request names: nothing proves it, except
+	// that naming an admin takes the admin token.
+	if _, err := f.e.RegisterAccount("carol"); err != nil {
+		t.Fatal(err)
+	}
+	if rec := c.do("PUT", "/api/v1/r/science/bans/carol", "alice", `{"reason":"Spam"}`, "Authorization", "", "X-Request-ID", "claimed"); rec.Code != http.StatusOK {
+		t.Fatalf("ban naming alice without credentials: status %d\n%s", rec.Code, rec.Body)
+	}
+	if rec := c.do("PUT", "/api/v1/r/science/bans/carol", "bob", `{"reason":"Spam"}`, "Authorization", "", "X-Request-ID", "admin"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("ban naming an admin without the token: status %d", rec.Code)
+	}
+	claimed := false
+	for _, a := range f.e.AuditLog(context.Background(), engine.AuditFilter{}) {
+		switch a.RequestID {
+		case "claimed":
+			claimed = a.Actor == "alice"
+		case "admin":
+			t.Errorf("a refused admin action was audited: %+v", a)
+		}
+	}
+	if !claimed {
+		t.Error("the ban was not audited as alice")
+	}
+}
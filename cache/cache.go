@@ -0,0 +1,237 @@
+// Package cache is a size-bounded LRU cache that loads missing values
+// through a caller-supplied function. Concurrent requests for a key that is
+// being loaded wait for that load instead of starting their own, and
+// entries removed while their value is being loaded are not stored, so a
+// load that raced with a change never overwrites it.
+package cache
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Options configure a Cache.
+type Options[V any] struct {
+	// Capacity bounds the total cost of the entries; the least recently
+	// used ones are evicted to make room.
+	Capacity int
+	// Cost returns the cost of a value. It is 1 for every value if nil, so
+	// that Capacity counts entries.
+	Cost func(V) int
+	// TTL, if set, is how long an entry is served after it was loaded.
+	TTL time.Duration
+	// Now returns the current time; it defaults to time.Now.
+	Now func() time.Time
+}
+
+// Stats count what a cache has done since it was created.
+type Stats struct {
+	Hits   int64
+	Misses int64
+	// Shared counts requests that waited for a load another request
+	// started.
+	Shared        int64
+	Evictions     int64
+	Invalidations int64
+	Entries       int
+	Cost          int
+}
+
+// Cache maps keys to values. The zero value is not usable; call New.
+type Cache[K comparable, V any] struct {
+	opts Options[V]
+
+	mu    sync.Mutex
+	lru   *list.List // of *entry[K, V], most recently used first
+	items map[K]*list.Element
+	loads map[K]*load[V]
+	cost  int
+	stats Stats
+}
+
+type entry[K comparable, V any] struct {
+	key     K
+	value   V
+	cost    int
+	expires time.Time
+}
+
+// load is a load in progress. Requests that find one wait on done.
+type load[V any] struct {
+	done  chan struct{}
+	value V
+	err   error
+	// removed is set when the key is removed during the load, so that its
+	// possibly stale result is not stored.
+	removed bool
+}
+
+// New returns an empty cache.
+func New[K comparable, V any](opts Options[V]) *Cache[K, V] {
+	if opts.Capacity <= 0 {
+		panic("cache: capacity must be positive")
+	}
+	if opts.Cost == nil {
+		opts.Cost = func(V) int { return 1 }
+	}
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	return &Cache[K, V]{opts: opts, lru: list.New(), items: make(map[K]*list.Element), loads: make(map[K]*load[V])}
+}
+
+// Get returns the value cached for key, if there is one.
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e := c.lookup(key); e != nil {
+		c.stats.Hits++
+		return e.value, true
+	}
+	c.stats.Misses++
+	var zero V
+	return zero, false
+}
+
+// Load returns the value cached for key, calling fn to load it if there is
+// none. Only one fn runs for a key at a time; other callers wait for its
+// result. Errors are returned to every waiting caller but not cached.
+func (c *Cache[K, V]) Load(key K, fn func() (V, error)) (V, error) {
+	c.mu.Lock()
+	if e := c.lookup(key); e != nil {
+		c.stats.Hits++
+		c.mu.Unlock()
+		return e.value, nil
+	}
+	if l, ok := c.loads[key]; ok {
+		c.stats.Shared++
+		c.mu.Unlock()
+		<-l.done
+		return l.value, l.err
+	}
+	c.stats.Misses++
+	l := &load[V]{done: make(chan struct{})}
+	c.loads[key] = l
+	c.mu.Unlock()
+
+	finished := false
+	defer func() {
+		if !finished {
+			// fn panicked; let the waiters go and try again.
+			l.err = fmt.Errorf("cache: loading %v panicked", key)
+		}
+		c.mu.Lock()
+		delete(c.loads, key)
+		if l.err == nil && !l.removed {
+			c.add(key, l.value)
+		}
+		c.mu.Unlock()
+		close(l.done)
+	}()
+	l.value, l.err = fn()
+	finished = true
+	return l.value, l.err
+}
+
+// Put caches value for key, replacing any value it had.
+func (c *Cache[K, V]) Put(key K, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.add(key, value)
+}
+
+// Remove drops key, and keeps a load of it in progress from being cached.
+func (c *Cache[K, V]) Remove(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remove(key)
+}
+
+// RemoveFunc drops every key match returns true for, including keys being
+// loaded.
+func (c *Cache[K, V]) RemoveFunc(match func(K) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.items {
+		if match(key) {
+			c.remove(key)
+		}
+	}
+	for key, l := range c.loads {
+		if match(key) {
+			l.removed = true
+		}
+	}
+}
+
+// Purge drops every entry.
+func (c *Cache[K, V]) Purge() {
+	c.RemoveFunc(func(K) bool { return true })
+}
+
+// Stats returns the cache's counters.
+func (c *Cache[K, V]) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.stats
+	s.Entries, s.Cost = len(c.items), c.cost
+	return s
+}
+
+// lookup returns key's live entry and marks it used. The caller holds
+// c.mu.
+func (c *Cache[K, V]) lookup(key K) *entry[K, V] {
+	el, ok := c.items[key]
+	if !ok {
+		return nil
+	}
+	e := el.Value.(*entry[K, V])
+	if !e.expires.IsZero() && !c.opts.Now().Before(e.expires) {
+		c.drop(el)
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	return e
+}
+
+// add stores value, evicting the least recently used entries to make
+// room. Values costing more than the whole capacity are not stored. The
+// caller holds c.mu.
+func (c *Cache[K, V]) add(key K, value V) {
+	if el, ok := c.items[key]; ok {
+		c.drop(el)
+	}
+	cost := c.opts.Cost(value)
+	if cost > c.opts.Capacity {
+		return
+	}
+	for c.cost+cost > c.opts.Capacity {
+		c.drop(c.lru.Back())
+		c.stats.Evictions++
+	}
+	e := &entry[K, V]{key: key, value: value, cost: cost}
+	if c.opts.TTL > 0 {
+		e.expires = c.opts.Now().Add(c.opts.TTL)
+	}
+	c.items[key] = c.lru.PushFront(e)
+	c.cost += cost
+}
+
+// remove drops key and marks a load of it as stale. The caller holds c.mu.
+func (c *Cache[K, V]) remove(key K) {
+	if el, ok := c.items[key]; ok {
+		c.drop(el)
+		c.stats.Invalidations++
+	}
+	if l, ok := c.loads[key]; ok {
+		l.removed = true
+	}
+}
+
+func (c *Cache[K, V]) drop(el *list.Element) {
+	e := c.lru.Remove(el).(*entry[K, V])
+	delete(c.items, e.key)
+	c.cost -= e.cost
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"reddit-clone/cache"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestCache checks eviction by cost, expiry, and that concurrent loads of a
+// key share one call and are not stored if the key is removed meanwhile.
+func TestCache(t *testing.T) {
+	now := time.Unix(0, 0)
+	c := cache.New[string](cache.Options[string]{
+		Capacity: 10,
+		Cost:     func(v string) int { return len(v) },
+		TTL:      time.Minute,
+		Now:      func() time.Time { return now },
+	})
+	c.Put("a", "aaaa")
+	c.Put("b", "bbbb")
+	c.Get("a")
+	c.Put("c", "cccc")
+	if _, ok := c.Get("b"); ok {
+		t.Error("the least recently used entry was not evicted")
+	}
+	if v, ok := c.Get("a"); !ok || v != "aaaa" {
+		t.Errorf("recently used entry: %q, %v", v, ok)
+	}
+	c.Put("huge", strings.Repeat("x", 11))
+	if _, ok := c.Get("huge"); ok {
+		t.Error("an entry costing more than the capacity was stored")
+	}
+	now = now.Add(time.Minute)
+	if _, ok := c.Get("a"); ok {
+		t.Error("an expired entry was served")
+	}
+
+	var calls atomic.Int32
+	release := make(chan struct{})
+	load := func() (string, error) {
+		calls.Add(1)
+		<-release
+		return "loaded", nil
+	}
+	base := c.Stats()
+	var wg sync.WaitGroup
+	results := make([]string, 8)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = c.Load("k", load)
+		}(i)
+	}
+	waitFor(t, "the loads to queue", func() bool {
+		s := c.Stats()
+		return s.Misses+s.Shared-base.Misses-base.Shared == int64(len(results))
+	})
+	c.Remove("k")
+	close(release)
+	wg.Wait()
+	if calls.Load() != 1 {
+		t.Errorf("%d concurrent loads ran, want 1", calls.Load())
+	}
+	for _, v := range results {
+		if v != "loaded" {
+			t.Errorf("waiter got %q", v)
+		}
+	}
+	if _, ok := c.Get("k"); ok {
+		t.Error("a load that raced with a removal was stored")
+	}
+
+	boom := errors.New("boom")
+	if _, err := c.Load("e", func() (string, error) { return "", boom }); err != boom {
+		t.Errorf("load error: %v", err)
+	}
+	if _, ok := c.Get("e"); ok {
+		t.Error("a failed load was stored")
+	}
+}
+
+// TestResponseCache checks that anonymous reads are served from the cache
+// and that votes, comments and new posts invalidate what they change.
+func TestResponseCache(t *testing.T) {
+	api := newTestAPI(newFixture(t).e)
+	c := newAPIClient(t, api)
+	score := func(path string) int {
+		t.Helper()
+		var post PostResponse
+		c.mustDo("GET", path, "", "", &post)
+		return post.Score
+	}
+	hits := func() int64 { return api.responses.Stats().Hits }
+
+	for _, path := range []string{"/api/v1/posts/1", "/api/v1/posts/1/comments", "/api/v1/posts", "/api/v1/r/news/posts", "/api/v1/users/bob"} {
+		first := c.mustDo("GET", path, "", "", nil)
+		before := hits()
+		second := c.mustDo("GET", path, "", "", nil)
+		if hits() != before+1 {
+			t.Errorf("second GET %s was not served from the cache", path)
+		}
+		if second.Body.String() != first.Body.String() || second.Header().Get("ETag") != first.Header().Get("ETag") {
+			t.Errorf("cached GET %s differs:\n%s\n%s", path, first.Body, second.Body)
+		}
+	}
+	before := hits()
+	c.mustDo("GET", "/api/v1/posts/1", "alice", "", nil)
+	if hits() != before {
+		t.Error("a response for a viewer was served from the cache")
+	}
+
+	c.mustDo("POST", "/api/v1/posts/1/votes", "", `{"direction":1,"username":"alice"}`, nil)
+	if got := score("/api/v1/posts/1"); got != 1 {
+		t.Errorf("score after a vote: %d, want 1", got)
+	}
+	var posts []PostResponse
+	c.mustDo("GET", "/api/v1/posts", "", "", &posts)
+	if len(posts) != 1 || posts[0].Score != 1 {
+		t.Errorf("all posts after a vote: %+v", posts)
+	}
+	c.mustDo("POST", "/api/v1/posts/1/comments", "", `{"content":"Agreed","username":"bob"}`, nil)
+	if body := c.mustDo("GET", "/api/v1/posts/1/comments", "", "", nil).Body.String(); !strings.Contains(body, "Agreed") {
+		t.Errorf("comments after a new one: %s", body)
+	}
+	c.mustDo("POST", "/api/v1/r/news/posts", "", `{"title":"Second","username":"bob"}`, nil)
+	if body := c.mustDo("GET", "/api/v1/r/news/posts", "", "", nil).Body.String(); !strings.Contains(body, "Second") {
+		t.Errorf("feed after a new post: %s", body)
+	}
+
+	site := api.Site()
+	page := func() string {
+		rec := httptest.NewRecorder()
+		site.ServeHTTP(rec, httptest.NewRequest("GET", "/?sort=new", nil))
+		return rec.Body.String()
+	}
+	page()
+	before = api.listings.Stats().Hits
+	page()
+	if api.listings.Stats().Hits != before+1 {
+		t.Error("the front page was not served from the listing cache")
+	}
+	c.mustDo("POST", "/api/v1/r/news/posts", "", `{"title":"Third","username":"bob"}`, nil)
+	if !strings.Contains(page(), "Third") {
+		t.Error("the front page does not show a new post")
+	}
+}
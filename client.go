@@ -1,95 +1,95 @@
+//go:build ignore
+
+// client.go is a standalone command-line client for the REST API, run with
+// "go run client.go <command>".
 package main
 
 import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 )
 
 const baseURL = "http://localhost:8080/api"
 
-func initLog() *os.File {
+// newLogger returns a logger that appends to server.log.
+func newLogger() (*slog.Logger, *os.File) {
 	logFile, err := os.OpenFile("server.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
 	if err != nil {
 		fmt.Println("Error opening log file:", err)
 		os.Exit(1)
 	}
-
-	log.SetOutput(logFile)
-
-	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
-
-	return logFile
+	return slog.New(slog.NewTextHandler(logFile, nil)), logFile
 }
 
-func createUser(username string) {
+func createUser(logger *slog.Logger, username string) {
 	data := map[string]string{"username": username}
 	body, _ := json.Marshal(data)
 
 	resp, err := http.Post(baseURL+"/user", "application/json", bytes.NewBuffer(body))
 	if err != nil {
-		log.Println("Error creating user:", err)
+		logger.Error("Error creating user", "err", err)
 		return
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		log.Printf("Error: Received status code %d\n", resp.StatusCode)
+		logger.Error("Unexpected status", "status", resp.StatusCode)
 		return
 	}
 
 	var result map[string]interface{}
 	json.NewDecoder(resp.Body).Decode(&result)
-	log.Println("User created:", result)
+	logger.Info("User created", "result", result)
 }
 
-func createSubreddit(name string) {
+func createSubreddit(logger *slog.Logger, name string) {
 	data := map[string]string{"name": name}
 	body, _ := json.Marshal(data)
 
 	resp, err := http.Post(baseURL+"/subreddit", "application/json", bytes.NewBuffer(body))
 	if err != nil {
-		log.Println("Error creating subreddit:", err)
+		logger.Error("Error creating subreddit", "err", err)
 		return
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		log.Printf("Error: Received status code %d\n", resp.StatusCode)
+		logger.Error("Unexpected status", "status", resp.StatusCode)
 		return
 	}
 
 	var result map[string]interface{}
 	json.NewDecoder(resp.Body).Decode(&result)
-	log.Println("Subreddit created:", result)
+	logger.Info("Subreddit created", "result", result)
 }
 
-func submitPost(subreddit, username, title, content string) {
+func submitPost(logger *slog.Logger, subreddit, username, title, content string) {
 	data := map[string]string{"title": title, "content": content, "username": username}
 	body, _ := json.Marshal(data)
 
 	resp, err := http.Post(fmt.Sprintf("%s/%s/submit", baseURL, subreddit), "application/json", bytes.NewBuffer(body))
 	if err != nil {
-		log.Println("Error submitting post:", err)
+		logger.Error("Error submitting post", "err", err)
 		return
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		log.Printf("Error: Received status code %d\n", resp.StatusCode)
+		logger.Error("Unexpected status", "status", resp.StatusCode)
 		return
 	}
 
 	var result map[string]interface{}
 	json.NewDecoder(resp.Body).Decode(&result)
-	log.Println("Post submitted:", result)
+	logger.Info("Post submitted", "result", result, "subreddit", subreddit)
 }
 
 
-func createComment(postID string, username, content string) {
+func createComment(logger *slog.Logger, postID string, username, content string) {
 	data := map[string]string{"content": content, "username": username}
 	body, _ := json.Marshal(data)
 
@@ -97,154 +97,154 @@ func createComment(postID string, username, content string) {
 
 	resp, err := http.Post(url, "application/json", bytes.NewBuffer(body))
 	if err != nil {
-		log.Println("Error creating comment:", err)
+		logger.Error("Error creating comment", "err", err)
 		return
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		log.Printf("Error: Received status code %d\n", resp.StatusCode)
+		logger.Error("Unexpected status", "status", resp.StatusCode)
 		return
 	}
 
 	var result map[string]interface{}
 	json.NewDecoder(resp.Body).Decode(&result)
-	log.Println("Comment created:", result)
+	logger.Info("Comment created", "result", result, "post_id", postID)
 }
 
 
 
-func voteOnPost(postID string, upvote bool) {
+func voteOnPost(logger *slog.Logger, postID string, upvote bool) {
 	data := map[string]bool{"upvote": upvote}
 	body, _ := json.Marshal(data)
 
 	url := fmt.Sprintf("%s/%s/vote", baseURL, postID)
 	resp, err := http.Post(url, "application/json", bytes.NewBuffer(body))
 	if err != nil {
-		log.Println("Error voting on post:", err)
+		logger.Error("Error voting on post", "err", err)
 		return
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		log.Printf("Error: Received status code %d\n", resp.StatusCode)
+		logger.Error("Unexpected status", "status", resp.StatusCode)
 		return
 	}
 
-	log.Println("Vote successful!")
+	logger.Info("Vote successful", "post_id", postID, "upvote", upvote)
 }
 
 
 
-func getAllUsers() {
+func getAllUsers(logger *slog.Logger) {
 	resp, err := http.Get(baseURL + "/getusers")
 	if err != nil {
-		log.Println("Error fetching users:", err)
+		logger.Error("Error fetching users", "err", err)
 		return
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		log.Printf("Error: Received status code %d\n", resp.StatusCode)
+		logger.Error("Unexpected status", "status", resp.StatusCode)
 		return
 	}
 
 	var users []map[string]interface{}
 	json.NewDecoder(resp.Body).Decode(&users)
-	log.Println("Users:", users)
+	logger.Info("Users", "users", users)
 }
 
-func getAllSubreddits() {
+func getAllSubreddits(logger *slog.Logger) {
 	resp, err := http.Get(baseURL + "/getsubreddits")
 	if err != nil {
-		log.Println("Error fetching subreddits:", err)
+		logger.Error("Error fetching subreddits", "err", err)
 		return
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		log.Printf("Error: Received status code %d\n", resp.StatusCode)
+		logger.Error("Unexpected status", "status", resp.StatusCode)
 		return
 	}
 
 	var subreddits []map[string]interface{}
 	json.NewDecoder(resp.Body).Decode(&subreddits)
-	log.Println("Subreddits:", subreddits)
+	logger.Info("Subreddits", "subreddits", subreddits)
 }
 
-func getAllPosts() {
+func getAllPosts(logger *slog.Logger) {
 	resp, err := http.Get(baseURL + "/getposts")
 	if err != nil {
-		log.Println("Error fetching posts:", err)
+		logger.Error("Error fetching posts", "err", err)
 		return
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		log.Printf("Error: Received status code %d\n", resp.StatusCode)
+		logger.Error("Unexpected status", "status", resp.StatusCode)
 		return
 	}
 
 	var posts []map[string]interface{}
 	json.NewDecoder(resp.Body).Decode(&posts)
-	log.Println("Posts:", posts)
+	logger.Info("Posts", "posts", posts)
 }
 
-func joinSubreddit(subreddit, username string) {
+func joinSubreddit(logger *slog.Logger, subreddit, username string) {
 	data := map[string]string{"username": username}
 	body, _ := json.Marshal(data)
 
 	resp, err := http.Post(fmt.Sprintf("%s/%s/join", baseURL, subreddit), "application/json", bytes.NewBuffer(body))
 	if err != nil {
-		log.Println("Error joining subreddit:", err)
+		logger.Error("Error joining subreddit", "err", err)
 		return
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		log.Printf("Error: Received status code %d\n", resp.StatusCode)
+		logger.Error("Unexpected status", "status", resp.StatusCode)
 		return
 	}
 
-	log.Println("Joined subreddit:", subreddit)
+	logger.Info("Joined subreddit", "subreddit", subreddit, "username", username)
 }
 
-func leaveSubreddit(subreddit, username string) {
+func leaveSubreddit(logger *slog.Logger, subreddit, username string) {
 	data := map[string]string{"username": username}
 	body, _ := json.Marshal(data)
 
 	resp, err := http.Post(fmt.Sprintf("%s/%s/leave", baseURL, subreddit), "application/json", bytes.NewBuffer(body))
 	if err != nil {
-		log.Println("Error leaving subreddit:", err)
+		logger.Error("Error leaving subreddit", "err", err)
 		return
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		log.Printf("Error: Received status code %d\n", resp.StatusCode)
+		logger.Error("Unexpected status", "status", resp.StatusCode)
 		return
 	}
 
-	log.Println("Left subreddit:", subreddit)
+	logger.Info("Left subreddit", "subreddit", subreddit, "username", username)
 }
 
-func getFeed(subreddit string) {
+func getFeed(logger *slog.Logger, subreddit string) {
 	url := fmt.Sprintf("%s/%s/feed", baseURL, subreddit)
 	resp, err := http.Get(url)
 	if err != nil {
-		log.Println("Error fetching feed:", err)
+		logger.Error("Error fetching feed", "err", err)
 		return
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		log.Printf("Error: Received status code %d\n", resp.StatusCode)
+		logger.Error("Unexpected status", "status", resp.StatusCode)
 		return
 	}
 
 	var feed []map[string]interface{}
 	json.NewDecoder(resp.Body).Decode(&feed)
-	log.Println("Feed:", feed)
+	logger.Info("Feed", "feed", feed)
 }
 
 func printUsage() {
@@ -263,7 +263,7 @@ func printUsage() {
 }
 
 func main() {
-	logFile := initLog()
+	logger, logFile := newLogger()
 	defer logFile.Close()
 
 	if len(os.Args) < 2 {
@@ -276,71 +276,71 @@ func main() {
 	switch command {
 	case "createUser":
 		if len(os.Args) < 3 {
-			log.Println("Please provide a username.")
+			fmt.Println("Please provide a username.")
 			printUsage()
 			return
 		}
-		createUser(os.Args[2])
+		createUser(logger, os.Args[2])
 	case "createSubreddit":
 		if len(os.Args) < 3 {
-			log.Println("Please provide a subreddit name.")
+			fmt.Println("Please provide a subreddit name.")
 			printUsage()
 			return
 		}
-		createSubreddit(os.Args[2])
+		createSubreddit(logger, os.Args[2])
 	case "submitPost":
 		if len(os.Args) < 6 {
-			log.Println("Please provide subreddit, username, title, and content for the post.")
+			fmt.Println("Please provide subreddit, username, title, and content for the post.")
 			printUsage()
 			return
 		}
-		submitPost(os.Args[2], os.Args[3], os.Args[4], os.Args[5])
+		submitPost(logger, os.Args[2], os.Args[3], os.Args[4], os.Args[5])
 	case "createComment":
 		if len(os.Args) < 5 {
-			log.Println("Please provide postID, username, and content for the comment.")
+			fmt.Println("Please provide postID, username, and content for the comment.")
 			printUsage()
 			return
 		}
 		postID := os.Args[2]
-		createComment(postID, os.Args[3], os.Args[4])
+		createComment(logger, postID, os.Args[3], os.Args[4])
 	case "getFeed":
 		if len(os.Args) < 3 {
-			log.Println("Please provide a username.")
+			fmt.Println("Please provide a username.")
 			printUsage()
 			return
 		}
-		getFeed(os.Args[2])
+		getFeed(logger, os.Args[2])
 	case "vote":
 		if len(os.Args) < 4 {
-			log.Println("Please provide postID and vote status (true/false).")
+			fmt.Println("Please provide postID and vote status (true/false).")
 			printUsage()
 			return
 		}
 		postID := os.Args[2]
 		upvote := os.Args[3] == "true"
-		voteOnPost(postID, upvote)
+		voteOnPost(logger, postID, upvote)
 	case "getAllUsers":
-		getAllUsers()
+		getAllUsers(logger)
 	case "getAllSubreddits":
-		getAllSubreddits()
+		getAllSubreddits(logger)
 	case "getAllPosts":
-		getAllPosts()
+		getAllPosts(logger)
 	case "joinSubreddit":
 		if len(os.Args) < 4 {
-			log.Println("Please provide subreddit and username.")
+			fmt.Println("Please provide subreddit and username.")
 			printUsage()
 			return
 		}
-		joinSubreddit(os.Args[2], os.Args[3])
+		joinSubreddit(logger, os.Args[2], os.Args[3])
 	case "leaveSubreddit":
 		if len(os.Args) < 4 {
-			log.Println("Please provide subreddit and username.")
+			fmt.Println("Please provide subreddit and username.")
 			printUsage()
 			return
 		}
-		leaveSubreddit(os.Args[2], os.Args[3])
+		leaveSubreddit(logger, os.Args[2], os.Args[3])
 	default:
-		log.Printf("Unknown command: %s\n", command)
+		fmt.Printf("Unknown command: %s\n", command)
 		printUsage()
 	}
 }
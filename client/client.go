@@ -9,27 +9,34 @@ type Client struct {
     User   *engine.User
 }
 
-func NewClient(engine *engine.RedditEngine, username string) *Client {
-    user := engine.RegisterAccount(username)
+func NewClient(engine *engine.RedditEngine, username string) (*Client, error) {
+    user, err := engine.RegisterAccount(username)
+    if err != nil {
+        return nil, err
+    }
     return &Client{
         Engine: engine,
         User:   user,
-    }
+    }, nil
 }
 
-func (c *Client) CreatePost(sr *engine.SubReddit, title, content string) *engine.Post {
+func (c *Client) CreatePost(sr *engine.SubReddit, title, content string) (*engine.Post, error) {
     return c.Engine.CreatePost(c.User, sr, title, content)
 }
 
-func (c *Client) CreateComment(post *engine.Post, content string) *engine.Comment {
+func (c *Client) CreateComment(post *engine.Post, content string) (*engine.Comment, error) {
     return c.Engine.CreateComment(c.User, post, content)
 }
 
 func (c *Client) Vote(post *engine.Post, upvote bool) {
-    c.Engine.Vote(post, upvote)
+    direction := -1
+    if upvote {
+        direction = 1
+    }
+    c.Engine.CastVote(c.User, post, direction)
 }
 
-func (c *Client) SendMessage(to *engine.User, content string) *engine.Message {
+func (c *Client) SendMessage(to *engine.User, content string) (*engine.Message, error) {
     return c.Engine.SendMessage(c.User, to, content)
 }
 
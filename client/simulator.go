@@ -1,103 +1,310 @@
 package client
 
 import (
+	"bytes"
+	"context"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"math/rand"
-	"os"
 	"reddit-clone/engine"
+	"reddit-clone/logging"
+	"reddit-clone/metrics"
+	"strings"
 )
 
-var LoggingEnabled = true 
-
 type Simulator struct {
 	Engine     *engine.RedditEngine
 	Clients    []*Client
 	SubReddits []*engine.SubReddit
+	// Metrics exposes the engine's operation counters, lock contention and
+	// entity totals.
+	Metrics    *metrics.Registry
+	// RepostRate is the share of posts Run makes that repeat an earlier
+	// post, as an exact copy, a copy with one word changed, or the same
+	// link dressed differently.
+	RepostRate float64
+	logger     *slog.Logger
+	// originals are the posts Run made that are not reposts, and reposts
+	// maps each repost to the post it repeats.
+	originals  []*engine.Post
+	reposts    map[*engine.Post]*engine.Post
 }
 
-func NewSimulator() *Simulator {
-	if LoggingEnabled {
-		logFile, err := os.OpenFile("reddit_simulation.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
-		if err != nil {
-			fmt.Printf("Error opening log file: %v\n", err)
-			return nil
-		}
-		log.SetOutput(logFile)
-		log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
+// NewSimulator returns a simulator with a fresh engine that logs to logger.
+// A nil logger disables logging.
+func NewSimulator(logger *slog.Logger) *Simulator {
+	logger = logging.OrDiscard(logger)
+	sim := &Simulator{
+		Engine:  engine.NewRedditEngine(),
+		Metrics: metrics.NewRegistry(),
+		logger:  logger,
 	}
+	sim.Engine.SetLogger(logger)
+	metrics.RegisterEngine(sim.Metrics, sim.Engine)
+	metrics.RegisterRuntime(sim.Metrics)
+	return sim
+}
 
-	return &Simulator{
-		Engine: engine.NewRedditEngine(),
-	}
+// ScrapeMetrics returns the metrics served at url, or the simulator's own
+// metrics if url is empty.
+func (s *Simulator) ScrapeMetrics(url string) ([]metrics.Sample, error) {
+    if url != "" {
+        return metrics.Scrape(url)
+    }
+    var buf bytes.Buffer
+    s.Metrics.WriteText(&buf)
+    return metrics.Parse(&buf)
+}
+
+// WriteMetricsReport summarises scraped metrics for the end-of-run report.
+func WriteMetricsReport(w io.Writer, samples []metrics.Sample) {
+    fmt.Fprintln(w, "Engine operations:")
+    for _, op := range []engine.EventType{engine.EventPostCreated, engine.EventCommentCreated, engine.EventVoteCast, engine.EventMessageSent} {
+        n := metrics.Sum(samples, "reddit_engine_operations_total", map[string]string{"op": string(op)})
+        fmt.Fprintf(w, "  %-18s %.0f\n", op, n)
+    }
+    fmt.Fprintln(w, "Entities:")
+    for _, kind := range []string{"users", "subreddits", "posts", "comments", "messages"} {
+        n := metrics.Sum(samples, "reddit_entities", map[string]string{"kind": kind})
+        fmt.Fprintf(w, "  %-18s %.0f\n", kind, n)
+    }
+    acquisitions := metrics.Sum(samples, "reddit_engine_lock_acquisitions_total", nil)
+    wait := metrics.Sum(samples, "reddit_engine_lock_wait_seconds_total", nil)
+    fmt.Fprintf(w, "Lock acquisitions: %.0f, total wait %.6fs", acquisitions, wait)
+    if acquisitions > 0 {
+        fmt.Fprintf(w, " (mean %.3fµs)", wait/acquisitions*1e6)
+    }
+    fmt.Fprintln(w)
+    if requests := metrics.Sum(samples, "http_requests_total", nil); requests > 0 {
+        fmt.Fprintf(w, "HTTP requests: %.0f\n", requests)
+    }
+    fmt.Fprintf(w, "Goroutines: %.0f\n", metrics.Sum(samples, "go_goroutines", nil))
 }
 
 // Run the simulation and log actions
 func (s *Simulator) Run(numUsers, numSRs, numPosts, numComments, numVotes, numMessages int) {
-    if LoggingEnabled {
-        log.Printf("Starting simulation with %d users, %d subreddits, %d posts, %d comments per post, %d votes per post, %d messages\n",
-            numUsers, numSRs, numPosts, numComments, numVotes, numMessages)
-    }
+    s.logger.Info("starting simulation", "users", numUsers, "subreddits", numSRs, "posts", numPosts,
+        "comments_per_post", numComments, "votes_per_post", numVotes, "messages", numMessages)
 
     // Create users and clients
     for i := 0; i < numUsers; i++ {
-        client := NewClient(s.Engine, fmt.Sprintf("user%d", i))
-        s.Clients = append(s.Clients, client)
-        if LoggingEnabled {
-            log.Printf("Created user: %s\n", client.User.Username)
+        client, err := NewClient(s.Engine, fmt.Sprintf("user%d", i))
+        if err != nil {
+            s.logger.Error("creating user", "err", err)
+            continue
         }
+        s.Clients = append(s.Clients, client)
+        s.logger.Info("created user", "user", client.User.Username)
     }
 
     // Create subreddits
     for i := 0; i < numSRs; i++ {
-        sr := s.Engine.CreateSubReddit(fmt.Sprintf("sr%d", i))
-        s.SubReddits = append(s.SubReddits, sr)
-        if LoggingEnabled {
-            log.Printf("Created subreddit: %s\n", sr.Name)
+        sr, err := s.Engine.CreateSubReddit(fmt.Sprintf("sr%d", i))
+        if err != nil {
+            s.logger.Error("creating subreddit", "err", err)
+            continue
         }
+        s.SubReddits = append(s.SubReddits, sr)
+        s.logger.Info("created subreddit", "subreddit", sr.Name)
     }
 
     // Simulate activity
     for i := 0; i < numPosts; i++ {
         client := s.Clients[rand.Intn(len(s.Clients))]
         sr := s.SubReddits[rand.Intn(len(s.SubReddits))]
-        post := client.CreatePost(sr, fmt.Sprintf("Post %d", i), "Content")
-        if LoggingEnabled {
-            log.Printf("User %s created a post in subreddit %s: %s\n", client.User.Username, sr.Name, post.Title)
+        var original *engine.Post
+        title, content := postText(i)
+        if len(s.originals) > 0 && rand.Float64() < s.RepostRate {
+            original = s.originals[rand.Intn(len(s.originals))]
+            title, content = repostText(original)
+            // Most reposts go back to the same community.
+            if rand.Intn(4) > 0 {
+                sr = s.Engine.SubReddits[original.SubRedditID]
+            }
+        }
+        post, err := client.CreatePost(sr, title, content)
+        if err != nil {
+            s.logger.Error("creating post", "err", err)
+            continue
+        }
+        if original == nil {
+            s.originals = append(s.originals, post)
+            s.logger.Info("created post", "user", client.User.Username, "subreddit", sr.Name, "post_id", post.ID, "title", post.Title)
+        } else {
+            if s.reposts == nil {
+                s.reposts = make(map[*engine.Post]*engine.Post)
+            }
+            s.reposts[post] = original
+            s.logger.Info("reposted", "user", client.User.Username, "subreddit", sr.Name, "post_id", post.ID, "original_id", original.ID)
         }
 
         for j := 0; j < numComments; j++ {
             commenter := s.Clients[rand.Intn(len(s.Clients))]
-            comment := commenter.CreateComment(post, fmt.Sprintf("Comment %d", j))
-            if LoggingEnabled {
-                log.Printf("User %s commented on post '%s': %s\n", commenter.User.Username, post.Title, comment.Content)
+            comment, err := commenter.CreateComment(post, fmt.Sprintf("Comment %d", j))
+            if err != nil {
+                s.logger.Error("creating comment", "err", err)
+                continue
             }
+            s.logger.Info("created comment", "user", commenter.User.Username, "post_id", post.ID, "comment_id", comment.ID)
         }
 
         for j := 0; j < numVotes; j++ {
             voter := s.Clients[rand.Intn(len(s.Clients))]
             upvote := rand.Intn(2) == 0
             voter.Vote(post, upvote)
-            if LoggingEnabled {
-                voteType := "upvoted"
-                if !upvote {
-                    voteType = "downvoted"
-                }
-                log.Printf("User %s %s post '%s'\n", voter.User.Username, voteType, post.Title)
-            }
+            s.logger.Info("voted", "user", voter.User.Username, "post_id", post.ID, "upvote", upvote)
         }
     }
 
     for i := 0; i < numMessages; i++ {
         fromClient := s.Clients[rand.Intn(len(s.Clients))]
         toClient := s.Clients[rand.Intn(len(s.Clients))]
-        msg := fromClient.SendMessage(toClient.User, fmt.Sprintf("Message %d", i))
-        if LoggingEnabled {
-            log.Printf("User %s sent message to user %s: %s\n", fromClient.User.Username, toClient.User.Username, msg.Content)
+        msg, err := fromClient.SendMessage(toClient.User, fmt.Sprintf("Message %d", i))
+        if err != nil {
+            s.logger.Error("sending message", "err", err)
+            continue
+        }
+        s.logger.Info("sent message", "from", fromClient.User.Username, "to", toClient.User.Username, "message_id", msg.ID)
+    }
+
+    s.logger.Info("simulation completed")
+}
+// words is the vocabulary of simulated posts.
+var words = strings.Fields(`
+    about after again air answer area back best body book build city close
+    come country course data design early end energy every face fact family
+    field find game give good government great group hand head health help
+    high home house idea issue job keep kind land large last law leave life
+    light line local long look market money month music name never new news
+    night number old open order part party people place plan play point
+    power price problem program public question read real report right road
+    rule school science season see service small space start state story
+    study system team thing think time today town tree true turn value
+    video want water way week work world write year young`)
+
+// postText returns a random title and body for the i'th simulated post.
+// Some bodies link to a page of their own.
+func postText(i int) (title, content string) {
+    title = randomWords(6 + rand.Intn(5))
+    content = randomWords(20 + rand.Intn(20))
+    if rand.Intn(3) == 0 {
+        content += fmt.Sprintf(" https://example.com/stories/%d", i)
+    }
+    return title, content
+}
+
+func randomWords(n int) string {
+    picked := make([]string, n)
+    for i := range picked {
+        picked[i] = words[rand.Intn(len(words))]
+    }
+    return strings.Join(picked, " ")
+}
+
+// repostText returns the title and body of a repost of original: the same
+// link with a tracking parameter and new words, the same text with one word
+// changed, or an exact copy.
+func repostText(original *engine.Post) (title, content string) {
+    fields := strings.Fields(original.Content)
+    last := fields[len(fields)-1]
+    switch rand.Intn(3) {
+    case 0:
+        if strings.HasPrefix(last, "https://") {
+            link := strings.Replace(last, "https://", "http://www.", 1) + "/?utm_source=sim"
+            return randomWords(8), randomWords(10) + " " + link
         }
+        fallthrough
+    case 1:
+        fields[rand.Intn(len(fields))] = words[rand.Intn(len(words))]
+        return original.Title, strings.Join(fields, " ")
     }
+    return original.Title, original.Content
+}
 
-    if LoggingEnabled {
-        log.Println("Simulation completed")
+// CheckReposts returns how many reposts Run made, for how many of them
+// the engine found the post they repeat, and how many original posts it
+// took for reposts of something else.
+func (s *Simulator) CheckReposts() (submitted, detected, falseMatches int) {
+    ctx := context.Background()
+    for repost, original := range s.reposts {
+        submitted++
+        for _, r := range s.Engine.Reposts(ctx, repost) {
+            if r.Post == original {
+                detected++
+                break
+            }
+        }
     }
-}
\ No newline at end of file
+    for _, post := range s.originals {
+        if len(s.Engine.Reposts(ctx, post)) > 0 {
+            falseMatches++
+        }
+    }
+    return submitted, detected, falseMatches
+}
+
+// voteRingPosts is how many posts each injected vote ring boosts.
+const voteRingPosts = 5
+
+// InjectVoteRings adds rings vote rings of size new accounts each, as
+// sockpuppets brigading for one user would: the user makes a few posts and
+// the ring upvotes every one of them at once, through a share link named
+// after the ring. It returns the accounts of each ring.
+func (s *Simulator) InjectVoteRings(rings, size int) [][]*engine.User {
+    var injected [][]*engine.User
+    for i := 0; i < rings && len(s.Clients) > 0 && len(s.SubReddits) > 0; i++ {
+        boosted := s.Clients[rand.Intn(len(s.Clients))]
+        ctx := engine.WithVoteRef(context.Background(), fmt.Sprintf("ring%d", i))
+        var members []*engine.User
+        for j := 0; j < size; j++ {
+            user, err := s.Engine.RegisterAccount(fmt.Sprintf("ring%d_%d", i, j))
+            if err != nil {
+                s.logger.Error("creating ring account", "err", err)
+                continue
+            }
+            members = append(members, user)
+        }
+        for j := 0; j < voteRingPosts; j++ {
+            post, err := boosted.CreatePost(s.SubReddits[rand.Intn(len(s.SubReddits))], fmt.Sprintf("Boosted %d.%d", i, j), "Content")
+            if err != nil {
+                s.logger.Error("creating post", "err", err)
+                continue
+            }
+            for _, user := range members {
+                s.Engine.CastVoteContext(ctx, user, post, 1)
+            }
+        }
+        s.logger.Info("injected vote ring", "ring", i, "boosted", boosted.User.Username, "accounts", len(members))
+        injected = append(injected, members)
+    }
+    return injected
+}
+
+// CheckVoteRings runs vote ring detection and returns how many of the
+// injected rings were found with exactly their accounts, and how many
+// accounts were flagged that are in no injected ring.
+func (s *Simulator) CheckVoteRings(injected [][]*engine.User) (found, falsePositives int) {
+    report := s.Engine.DetectVoteRings(context.Background(), engine.DefaultVoteRingOptions())
+    ringOf := make(map[int]int)
+    for i, members := range injected {
+        for _, user := range members {
+            ringOf[user.ID] = i + 1
+        }
+    }
+    for _, ring := range report.Rings {
+        exact := len(ring.Members) > 0
+        for _, user := range ring.Members {
+            if ringOf[user.ID] == 0 {
+                falsePositives++
+                exact = false
+            } else if ringOf[user.ID] != ringOf[ring.Members[0].ID] {
+                exact = false
+            }
+        }
+        if exact && len(ring.Members) == len(injected[ringOf[ring.Members[0].ID]-1]) {
+            found++
+        }
+    }
+    return found, falsePositives
+}
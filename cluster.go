@@ -0,0 +1,905 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"reddit-clone/engine"
+	"reddit-clone/logging"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultPartitions is how many partitions a cluster's data is split
+	// into, which bounds how many nodes can share the load.
+	defaultPartitions = 32
+	// ringReplicas is how many points each node has on the hash ring; more
+	// points even out how many partitions each node gets.
+	ringReplicas = 64
+	// maxClusterHops bounds how often a request is passed on between nodes
+	// whose views of the ring disagree.
+	maxClusterHops = 3
+	// clusterTimeout bounds a request from one node to another.
+	clusterTimeout = 30 * time.Second
+)
+
+// Headers nodes add to the API requests they forward to each other.
+const (
+	headerPartition     = "X-Cluster-Partition"
+	headerClusterToken  = "X-Cluster-Token"
+	headerClusterHops   = "X-Cluster-Hops"
+	headerClusterClient = "X-Cluster-Client"
+)
+
+// Ring assigns partitions to nodes by consistent hashing: each node has
+// ringReplicas points on a circle of hashes, and a partition belongs to the
+// node owning the first point at or after the partition's hash. Adding or
+// removing a node only moves the partitions next to its points.
+type Ring struct {
+	Version int      `json:"version"`
+	Nodes   []string `json:"nodes"`
+	// Owners[p] is the node that owns partition p.
+	Owners []string `json:"owners"`
+}
+
+func newRing(nodes []string, partitions, version int) *Ring {
+	nodes = slices.Clone(nodes)
+	for i := range nodes {
+		nodes[i] = strings.TrimSuffix(nodes[i], "/")
+	}
+	slices.Sort(nodes)
+	nodes = slices.Compact(nodes)
+
+	type point struct {
+		hash uint64
+		node string
+	}
+	points := make([]point, 0, len(nodes)*ringReplicas)
+	for _, node := range nodes {
+		for i := 0; i < ringReplicas; i++ {
+			points = append(points, point{hash64(node + "#" + strconv.Itoa(i)), node})
+		}
+	}
+	slices.SortFunc(points, func(a, b point) int { return cmp.Compare(a.hash, b.hash) })
+
+	r := &Ring{Version: version, Nodes: nodes, Owners: make([]string, partitions)}
+	if len(points) == 0 {
+		return r
+	}
+	for p := range r.Owners {
+		h := hash64("partition#" + strconv.Itoa(p))
+		i, _ := slices.BinarySearchFunc(points, h, func(pt point, h uint64) int { return cmp.Compare(pt.hash, h) })
+		r.Owners[p] = points[i%len(points)].node
+	}
+	return r
+}
+
+func hash64(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// ClusterStatus is the body of GET /cluster/status.
+type ClusterStatus struct {
+	Self string `json:"self"`
+	Ring *Ring  `json:"ring"`
+	// Hosted are the partitions this node has; Frozen those of them that
+	// are being handed to another node, and Moved where partitions handed
+	// over went until the ring says so.
+	Hosted []int          `json:"hosted"`
+	Frozen []int          `json:"frozen,omitempty"`
+	Moved  map[int]string `json:"moved,omitempty"`
+}
+
+// partition is one shard of the site: an engine of its own, served by an
+// API of its own.
+type partition struct {
+	id     int
+	engine *engine.RedditEngine
+	api    *API
+	// writes is held shared by writes in flight, and exclusively to freeze
+	// the partition once they are done.
+	writes sync.RWMutex
+	frozen atomic.Bool
+}
+
+// cluster makes the server one node of a sharded site. It hosts the
+// partitions the ring gives it and routes every API request: requests about
+// one subreddit, post or user go to the partition that has it, and
+// listings and karma are gathered from all of them. Membership changes move
+// partitions between nodes while they keep serving: a partition is frozen
+// for writes while it is copied, and its old node then forwards its
+// requests to the new one until every node has the new ring.
+type cluster struct {
+	self       string
+	partitions int
+	token      string
+	dataFile   string
+	client     *http.Client
+	logger     *slog.Logger
+	// docs serves the API description, which is the same everywhere.
+	docs *API
+	// configure sets up the API of each partition like the server's own.
+	configure func(*API)
+
+	mu    sync.RWMutex
+	ring  *Ring
+	parts map[int]*partition
+	moved map[int]string
+
+	// changing serialises the membership changes this node coordinates.
+	changing sync.Mutex
+
+	forwarded atomic.Int64
+	moves     atomic.Int64
+}
+
+// newCluster creates the partitions the initial ring gives this node,
+// loading those saved under dataFile, and registers the cluster metrics
+// with docs.
+func newCluster(docs *API, cfg ClusterConfig, dataFile string, logger *slog.Logger, configure func(*API)) (*cluster, error) {
+	c := &cluster{
+		self:       strings.TrimSuffix(cfg.Self, "/"),
+		partitions: cfg.Partitions,
+		token:      cfg.Token,
+		dataFile:   dataFile,
+		client:     &http.Client{Timeout: clusterTimeout},
+		logger:     logging.OrDiscard(logger),
+		docs:       docs,
+		configure:  configure,
+		parts:      make(map[int]*partition),
+		moved:      make(map[int]string),
+	}
+	if c.partitions <= 0 {
+		c.partitions = defaultPartitions
+	}
+	c.ring = newRing(cfg.Nodes, c.partitions, 1)
+	for p, owner := range c.ring.Owners {
+		if owner != c.self {
+			continue
+		}
+		part, err := c.newPartition(p, nil)
+		if err != nil {
+			return nil, err
+		}
+		if path := c.partitionFile(p); path != "" {
+			err := part.engine.LoadFile(path)
+			switch {
+			case err == nil:
+				c.logger.Info("loaded partition", "partition", p, "file", path)
+			case !errors.Is(err, fs.ErrNotExist):
+				return nil, fmt.Errorf("loading %s: %w", path, err)
+			}
+		}
+		c.parts[p] = part
+	}
+
+	reg := docs.metrics.registry
+	reg.NewGaugeFunc("cluster_ring_version", "Version of the partition ring this node routes by.", func() float64 {
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		return float64(c.ring.Version)
+	})
+	reg.NewGaugeFunc("cluster_partitions_hosted", "Partitions this node has.", func() float64 {
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		return float64(len(c.parts))
+	})
+	reg.NewCounterFunc("cluster_forwarded_requests_total", "Requests this node passed to the node owning their partition.", func() float64 {
+		return float64(c.forwarded.Load())
+	})
+	reg.NewCounterFunc("cluster_partition_moves_total", "Partitions this node handed to another node.", func() float64 {
+		return float64(c.moves.Load())
+	})
+	return c, nil
+}
+
+func (c *cluster) newPartition(p int, snap *engine.Snapshot) (*partition, error) {
+	e := engine.NewRedditEngine()
+	e.SetLogger(c.logger.With("partition", p))
+	e.SetPartition(p, c.partitions)
+	if snap != nil {
+		if err := e.Restore(snap); err != nil {
+			return nil, err
+		}
+	}
+	e.SetUserResolver(c.resolver(p))
+	api := NewAPI(e)
+	if c.configure != nil {
+		c.configure(api)
+	}
+	api.SetReady(true)
+	return &partition{id: p, engine: e, api: api}, nil
+}
+
+// partitionFile is where partition p is saved, or "" without a data file.
+func (c *cluster) partitionFile(p int) string {
+	if c.dataFile == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s.%d", c.dataFile, p)
+}
+
+// Save writes every partition this node has to its data file.
+func (c *cluster) Save() error {
+	if c.dataFile == "" {
+		return nil
+	}
+	c.mu.RLock()
+	parts := make([]*partition, 0, len(c.parts))
+	for _, part := range c.parts {
+		parts = append(parts, part)
+	}
+	c.mu.RUnlock()
+	var errs []error
+	for _, part := range parts {
+		if err := part.engine.SaveFile(c.partitionFile(part.id)); err != nil {
+			errs = append(errs, fmt.Errorf("saving partition %d: %w", part.id, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// partitionOf returns the partition a subreddit or user name belongs to.
+func (c *cluster) partitionOf(name string) int {
+	return int(hash64("name#"+strings.ToLower(name)) % uint64(c.partitions))
+}
+
+// locate returns partition p if this node has it, and otherwise the node
+// to ask for it.
+func (c *cluster) locate(p int) (*partition, string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if part := c.parts[p]; part != nil {
+		return part, ""
+	}
+	if node := c.moved[p]; node != "" {
+		return nil, node
+	}
+	return nil, c.ring.Owners[p]
+}
+
+func (c *cluster) currentRing() *Ring {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.ring
+}
+
+// resolver finds users registered with another partition by asking their
+// home partition.
+func (c *cluster) resolver(p int) engine.UserResolver {
+	return func(ctx context.Context, username string) (*engine.User, error) {
+		home := c.partitionOf(username)
+		if home == p {
+			return nil, nil
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "/api/v1/users/"+url.PathEscape(username), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp := c.exchange(req, home, 0)
+		switch resp.status {
+		case http.StatusOK:
+		case http.StatusNotFound:
+			return nil, nil
+		default:
+			return nil, &apiError{status: http.StatusServiceUnavailable, code: codeNodeUnavailable, msg: fmt.Sprintf("looking up %s in partition %d: %s", username, home, http.StatusText(resp.status))}
+		}
+		var user UserResponse
+		if err := json.Unmarshal(resp.body.Bytes(), &user); err != nil {
+			return nil, err
+		}
+		return &engine.User{ID: user.ID, Username: user.Username}, nil
+	}
+}
+
+// ServeHTTP routes a request to the public API, or one another node
+// forwarded, to the partitions it concerns.
+func (c *cluster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !c.authorized(r.Header.Get(headerClusterToken)) {
+		// Only other nodes may pick the partition or name the client.
+		for _, name := range clusterHeaders {
+			r.Header.Del(name)
+		}
+	}
+	if s := r.Header.Get(headerPartition); s != "" {
+		p, err := strconv.Atoi(s)
+		if err != nil || p < 0 || p >= c.partitions {
+			writeError(w, r, badRequest("invalid partition"))
+			return
+		}
+		hops, _ := strconv.Atoi(r.Header.Get(headerClusterHops))
+		if client := r.Header.Get(headerClusterClient); client != "" {
+			r.RemoteAddr = client
+		}
+		c.exchange(r, p, hops).writeTo(w)
+		return
+	}
+	r.Header.Del(headerClusterToken)
+
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(segments) < 3 || segments[0] != "api" || segments[1] != "v1" {
+		switch r.URL.Path {
+		case "/api/openapi.json", "/api/docs":
+			c.docs.ServeHTTP(w, r)
+		default:
+			writeError(w, r, &apiError{status: http.StatusNotImplemented, code: codeNotImplemented, msg: "only /api/v1 is available in a cluster"})
+		}
+		return
+	}
+	list := len(segments) == 3 && r.Method == http.MethodGet
+	switch resource := segments[2]; {
+	case resource == "users" && list:
+		c.gather(w, r, false)
+	case resource == "users" && len(segments) == 3:
+		c.routeByBody(w, r, "username")
+	case resource == "users" && len(segments) == 4 && r.Method == http.MethodGet:
+		c.getUser(w, r, segments[3])
+	case resource == "users":
+		c.exchange(r, c.partitionOf(segments[3]), 0).writeTo(w)
+	case resource == "r" && list:
+		c.gather(w, r, false)
+	case resource == "r" && len(segments) == 3:
+		c.routeByBody(w, r, "name")
+	case resource == "r":
+		c.exchange(r, c.partitionOf(segments[3]), 0).writeTo(w)
+	case resource == "posts" && list:
+		c.gather(w, r, true)
+	case resource == "posts" && len(segments) > 3:
+		// Malformed IDs are left to partition 0 to reject.
+		id, _ := strconv.Atoi(segments[3])
+		c.exchange(r, max(id, 0)%c.partitions, 0).writeTo(w)
+	default:
+		writeError(w, r, &apiError{status: http.StatusNotImplemented, code: codeNotImplemented, msg: "not available in a cluster"})
+	}
+}
+
+// routeByBody sends a request creating a user or subreddit to the
+// partition the name in its body belongs to.
+func (c *cluster) routeByBody(w http.ResponseWriter, r *http.Request, field string) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	if err != nil {
+		writeError(w, r, bodyError(err))
+		return
+	}
+	var fields map[string]any
+	json.Unmarshal(body, &fields)
+	name, _ := fields[field].(string)
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	c.exchange(r, c.partitionOf(name), 0).writeTo(w)
+}
+
+// exchange serves r with partition p, here or on the node that has it.
+func (c *cluster) exchange(r *http.Request, p, hops int) *bufferedResponse {
+	resp := newBufferedResponse()
+	part, node := c.locate(p)
+	switch {
+	case part != nil:
+		c.serveLocal(resp, r, part)
+	case node == "" || node == c.self || hops >= maxClusterHops:
+		writeError(resp, r, &apiError{status: http.StatusServiceUnavailable, code: codeNodeUnavailable, msg: fmt.Sprintf("partition %d is unavailable", p)})
+	default:
+		c.forwarded.Add(1)
+		if err := c.forward(resp, r, node, p, hops+1); err != nil {
+			c.logger.Warn("forwarding request", "node", node, "partition", p, "err", err)
+			resp = newBufferedResponse()
+			writeError(resp, r, &apiError{status: http.StatusBadGateway, code: codeNodeUnavailable, msg: fmt.Sprintf("partition %d is unavailable", p)})
+		}
+	}
+	return resp
+}
+
+// serveLocal serves r with a partition this node has. A frozen partition
+// answers reads only.
+func (c *cluster) serveLocal(w http.ResponseWriter, r *http.Request, part *partition) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		part.writes.RLock()
+		defer part.writes.RUnlock()
+		if part.frozen.Load() {
+			w.Header().Set("Retry-After", "1")
+			writeError(w, r, &apiError{status: http.StatusServiceUnavailable, code: codePartitionMoving, msg: fmt.Sprintf("partition %d is moving to another node", part.id)})
+			return
+		}
+	}
+	part.api.ServeHTTP(w, r)
+}
+
+// clusterHeaders are set by the node forwarding a request and removed from
+// requests that do not carry the cluster token.
+var clusterHeaders = []string{headerPartition, headerClusterToken, headerClusterHops, headerClusterClient}
+
+// hopHeaders are not passed on between nodes.
+var hopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade"}
+
+func (c *cluster) forward(w *bufferedResponse, r *http.Request, node string, p, hops int) error {
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, node+r.URL.RequestURI(), r.Body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = r.ContentLength
+	req.Header = r.Header.Clone()
+	for _, name := range hopHeaders {
+		req.Header.Del(name)
+	}
+	req.Header.Set(headerPartition, strconv.Itoa(p))
+	req.Header.Set(headerClusterHops, strconv.Itoa(hops))
+	if r.Header.Get(headerClusterClient) == "" {
+		req.Header.Set(headerClusterClient, r.RemoteAddr)
+	}
+	if c.token != "" {
+		req.Header.Set(headerClusterToken, c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	for name, values := range resp.Header {
+		w.header[name] = values
+	}
+	for _, name := range hopHeaders {
+		w.header.Del(name)
+	}
+	w.header.Del("Content-Length")
+	w.status = resp.StatusCode
+	_, err = io.Copy(&w.body, resp.Body)
+	return err
+}
+
+// gather serves a listing by asking every partition for the page and
+// merging the answers by ID. Since every partition lists the items after
+// or before the cursor in the same order, the first limit items of the
+// merge are the page the whole site would give.
+func (c *cluster) gather(w http.ResponseWriter, r *http.Request, desc bool) {
+	p, err := parsePageParams(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	responses := make([]*bufferedResponse, c.partitions)
+	var wg sync.WaitGroup
+	for i := range responses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := r.Clone(r.Context())
+			req.Body = http.NoBody
+			// Validators are per partition, so the merged listing has none.
+			req.Header.Del("If-None-Match")
+			req.Header.Del("If-Modified-Since")
+			responses[i] = c.exchange(req, i, 0)
+		}(i)
+	}
+	wg.Wait()
+
+	type item struct {
+		id  int
+		raw json.RawMessage
+	}
+	var items []item
+	var total int
+	var more, earlier bool
+	for _, resp := range responses {
+		if resp.status != http.StatusOK {
+			resp.writeTo(w)
+			return
+		}
+		var raws []json.RawMessage
+		if err := json.Unmarshal(resp.body.Bytes(), &raws); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		for _, raw := range raws {
+			var v struct {
+				ID int `json:"id"`
+			}
+			json.Unmarshal(raw, &v)
+			items = append(items, item{v.ID, raw})
+		}
+		n, _ := strconv.Atoi(resp.header.Get("X-Total-Count"))
+		total += n
+		link := strings.Join(resp.header.Values("Link"), ", ")
+		more = more || strings.Contains(link, `rel="next"`)
+		earlier = earlier || strings.Contains(link, `rel="prev"`)
+	}
+	slices.SortFunc(items, func(a, b item) int {
+		if desc {
+			return cmp.Compare(b.id, a.id)
+		}
+		return cmp.Compare(a.id, b.id)
+	})
+
+	if p.Before != 0 {
+		earlier = earlier || len(items) > p.Limit
+		items = items[max(len(items)-p.Limit, 0):]
+	} else {
+		more = more || len(items) > p.Limit
+		items = items[:min(p.Limit, len(items))]
+	}
+	result := page[json.RawMessage]{Total: total}
+	for _, it := range items {
+		result.Items = append(result.Items, it.raw)
+	}
+	if len(items) > 0 {
+		if more {
+			result.Next = encodeCursor(items[len(items)-1].id)
+		}
+		if earlier {
+			result.Prev = encodeCursor(items[0].id)
+		}
+	}
+	writePage(w, r, result, p.Limit)
+}
+
+// getUser serves a user from their home partition, with the karma they
+// earned in every partition.
+func (c *cluster) getUser(w http.ResponseWriter, r *http.Request, username string) {
+	r.Header.Del("If-None-Match")
+	r.Header.Del("If-Modified-Since")
+	resp := c.exchange(r, c.partitionOf(username), 0)
+	if resp.status != http.StatusOK {
+		resp.writeTo(w)
+		return
+	}
+	var user UserResponse
+	if err := json.Unmarshal(resp.body.Bytes(), &user); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	karma, err := c.karma(r.Context(), username)
+	if err != nil {
+		c.logger.Warn("gathering karma", "user", username, "err", err)
+		writeError(w, r, &apiError{status: http.StatusBadGateway, code: codeNodeUnavailable, msg: "karma is unavailable"})
+		return
+	}
+	user.Karma = karma
+	writeJSON(w, r, user)
+}
+
+// karma adds up the karma username has in the partitions of every node.
+func (c *cluster) karma(ctx context.Context, username string) (int, error) {
+	nodes := c.currentRing().Nodes
+	if !slices.Contains(nodes, c.self) {
+		nodes = append(slices.Clone(nodes), c.self)
+	}
+	sums := make([]int, len(nodes))
+	errs := make([]error, len(nodes))
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		wg.Add(1)
+		go func(i int, node string) {
+			defer wg.Done()
+			if node == c.self {
+				sums[i] = c.localKarma(ctx, username)
+				return
+			}
+			var body struct {
+				Karma int `json:"karma"`
+			}
+			errs[i] = c.call(ctx, node, http.MethodGet, "/cluster/karma?username="+url.QueryEscape(username), nil, &body)
+			sums[i] = body.Karma
+		}(i, node)
+	}
+	wg.Wait()
+	total := 0
+	for _, n := range sums {
+		total += n
+	}
+	return total, errors.Join(errs...)
+}
+
+// localKarma adds up the karma username has in the partitions this node
+// serves. Frozen partitions are left out, since their new node counts them.
+func (c *cluster) localKarma(ctx context.Context, username string) int {
+	c.mu.RLock()
+	parts := make([]*partition, 0, len(c.parts))
+	for _, part := range c.parts {
+		parts = append(parts, part)
+	}
+	c.mu.RUnlock()
+	total := 0
+	for _, part := range parts {
+		if part.frozen.Load() || !part.engine.UserExistsContext(ctx, username) {
+			continue
+		}
+		user := part.engine.GetUserByUsernameContext(ctx, username)
+		part.engine.ViewContext(ctx, func() { total += user.Karma })
+	}
+	return total
+}
+
+// Handler serves the cluster's own endpoints under /cluster/.
+func (c *cluster) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !c.authorized(given) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="cluster"`)
+			writeError(w, r, &apiError{status: http.StatusUnauthorized, code: codeUnauthorized, msg: "a valid cluster token is required"})
+			return
+		}
+		route := r.Method + " " + r.URL.Path
+		switch {
+		case route == "GET /cluster/status":
+			writeJSON(w, r, c.Status())
+		case route == "PUT /cluster/ring":
+			var ring Ring
+			if err := decodeJSON(r, &ring); err != nil {
+				writeError(w, r, err)
+				return
+			}
+			c.install(&ring)
+			writeJSON(w, r, c.Status())
+		case route == "POST /cluster/nodes" || route == "DELETE /cluster/nodes":
+			c.serveMembership(w, r)
+		case route == "GET /cluster/karma":
+			writeJSON(w, r, map[string]int{"karma": c.localKarma(r.Context(), r.URL.Query().Get("username"))})
+		case strings.HasPrefix(r.URL.Path, "/cluster/partitions/"):
+			c.servePartition(w, r)
+		default:
+			writeError(w, r, &apiError{status: http.StatusNotFound, code: codeNotFound, msg: "no such route"})
+		}
+	})
+}
+
+// authorized reports whether given is the cluster token. validate refuses
+// to start a cluster without one.
+func (c *cluster) authorized(given string) bool {
+	return c.token != "" && subtle.ConstantTimeCompare([]byte(given), []byte(c.token)) == 1
+}
+
+// Status reports this node's view of the cluster.
+func (c *cluster) Status() ClusterStatus {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	s := ClusterStatus{Self: c.self, Ring: c.ring, Hosted: []int{}}
+	for p, part := range c.parts {
+		s.Hosted = append(s.Hosted, p)
+		if part.frozen.Load() {
+			s.Frozen = append(s.Frozen, p)
+		}
+	}
+	slices.Sort(s.Hosted)
+	slices.Sort(s.Frozen)
+	if len(c.moved) > 0 {
+		s.Moved = make(map[int]string, len(c.moved))
+		for p, node := range c.moved {
+			s.Moved[p] = node
+		}
+	}
+	return s
+}
+
+// serveMembership adds the node in the body of a POST, or removes the one
+// in the ?url= parameter of a DELETE, with this node coordinating.
+func (c *cluster) serveMembership(w http.ResponseWriter, r *http.Request) {
+	node := r.URL.Query().Get("url")
+	if r.Method == http.MethodPost {
+		var body struct {
+			URL string `json:"url"`
+		}
+		if err := decodeJSON(r, &body); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		node = body.URL
+	}
+	node = strings.TrimSuffix(node, "/")
+	if !isHTTPURL(node) {
+		writeError(w, r, badRequest("url must be an http or https URL"))
+		return
+	}
+	nodes := slices.DeleteFunc(slices.Clone(c.currentRing().Nodes), func(n string) bool { return n == node })
+	if r.Method == http.MethodPost {
+		nodes = append(nodes, node)
+	} else if len(nodes) == 0 {
+		writeError(w, r, &apiError{status: http.StatusConflict, code: codeConflict, msg: "can not remove the last node"})
+		return
+	}
+	ring, err := c.rebalance(r.Context(), nodes)
+	if err != nil {
+		writeError(w, r, &apiError{status: http.StatusBadGateway, code: codeNodeUnavailable, msg: err.Error()})
+		return
+	}
+	writeJSON(w, r, ring)
+}
+
+// rebalance moves every partition whose owner changes when the cluster
+// becomes nodes, then gives all old and new members the new ring.
+func (c *cluster) rebalance(ctx context.Context, nodes []string) (*Ring, error) {
+	c.changing.Lock()
+	defer c.changing.Unlock()
+	old := c.currentRing()
+	next := newRing(nodes, c.partitions, old.Version+1)
+	c.logger.Info("rebalancing cluster", "from", old.Nodes, "to", next.Nodes, "version", next.Version)
+	for p := range next.Owners {
+		from, to := old.Owners[p], next.Owners[p]
+		if from == to {
+			continue
+		}
+		if err := c.move(ctx, p, from, to); err != nil {
+			return nil, fmt.Errorf("moving partition %d from %s to %s: %w", p, from, to, err)
+		}
+	}
+	members := append(slices.Clone(old.Nodes), next.Nodes...)
+	slices.Sort(members)
+	for _, node := range slices.Compact(members) {
+		if err := c.call(ctx, node, http.MethodPut, "/cluster/ring", next, nil); err != nil {
+			// The node still finds the partitions through their old owners.
+			c.logger.Warn("sending ring", "node", node, "err", err)
+		}
+	}
+	return next, nil
+}
+
+// move has the to node copy partition p from the from node, which then
+// forwards the partition's requests there.
+func (c *cluster) move(ctx context.Context, p int, from, to string) error {
+	pull := fmt.Sprintf("/cluster/partitions/%d/pull?from=%s", p, url.QueryEscape(from))
+	if err := c.call(ctx, to, http.MethodPost, pull, nil, nil); err != nil {
+		if err := c.call(ctx, from, http.MethodPost, fmt.Sprintf("/cluster/partitions/%d/thaw", p), nil, nil); err != nil {
+			c.logger.Warn("thawing partition", "partition", p, "node", from, "err", err)
+		}
+		return err
+	}
+	return c.call(ctx, from, http.MethodDelete, fmt.Sprintf("/cluster/partitions/%d?to=%s", p, url.QueryEscape(to)), nil, nil)
+}
+
+// servePartition serves the steps of moving a partition:
+//
+//	GET    /cluster/partitions/{p}/snapshot  freeze p and return its state
+//	POST   /cluster/partitions/{p}/pull?from copy p from another node
+//	POST   /cluster/partitions/{p}/thaw      take writes again after a failed move
+//	DELETE /cluster/partitions/{p}?to        drop p, forwarding to its new node
+func (c *cluster) servePartition(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/cluster/partitions/")
+	id, action, _ := strings.Cut(rest, "/")
+	p, err := strconv.Atoi(id)
+	if err != nil || p < 0 || p >= c.partitions {
+		writeError(w, r, badRequest("invalid partition"))
+		return
+	}
+	part, _ := c.locate(p)
+	if part == nil && r.Method+" "+action != "POST pull" {
+		writeError(w, r, &apiError{status: http.StatusNotFound, code: codeNotFound, msg: fmt.Sprintf("partition %d is not here", p)})
+		return
+	}
+	switch r.Method + " " + action {
+	case "GET snapshot":
+		// Writes in flight finish before the snapshot is taken, and later
+		// ones are refused.
+		part.writes.Lock()
+		part.frozen.Store(true)
+		part.writes.Unlock()
+		writeJSON(w, r, part.engine.Snapshot())
+	case "POST pull":
+		if err := c.pull(r.Context(), p, r.URL.Query().Get("from")); err != nil {
+			writeError(w, r, &apiError{status: http.StatusBadGateway, code: codeNodeUnavailable, msg: err.Error()})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "POST thaw":
+		part.frozen.Store(false)
+		w.WriteHeader(http.StatusNoContent)
+	case "DELETE ":
+		to := r.URL.Query().Get("to")
+		if !isHTTPURL(to) {
+			writeError(w, r, badRequest("to must be an http or https URL"))
+			return
+		}
+		c.mu.Lock()
+		delete(c.parts, p)
+		c.moved[p] = to
+		c.mu.Unlock()
+		c.moves.Add(1)
+		if path := c.partitionFile(p); path != "" {
+			os.Remove(path)
+		}
+		c.logger.Info("handed over partition", "partition", p, "to", to)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, r, &apiError{status: http.StatusNotFound, code: codeNotFound, msg: "no such route"})
+	}
+}
+
+// pull copies partition p from node from, which freezes it meanwhile.
+func (c *cluster) pull(ctx context.Context, p int, from string) error {
+	var snap engine.Snapshot
+	if err := c.call(ctx, from, http.MethodGet, fmt.Sprintf("/cluster/partitions/%d/snapshot", p), nil, &snap); err != nil {
+		return err
+	}
+	part, err := c.newPartition(p, &snap)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.parts[p] = part
+	delete(c.moved, p)
+	c.mu.Unlock()
+	c.logger.Info("took over partition", "partition", p, "from", from)
+	return nil
+}
+
+// install makes next the ring this node routes by, unless it already has a
+// newer one. Partitions the ring gives this node that it does not have, as
+// when their node was lost, start out empty.
+func (c *cluster) install(next *Ring) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if next.Version <= c.ring.Version || len(next.Owners) != c.partitions {
+		return
+	}
+	c.ring = next
+	for p, owner := range next.Owners {
+		switch {
+		case owner != c.self:
+			if c.moved[p] == owner {
+				delete(c.moved, p)
+			}
+		case c.parts[p] == nil:
+			part, err := c.newPartition(p, nil)
+			if err != nil {
+				c.logger.Error("creating partition", "partition", p, "err", err)
+				continue
+			}
+			c.logger.Warn("partition starts empty", "partition", p)
+			c.parts[p] = part
+			delete(c.moved, p)
+		}
+	}
+	c.logger.Info("installed ring", "version", next.Version, "nodes", next.Nodes)
+}
+
+// call sends a request to another node's /cluster/ endpoints, encoding in
+// as the body and decoding the response into out if they are not nil.
+func (c *cluster) call(ctx context.Context, node, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, node+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var e ErrorResponse
+		json.NewDecoder(resp.Body).Decode(&e)
+		return fmt.Errorf("%s %s: %s %s", method, node+path, resp.Status, e.Error.Message)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
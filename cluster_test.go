@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startNode runs a cluster node in its own process and waits until it is
+// ready.
+func startNode(t *testing.T, addr string, members []string) string {
+	t.Helper()
+	return startServer(t, addr, fmt.Sprintf("-cluster-self http://%s -cluster-nodes %s -partitions 8 -cluster-token secret",
+		addr, strings.Join(members, ","))).url
+}
+
+// TestCluster shards the site over two node processes, adds a third while
+// comments are being written, and removes one of the first two.
+func TestCluster(t *testing.T) {
+	addrs := []string{freeAddr(t), freeAddr(t), freeAddr(t)}
+	members := []string{"http://" + addrs[0], "http://" + addrs[1]}
+	// The partitions a node owns depend on its URL, so pick an address for
+	// the third node that takes some over when it joins.
+	for !slices.Contains(newRing(append(members, "http://"+addrs[2]), 8, 0).Owners, "http://"+addrs[2]) {
+		addrs[2] = freeAddr(t)
+	}
+	a := startNode(t, addrs[0], members)
+	b := startNode(t, addrs[1], members)
+
+	send := func(method, url, body string, out any) (int, http.Header) {
+		t.Helper()
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("X-Username", "alice")
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if out != nil {
+			json.NewDecoder(resp.Body).Decode(out)
+		}
+		return resp.StatusCode, resp.Header
+	}
+	mustSend := func(method, url, body string, out any) {
+		t.Helper()
+		if status, _ := send(method, url, body, out); status != http.StatusOK {
+			t.Fatalf("%s %s: %d", method, url, status)
+		}
+	}
+
+	mustSend("POST", a+"/api/v1/users", `{"username":"alice"}`, nil)
+	mustSend("POST", b+"/api/v1/users", `{"username":"bob"}`, nil)
+	var postIDs []int
+	for _, name := range []string{"news", "golang", "music", "cats"} {
+		mustSend("POST", b+"/api/v1/r", `{"name":"`+name+`"}`, nil)
+		var post PostResponse
+		mustSend("POST", a+"/api/v1/r/"+name+"/posts", `{"title":"About `+name+`","username":"alice"}`, &post)
+		mustSend("POST", b+fmt.Sprintf("/api/v1/posts/%d/votes", post.ID), `{"direction":1,"username":"bob"}`, nil)
+		postIDs = append(postIDs, post.ID)
+		// Post IDs order posts across partitions to the millisecond.
+		time.Sleep(2 * time.Millisecond)
+	}
+	mustSend("POST", b+"/api/v1/users/alice/messages", `{"content":"Hi","from":"bob"}`, nil)
+
+	// check reads the site through node, which must see all of it.
+	check := func(node string, comments int) {
+		t.Helper()
+		var posts []PostResponse
+		_, header := send("GET", node+"/api/v1/posts?limit=3", "", &posts)
+		if len(posts) != 3 || posts[0].ID != postIDs[3] || !strings.Contains(header.Get("Link"), `rel="next"`) {
+			t.Fatalf("first page from %s: %+v, Link %q", node, posts, header.Get("Link"))
+		}
+		var rest []PostResponse
+		next := strings.TrimSuffix(strings.TrimPrefix(strings.Split(header.Get("Link"), ";")[0], "<"), ">")
+		send("GET", node+next, "", &rest)
+		if len(rest) != 1 || rest[0].ID != postIDs[0] {
+			t.Errorf("second page from %s: %+v", node, rest)
+		}
+		var alice UserResponse
+		send("GET", node+"/api/v1/users/alice", "", &alice)
+		if alice.Karma != 4 {
+			t.Errorf("alice's karma from %s: %d, want 4", node, alice.Karma)
+		}
+		var users, subreddits []json.RawMessage
+		send("GET", node+"/api/v1/users", "", &users)
+		send("GET", node+"/api/v1/r", "", &subreddits)
+		if len(users) != 2 || len(subreddits) != 4 {
+			t.Errorf("from %s: %d users and %d subreddits, want 2 and 4", node, len(users), len(subreddits))
+		}
+		var inbox []MessageResponse
+		send("GET", node+"/api/v1/users/alice/messages", "", &inbox)
+		if len(inbox) != 1 {
+			t.Errorf("alice's inbox from %s: %+v", node, inbox)
+		}
+		_, header = send("GET", node+fmt.Sprintf("/api/v1/posts/%d/comments", postIDs[1]), "", nil)
+		if total := header.Get("X-Total-Count"); total != fmt.Sprint(comments) {
+			t.Errorf("comments from %s: %s, want %d", node, total, comments)
+		}
+	}
+	check(a, 0)
+
+	// Comments keep being written while the third node joins; each one is
+	// either accepted or refused while its partition is moving.
+	var accepted int
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			resp, err := http.Post(a+fmt.Sprintf("/api/v1/posts/%d/comments", postIDs[1]), "application/json", strings.NewReader(`{"content":"Busy","username":"bob"}`))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			switch resp.StatusCode {
+			case http.StatusOK:
+				accepted++
+			case http.StatusServiceUnavailable:
+				time.Sleep(time.Millisecond)
+			default:
+				t.Errorf("comment during rebalancing: %d", resp.StatusCode)
+				return
+			}
+		}
+	}()
+	c := startNode(t, addrs[2], members)
+	var ring Ring
+	mustSend("POST", b+"/cluster/nodes", `{"url":"`+c+`"}`, &ring)
+	time.Sleep(50 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+	if ring.Version != 2 || len(ring.Nodes) != 3 {
+		t.Fatalf("ring after adding a node: %+v", ring)
+	}
+	var status ClusterStatus
+	mustSend("GET", c+"/cluster/status", "", &status)
+	if len(status.Hosted) == 0 || status.Ring.Version != 2 {
+		t.Errorf("new node's status: %+v", status)
+	}
+	check(c, accepted)
+
+	mustSend("DELETE", c+"/cluster/nodes?url="+a, "", &ring)
+	mustSend("GET", a+"/cluster/status", "", &status)
+	if len(status.Hosted) != 0 || status.Ring.Version != 3 {
+		t.Errorf("removed node's status: %+v", status)
+	}
+	check(b, accepted)
+	// The removed node still routes requests to the others.
+	check(a, accepted)
+
+	if status, _ := send("GET", a+"/api/v1/admin/stats", "", nil); status != http.StatusNotImplemented {
+		t.Errorf("admin route in a cluster: %d", status)
+	}
+	resp, err := http.Get(b + "/cluster/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("cluster status without the token: %d", resp.StatusCode)
+	}
+
+	// Without the cluster token, a client can not pick the partition; the
+	// header is dropped and the request routed as usual.
+	req, _ := http.NewRequest("GET", b+"/api/v1/users/alice", nil)
+	req.Header.Set(headerPartition, "999")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("request naming a partition without the cluster token: %d", resp.StatusCode)
+	}
+}
+
+// TestClusterNeedsToken checks that a node does not start without the
+// cluster token, which is all that stops clients from posing as nodes.
+func TestClusterNeedsToken(t *testing.T) {
+	cfg := defaultServerConfig()
+	cfg.Cluster.Self = "http://localhost:8080"
+	cfg.Cluster.Nodes = []string{cfg.Cluster.Self}
+	if err := cfg.validate(); err == nil {
+		t.Error("cluster without a token passed validation")
+	}
+	cfg.Cluster.Token = "secret"
+	if err := cfg.validate(); err != nil {
+		t.Errorf("cluster with a token: %v", err)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/signal"
+	"reddit-clone/engine"
+	"reddit-clone/replay"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// commands are the subcommands run by naming them as the first argument,
+// e.g. "reddit-clone export -data-file site.json". Those that use a data
+// file work on it offline, so the server must not be running on the same
+// file.
+var commands = map[string]func(args []string) error{
+	"export": exportCommand,
+	"import": importCommand,
+	"replay": replayCommand,
+}
+
+// runCommand runs the subcommand named by args[0] and reports whether
+// there was one.
+func runCommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return false
+	}
+	if err := cmd(args[1:]); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", args[0], err)
+		}
+		os.Exit(1)
+	}
+	return true
+}
+
+// openDataFile loads the engine from dataFile. A missing file gives an
+// empty engine only if create is set.
+func openDataFile(dataFile string, create bool) (*engine.RedditEngine, error) {
+	if dataFile == "" {
+		return nil, errors.New("-data-file is required")
+	}
+	e := engine.NewRedditEngine()
+	if err := e.LoadFile(dataFile); err != nil && !(create && errors.Is(err, fs.ErrNotExist)) {
+		return nil, fmt.Errorf("loading %s: %w", dataFile, err)
+	}
+	return e, nil
+}
+
+// exportCommand writes the data file in the export format. It only reads
+// the data file, so unlike an export through the API it is not audited.
+func exportCommand(args []string) error {
+	set := flag.NewFlagSet("export", flag.ContinueOnError)
+	dataFile := set.String("data-file", os.Getenv("REDDIT_DATA_FILE"), "Data file of the server")
+	out := set.String("o", "-", "Output file, or - for standard output; a name ending in .gz is gzipped")
+	set.Usage = func() {
+		fmt.Fprintln(set.Output(), "usage: reddit-clone export [-data-file FILE] [-o FILE]")
+		set.PrintDefaults()
+	}
+	if err := set.Parse(args); err != nil {
+		return err
+	}
+	e, err := openDataFile(*dataFile, false)
+	if err != nil {
+		return err
+	}
+
+	if *out == "-" {
+		return engine.WriteNDJSON(os.Stdout, e.Snapshot(), time.Now())
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := io.Writer(f)
+	var gz *gzip.Writer
+	if strings.HasSuffix(*out, ".gz") {
+		gz = gzip.NewWriter(f)
+		w = gz
+	}
+	if err := engine.WriteNDJSON(w, e.Snapshot(), time.Now()); err != nil {
+		return err
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// importCommand adds exports or dumps to the data file. New audit log
+// entries are appended to -audit-file only once the data file is saved, so
+// the two stay in step if an import fails.
+func importCommand(args []string) error {
+	set := flag.NewFlagSet("import", flag.ContinueOnError)
+	dataFile := set.String("data-file", os.Getenv("REDDIT_DATA_FILE"), "Data file of the server, created if missing")
+	auditFile := set.String("audit-file", os.Getenv("REDDIT_AUDIT_FILE"), "File new audit log entries are appended to as NDJSON")
+	format := set.String("format", "ndjson", "Input format: ndjson or pushshift")
+	set.Usage = func() {
+		fmt.Fprintln(set.Output(), "usage: reddit-clone import [-data-file FILE] [-format ndjson|pushshift] FILE...")
+		fmt.Fprintln(set.Output(), "Files ending in .gz are decompressed; - reads standard input.")
+		set.PrintDefaults()
+	}
+	if err := set.Parse(args); err != nil {
+		return err
+	}
+	if set.NArg() == 0 {
+		set.Usage()
+		return flag.ErrHelp
+	}
+	e, err := openDataFile(*dataFile, true)
+	if err != nil {
+		return err
+	}
+	var audit bytes.Buffer
+	e.SetAuditWriter(&audit)
+
+	enc := json.NewEncoder(os.Stdout)
+	for _, name := range set.Args() {
+		snap, skipped, err := readImportFile(name, *format)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		res, err := e.Import(context.Background(), nil, snap)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		enc.Encode(struct {
+			File string `json:"file"`
+			*ImportResponse
+		}{name, importResponse(res, skipped)})
+	}
+	if err := e.SaveFile(*dataFile); err != nil {
+		return err
+	}
+	if *auditFile == "" {
+		return nil
+	}
+	f, err := os.OpenFile(*auditFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("opening audit file: %w", err)
+	}
+	if _, err := f.Write(audit.Bytes()); err != nil {
+		f.Close()
+		return fmt.Errorf("writing audit file: %w", err)
+	}
+	return f.Close()
+}
+
+func readImportFile(name, format string) (*engine.Snapshot, map[string]int, error) {
+	r := io.Reader(os.Stdin)
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	r = bufio.NewReaderSize(r, 1<<20)
+	if strings.HasSuffix(name, ".gz") {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	return readImport(r, format)
+}
+
+// replayCommand replays a simulator or client.go log into a fresh engine,
+// the engine in a data file, or a running server.
+func replayCommand(args []string) error {
+	set := flag.NewFlagSet("replay", flag.ContinueOnError)
+	apiURL := set.String("api", "", "Replay against the server at this URL, e.g. http://localhost:8080, instead of an engine")
+	dataFile := set.String("data-file", "", "Replay into the engine in this data file, created if missing, and save it")
+	speed := set.Float64("speed", 0, "Replay speed: 1 keeps the original timing, 10 is ten times as fast, 0 as fast as possible")
+	maxGap := set.Duration("max-gap", 0, "Longest wait between two operations when timed (0 for no limit)")
+	run := set.Int("run", 0, "Replay only this simulation of a log holding several (0 for all)")
+	show := set.Int("show", 20, "Number of divergences to list (-1 for all)")
+	asJSON := set.Bool("json", false, "Print the report as JSON")
+	set.Usage = func() {
+		fmt.Fprintln(set.Output(), "usage: reddit-clone replay [-api URL | -data-file FILE] [-speed N] LOGFILE")
+		fmt.Fprintln(set.Output(), "Exits with status 1 if any operation diverged from the log.")
+		set.PrintDefaults()
+	}
+	if err := set.Parse(args); err != nil {
+		return err
+	}
+	if set.NArg() != 1 {
+		set.Usage()
+		return flag.ErrHelp
+	}
+	if *apiURL != "" && *dataFile != "" {
+		return errors.New("-api and -data-file are mutually exclusive")
+	}
+	if *speed < 0 {
+		return errors.New("-speed must not be negative")
+	}
+
+	f, err := os.Open(set.Arg(0))
+	if err != nil {
+		return err
+	}
+	parsed, err := replay.Parse(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("%s: %w", set.Arg(0), err)
+	}
+	ops := parsed.Ops
+	if *run != 0 {
+		if *run < 0 || *run > parsed.Runs {
+			return fmt.Errorf("-run %d: the log has %d simulations", *run, parsed.Runs)
+		}
+		ops = slices.DeleteFunc(ops, func(op replay.Op) bool { return op.Run != *run })
+	}
+	fmt.Fprintf(os.Stderr, "%s: %d operations in %d simulations, %d other lines\n", set.Arg(0), len(ops), parsed.Runs, parsed.Ignored)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	opts := replay.Options{Speed: *speed, MaxGap: *maxGap}
+	var report *replay.Report
+	var runErr error
+	var e *engine.RedditEngine
+	switch {
+	case *apiURL != "":
+		target := replay.APITarget{BaseURL: *apiURL, Client: &http.Client{Timeout: 30 * time.Second}}
+		report, runErr = replay.Run(ctx, target, ops, opts)
+	case *dataFile != "":
+		if e, err = openDataFile(*dataFile, true); err != nil {
+			return err
+		}
+		report, runErr = replay.Run(ctx, replay.EngineTarget{Engine: e}, ops, opts)
+	default:
+		// Each simulation ran against a fresh engine, so each is replayed
+		// into one.
+		report = &replay.Report{}
+		for start := 0; start < len(ops) && runErr == nil; {
+			end := start + 1
+			for end < len(ops) && ops[end].Run == ops[start].Run {
+				end++
+			}
+			var part *replay.Report
+			part, runErr = replay.Run(ctx, replay.EngineTarget{Engine: engine.NewRedditEngine()}, ops[start:end], opts)
+			report.Add(part)
+			start = end
+		}
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		for i, d := range report.Divergences {
+			if *show >= 0 && i >= *show {
+				fmt.Printf("... and %d more\n", len(report.Divergences)-i)
+				break
+			}
+			fmt.Println(d)
+		}
+		fmt.Println(report.Summary())
+	}
+	if runErr != nil {
+		return runErr
+	}
+	if e != nil && *dataFile != "" {
+		if err := e.SaveFile(*dataFile); err != nil {
+			return err
+		}
+	}
+	if n := len(report.Divergences); n > 0 {
+		return fmt.Errorf("%d operations diverged from the log", n)
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"reddit-clone/cache"
+	"reddit-clone/engine"
+	"strings"
+	"time"
+)
+
+// Cache-Control policies. Responses that depend on the viewer are always
+// private.
+const (
+	cacheFeed       = "public, max-age=5"
+	cacheListing    = "public, max-age=30"
+	cacheRevalidate = "no-cache"
+	cachePrivate    = "private, no-cache"
+)
+
+// defaultResponseCacheBytes bounds the bodies of the anonymous responses
+// kept in memory, each counted with responseOverhead for its headers.
+const (
+	defaultResponseCacheBytes = 32 << 20
+	responseOverhead          = 512
+)
+
+// etagFor builds a weak ETag from an entity's version counter and the parts
+// of the request that change the representation.
+func etagFor(r *http.Request, kind string, id int, version uint64) string {
+	h := fnv.New64a()
+	h.Write([]byte(r.URL.Query().Encode()))
+	h.Write([]byte{0})
+	h.Write([]byte(r.Header.Get("X-Username")))
+	return fmt.Sprintf(`W/"%s-%d-%d-%x"`, kind, id, version, h.Sum64())
+}
+
+// cachePolicy returns policy, or cachePrivate if the response is
+// personalised for a viewer.
+func cachePolicy(r *http.Request, policy string) string {
+	if hasViewer(r) {
+		return cachePrivate
+	}
+	return policy
+}
+
+func hasViewer(r *http.Request) bool {
+	return r.Header.Get("X-Username") != "" || r.URL.Query().Get("viewer") != ""
+}
+
+// checkFresh sets the validator and caching headers for a response and
+// reports whether the client's copy is current, in which case it has written
+// 304 Not Modified. If-None-Match takes precedence over If-Modified-Since.
+func checkFresh(w http.ResponseWriter, r *http.Request, etag string, modified time.Time, cacheControl string) bool {
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", cacheControl)
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if etagMatches(inm, etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+		return false
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && !modified.IsZero() {
+		since, err := http.ParseTime(ims)
+		if err == nil && !modified.Truncate(time.Second).After(since) {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+// etagMatches implements the weak comparison used by If-None-Match.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// responseKey names a rendered anonymous response: the kind of resource,
+// its ID, the request path and query string, and the ETag it was rendered
+// for. Keying by ETag means a response is never served for an older version
+// of its entity; keying by path keeps a legacy route and its successor,
+// whose links and paging differ, from serving each other's responses.
+type responseKey struct {
+	kind  string
+	id    int
+	path  string
+	query string
+	etag  string
+}
+
+// Kinds of cached responses.
+const (
+	cachedFeed     = "feed"     // a subreddit's posts; id is the subreddit
+	cachedPosts    = "posts"    // all posts; etag is empty
+	cachedPost     = "post"     // id is the post
+	cachedComments = "comments" // id is the post
+	cachedUser     = "user"     // id is the user
+)
+
+// errUncacheable keeps a rendered response out of the response cache.
+var errUncacheable = errors.New("response is not cacheable")
+
+// responseCache holds rendered responses for anonymous readers, evicting
+// the least recently used beyond defaultResponseCacheBytes. Entries are
+// dropped as soon as the engine reports a change to what they show.
+type responseCache struct {
+	*cache.Cache[responseKey, *bufferedResponse]
+}
+
+func newResponseCache(e *engine.RedditEngine) *responseCache {
+	c := &responseCache{cache.New[responseKey](cache.Options[*bufferedResponse]{
+		Capacity: defaultResponseCacheBytes,
+		Cost:     func(resp *bufferedResponse) int { return resp.body.Len() + responseOverhead },
+	})}
+	e.Subscribe(c.invalidate)
+	return c
+}
+
+func (c *responseCache) invalidate(ev engine.Event) {
+	switch ev.Type {
+	case engine.EventDataImported, engine.EventStateRestored, engine.EventUserRenamed, engine.EventSubRedditRenamed:
+		// Names appear in responses of every kind.
+		c.Purge()
+		return
+	}
+	c.RemoveFunc(func(key responseKey) bool {
+		switch key.kind {
+		case cachedFeed:
+			return key.id == ev.SubRedditID
+		case cachedPosts:
+			return ev.PostID != 0
+		case cachedPost, cachedComments:
+			return key.id == ev.PostID
+		case cachedUser:
+			// Profiles can expand the user's posts.
+			return key.id == ev.UserID || ev.PostID != 0 && strings.Contains(key.query, "expand")
+		}
+		return false
+	})
+}
+
+// serveCached writes the response render produces for r. Anonymous
+// responses are served from the response cache under key, and concurrent
+// requests for a key that is not cached yet wait for one render instead of
+// each rendering it. Only successful responses are cached. A request that
+// waited for a render that failed, such as one that panicked, renders the
+// response itself.
+func (api *API) serveCached(w http.ResponseWriter, r *http.Request, key responseKey, render func(http.ResponseWriter)) {
+	if hasViewer(r) {
+		render(w)
+		return
+	}
+	key.path = r.URL.Path
+	key.query = r.URL.Query().Encode()
+	resp, err := api.responses.Load(key, func() (*bufferedResponse, error) {
+		buf := newBufferedResponse()
+		render(buf)
+		if buf.status != http.StatusOK {
+			return buf, errUncacheable
+		}
+		return buf, nil
+	})
+	if resp == nil || (err != nil && !errors.Is(err, errUncacheable)) {
+		render(w)
+		return
+	}
+	resp.writeTo(w)
+}
+
+// bufferedResponse is an http.ResponseWriter that keeps the response in
+// memory so it can be cached, or inspected before it is passed on.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: make(http.Header), status: http.StatusOK}
+}
+
+func (b *bufferedResponse) Header() http.Header         { return b.header }
+func (b *bufferedResponse) Write(p []byte) (int, error) { return b.body.Write(p) }
+func (b *bufferedResponse) WriteHeader(status int)      { b.status = status }
+
+// writeTo copies the response to w. The header values are copied too, since
+// a cached response is written to many requests. Links are added to any
+// already set on w, such as a deprecated route's successor.
+func (b *bufferedResponse) writeTo(w http.ResponseWriter) {
+	for name, values := range b.header {
+		if name == "Link" {
+			w.Header()[name] = append(w.Header()[name], values...)
+			continue
+		}
+		w.Header()[name] = append([]string(nil), values...)
+	}
+	w.WriteHeader(b.status)
+	w.Write(b.body.Bytes())
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestConditionalRequests checks the validators on read endpoints: a
+// current ETag or modification date gets 304, a change or a different
+// representation gets a new ETag, and personalised responses are private.
+func TestConditionalRequests(t *testing.T) {
+	f := newFixture(t)
+	c := newAPIClient(t, newTestAPI(f.e))
+	get := func(path, user string, header ...string) (int, http.Header, string) {
+		t.Helper()
+		rec := c.do("GET", path, user, "", header...)
+		return rec.Code, rec.Header(), rec.Body.String()
+	}
+
+	status, h, _ := get("/api/v1/posts/1", "")
+	etag, modified := h.Get("ETag"), h.Get("Last-Modified")
+	if status != http.StatusOK || etag == "" || modified == "" || h.Get("Cache-Control") != cacheRevalidate {
+		t.Fatalf("post: status %d, headers %v", status, h)
+	}
+	for _, inm := range []string{etag, `W/"other", ` + etag, "*"} {
+		if status, h, body := get("/api/v1/posts/1", "", "If-None-Match", inm); status != http.StatusNotModified || body != "" || h.Get("ETag") != etag {
+			t.Errorf("If-None-Match %s: status %d, body %q", inm, status, body)
+		}
+	}
+	if status, _, _ := get("/api/v1/posts/1", "", "If-Modified-Since", modified); status != http.StatusNotModified {
+		t.Errorf("If-Modified-Since the last modification: status %d", status)
+	}
+	earlier := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	if status, _, _ := get("/api/v1/posts/1", "", "If-Modified-Since", earlier); status != http.StatusOK {
+		t.Errorf("If-Modified-Since an hour ago: status %d", status)
+	}
+	// If-None-Match wins over If-Modified-Since.
+	if status, _, _ := get("/api/v1/posts/1", "", "If-None-Match", `W/"other"`, "If-Modified-Since", modified); status != http.StatusOK {
+		t.Errorf("stale ETag with a current date: status %d", status)
+	}
+
+	if _, h, _ := get("/api/v1/posts/1?expand=comments", ""); h.Get("ETag") == etag {
+		t.Error("an expanded post has the same ETag")
+	}
+	if _, h, _ := get("/api/v1/posts/1", "alice"); h.Get("ETag") == etag || h.Get("Cache-Control") != cachePrivate {
+		t.Errorf("alice's view of the post: ETag %s, Cache-Control %q", h.Get("ETag"), h.Get("Cache-Control"))
+	}
+
+	f.e.CastVote(f.alice, f.post, 1)
+	if status, h, _ := get("/api/v1/posts/1", "", "If-None-Match", etag); status != http.StatusOK || h.Get("ETag") == etag {
+		t.Errorf("after a vote: status %d, ETag %s", status, h.Get("ETag"))
+	}
+
+	status, h, _ = get("/api/v1/r/news/posts", "")
+	if status != http.StatusOK || h.Get("Cache-Control") != cacheFeed {
+		t.Errorf("feed: status %d, Cache-Control %q", status, h.Get("Cache-Control"))
+	}
+	if status, _, _ := get("/api/v1/r/news/posts", "", "If-None-Match", h.Get("ETag")); status != http.StatusNotModified {
+		t.Errorf("feed with its ETag: status %d", status)
+	}
+	f.e.CreatePost(f.bob, f.news, "Another", "")
+	if status, _, _ := get("/api/v1/r/news/posts", "", "If-None-Match", h.Get("ETag")); status != http.StatusOK {
+		t.Errorf("feed with its ETag after a new post: status %d", status)
+	}
+
+	// A legacy route and its successor do not share cached responses.
+	_, h, _ = get("/api/v1/r/news/posts?limit=1", "")
+	if links := h.Values("Link"); len(links) != 1 || !strings.HasPrefix(links[0], "</api/v1/r/news/posts?") || h.Get("Deprecation") != "" {
+		t.Errorf("v1 feed: Link %q, Deprecation %q", links, h.Get("Deprecation"))
+	}
+	_, h, _ = get("/api/news/feed?limit=1", "")
+	if links := strings.Join(h.Values("Link"), ", "); !strings.Contains(links, `rel="successor-version"`) || !strings.Contains(links, "</api/news/feed?") || h.Get("Deprecation") != "true" {
+		t.Errorf("legacy feed: Link %q, Deprecation %q", links, h.Get("Deprecation"))
+	}
+}
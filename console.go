@@ -0,0 +1,585 @@
+package main
+
+import (
+	"embed"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"reddit-clone/engine"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed templates/console/*.html
+var consoleTemplates embed.FS
+
+// auditConsoleLimit is how many audit entries the console shows at once.
+const auditConsoleLimit = 200
+
+// console is the server-rendered operator console under /admin/. It works
+// without JavaScript: every action is a form post followed by a redirect.
+type console struct {
+	api    *API
+	router *Router
+	pages  map[string]*template.Template
+}
+
+// consolePage is the data every console template receives.
+type consolePage struct {
+	Title string
+	Admin string
+	CSRF  string
+	Flash string
+	Error string
+	Data  any
+}
+
+// templateFuncs are the functions available to the console and site
+// templates.
+var templateFuncs = template.FuncMap{
+	"pct": func(n, max int) int {
+		if max == 0 {
+			return 0
+		}
+		return n * 100 / max
+	},
+	"add": func(a, b int) int { return a + b },
+	// deref reads an optional number, such as a viewer's vote.
+	"deref": func(n *int) int {
+		if n == nil {
+			return 0
+		}
+		return *n
+	},
+	"datetime": func(t any) string {
+		switch t := t.(type) {
+		case time.Time:
+			return t.UTC().Format("2006-01-02 15:04:05 MST")
+		case *time.Time:
+			return t.UTC().Format("2006-01-02 15:04:05 MST")
+		}
+		return ""
+	},
+	"ago":  ago,
+	"path": url.PathEscape,
+	// dict builds a map from alternating keys and values, for passing
+	// several values to a nested template.
+	"dict": func(kv ...any) map[string]any {
+		m := make(map[string]any, len(kv)/2)
+		for i := 0; i+1 < len(kv); i += 2 {
+			m[kv[i].(string)] = kv[i+1]
+		}
+		return m
+	},
+}
+
+// Console returns the handler for the operator console. It is meant to be
+// mounted at /admin/ and only lets in admins who give the admin token.
+func (api *API) Console() http.Handler {
+	c := &console{api: api, router: NewRouter(), pages: make(map[string]*template.Template)}
+	for _, page := range []string{"login", "error", "dashboard", "user", "subreddit", "audit", "voterings", "filters"} {
+		c.pages[page] = template.Must(template.New("layout.html").Funcs(templateFuncs).
+			ParseFS(consoleTemplates, "templates/console/layout.html", "templates/console/"+page+".html"))
+	}
+	c.router.NotFound = func(w http.ResponseWriter, r *http.Request) {
+		c.render(w, r, http.StatusNotFound, "error", "Not found", "", nil, "No such page")
+	}
+
+	rt := c.router
+	rt.Handle("GET", "/admin/login", "console.login", c.loginPage)
+	rt.Handle("POST", "/admin/login", "console.doLogin", c.login)
+	rt.Handle("POST", "/admin/logout", "console.logout", c.admin(c.logout))
+	rt.Handle("GET", "/admin", "console.dashboard", c.admin(c.dashboard))
+	rt.Handle("GET", "/admin/users", "console.findUser", c.admin(c.findUser))
+	rt.Handle("GET", "/admin/users/{username}", "console.user", c.admin(c.user))
+	rt.Handle("POST", "/admin/users/{username}/suspend", "console.suspend", c.admin(c.suspend))
+	rt.Handle("POST", "/admin/users/{username}/unsuspend", "console.unsuspend", c.admin(c.unsuspend))
+	rt.Handle("POST", "/admin/users/{username}/rename", "console.renameUser", c.admin(c.renameUser))
+	rt.Handle("POST", "/admin/users/{username}/grant-admin", "console.grantAdmin", c.admin(c.grantAdmin))
+	rt.Handle("POST", "/admin/users/{username}/revoke-admin", "console.revokeAdmin", c.admin(c.revokeAdmin))
+	rt.Handle("GET", "/admin/r", "console.findSubreddit", c.admin(c.findSubreddit))
+	rt.Handle("GET", "/admin/r/{name}", "console.subreddit", c.admin(c.subreddit))
+	rt.Handle("POST", "/admin/r/{name}/rename", "console.renameSubreddit", c.admin(c.renameSubreddit))
+	rt.Handle("POST", "/admin/posts/{id}/remove", "console.removePost", c.admin(c.removePost))
+	rt.Handle("POST", "/admin/posts/{id}/restore", "console.restorePost", c.admin(c.restorePost))
+	rt.Handle("POST", "/admin/posts/{id}/comments/{commentId}/remove", "console.removeComment", c.admin(c.removeComment))
+	rt.Handle("POST", "/admin/posts/{id}/comments/{commentId}/restore", "console.restoreComment", c.admin(c.restoreComment))
+	rt.Handle("POST", "/admin/messages/{id}/remove", "console.removeMessage", c.admin(c.removeMessage))
+	rt.Handle("POST", "/admin/messages/{id}/restore", "console.restoreMessage", c.admin(c.restoreMessage))
+	rt.Handle("GET", "/admin/audit", "console.audit", c.admin(c.audit))
+	rt.Handle("GET", "/admin/vote-rings", "console.voteRings", c.admin(c.voteRings))
+	rt.Handle("POST", "/admin/vote-rings/{ring}/discount", "console.discountVoteRing", c.admin(c.discountVoteRing))
+	rt.Handle("POST", "/admin/vote-rings/{ring}/restore", "console.restoreVoteRing", c.admin(c.restoreVoteRing))
+	rt.Handle("GET", "/admin/filters", "console.wordFilters", c.admin(c.wordFilters))
+	rt.Handle("POST", "/admin/filters", "console.addWordFilter", c.admin(c.addWordFilter))
+	rt.Handle("POST", "/admin/filters/{filter}/remove", "console.removeWordFilter", c.admin(c.removeWordFilter))
+	return c
+}
+
+func (c *console) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+	r = withRouteSlot(r)
+	r = r.WithContext(engine.WithClientIP(r.Context(), remoteIP(r)))
+	api := c.api
+	api.traceRequests(api.metrics.middleware(withRequestID(api.accessLog(c.router)))).ServeHTTP(w, r)
+}
+
+// consoleHandler is a console handler that runs on behalf of an admin.
+type consoleHandler func(w http.ResponseWriter, r *http.Request, admin *engine.User)
+
+// admin sends visitors without an admin session to the login page and
+// checks the CSRF token of every form post.
+func (c *console) admin(h consoleHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var user *engine.User
+		if name := c.api.sessions.consoleUser(r, c.api.adminToken); name != "" && c.api.adminToken != "" {
+			user = c.api.engine.GetUserByUsernameContext(r.Context(), name)
+		}
+		var admin bool
+		if user != nil {
+			c.api.engine.ViewContext(r.Context(), func() { admin = user.IsAdmin() })
+		}
+		if !admin {
+			if r.Method == http.MethodGet {
+				http.Redirect(w, r, "/admin/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+				return
+			}
+			c.render(w, r, http.StatusForbidden, "login", "Log in", "", nil, "Your session has expired; log in again")
+			return
+		}
+		if r.Method == http.MethodPost {
+			if err := c.api.sessions.checkCSRF(r); err != nil {
+				noteError(r, err)
+				c.render(w, r, http.StatusForbidden, "error", "Forbidden", user.Username, nil, err.Error())
+				return
+			}
+		}
+		h(w, r, user)
+	}
+}
+
+// render writes a page inside the console layout.
+func (c *console) render(w http.ResponseWriter, r *http.Request, status int, page, title, admin string, data any, errMsg string) {
+	p := consolePage{
+		Title: title,
+		Admin: admin,
+		CSRF:  c.api.sessions.csrfToken(w, r),
+		Flash: r.URL.Query().Get("flash"),
+		Error: errMsg,
+		Data:  data,
+	}
+	if p.Error == "" {
+		p.Error = r.URL.Query().Get("error")
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.WriteHeader(status)
+	if err := c.pages[page].Execute(w, p); err != nil {
+		noteError(r, err)
+	}
+}
+
+// done redirects to path after a form post, reporting err or flash there.
+func (c *console) done(w http.ResponseWriter, r *http.Request, path string, err error, flash string) {
+	q := url.Values{}
+	if err != nil {
+		noteError(r, err)
+		q.Set("error", formError(err))
+	} else {
+		q.Set("flash", flash)
+	}
+	http.Redirect(w, r, path+"?"+q.Encode(), http.StatusSeeOther)
+}
+
+// formError is the message shown on a page for err, which for validation
+// errors lists the fields that failed.
+func formError(err error) string {
+	var validation *engine.ValidationError
+	if errors.As(err, &validation) {
+		msgs := make([]string, 0, len(validation.Fields))
+		for _, f := range validation.Fields {
+			msgs = append(msgs, f.Field+" "+f.Message)
+		}
+		return strings.Join(msgs, "; ")
+	}
+	return err.Error()
+}
+
+// ago describes how long before now t was, as in "5 minutes ago".
+func ago(t time.Time) string {
+	d := time.Since(t)
+	unit := func(n int, name string) string {
+		if n == 1 {
+			return "1 " + name + " ago"
+		}
+		return strconv.Itoa(n) + " " + name + "s ago"
+	}
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return unit(int(d/time.Minute), "minute")
+	case d < 24*time.Hour:
+		return unit(int(d/time.Hour), "hour")
+	case d < 30*24*time.Hour:
+		return unit(int(d/(24*time.Hour)), "day")
+	case d < 365*24*time.Hour:
+		return unit(int(d/(30*24*time.Hour)), "month")
+	}
+	return unit(int(d/(365*24*time.Hour)), "year")
+}
+
+// back returns the console page a form asked to return to.
+func back(r *http.Request, fallback string) string {
+	if b := r.PostFormValue("back"); strings.HasPrefix(b, "/admin/") && !strings.HasPrefix(b, "//") {
+		return b
+	}
+	return fallback
+}
+
+func (c *console) loginPage(w http.ResponseWriter, r *http.Request) {
+	c.render(w, r, http.StatusOK, "login", "Log in", "", r.URL.Query().Get("next"), "")
+}
+
+func (c *console) login(w http.ResponseWriter, r *http.Request) {
+	if err := c.api.sessions.checkCSRF(r); err != nil {
+		noteError(r, err)
+		c.render(w, r, http.StatusForbidden, "login", "Log in", "", "", err.Error())
+		return
+	}
+	if c.api.adminToken == "" {
+		c.render(w, r, http.StatusForbidden, "login", "Log in", "", r.PostFormValue("next"), "The console is disabled; start the server with -admin-token")
+		return
+	}
+	user := c.api.engine.GetUserByUsernameContext(r.Context(), r.PostFormValue("username"))
+	var admin bool
+	if user != nil {
+		c.api.engine.ViewContext(r.Context(), func() { admin = user.IsAdmin() })
+	}
+	// The same message for both keeps the form from telling who the
+	// admins are.
+	if !admin || !c.api.validAdminToken(r.PostFormValue("token")) {
+		c.render(w, r, http.StatusForbidden, "login", "Log in", "", r.PostFormValue("next"), "Wrong username or admin token")
+		return
+	}
+	c.api.engine.RecordLogin(r.Context(), user)
+	c.api.sessions.loginConsole(w, r, user.Username, c.api.adminToken)
+	next := r.PostFormValue("next")
+	if !strings.HasPrefix(next, "/admin") || strings.HasPrefix(next, "//") {
+		next = "/admin/"
+	}
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+func (c *console) logout(w http.ResponseWriter, r *http.Request, admin *engine.User) {
+	c.api.sessions.logoutConsole(w)
+	http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
+}
+
+func (c *console) dashboard(w http.ResponseWriter, r *http.Request, admin *engine.User) {
+	days, err := statsDays(r)
+	if err != nil {
+		days = defaultStatsDays
+	}
+	stats := siteStatsResponse(c.api.engine.SiteStats(r.Context(), days))
+	// Newest day first, with the busiest day setting the bar scale.
+	growth := make([]GrowthPointResponse, len(stats.Growth))
+	busiest := 0
+	for i, g := range stats.Growth {
+		growth[len(growth)-1-i] = g
+		busiest = max(busiest, g.New.Posts+g.New.Comments)
+	}
+	data := struct {
+		Counts  CountsResponse
+		Growth  []GrowthPointResponse
+		Busiest int
+		Days    int
+	}{stats.Counts, growth, busiest, days}
+	c.render(w, r, http.StatusOK, "dashboard", "Dashboard", admin.Username, data, "")
+}
+
+func (c *console) findUser(w http.ResponseWriter, r *http.Request, admin *engine.User) {
+	http.Redirect(w, r, "/admin/users/"+url.PathEscape(strings.TrimSpace(r.URL.Query().Get("q"))), http.StatusSeeOther)
+}
+
+func (c *console) user(w http.ResponseWriter, r *http.Request, admin *engine.User) {
+	user, err := c.api.engine.LookupUserContext(r.Context(), pathParam(r, "username"))
+	if err != nil {
+		c.render(w, r, http.StatusNotFound, "error", "Not found", admin.Username, nil, err.Error())
+		return
+	}
+	entries := c.api.engine.AuditLog(r.Context(), engine.AuditFilter{})
+	var related []engine.AuditEntry
+	var id int
+	c.api.engine.ViewContext(r.Context(), func() { id = user.ID })
+	for i := len(entries) - 1; i >= 0 && len(related) < 50; i-- {
+		if a := entries[i]; a.ActorID == id || (a.TargetType == engine.TargetUser && a.TargetID == id) {
+			related = append(related, a)
+		}
+	}
+	m := c.api.newMapper(r)
+	data := struct {
+		User  *AdminUserResponse
+		Audit []*AuditEntryResponse
+	}{
+		User:  c.api.adminUser(r, user),
+		Audit: mapPage(r.Context(), c.api.engine, page[engine.AuditEntry]{Items: related}, m.auditEntry).Items,
+	}
+	c.render(w, r, http.StatusOK, "user", "u/"+data.User.User.Username, admin.Username, data, "")
+}
+
+// userAction runs fn on the user named in the path and returns to their
+// page.
+func (c *console) userAction(w http.ResponseWriter, r *http.Request, flash string, fn func(user *engine.User) error) {
+	username := pathParam(r, "username")
+	user, err := c.api.engine.LookupUserContext(r.Context(), username)
+	if err == nil {
+		err = fn(user)
+	}
+	c.done(w, r, "/admin/users/"+url.PathEscape(username), err, flash)
+}
+
+func (c *console) suspend(w http.ResponseWriter, r *http.Request, admin *engine.User) {
+	c.userAction(w, r, "User suspended", func(user *engine.User) error {
+		until, err := suspensionEnd(r.PostFormValue("duration"))
+		if err != nil {
+			return err
+		}
+		return c.api.engine.SuspendUser(r.Context(), admin, user, r.PostFormValue("reason"), until)
+	})
+}
+
+func (c *console) unsuspend(w http.ResponseWriter, r *http.Request, admin *engine.User) {
+	c.userAction(w, r, "Suspension lifted", func(user *engine.User) error {
+		return c.api.engine.UnsuspendUser(r.Context(), admin, user)
+	})
+}
+
+func (c *console) grantAdmin(w http.ResponseWriter, r *http.Request, admin *engine.User) {
+	c.userAction(w, r, "Admin role granted", func(user *engine.User) error {
+		return c.api.engine.GrantAdmin(r.Context(), admin, user)
+	})
+}
+
+func (c *console) revokeAdmin(w http.ResponseWriter, r *http.Request, admin *engine.User) {
+	c.userAction(w, r, "Admin role revoked", func(user *engine.User) error {
+		return c.api.engine.RevokeAdmin(r.Context(), admin, user)
+	})
+}
+
+func (c *console) renameUser(w http.ResponseWriter, r *http.Request, admin *engine.User) {
+	name := r.PostFormValue("name")
+	user, err := c.api.engine.LookupUserContext(r.Context(), pathParam(r, "username"))
+	if err == nil {
+		err = c.api.engine.RenameUser(r.Context(), admin, user, name)
+	}
+	if err != nil {
+		c.done(w, r, "/admin/users/"+url.PathEscape(pathParam(r, "username")), err, "")
+		return
+	}
+	c.done(w, r, "/admin/users/"+url.PathEscape(name), nil, "User renamed")
+}
+
+func (c *console) findSubreddit(w http.ResponseWriter, r *http.Request, admin *engine.User) {
+	http.Redirect(w, r, "/admin/r/"+url.PathEscape(strings.TrimSpace(r.URL.Query().Get("q"))), http.StatusSeeOther)
+}
+
+// consoleBan is a banned user as listed on a subreddit's console page.
+type consoleBan struct {
+	Username string
+	Reason   string
+}
+
+func (c *console) subreddit(w http.ResponseWriter, r *http.Request, admin *engine.User) {
+	sr, err := c.api.engine.LookupSubRedditContext(r.Context(), pathParam(r, "name"))
+	if err != nil {
+		c.render(w, r, http.StatusNotFound, "error", "Not found", admin.Username, nil, err.Error())
+		return
+	}
+	m := c.api.newMapper(r)
+	m.expand[expandMembers] = true
+	m.expand[expandPosts] = true
+	m.expand[expandComments] = true
+	m.expand[expandReplies] = true
+	var data struct {
+		Subreddit *SubredditResponse
+		Banned    []consoleBan
+	}
+	c.api.engine.ViewContext(r.Context(), func() {
+		data.Subreddit = m.subreddit(sr)
+		for id, reason := range sr.Banned {
+			data.Banned = append(data.Banned, consoleBan{Username: c.api.engine.Users[id].Username, Reason: reason})
+		}
+	})
+	// Newest posts first, as in the feed.
+	posts := data.Subreddit.Posts
+	for i, j := 0, len(posts)-1; i < j; i, j = i+1, j-1 {
+		posts[i], posts[j] = posts[j], posts[i]
+	}
+	c.render(w, r, http.StatusOK, "subreddit", "r/"+data.Subreddit.Name, admin.Username, data, "")
+}
+
+func (c *console) renameSubreddit(w http.ResponseWriter, r *http.Request, admin *engine.User) {
+	name := r.PostFormValue("name")
+	sr, err := c.api.engine.LookupSubRedditContext(r.Context(), pathParam(r, "name"))
+	if err == nil {
+		err = c.api.engine.RenameSubReddit(r.Context(), admin, sr, name)
+	}
+	if err != nil {
+		c.done(w, r, "/admin/r/"+url.PathEscape(pathParam(r, "name")), err, "")
+		return
+	}
+	c.done(w, r, "/admin/r/"+url.PathEscape(name), nil, "Subreddit renamed")
+}
+
+// postAction runs fn on the post in the path and returns to the page the
+// form came from.
+func (c *console) postAction(w http.ResponseWriter, r *http.Request, flash string, fn func(post *engine.Post) error) {
+	post, err := c.api.postFromPath(r)
+	if err == nil {
+		err = fn(post)
+	}
+	c.done(w, r, back(r, "/admin/"), err, flash)
+}
+
+func (c *console) removePost(w http.ResponseWriter, r *http.Request, admin *engine.User) {
+	c.postAction(w, r, "Post removed", func(post *engine.Post) error {
+		return c.api.engine.RemovePost(r.Context(), admin, post, r.PostFormValue("reason"))
+	})
+}
+
+func (c *console) restorePost(w http.ResponseWriter, r *http.Request, admin *engine.User) {
+	c.postAction(w, r, "Post restored", func(post *engine.Post) error {
+		return c.api.engine.RestorePost(r.Context(), admin, post)
+	})
+}
+
+func (c *console) commentAction(w http.ResponseWriter, r *http.Request, flash string, fn func(post *engine.Post, comment *engine.Comment) error) {
+	c.postAction(w, r, flash, func(post *engine.Post) error {
+		id, err := strconv.Atoi(pathParam(r, "commentId"))
+		if err != nil {
+			return badRequest("invalid comment ID")
+		}
+		comment, err := c.api.engine.LookupComment(r.Context(), post, id)
+		if err != nil {
+			return err
+		}
+		return fn(post, comment)
+	})
+}
+
+func (c *console) removeComment(w http.ResponseWriter, r *http.Request, admin *engine.User) {
+	c.commentAction(w, r, "Comment removed", func(post *engine.Post, comment *engine.Comment) error {
+		return c.api.engine.RemoveComment(r.Context(), admin, post, comment, r.PostFormValue("reason"))
+	})
+}
+
+func (c *console) restoreComment(w http.ResponseWriter, r *http.Request, admin *engine.User) {
+	c.commentAction(w, r, "Comment restored", func(post *engine.Post, comment *engine.Comment) error {
+		return c.api.engine.RestoreComment(r.Context(), admin, post, comment)
+	})
+}
+
+func (c *console) messageAction(w http.ResponseWriter, r *http.Request, flash string, fn func(message *engine.Message) error) {
+	id, err := strconv.Atoi(pathParam(r, "id"))
+	var message *engine.Message
+	if err != nil {
+		err = badRequest("invalid message ID")
+	} else if message, err = c.api.engine.LookupMessage(r.Context(), id); err == nil {
+		err = fn(message)
+	}
+	c.done(w, r, back(r, "/admin/"), err, flash)
+}
+
+func (c *console) removeMessage(w http.ResponseWriter, r *http.Request, admin *engine.User) {
+	c.messageAction(w, r, "Message removed", func(message *engine.Message) error {
+		return c.api.engine.RemoveMessage(r.Context(), admin, message, r.PostFormValue("reason"))
+	})
+}
+
+func (c *console) restoreMessage(w http.ResponseWriter, r *http.Request, admin *engine.User) {
+	c.messageAction(w, r, "Message restored", func(message *engine.Message) error {
+		return c.api.engine.RestoreMessage(r.Context(), admin, message)
+	})
+}
+
+func (c *console) audit(w http.ResponseWriter, r *http.Request, admin *engine.User) {
+	filter, err := c.api.auditFilter(r)
+	if err != nil {
+		c.render(w, r, http.StatusNotFound, "audit", "Audit log", admin.Username, nil, err.Error())
+		return
+	}
+	entries := newestEntriesFirst(c.api.engine.AuditLog(r.Context(), filter))
+	if len(entries) > auditConsoleLimit {
+		entries = entries[:auditConsoleLimit]
+	}
+	n, verifyErr := c.api.engine.VerifyAuditLog(r.Context())
+	data := struct {
+		Entries  []*AuditEntryResponse
+		Filter   url.Values
+		Checked  int
+		ChainErr string
+	}{
+		Entries: mapPage(r.Context(), c.api.engine, page[engine.AuditEntry]{Items: entries}, c.api.newMapper(r).auditEntry).Items,
+		Filter:  r.URL.Query(),
+		Checked: n,
+	}
+	if verifyErr != nil {
+		data.ChainErr = verifyErr.Error()
+	}
+	c.render(w, r, http.StatusOK, "audit", "Audit log", admin.Username, data, "")
+}
+
+func (c *console) voteRings(w http.ResponseWriter, r *http.Request, admin *engine.User) {
+	report := c.api.engine.DetectVoteRings(r.Context(), engine.DefaultVoteRingOptions())
+	data := mapOne(r.Context(), c.api.engine, report, c.api.newMapper(r).voteRingReport)
+	c.render(w, r, http.StatusOK, "voterings", "Vote rings", admin.Username, data, "")
+}
+
+func (c *console) discountVoteRing(w http.ResponseWriter, r *http.Request, admin *engine.User) {
+	_, err := c.api.engine.DiscountVoteRing(r.Context(), admin, pathParam(r, "ring"), engine.DefaultVoteRingOptions())
+	c.done(w, r, "/admin/vote-rings", err, "Votes discounted")
+}
+
+func (c *console) restoreVoteRing(w http.ResponseWriter, r *http.Request, admin *engine.User) {
+	_, err := c.api.engine.RestoreVoteRing(r.Context(), admin, pathParam(r, "ring"), engine.DefaultVoteRingOptions())
+	c.done(w, r, "/admin/vote-rings", err, "Votes restored")
+}
+
+// wordFilters lists the site-wide word filters and everything held for
+// review across the site.
+func (c *console) wordFilters(w http.ResponseWriter, r *http.Request, admin *engine.User) {
+	filters, err := c.api.engine.WordFilters(r.Context(), admin, nil)
+	var queue []engine.QueueItem
+	if err == nil {
+		queue, err = c.api.engine.ModQueue(r.Context(), admin, nil)
+	}
+	if err != nil {
+		c.render(w, r, errorStatus(err), "error", "Word filters", admin.Username, nil, formError(err))
+		return
+	}
+	data := struct {
+		Filters []WordFilterResponse
+		Queue   *ModQueueResponse
+	}{wordFiltersResponse(filters), mapOne(r.Context(), c.api.engine, queue, c.api.newMapper(r).modQueue)}
+	c.render(w, r, http.StatusOK, "filters", "Word filters", admin.Username, data, "")
+}
+
+func (c *console) addWordFilter(w http.ResponseWriter, r *http.Request, admin *engine.User) {
+	f := engine.WordFilter{Kind: r.PostFormValue("kind"), Pattern: r.PostFormValue("pattern"), Action: r.PostFormValue("action")}
+	_, err := c.api.engine.AddWordFilter(r.Context(), admin, nil, f)
+	c.done(w, r, "/admin/filters", err, "Filter added")
+}
+
+func (c *console) removeWordFilter(w http.ResponseWriter, r *http.Request, admin *engine.User) {
+	id, err := strconv.Atoi(pathParam(r, "filter"))
+	if err != nil {
+		err = badRequest("invalid filter ID")
+	} else {
+		err = c.api.engine.RemoveWordFilter(r.Context(), admin, nil, id)
+	}
+	c.done(w, r, "/admin/filters", err, "Filter removed")
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"reddit-clone/engine"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestConsolePages logs in to the console and renders every page, since
+// template mistakes only show up when a page is executed.
+func TestConsolePages(t *testing.T) {
+	ctx := context.Background()
+	f := newFixture(t)
+	e, alice, bob, post := f.e, f.alice, f.bob, f.post
+	e.AddWordFilter(ctx, bob, nil, engine.WordFilter{Kind: engine.FilterWord, Pattern: "later", Action: engine.FilterReview})
+	e.SendMessage(alice, bob, "See you later")
+	e.CreateComment(alice, post, "Later!")
+	e.SuspendUser(ctx, bob, alice, "Spam", time.Now().Add(time.Hour))
+	e.RemovePost(ctx, bob, post, "Off topic")
+	console := newTestAPI(e).Console()
+
+	b := &browser{h: console}
+
+	if rec := b.do("GET", "/admin/", nil); rec.Code != http.StatusSeeOther {
+		t.Fatalf("GET /admin/ without a session: status %d, want 303", rec.Code)
+	}
+	csrf := csrfToken(t, b.do("GET", "/admin/login", nil))
+	if rec := b.do("POST", "/admin/login", url.Values{"username": {"bob"}}); rec.Code != http.StatusForbidden {
+		t.Fatalf("login without CSRF token: status %d, want 403", rec.Code)
+	}
+	if rec := b.do("POST", "/admin/login", url.Values{"username": {"bob"}, "token": {"guess"}, "csrf": {csrf}}); rec.Code != http.StatusForbidden {
+		t.Fatalf("login with the wrong admin token: status %d, want 403", rec.Code)
+	}
+	if rec := b.do("POST", "/admin/login", url.Values{"username": {"bob"}, "token": {testAdminToken}, "csrf": {csrf}}); rec.Code != http.StatusSeeOther {
+		t.Fatalf("login: status %d\n%s", rec.Code, rec.Body)
+	}
+
+	for _, path := range []string{"/admin/", "/admin/users/alice", "/admin/users/bob", "/admin/r/news", "/admin/audit", "/admin/audit?actor=bob", "/admin/filters"} {
+		rec := b.do("GET", path, nil)
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "</html>") {
+			t.Errorf("GET %s: status %d, incomplete page:\n%s", path, rec.Code, rec.Body)
+		}
+	}
+
+	rec := b.do("POST", "/admin/users/alice/unsuspend", url.Values{"csrf": {csrf}})
+	if rec.Code != http.StatusSeeOther || strings.Contains(rec.Header().Get("Location"), "error=") {
+		t.Fatalf("unsuspend: status %d, location %s", rec.Code, rec.Header().Get("Location"))
+	}
+	if alice.Suspended(time.Now()) {
+		t.Error("alice is still suspended")
+	}
+	if n, err := e.VerifyAuditLog(ctx); err != nil || n == 0 {
+		t.Errorf("audit log: %d entries, %v", n, err)
+	}
+}
+
+// TestConsoleNeedsAdminToken checks that knowing an admin's username is not
+// enough to use the console.
+func TestConsoleNeedsAdminToken(t *testing.T) {
+	f := newFixture(t)
+	api := newTestAPI(f.e)
+	site, console := api.Site(), api.Console()
+
+	// A front end session for bob, which anyone can get by typing his name.
+	b := &browser{h: site}
+	csrf := csrfToken(t, b.do("GET", "/login", nil))
+	if rec := b.do("POST", "/login", url.Values{"username": {"bob"}, "csrf": {csrf}}); rec.Code != http.StatusSeeOther {
+		t.Fatalf("front end login: status %d\n%s", rec.Code, rec.Body)
+	}
+	b.h = console
+	if rec := b.do("GET", "/admin/", nil); rec.Code != http.StatusSeeOther {
+		t.Fatalf("GET /admin/ with a front end session: status %d, want 303", rec.Code)
+	}
+	if rec := b.do("POST", "/admin/login", url.Values{"username": {"bob"}, "csrf": {csrf}}); rec.Code != http.StatusForbidden {
+		t.Fatalf("login without an admin token: status %d, want 403", rec.Code)
+	}
+
+	// Without a configured admin token the console lets nobody in.
+	b = &browser{h: NewAPI(f.e).Console()}
+	csrf = csrfToken(t, b.do("GET", "/admin/login", nil))
+	if rec := b.do("POST", "/admin/login", url.Values{"username": {"bob"}, "token": {""}, "csrf": {csrf}}); rec.Code != http.StatusForbidden {
+		t.Fatalf("login to a console without an admin token: status %d, want 403", rec.Code)
+	}
+}
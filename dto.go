@@ -0,0 +1,707 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reddit-clone/engine"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The API never encodes engine structs directly: they link to each other
+// through pointers and maps, so encoding one subreddit would dump its members,
+// every post and every comment. The types below are the public shapes, and
+// nested data is only included when requested with ?expand=.
+
+type UserSummary struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+}
+
+type UserResponse struct {
+	ID        int    `json:"id"`
+	Username  string `json:"username"`
+	Karma     int    `json:"karma"`
+	Suspended bool   `json:"suspended,omitempty"`
+}
+
+type SubredditResponse struct {
+	ID          int             `json:"id"`
+	Name        string          `json:"name"`
+	MemberCount int             `json:"memberCount"`
+	PostCount   int             `json:"postCount"`
+	Moderators  []UserSummary   `json:"moderators"`
+	Members     []UserSummary   `json:"members,omitempty"`
+	Posts       []*PostResponse `json:"posts,omitempty"`
+	// RepostPolicy says what happens to posts that repeat recent ones.
+	RepostPolicy RepostPolicyResponse `json:"repostPolicy"`
+}
+
+type PostResponse struct {
+	ID           int                `json:"id"`
+	Subreddit    string             `json:"subreddit"`
+	Title        string             `json:"title"`
+	Content      string             `json:"content"`
+	Author       UserSummary        `json:"author"`
+	Score        int                `json:"score"`
+	CommentCount int                `json:"commentCount"`
+	ViewerVote   *int               `json:"viewerVote,omitempty"`
+	Removed      bool               `json:"removed,omitempty"`
+	Held         bool               `json:"held,omitempty"`
+	CreatedAt    time.Time          `json:"createdAt"`
+	Comments     []*CommentResponse `json:"comments,omitempty"`
+	// PreviouslyPosted is only set on the response to a submission. It
+	// lists the recent posts in the subreddit that the new post repeats;
+	// GET /api/v1/posts/{id}/reposts lists all of them.
+	PreviouslyPosted []RepostResponse `json:"previouslyPosted,omitempty"`
+}
+
+type CommentResponse struct {
+	ID         int                `json:"id"`
+	Content    string             `json:"content"`
+	Author     UserSummary        `json:"author"`
+	Score      int                `json:"score"`
+	ReplyCount int                `json:"replyCount"`
+	Removed    bool               `json:"removed,omitempty"`
+	Held       bool               `json:"held,omitempty"`
+	CreatedAt  time.Time          `json:"createdAt"`
+	Replies    []*CommentResponse `json:"replies,omitempty"`
+}
+
+// ModLogEntry is a moderation action as shown in a subreddit's public
+// moderation log. It leaves out the IP address and request ID recorded in
+// the audit log.
+type ModLogEntry struct {
+	ID         int       `json:"id"`
+	Time       time.Time `json:"time"`
+	Moderator  string    `json:"moderator"`
+	Action     string    `json:"action"`
+	TargetType string    `json:"targetType"`
+	TargetID   int       `json:"targetId"`
+	Target     string    `json:"target,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+}
+
+// AuditEntryResponse is a full audit log entry, shown to admins.
+type AuditEntryResponse struct {
+	ID         int            `json:"id"`
+	Time       time.Time      `json:"time"`
+	Actor      string         `json:"actor"`
+	Action     string         `json:"action"`
+	TargetType string         `json:"targetType"`
+	TargetID   int            `json:"targetId"`
+	Target     string         `json:"target,omitempty"`
+	Subreddit  string         `json:"subreddit,omitempty"`
+	Reason     string         `json:"reason,omitempty"`
+	Before     map[string]any `json:"before,omitempty"`
+	After      map[string]any `json:"after,omitempty"`
+	IP         string         `json:"ip,omitempty"`
+	RequestID  string         `json:"requestId,omitempty"`
+	PrevHash   string         `json:"prevHash"`
+	Hash       string         `json:"hash"`
+}
+
+type AuditVerifyResponse struct {
+	Valid   bool   `json:"valid"`
+	Entries int    `json:"entries"`
+	Error   string `json:"error,omitempty"`
+}
+
+type MessageResponse struct {
+	ID      int         `json:"id"`
+	From    UserSummary `json:"from"`
+	To      UserSummary `json:"to"`
+	Content string      `json:"content"`
+	Removed bool        `json:"removed,omitempty"`
+	Held    bool        `json:"held,omitempty"`
+}
+
+// CountsResponse holds the number of each kind of entity.
+type CountsResponse struct {
+	Users      int `json:"users"`
+	Subreddits int `json:"subreddits"`
+	Posts      int `json:"posts"`
+	Comments   int `json:"comments"`
+	Messages   int `json:"messages"`
+}
+
+type GrowthPointResponse struct {
+	Day   string         `json:"day"`
+	New   CountsResponse `json:"new"`
+	Total CountsResponse `json:"total"`
+}
+
+type SiteStatsResponse struct {
+	Counts CountsResponse        `json:"counts"`
+	Growth []GrowthPointResponse `json:"growth"`
+}
+
+type SuspensionResponse struct {
+	Reason string     `json:"reason"`
+	Until  *time.Time `json:"until,omitempty"`
+}
+
+// UserCommentResponse is a comment in a user's history, with the post it
+// is on.
+type UserCommentResponse struct {
+	PostID    int              `json:"postId"`
+	PostTitle string           `json:"postTitle"`
+	Comment   *CommentResponse `json:"comment"`
+}
+
+// AdminUserResponse is a user as seen by admins, with their content
+// history.
+type AdminUserResponse struct {
+	User       *UserResponse          `json:"user"`
+	Admin      bool                   `json:"admin"`
+	CreatedAt  time.Time              `json:"createdAt"`
+	Suspension *SuspensionResponse    `json:"suspension,omitempty"`
+	Moderates  []string               `json:"moderates"`
+	BannedFrom []string               `json:"bannedFrom"`
+	Messages   []*MessageResponse     `json:"messages"`
+	Posts      []*PostResponse        `json:"posts"`
+	Comments   []*UserCommentResponse `json:"comments"`
+}
+
+// RepostPolicyResponse is a subreddit's repost policy. Window is a Go
+// duration such as "720h0m0s".
+type RepostPolicyResponse struct {
+	Action string `json:"action"`
+	Window string `json:"window"`
+}
+
+// RepostResponse is an earlier post that a post repeats. Match is "link"
+// when both link to the same page and "text" when their words are
+// near-duplicates. Flagged is set when the subreddit's repost policy
+// applies to it.
+type RepostResponse struct {
+	Post       *PostResponse `json:"post"`
+	Match      string        `json:"match"`
+	Similarity float64       `json:"similarity"`
+	Flagged    bool          `json:"flagged,omitempty"`
+}
+
+// WordFilterResponse is one entry in a subreddit's or the site's word
+// filter list.
+type WordFilterResponse struct {
+	ID        int       `json:"id"`
+	Kind      string    `json:"kind"`
+	Pattern   string    `json:"pattern"`
+	Action    string    `json:"action"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// ModQueueResponse lists the posts, comments and messages that word filters
+// held for review, newest first.
+type ModQueueResponse struct {
+	Items []ModQueueItemResponse `json:"items"`
+}
+
+// ModQueueItemResponse is one held post, comment or message. Type says
+// which; PostID is set for posts and comments, CommentID for comments and
+// MessageID and To for messages. Title and Content are shown as written.
+type ModQueueItemResponse struct {
+	Type      string       `json:"type"`
+	Subreddit string       `json:"subreddit,omitempty"`
+	PostID    int          `json:"postId,omitempty"`
+	CommentID int          `json:"commentId,omitempty"`
+	MessageID int          `json:"messageId,omitempty"`
+	Author    UserSummary  `json:"author"`
+	To        *UserSummary `json:"to,omitempty"`
+	Title     string       `json:"title,omitempty"`
+	Content   string       `json:"content"`
+	Reason    string       `json:"reason"`
+	CreatedAt time.Time    `json:"createdAt"`
+}
+
+// VoteRingReportResponse lists groups of accounts that vote together.
+// LoggedVotes counts the analyzed votes whose time and share link are
+// still known.
+type VoteRingReportResponse struct {
+	GeneratedAt   time.Time          `json:"generatedAt"`
+	VotesAnalyzed int                `json:"votesAnalyzed"`
+	LoggedVotes   int                `json:"loggedVotes"`
+	Rings         []VoteRingResponse `json:"rings"`
+}
+
+// VoteRingResponse is a suspected vote ring. Discounted counts the
+// members' votes that are left out of scores and karma.
+type VoteRingResponse struct {
+	ID         string                   `json:"id"`
+	Members    []VoteRingMemberResponse `json:"members"`
+	Posts      []*PostResponse          `json:"posts"`
+	Signals    []string                 `json:"signals"`
+	Similarity float64                  `json:"similarity"`
+	Votes      int                      `json:"votes"`
+	Discounted int                      `json:"discounted"`
+	Refs       []string                 `json:"refs,omitempty"`
+}
+
+type VoteRingMemberResponse struct {
+	User      *UserResponse `json:"user"`
+	CreatedAt time.Time     `json:"createdAt"`
+}
+
+// ImportResponse counts what an import added. Users and subreddits whose
+// names already existed were merged rather than added.
+type ImportResponse struct {
+	Users            int            `json:"users"`
+	MergedUsers      int            `json:"mergedUsers"`
+	Subreddits       int            `json:"subreddits"`
+	MergedSubreddits int            `json:"mergedSubreddits"`
+	Memberships      int            `json:"memberships"`
+	Posts            int            `json:"posts"`
+	Comments         int            `json:"comments"`
+	Votes            int            `json:"votes"`
+	Messages         int            `json:"messages"`
+	Skipped          map[string]int `json:"skipped,omitempty"`
+}
+
+// Request bodies. The example tags are published in the OpenAPI document.
+
+type CreateUserRequest struct {
+	Username string `json:"username" example:"alice"`
+}
+
+type CreateSubredditRequest struct {
+	Name string `json:"name" example:"golang"`
+}
+
+type SubmitPostRequest struct {
+	Title    string `json:"title" example:"Hello"`
+	Content  string `json:"content" example:"My first post"`
+	Username string `json:"username" example:"alice"`
+}
+
+// CreateCommentRequest comments on a post, or replies to the comment
+// ParentID if it is set.
+type CreateCommentRequest struct {
+	Content  string `json:"content" example:"Nice post!"`
+	Username string `json:"username" example:"alice"`
+	ParentID int    `json:"parentId,omitempty" example:"1"`
+}
+
+// VoteRequest votes on a post. Without a username the vote is anonymous.
+// Ref names the share link the voter followed, if any.
+type VoteRequest struct {
+	Upvote    bool   `json:"upvote" example:"true"`
+	Direction *int   `json:"direction,omitempty" example:"1"`
+	Username  string `json:"username,omitempty" example:"alice"`
+	Ref       string `json:"ref,omitempty" example:"bob"`
+}
+
+// RepostPolicyRequest sets a subreddit's repost policy. Action is warn,
+// block or allow, and Window a Go duration; an empty window means 720h.
+type RepostPolicyRequest struct {
+	Action string `json:"action" example:"block"`
+	Window string `json:"window,omitempty" example:"168h"`
+}
+
+// WordFilterRequest adds a word filter. Kind is word, wildcard (where *
+// stands for any letters) or regex, and Action is reject, mask or review.
+type WordFilterRequest struct {
+	Kind    string `json:"kind" example:"word"`
+	Pattern string `json:"pattern" example:"darn"`
+	Action  string `json:"action" example:"mask"`
+}
+
+type SendMessageRequest struct {
+	From    string `json:"from" example:"bob"`
+	Content string `json:"content" example:"Hi there"`
+}
+
+// ModerationRequest gives the reason for a ban or removal, which is shown in
+// the moderation log.
+type ModerationRequest struct {
+	Reason string `json:"reason" example:"Spam"`
+}
+
+// SuspendRequest suspends a user. Without a duration the suspension lasts
+// until it is lifted.
+type SuspendRequest struct {
+	Reason   string `json:"reason" example:"Harassment"`
+	Duration string `json:"duration,omitempty" example:"72h"`
+}
+
+// RenameRequest forces a new username or subreddit name.
+type RenameRequest struct {
+	Name string `json:"name" example:"renamed_1"`
+}
+
+// MembershipRequest is the body of the legacy join and leave routes.
+type MembershipRequest struct {
+	Username string `json:"username" example:"alice"`
+}
+
+// Expansions accepted by ?expand=, as a comma-separated list.
+const (
+	expandMembers  = "members"
+	expandPosts    = "posts"
+	expandComments = "comments"
+	expandReplies  = "replies"
+)
+
+// mapper converts engine entities to response types. It must only be used
+// inside RedditEngine.View so the entities are read under the engine lock.
+type mapper struct {
+	engine *engine.RedditEngine
+	viewer *engine.User
+	expand map[string]bool
+}
+
+// newMapper reads the viewer and expansions from the request. The viewer is
+// the user named by the X-Username header or ?viewer= parameter, if any.
+func (api *API) newMapper(r *http.Request) *mapper {
+	m := &mapper{engine: api.engine, expand: make(map[string]bool)}
+	for _, field := range strings.Split(r.URL.Query().Get("expand"), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			m.expand[field] = true
+		}
+	}
+	viewer := r.Header.Get("X-Username")
+	if viewer == "" {
+		viewer = r.URL.Query().Get("viewer")
+	}
+	if viewer != "" {
+		m.viewer = api.engine.GetUserByUsernameContext(r.Context(), viewer)
+	}
+	return m
+}
+
+func (m *mapper) summary(u *engine.User) UserSummary {
+	if u == nil {
+		return UserSummary{}
+	}
+	return UserSummary{ID: u.ID, Username: u.Username}
+}
+
+// summaries lists users ordered by ID.
+func (m *mapper) summaries(users map[int]*engine.User) []UserSummary {
+	list := make([]UserSummary, 0, len(users))
+	for _, u := range users {
+		list = append(list, m.summary(u))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+func (m *mapper) user(u *engine.User) *UserResponse {
+	return &UserResponse{
+		ID:        u.ID,
+		Username:  u.Username,
+		Karma:     u.Karma,
+		Suspended: u.Suspended(time.Now()),
+	}
+}
+
+func (m *mapper) subreddit(sr *engine.SubReddit) *SubredditResponse {
+	resp := &SubredditResponse{
+		ID:          sr.ID,
+		Name:        sr.Name,
+		MemberCount: len(sr.Members),
+		PostCount:   len(sr.Posts),
+		Moderators:  m.summaries(sr.Moderators),
+	}
+	policy := sr.Reposts.WithDefaults()
+	resp.RepostPolicy = RepostPolicyResponse{Action: policy.Action, Window: policy.Window.String()}
+	if m.expand[expandMembers] {
+		resp.Members = m.summaries(sr.Members)
+	}
+	if m.expand[expandPosts] {
+		resp.Posts = make([]*PostResponse, 0, len(sr.Posts))
+		for _, post := range sr.Posts {
+			resp.Posts = append(resp.Posts, m.post(post))
+		}
+	}
+	return resp
+}
+
+func (m *mapper) post(p *engine.Post) *PostResponse {
+	resp := &PostResponse{
+		ID:           p.ID,
+		Title:        p.Title,
+		Content:      p.Content,
+		Author:       m.summary(p.Author),
+		Score:        p.Votes,
+		CommentCount: countComments(p.Comments),
+		CreatedAt:    p.CreatedAt,
+	}
+	if sr := m.engine.SubReddits[p.SubRedditID]; sr != nil {
+		resp.Subreddit = sr.Name
+	}
+	if p.Removed {
+		resp.Title, resp.Content, resp.Removed, resp.Held = "[removed]", "", true, p.Held
+	}
+	if m.viewer != nil {
+		vote := p.Voters[m.viewer.ID]
+		// Viewers see their own buffered vote before it is applied.
+		if pending, ok := m.engine.PendingVote(p, m.viewer); ok && !p.Discounted[m.viewer.ID] {
+			resp.Score += pending - vote
+			vote = pending
+		}
+		resp.ViewerVote = &vote
+	}
+	if m.expand[expandComments] {
+		resp.Comments = m.comments(p.Comments)
+	}
+	return resp
+}
+
+func (m *mapper) comment(c *engine.Comment) *CommentResponse {
+	resp := &CommentResponse{
+		ID:         c.ID,
+		Content:    c.Content,
+		Author:     m.summary(c.Author),
+		Score:      c.Votes,
+		ReplyCount: len(c.Replies),
+		CreatedAt:  c.CreatedAt,
+	}
+	if c.Removed {
+		resp.Content, resp.Removed, resp.Held = "[removed]", true, c.Held
+	}
+	if m.expand[expandReplies] {
+		resp.Replies = m.comments(c.Replies)
+	}
+	return resp
+}
+
+func (m *mapper) comments(comments []*engine.Comment) []*CommentResponse {
+	resp := make([]*CommentResponse, 0, len(comments))
+	for _, c := range comments {
+		resp = append(resp, m.comment(c))
+	}
+	return resp
+}
+
+func (m *mapper) message(msg *engine.Message) *MessageResponse {
+	resp := &MessageResponse{
+		ID:      msg.ID,
+		From:    m.summary(msg.From),
+		To:      m.summary(msg.To),
+		Content: msg.Content,
+	}
+	if msg.Removed {
+		resp.Content, resp.Removed, resp.Held = "[removed]", true, msg.Held
+	}
+	return resp
+}
+
+func countsResponse(c engine.Counts) CountsResponse {
+	return CountsResponse{Users: c.Users, Subreddits: c.SubReddits, Posts: c.Posts, Comments: c.Comments, Messages: c.Messages}
+}
+
+func siteStatsResponse(stats engine.SiteStats) *SiteStatsResponse {
+	resp := &SiteStatsResponse{Counts: countsResponse(stats.Counts), Growth: make([]GrowthPointResponse, 0, len(stats.Growth))}
+	for _, g := range stats.Growth {
+		resp.Growth = append(resp.Growth, GrowthPointResponse{
+			Day:   g.Day.Format(time.DateOnly),
+			New:   countsResponse(g.New),
+			Total: countsResponse(g.Total),
+		})
+	}
+	return resp
+}
+
+func importResponse(res engine.ImportResult, skipped map[string]int) *ImportResponse {
+	return &ImportResponse{
+		Users:            res.Users,
+		MergedUsers:      res.MergedUsers,
+		Subreddits:       res.SubReddits,
+		MergedSubreddits: res.MergedSubReddits,
+		Memberships:      res.Memberships,
+		Posts:            res.Posts,
+		Comments:         res.Comments,
+		Votes:            res.Votes,
+		Messages:         res.Messages,
+		Skipped:          skipped,
+	}
+}
+
+func (m *mapper) adminUser(u *engine.User, h engine.UserHistory) *AdminUserResponse {
+	resp := &AdminUserResponse{
+		User:       m.user(u),
+		Admin:      u.IsAdmin(),
+		CreatedAt:  u.CreatedAt,
+		Moderates:  make([]string, 0, len(h.Moderates)),
+		BannedFrom: make([]string, 0, len(h.BannedFrom)),
+		Messages:   make([]*MessageResponse, 0, len(h.Messages)),
+		Posts:      make([]*PostResponse, 0, len(h.Posts)),
+		Comments:   make([]*UserCommentResponse, 0, len(h.Comments)),
+	}
+	if u.Suspended(time.Now()) {
+		resp.Suspension = &SuspensionResponse{Reason: u.Suspension.Reason}
+		if until := u.Suspension.Until; !until.IsZero() {
+			resp.Suspension.Until = &until
+		}
+	}
+	for _, sr := range h.Moderates {
+		resp.Moderates = append(resp.Moderates, sr.Name)
+	}
+	for _, sr := range h.BannedFrom {
+		resp.BannedFrom = append(resp.BannedFrom, sr.Name)
+	}
+	for _, p := range h.Posts {
+		resp.Posts = append(resp.Posts, m.post(p))
+	}
+	for _, msg := range h.Messages {
+		resp.Messages = append(resp.Messages, m.message(msg))
+	}
+	for _, ref := range h.Comments {
+		title := ref.Post.Title
+		if ref.Post.Removed {
+			title = "[removed]"
+		}
+		resp.Comments = append(resp.Comments, &UserCommentResponse{PostID: ref.Post.ID, PostTitle: title, Comment: m.comment(ref.Comment)})
+	}
+	return resp
+}
+
+func (m *mapper) modLogEntry(a engine.AuditEntry) *ModLogEntry {
+	return &ModLogEntry{
+		ID:         a.ID,
+		Time:       a.Time,
+		Moderator:  a.Actor,
+		Action:     a.Action,
+		TargetType: a.TargetType,
+		TargetID:   a.TargetID,
+		Target:     m.auditTarget(a),
+		Reason:     a.Reason,
+	}
+}
+
+func (m *mapper) auditEntry(a engine.AuditEntry) *AuditEntryResponse {
+	resp := &AuditEntryResponse{
+		ID:         a.ID,
+		Time:       a.Time,
+		Actor:      a.Actor,
+		Action:     a.Action,
+		TargetType: a.TargetType,
+		TargetID:   a.TargetID,
+		Target:     a.Target,
+		Reason:     a.Reason,
+		Before:     a.Before,
+		After:      a.After,
+		IP:         a.IP,
+		RequestID:  a.RequestID,
+		PrevHash:   a.PrevHash,
+		Hash:       a.Hash,
+	}
+	if sr := m.engine.SubReddits[a.SubRedditID]; sr != nil {
+		resp.Subreddit = sr.Name
+	}
+	return resp
+}
+
+// auditTarget names an audit entry's target for the public moderation log.
+// Removed posts keep their title out of it.
+func (m *mapper) auditTarget(a engine.AuditEntry) string {
+	if a.TargetType == engine.TargetPost {
+		return ""
+	}
+	return a.Target
+}
+
+// mapPage converts the items of a page with fn under the engine lock.
+func mapPage[T, R any](ctx context.Context, e *engine.RedditEngine, p page[T], fn func(T) R) page[R] {
+	resp := page[R]{Items: make([]R, 0, len(p.Items)), Total: p.Total, Next: p.Next, Prev: p.Prev}
+	e.ViewContext(ctx, func() {
+		for _, item := range p.Items {
+			resp.Items = append(resp.Items, fn(item))
+		}
+	})
+	return resp
+}
+
+// voteRingReport maps the result of a vote ring scan.
+func (m *mapper) voteRingReport(report engine.VoteRingReport) *VoteRingReportResponse {
+	resp := &VoteRingReportResponse{
+		GeneratedAt:   report.Time,
+		VotesAnalyzed: report.VotesAnalyzed,
+		LoggedVotes:   report.LoggedVotes,
+		Rings:         make([]VoteRingResponse, 0, len(report.Rings)),
+	}
+	for _, ring := range report.Rings {
+		resp.Rings = append(resp.Rings, *m.voteRing(ring))
+	}
+	return resp
+}
+
+func (m *mapper) voteRing(ring engine.VoteRing) *VoteRingResponse {
+	resp := &VoteRingResponse{
+		ID:         ring.ID,
+		Members:    make([]VoteRingMemberResponse, 0, len(ring.Members)),
+		Posts:      make([]*PostResponse, 0, len(ring.Posts)),
+		Signals:    ring.Signals,
+		Similarity: ring.Similarity,
+		Votes:      ring.Votes,
+		Discounted: ring.Discounted,
+		Refs:       ring.Refs,
+	}
+	for _, u := range ring.Members {
+		resp.Members = append(resp.Members, VoteRingMemberResponse{User: m.user(u), CreatedAt: u.CreatedAt})
+	}
+	for _, p := range ring.Posts {
+		resp.Posts = append(resp.Posts, m.post(p))
+	}
+	return resp
+}
+
+func wordFilterResponse(f engine.WordFilter) WordFilterResponse {
+	return WordFilterResponse{ID: f.ID, Kind: f.Kind, Pattern: f.Pattern, Action: f.Action, CreatedAt: f.CreatedAt}
+}
+
+func wordFiltersResponse(filters []engine.WordFilter) []WordFilterResponse {
+	resp := make([]WordFilterResponse, 0, len(filters))
+	for _, f := range filters {
+		resp = append(resp, wordFilterResponse(f))
+	}
+	return resp
+}
+
+func (m *mapper) modQueue(queue []engine.QueueItem) *ModQueueResponse {
+	resp := &ModQueueResponse{Items: make([]ModQueueItemResponse, 0, len(queue))}
+	for _, item := range queue {
+		resp.Items = append(resp.Items, m.modQueueItem(item))
+	}
+	return resp
+}
+
+func (m *mapper) modQueueItem(item engine.QueueItem) ModQueueItemResponse {
+	if msg := item.Message; msg != nil {
+		to := m.summary(msg.To)
+		return ModQueueItemResponse{Type: "message", MessageID: msg.ID, Author: m.summary(msg.From), To: &to,
+			Content: msg.Content, Reason: msg.RemovalReason, CreatedAt: msg.CreatedAt}
+	}
+	p := item.Post
+	resp := ModQueueItemResponse{Type: "post", PostID: p.ID, Author: m.summary(p.Author), Title: p.Title,
+		Content: p.Content, Reason: p.RemovalReason, CreatedAt: p.CreatedAt}
+	if sr := m.engine.SubReddits[p.SubRedditID]; sr != nil {
+		resp.Subreddit = sr.Name
+	}
+	if c := item.Comment; c != nil {
+		resp.Type, resp.CommentID, resp.Author, resp.Title = "comment", c.ID, m.summary(c.Author), ""
+		resp.Content, resp.Reason, resp.CreatedAt = c.Content, c.RemovalReason, c.CreatedAt
+	}
+	return resp
+}
+
+func (m *mapper) repost(r engine.Repost) *RepostResponse {
+	return &RepostResponse{Post: m.post(r.Post), Match: r.Match, Similarity: r.Similarity, Flagged: r.Flagged}
+}
+
+// mapOne converts a single entity with fn under the engine lock.
+func mapOne[T, R any](ctx context.Context, e *engine.RedditEngine, item T, fn func(T) R) R {
+	var resp R
+	e.ViewContext(ctx, func() { resp = fn(item) })
+	return resp
+}
+
+// countComments counts comments and all of their replies.
+func countComments(comments []*engine.Comment) int {
+	n := len(comments)
+	for _, c := range comments {
+		n += countComments(c.Replies)
+	}
+	return n
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// TestResponseShapes checks that engine objects are mapped to their public
+// shapes: nested data only with ?expand=, the viewer's vote only for a
+// viewer, and removed content blanked.
+func TestResponseShapes(t *testing.T) {
+	f := newFixture(t)
+	ctx := context.Background()
+	f.e.JoinSubReddit(f.alice, f.news)
+	f.e.CastVote(f.alice, f.post, 1)
+	if _, err := f.e.CreateReply(ctx, f.bob, f.post, f.comment, "Welcome"); err != nil {
+		t.Fatal(err)
+	}
+	c := newAPIClient(t, newTestAPI(f.e))
+	fields := func(path string) map[string]any {
+		t.Helper()
+		var obj map[string]any
+		rec := c.do("GET", path, "", "")
+		if err := json.Unmarshal(rec.Body.Bytes(), &obj); err != nil {
+			t.Fatalf("GET %s: %v\n%s", path, err, rec.Body)
+		}
+		return obj
+	}
+	keys := func(obj map[string]any) []string {
+		var names []string
+		for name := range obj {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	if got, want := keys(fields("/api/v1/users/alice")), []string{"id", "karma", "username"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("user fields %v, want %v", got, want)
+	}
+	if got, want := keys(fields("/api/v1/r/news")), []string{"id", "memberCount", "moderators", "name", "postCount", "repostPolicy"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("subreddit fields %v, want %v", got, want)
+	}
+	var sr SubredditResponse
+	c.mustDo("GET", "/api/v1/r/news?expand=members,posts", "", "", &sr)
+	if sr.MemberCount != 2 || len(sr.Members) != 2 || len(sr.Posts) != 1 || sr.Posts[0].Title != "Welcome" {
+		t.Errorf("expanded subreddit: %+v", sr)
+	}
+	if len(sr.Moderators) != 1 || sr.Moderators[0] != (UserSummary{ID: f.bob.ID, Username: "bob"}) {
+		t.Errorf("moderators: %+v", sr.Moderators)
+	}
+
+	if _, ok := fields("/api/v1/posts/1")["viewerVote"]; ok {
+		t.Error("anonymous post response has a viewer vote")
+	}
+	var post PostResponse
+	c.mustDo("GET", "/api/v1/posts/1?viewer=alice&expand=comments,replies", "", "", &post)
+	if post.ViewerVote == nil || *post.ViewerVote != 1 || post.Score != 1 || post.Subreddit != "news" || post.Author.Username != "bob" {
+		t.Errorf("post for alice: %+v", post)
+	}
+	if post.CommentCount != 2 || len(post.Comments) != 1 || post.Comments[0].ReplyCount != 1 || len(post.Comments[0].Replies) != 1 {
+		t.Errorf("expanded comments: %+v", post.Comments)
+	}
+	var unexpanded PostResponse
+	c.mustDo("GET", "/api/v1/posts/1?expand=comments", "", "", &unexpanded)
+	if len(unexpanded.Comments) != 1 || unexpanded.Comments[0].Replies != nil {
+		t.Errorf("replies without expand=replies: %+v", unexpanded.Comments[0])
+	}
+
+	f.e.RemovePost(ctx, f.bob, f.post, "Off topic")
+	var removed PostResponse
+	c.mustDo("GET", "/api/v1/posts/1", "", "", &removed)
+	if !removed.Removed || removed.Title != "[removed]" || removed.Content != "" {
+		t.Errorf("removed post: %+v", removed)
+	}
+}
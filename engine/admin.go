@@ -0,0 +1,564 @@
+package engine
+
+import (
+	"context"
+	"reddit-clone/tracing"
+	"sort"
+	"time"
+)
+
+// Suspension stops a user from posting, commenting, voting, messaging and
+// joining subreddits anywhere on the site.
+type Suspension struct {
+	Reason string
+	// Until is when the suspension ends; zero means it is indefinite.
+	Until time.Time
+}
+
+// inForce reports whether the suspension applies at now.
+func (s *Suspension) inForce(now time.Time) bool {
+	return s != nil && (s.Until.IsZero() || now.Before(s.Until))
+}
+
+// Suspended reports whether the user is suspended at now.
+func (u *User) Suspended(now time.Time) bool {
+	return u.Suspension.inForce(now)
+}
+
+// checkNotSuspended returns ErrForbidden if user is suspended. The caller
+// holds e.mu.
+func (e *RedditEngine) checkNotSuspended(user *User) error {
+	if user.Suspended(e.now()) {
+		return suspendedError(user.Username, user.Suspension)
+	}
+	return nil
+}
+
+func suspendedError(username string, s *Suspension) error {
+	if !s.Until.IsZero() {
+		return errorf(ErrForbidden, "%s is suspended until %s", username, s.Until.UTC().Format(time.RFC3339))
+	}
+	return errorf(ErrForbidden, "%s is suspended", username)
+}
+
+// suspendedUser is a user's suspension as published for checks made
+// without e.mu.
+type suspendedUser struct {
+	username   string
+	suspension *Suspension
+}
+
+// checkNotSuspendedUnlocked is checkNotSuspended for callers that do not
+// hold e.mu. It reads the published copy of the suspensions, which is
+// replaced rather than changed, so it takes no lock.
+func (e *RedditEngine) checkNotSuspendedUnlocked(user *User) error {
+	suspended := e.suspended.Load()
+	if suspended == nil {
+		return nil
+	}
+	if s, ok := (*suspended)[user.ID]; ok && s.suspension.inForce(e.now()) {
+		return suspendedError(s.username, s.suspension)
+	}
+	return nil
+}
+
+// publishSuspensionLocked updates the published copy of the suspensions
+// after user's suspension or username changed. The caller holds e.mu.
+func (e *RedditEngine) publishSuspensionLocked(user *User) {
+	var current map[int]suspendedUser
+	if p := e.suspended.Load(); p != nil {
+		current = *p
+	}
+	s, ok := current[user.ID]
+	if !ok && user.Suspension == nil || ok && s.suspension == user.Suspension && s.username == user.Username {
+		return
+	}
+	next := make(map[int]suspendedUser, len(current)+1)
+	for id, s := range current {
+		next[id] = s
+	}
+	if user.Suspension == nil {
+		delete(next, user.ID)
+	} else {
+		next[user.ID] = suspendedUser{username: user.Username, suspension: user.Suspension}
+	}
+	e.suspended.Store(&next)
+}
+
+// publishSuspensionsLocked republishes every user's suspension, after users
+// were loaded in bulk. The caller holds e.mu.
+func (e *RedditEngine) publishSuspensionsLocked() {
+	next := make(map[int]suspendedUser)
+	for _, u := range e.Users {
+		if u.Suspension != nil {
+			next[u.ID] = suspendedUser{username: u.Username, suspension: u.Suspension}
+		}
+	}
+	e.suspended.Store(&next)
+}
+
+func requireAdmin(actor *User) error {
+	if !actor.IsAdmin() {
+		return errorf(ErrForbidden, "admin role required")
+	}
+	return nil
+}
+
+// GrowthPoint is one day of site activity.
+type GrowthPoint struct {
+	Day time.Time
+	// New counts what was created that day; Total counts everything
+	// created by the end of it.
+	New   Counts
+	Total Counts
+}
+
+// SiteStats are the current totals and their daily growth.
+type SiteStats struct {
+	Counts Counts
+	Growth []GrowthPoint
+}
+
+// SiteStats returns the entity totals and daily growth over the last days
+// days, oldest first, in UTC.
+func (e *RedditEngine) SiteStats(ctx context.Context, days int) SiteStats {
+	ctx, span := tracing.Start(ctx, "engine.SiteStats")
+	defer span.End()
+	e.lockContext(ctx)
+	defer e.mu.Unlock()
+
+	end := e.now().UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+	start := end.Add(-time.Duration(days) * 24 * time.Hour)
+	var before Counts
+	growth := make([]GrowthPoint, days)
+	for i := range growth {
+		growth[i].Day = start.Add(time.Duration(i) * 24 * time.Hour)
+	}
+	// add counts an entity created at t into the day it falls in.
+	add := func(t time.Time, field func(*Counts) *int) {
+		switch i := int(t.UTC().Sub(start) / (24 * time.Hour)); {
+		case t.Before(start):
+			*field(&before)++
+		case i < days:
+			*field(&growth[i].New)++
+		}
+	}
+	users := func(c *Counts) *int { return &c.Users }
+	subreddits := func(c *Counts) *int { return &c.SubReddits }
+	posts := func(c *Counts) *int { return &c.Posts }
+	comments := func(c *Counts) *int { return &c.Comments }
+	messages := func(c *Counts) *int { return &c.Messages }
+
+	stats := SiteStats{Counts: Counts{Users: len(e.Users), SubReddits: len(e.SubReddits), Posts: len(e.posts), Messages: len(e.Messages)}}
+	for _, u := range e.Users {
+		add(u.CreatedAt, users)
+	}
+	for _, sr := range e.SubReddits {
+		add(sr.CreatedAt, subreddits)
+	}
+	for _, p := range e.posts {
+		add(p.CreatedAt, posts)
+		walkComments(p.Comments, func(c *Comment) {
+			stats.Counts.Comments++
+			add(c.CreatedAt, comments)
+		})
+	}
+	for _, m := range e.Messages {
+		add(m.CreatedAt, messages)
+	}
+
+	total := before
+	for i := range growth {
+		n := growth[i].New
+		total.Users += n.Users
+		total.SubReddits += n.SubReddits
+		total.Posts += n.Posts
+		total.Comments += n.Comments
+		total.Messages += n.Messages
+		growth[i].Total = total
+	}
+	stats.Growth = growth
+	return stats
+}
+
+// walkComments calls fn for every comment and reply, depth first.
+func walkComments(comments []*Comment, fn func(*Comment)) {
+	for _, c := range comments {
+		fn(c)
+		walkComments(c.Replies, fn)
+	}
+}
+
+// findComment finds a comment or reply by ID.
+func findComment(comments []*Comment, id int) *Comment {
+	for _, c := range comments {
+		if c.ID == id {
+			return c
+		}
+		if found := findComment(c.Replies, id); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// LookupComment finds a comment on post by ID.
+func (e *RedditEngine) LookupComment(ctx context.Context, post *Post, id int) (*Comment, error) {
+	e.lockContext(ctx)
+	defer e.mu.Unlock()
+	if c := findComment(post.Comments, id); c != nil {
+		return c, nil
+	}
+	return nil, errorf(ErrNotFound, "post %d has no comment %d", post.ID, id)
+}
+
+// LookupMessage finds a message by ID.
+func (e *RedditEngine) LookupMessage(ctx context.Context, id int) (*Message, error) {
+	e.lockContext(ctx)
+	defer e.mu.Unlock()
+	if m, ok := e.Messages[id]; ok {
+		return m, nil
+	}
+	return nil, errorf(ErrNotFound, "message %d not found", id)
+}
+
+// CommentRef is a comment together with the post it is on.
+type CommentRef struct {
+	Post    *Post
+	Comment *Comment
+}
+
+// UserHistory is everything a user has contributed, newest first. Its
+// entities must be read inside View.
+type UserHistory struct {
+	Posts      []*Post
+	Comments   []CommentRef
+	Moderates  []*SubReddit
+	BannedFrom []*SubReddit
+	// Messages are the private messages the user has sent.
+	Messages []*Message
+}
+
+// UserHistory collects user's posts, comments and standing in subreddits.
+func (e *RedditEngine) UserHistory(ctx context.Context, user *User) UserHistory {
+	ctx, span := tracing.Start(ctx, "engine.UserHistory")
+	defer span.End()
+	e.lockContext(ctx)
+	defer e.mu.Unlock()
+	var h UserHistory
+	for _, p := range sortedByID(e.posts) {
+		if p.Author == user {
+			h.Posts = append(h.Posts, p)
+		}
+		walkComments(p.Comments, func(c *Comment) {
+			if c.Author == user {
+				h.Comments = append(h.Comments, CommentRef{Post: p, Comment: c})
+			}
+		})
+	}
+	sort.SliceStable(h.Posts, func(i, j int) bool { return h.Posts[i].CreatedAt.After(h.Posts[j].CreatedAt) })
+	sort.SliceStable(h.Comments, func(i, j int) bool {
+		return h.Comments[i].Comment.CreatedAt.After(h.Comments[j].Comment.CreatedAt)
+	})
+	for _, sr := range sortedByID(e.SubReddits) {
+		if _, ok := sr.Moderators[user.ID]; ok {
+			h.Moderates = append(h.Moderates, sr)
+		}
+		if _, ok := sr.Banned[user.ID]; ok {
+			h.BannedFrom = append(h.BannedFrom, sr)
+		}
+	}
+	for _, m := range sortedByID(e.Messages) {
+		if m.From == user {
+			h.Messages = append(h.Messages, m)
+		}
+	}
+	sort.SliceStable(h.Messages, func(i, j int) bool { return h.Messages[i].ID > h.Messages[j].ID })
+	return h
+}
+
+// RevokeAdmin takes the admin role away from user. Admins cannot revoke
+// their own role, so there is always someone left to grant it.
+func (e *RedditEngine) RevokeAdmin(ctx context.Context, actor, user *User) error {
+	ctx, span := tracing.Start(ctx, "engine.RevokeAdmin")
+	defer span.End()
+	e.lockContext(ctx)
+	defer e.mu.Unlock()
+	if err := requireAdmin(actor); err != nil {
+		return err
+	}
+	if actor == user {
+		return errorf(ErrConflict, "admins cannot revoke their own role")
+	}
+	if !user.IsAdmin() {
+		return errorf(ErrNotFound, "%s is not an admin", user.Username)
+	}
+	user.Role = RoleUser
+	now := e.now()
+	user.touch(now)
+	e.emit(ctx, Event{Type: EventRoleChanged, Time: now, UserID: user.ID})
+	e.audit(ctx, actor, AuditEntry{
+		Action: AuditAdminRevoke, TargetType: TargetUser, TargetID: user.ID, Target: user.Username,
+		Before: map[string]any{"role": RoleAdmin}, After: map[string]any{"role": roleName(RoleUser)},
+	})
+	return nil
+}
+
+// SuspendUser suspends user site-wide until the given time, or
+// indefinitely if until is zero. Suspending a suspended user replaces the
+// suspension.
+func (e *RedditEngine) SuspendUser(ctx context.Context, actor, user *User, reason string, until time.Time) error {
+	ctx, span := tracing.Start(ctx, "engine.SuspendUser")
+	defer span.End()
+	var v validator
+	v.text("reason", reason, true, MaxReasonLength)
+	if err := v.err(); err != nil {
+		return err
+	}
+	e.lockContext(ctx)
+	defer e.mu.Unlock()
+	if err := requireAdmin(actor); err != nil {
+		return err
+	}
+	if user.IsAdmin() {
+		return errorf(ErrConflict, "%s is an admin and cannot be suspended", user.Username)
+	}
+	now := e.now()
+	if !until.IsZero() && !until.After(now) {
+		return errorf(ErrInvalid, "suspension must end in the future")
+	}
+	before := suspensionValues(user, now)
+	user.Suspension = &Suspension{Reason: reason, Until: until.UTC()}
+	e.publishSuspensionLocked(user)
+	user.touch(now)
+	e.emit(ctx, Event{Type: EventUserSuspended, Time: now, UserID: user.ID})
+	e.audit(ctx, actor, AuditEntry{
+		Action: AuditUserSuspend, TargetType: TargetUser, TargetID: user.ID, Target: user.Username, Reason: reason,
+		Before: before, After: suspensionValues(user, now),
+	})
+	return nil
+}
+
+// UnsuspendUser lifts a suspension early.
+func (e *RedditEngine) UnsuspendUser(ctx context.Context, actor, user *User) error {
+	ctx, span := tracing.Start(ctx, "engine.UnsuspendUser")
+	defer span.End()
+	e.lockContext(ctx)
+	defer e.mu.Unlock()
+	if err := requireAdmin(actor); err != nil {
+		return err
+	}
+	now := e.now()
+	if !user.Suspended(now) {
+		return errorf(ErrNotFound, "%s is not suspended", user.Username)
+	}
+	before := suspensionValues(user, now)
+	user.Suspension = nil
+	e.publishSuspensionLocked(user)
+	user.touch(now)
+	e.emit(ctx, Event{Type: EventUserUnsuspended, Time: now, UserID: user.ID})
+	e.audit(ctx, actor, AuditEntry{
+		Action: AuditUserUnsuspend, TargetType: TargetUser, TargetID: user.ID, Target: user.Username,
+		Before: before, After: suspensionValues(user, now),
+	})
+	return nil
+}
+
+func suspensionValues(user *User, now time.Time) map[string]any {
+	if !user.Suspended(now) {
+		return map[string]any{"suspended": false}
+	}
+	values := map[string]any{"suspended": true, "reason": user.Suspension.Reason}
+	if until := user.Suspension.Until; !until.IsZero() {
+		values["until"] = until.Format(time.RFC3339)
+	}
+	return values
+}
+
+// RenameUser forces a username change, for example to remove an abusive
+// name. Content keeps its author, so it shows the new name.
+func (e *RedditEngine) RenameUser(ctx context.Context, actor, user *User, username string) error {
+	ctx, span := tracing.Start(ctx, "engine.RenameUser")
+	defer span.End()
+	var v validator
+	validateUsername(&v, username)
+	if err := v.err(); err != nil {
+		return err
+	}
+	e.lockContext(ctx)
+	defer e.mu.Unlock()
+	if err := requireAdmin(actor); err != nil {
+		return err
+	}
+	if existing, ok := e.usersByName[nameKey(username)]; ok && existing != user {
+		return errorf(ErrConflict, "username %q is already taken", username)
+	}
+	old := user.Username
+	delete(e.usersByName, nameKey(old))
+	user.Username = username
+	e.usersByName[nameKey(username)] = user
+	e.publishSuspensionLocked(user)
+	now := e.now()
+	user.touch(now)
+	e.emit(ctx, Event{Type: EventUserRenamed, Time: now, UserID: user.ID})
+	e.audit(ctx, actor, AuditEntry{
+		Action: AuditUserRename, TargetType: TargetUser, TargetID: user.ID, Target: username,
+		Before: map[string]any{"username": old}, After: map[string]any{"username": username},
+	})
+	return nil
+}
+
+// RenameSubReddit forces a subreddit name change.
+func (e *RedditEngine) RenameSubReddit(ctx context.Context, actor *User, sr *SubReddit, name string) error {
+	ctx, span := tracing.Start(ctx, "engine.RenameSubReddit")
+	defer span.End()
+	var v validator
+	validateSubRedditName(&v, name)
+	if err := v.err(); err != nil {
+		return err
+	}
+	e.lockContext(ctx)
+	defer e.mu.Unlock()
+	if err := requireAdmin(actor); err != nil {
+		return err
+	}
+	if existing, ok := e.subRedditsByName[nameKey(name)]; ok && existing != sr {
+		return errorf(ErrConflict, "subreddit %q already exists", name)
+	}
+	old := sr.Name
+	delete(e.subRedditsByName, nameKey(old))
+	sr.Name = name
+	e.subRedditsByName[nameKey(name)] = sr
+	now := e.now()
+	sr.touch(now)
+	// Posts show their subreddit's name.
+	for _, p := range sr.Posts {
+		p.touch(now)
+	}
+	e.emit(ctx, Event{Type: EventSubRedditRenamed, Time: now, SubRedditID: sr.ID})
+	e.audit(ctx, actor, AuditEntry{
+		Action: AuditSubRedditRename, TargetType: TargetSubReddit, TargetID: sr.ID, Target: name, SubRedditID: sr.ID,
+		Before: map[string]any{"name": old}, After: map[string]any{"name": name},
+	})
+	return nil
+}
+
+// RemoveComment hides a comment's content. Moderators of the post's
+// subreddit and admins may remove comments, including those held for
+// review.
+func (e *RedditEngine) RemoveComment(ctx context.Context, actor *User, post *Post, c *Comment, reason string) error {
+	ctx, span := tracing.Start(ctx, "engine.RemoveComment")
+	defer span.End()
+	var v validator
+	v.text("reason", reason, false, MaxReasonLength)
+	if err := v.err(); err != nil {
+		return err
+	}
+	e.lockContext(ctx)
+	defer e.mu.Unlock()
+	sr := e.SubReddits[post.SubRedditID]
+	if !canModerate(actor, sr) {
+		return errorf(ErrForbidden, "only moderators of r/%s can remove comments", sr.Name)
+	}
+	if c.Removed && !c.Held {
+		return errorf(ErrConflict, "comment %d is already removed", c.ID)
+	}
+	before := map[string]any{"removed": false}
+	if c.Held {
+		before = removedValues(c.RemovalReason, true)
+	}
+	c.Removed, c.RemovalReason, c.Held = true, reason, false
+	now := e.now()
+	post.touch(now)
+	sr.touch(now)
+	e.emit(ctx, Event{Type: EventCommentRemoved, Time: now, SubRedditID: sr.ID, PostID: post.ID, CommentID: c.ID})
+	e.audit(ctx, actor, AuditEntry{
+		Action: AuditCommentRemove, TargetType: TargetComment, TargetID: c.ID, PostID: post.ID, SubRedditID: sr.ID, Reason: reason,
+		Before: before, After: map[string]any{"removed": true},
+	})
+	return nil
+}
+
+// RestoreComment reverses RemoveComment, and approves a comment held for
+// review.
+func (e *RedditEngine) RestoreComment(ctx context.Context, actor *User, post *Post, c *Comment) error {
+	ctx, span := tracing.Start(ctx, "engine.RestoreComment")
+	defer span.End()
+	e.lockContext(ctx)
+	defer e.mu.Unlock()
+	sr := e.SubReddits[post.SubRedditID]
+	if !canModerate(actor, sr) {
+		return errorf(ErrForbidden, "only moderators of r/%s can restore comments", sr.Name)
+	}
+	if !c.Removed {
+		return errorf(ErrNotFound, "comment %d is not removed", c.ID)
+	}
+	before := removedValues(c.RemovalReason, c.Held)
+	c.Removed, c.RemovalReason, c.Held = false, "", false
+	now := e.now()
+	post.touch(now)
+	sr.touch(now)
+	e.emit(ctx, Event{Type: EventCommentRestored, Time: now, SubRedditID: sr.ID, PostID: post.ID, CommentID: c.ID})
+	e.audit(ctx, actor, AuditEntry{
+		Action: AuditCommentRestore, TargetType: TargetComment, TargetID: c.ID, PostID: post.ID, SubRedditID: sr.ID,
+		Before: before, After: map[string]any{"removed": false},
+	})
+	return nil
+}
+
+// RemoveMessage hides a private message's content. Only admins can see
+// and act on messages between other users. Removing a message held for
+// review confirms that it stays removed.
+func (e *RedditEngine) RemoveMessage(ctx context.Context, actor *User, m *Message, reason string) error {
+	ctx, span := tracing.Start(ctx, "engine.RemoveMessage")
+	defer span.End()
+	var v validator
+	v.text("reason", reason, false, MaxReasonLength)
+	if err := v.err(); err != nil {
+		return err
+	}
+	e.lockContext(ctx)
+	defer e.mu.Unlock()
+	if err := requireAdmin(actor); err != nil {
+		return err
+	}
+	if m.Removed && !m.Held {
+		return errorf(ErrConflict, "message %d is already removed", m.ID)
+	}
+	before := map[string]any{"removed": false}
+	if m.Held {
+		before = removedValues(m.RemovalReason, true)
+	}
+	m.Removed, m.RemovalReason, m.Held = true, reason, false
+	now := e.now()
+	e.emit(ctx, Event{Type: EventMessageRemoved, Time: now, UserID: m.From.ID, MessageID: m.ID})
+	e.audit(ctx, actor, AuditEntry{
+		Action: AuditMessageRemove, TargetType: TargetMessage, TargetID: m.ID, Target: m.From.Username, Reason: reason,
+		Before: before, After: map[string]any{"removed": true},
+	})
+	return nil
+}
+
+// RestoreMessage reverses RemoveMessage, and delivers a message held for
+// review.
+func (e *RedditEngine) RestoreMessage(ctx context.Context, actor *User, m *Message) error {
+	ctx, span := tracing.Start(ctx, "engine.RestoreMessage")
+	defer span.End()
+	e.lockContext(ctx)
+	defer e.mu.Unlock()
+	if err := requireAdmin(actor); err != nil {
+		return err
+	}
+	if !m.Removed {
+		return errorf(ErrNotFound, "message %d is not removed", m.ID)
+	}
+	before := removedValues(m.RemovalReason, m.Held)
+	m.Removed, m.RemovalReason, m.Held = false, "", false
+	now := e.now()
+	e.emit(ctx, Event{Type: EventMessageRestored, Time: now, UserID: m.From.ID, MessageID: m.ID})
+	e.audit(ctx, actor, AuditEntry{
+		Action: AuditMessageRestore, TargetType: TargetMessage, TargetID: m.ID, Target: m.From.Username,
+		Before: before, After: map[string]any{"removed": false},
+	})
+	return nil
+}
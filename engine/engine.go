@@ -1,66 +1,309 @@
 package engine
-import "fmt"
+import (
+    "context"
+    "math"
+    "reddit-clone/logging"
+    "reddit-clone/tracing"
+    "sort"
+    "time"
+)
 
 func NewRedditEngine() *RedditEngine {
     return &RedditEngine{
         Users:      make(map[int]*User),
         SubReddits: make(map[int]*SubReddit),
         Messages:   make(map[int]*Message),
+        posts:      make(map[int]*Post),
+        usersByName:      make(map[string]*User),
+        subRedditsByName: make(map[string]*SubReddit),
+        now:              time.Now,
+        logger:           logging.Discard(),
+        reposts:          newRepostIndex(),
     }
 }
 
-func (e *RedditEngine) RegisterAccount(username string) *User {
-    e.mu.Lock()
+// RegisterAccount creates a user. Usernames are unique ignoring case.
+func (e *RedditEngine) RegisterAccount(username string) (*User, error) {
+    return e.RegisterAccountContext(context.Background(), username)
+}
+
+// RegisterAccountContext is RegisterAccount on behalf of the request in ctx.
+func (e *RedditEngine) RegisterAccountContext(ctx context.Context, username string) (*User, error) {
+    ctx, span := tracing.Start(ctx, "engine.RegisterAccount")
+    defer span.End()
+    var v validator
+    validateUsername(&v, username)
+    if err := v.err(); err != nil {
+        return nil, err
+    }
+    e.lockContext(ctx)
     defer e.mu.Unlock()
+    if _, exists := e.usersByName[nameKey(username)]; exists {
+        return nil, errorf(ErrConflict, "username %q is already taken", username)
+    }
+    now := e.now()
     user := &User{
-        ID:       len(e.Users) + 1,
-        Username: username,
+        ID:        e.localID(len(e.Users) + 1),
+        Username:  username,
+        CreatedAt: now,
+        UpdatedAt: now,
+        Version:   1,
     }
     e.Users[user.ID] = user
-    return user
+    e.usersByName[nameKey(username)] = user
+    e.emit(ctx, Event{Type: EventUserCreated, Time: now, UserID: user.ID})
+    e.audit(ctx, user, AuditEntry{Action: AuditAccountCreate, TargetType: TargetUser, TargetID: user.ID, Target: user.Username})
+    return user, nil
+}
+
+// CreateSubReddit creates a subreddit. Names are unique ignoring case.
+func (e *RedditEngine) CreateSubReddit(name string) (*SubReddit, error) {
+    return e.CreateSubRedditContext(context.Background(), name)
+}
+
+// CreateSubRedditContext is CreateSubReddit on behalf of the request in ctx.
+func (e *RedditEngine) CreateSubRedditContext(ctx context.Context, name string) (*SubReddit, error) {
+    ctx, span := tracing.Start(ctx, "engine.CreateSubReddit")
+    defer span.End()
+    var v validator
+    validateSubRedditName(&v, name)
+    if err := v.err(); err != nil {
+        return nil, err
+    }
+    e.lockContext(ctx)
+    defer e.mu.Unlock()
+    return e.createSubRedditLocked(ctx, name)
 }
 
-func (e *RedditEngine) CreateSubReddit(name string) *SubReddit {
-    e.mu.Lock()
+// CreateModeratedSubReddit creates the subreddit with creator as its first
+// moderator. Both happen under one lock, so no one sees the subreddit
+// without its moderator.
+func (e *RedditEngine) CreateModeratedSubReddit(ctx context.Context, creator *User, name string) (*SubReddit, error) {
+    ctx, span := tracing.Start(ctx, "engine.CreateSubReddit")
+    defer span.End()
+    var v validator
+    validateSubRedditName(&v, name)
+    if err := v.err(); err != nil {
+        return nil, err
+    }
+    e.lockContext(ctx)
     defer e.mu.Unlock()
+    sr, err := e.createSubRedditLocked(ctx, name)
+    if err != nil {
+        return nil, err
+    }
+    if err := e.addModeratorLocked(ctx, creator, creator, sr); err != nil {
+        return nil, err
+    }
+    return sr, nil
+}
+
+// createSubRedditLocked creates the subreddit with a validated name. The
+// caller holds e.mu.
+func (e *RedditEngine) createSubRedditLocked(ctx context.Context, name string) (*SubReddit, error) {
+    if _, exists := e.subRedditsByName[nameKey(name)]; exists {
+        return nil, errorf(ErrConflict, "subreddit %q already exists", name)
+    }
+    now := e.now()
     sr := &SubReddit{
-        ID:      len(e.SubReddits) + 1,
-        Name:    name,
-        Members: make(map[int]*User),
+        ID:        e.localID(len(e.SubReddits) + 1),
+        Name:      name,
+        Members:   make(map[int]*User),
+        Moderators: make(map[int]*User),
+        Banned:    make(map[int]string),
+        CreatedAt: now,
+        UpdatedAt: now,
+        Version:   1,
     }
     e.SubReddits[sr.ID] = sr
-    return sr
+    e.subRedditsByName[nameKey(name)] = sr
+    e.emit(ctx, Event{Type: EventSubRedditCreated, Time: now, SubRedditID: sr.ID})
+    return sr, nil
+}
+
+func (e *RedditEngine) CreatePost(user *User, sr *SubReddit, title, content string) (*Post, error) {
+    return e.CreatePostContext(context.Background(), user, sr, title, content)
 }
 
-func (e *RedditEngine) CreatePost(user *User, sr *SubReddit, title, content string) *Post {
-    e.mu.Lock()
+// CreatePostContext is CreatePost on behalf of the request in ctx.
+func (e *RedditEngine) CreatePostContext(ctx context.Context, user *User, sr *SubReddit, title, content string) (*Post, error) {
+    ctx, span := tracing.Start(ctx, "engine.CreatePost")
+    defer span.End()
+    var v validator
+    v.text("title", title, true, MaxTitleLength)
+    v.text("content", content, false, MaxPostLength)
+    if err := v.err(); err != nil {
+        return nil, err
+    }
+    fp := fingerprintPost(title, content)
+    e.lockContext(ctx)
     defer e.mu.Unlock()
+    if err := e.checkNotSuspended(user); err != nil {
+        return nil, err
+    }
+    if err := checkNotBanned(user, sr); err != nil {
+        return nil, err
+    }
+    var s screening
+    e.screenLocked(&s, sr, "title", &title)
+    e.screenLocked(&s, sr, "content", &content)
+    if err := s.v.err(); err != nil {
+        return nil, err
+    }
+    now := e.now()
+    if sr.Reposts.action() == RepostBlock {
+        if reposts := e.repostsLocked(fp, sr, now, math.MaxInt, true); len(reposts) > 0 {
+            return nil, errorf(ErrConflict, "r/%s does not allow reposts, and this repeats post %d", sr.Name, reposts[0].Post.ID)
+        }
+    }
+    // Post IDs are global so a post can be addressed without its subreddit.
     post := &Post{
-        ID:      len(sr.Posts) + 1,
-        Title:   title,
-        Content: content,
-        Author:  user,
+        ID:          e.newPostIDLocked(),
+        SubRedditID: sr.ID,
+        Title:       title,
+        Content:     content,
+        Author:      user,
+        Voters:      make(map[int]int),
+        CreatedAt:   now,
+        UpdatedAt:   now,
+        Version:     1,
+    }
+    if s.hold != "" {
+        post.Removed, post.RemovalReason, post.Held = true, s.hold, true
     }
     sr.Posts = append(sr.Posts, post)
-    return post
+    e.posts[post.ID] = post
+    e.reposts.add(post, &fp)
+    sr.touch(now)
+    e.emit(ctx, Event{Type: EventPostCreated, Time: now, UserID: user.ID, SubRedditID: sr.ID, PostID: post.ID})
+    return post, nil
 }
 
 
 
-func (e *RedditEngine) CreateComment(user *User, post *Post, content string) *Comment {
-    e.mu.Lock()
+func (e *RedditEngine) CreateComment(user *User, post *Post, content string) (*Comment, error) {
+    return e.CreateCommentContext(context.Background(), user, post, content)
+}
+
+// CreateCommentContext is CreateComment on behalf of the request in ctx.
+func (e *RedditEngine) CreateCommentContext(ctx context.Context, user *User, post *Post, content string) (*Comment, error) {
+    ctx, span := tracing.Start(ctx, "engine.CreateComment")
+    defer span.End()
+    var v validator
+    v.text("content", content, true, MaxCommentLength)
+    if err := v.err(); err != nil {
+        return nil, err
+    }
+    e.lockContext(ctx)
     defer e.mu.Unlock()
-    comment := &Comment{
-        ID:      len(post.Comments) + 1,
-        Content: content,
-        Author:  user,
+    if err := e.checkNotSuspended(user); err != nil {
+        return nil, err
+    }
+    sr := e.SubReddits[post.SubRedditID]
+    if err := checkNotBanned(user, sr); err != nil {
+        return nil, err
+    }
+    comment, err := e.newCommentLocked(sr, post, user, content)
+    if err != nil {
+        return nil, err
     }
     post.Comments = append(post.Comments, comment)
-    return comment
+    e.commentedLocked(ctx, post, comment)
+    return comment, nil
+}
+
+// CreateReply adds a reply to parent, a comment or reply on post.
+func (e *RedditEngine) CreateReply(ctx context.Context, user *User, post *Post, parent *Comment, content string) (*Comment, error) {
+    ctx, span := tracing.Start(ctx, "engine.CreateReply")
+    defer span.End()
+    var v validator
+    v.text("content", content, true, MaxCommentLength)
+    if err := v.err(); err != nil {
+        return nil, err
+    }
+    e.lockContext(ctx)
+    defer e.mu.Unlock()
+    if err := e.checkNotSuspended(user); err != nil {
+        return nil, err
+    }
+    sr := e.SubReddits[post.SubRedditID]
+    if err := checkNotBanned(user, sr); err != nil {
+        return nil, err
+    }
+    if parent.Removed {
+        return nil, errorf(ErrConflict, "cannot reply to a removed comment")
+    }
+    comment, err := e.newCommentLocked(sr, post, user, content)
+    if err != nil {
+        return nil, err
+    }
+    parent.Replies = append(parent.Replies, comment)
+    e.commentedLocked(ctx, post, comment)
+    return comment, nil
+}
+
+// newCommentLocked returns a new comment by user for post in sr, after
+// screening it with the word filters. Comment IDs are numbered per post
+// across all levels of replies. The caller holds e.mu.
+func (e *RedditEngine) newCommentLocked(sr *SubReddit, post *Post, user *User, content string) (*Comment, error) {
+    var s screening
+    e.screenLocked(&s, sr, "content", &content)
+    if err := s.v.err(); err != nil {
+        return nil, err
+    }
+    comment := &Comment{
+        ID:        countComments(post.Comments) + 1,
+        Content:   content,
+        Author:    user,
+        CreatedAt: e.now(),
+    }
+    if s.hold != "" {
+        comment.Removed, comment.RemovalReason, comment.Held = true, s.hold, true
+    }
+    return comment, nil
+}
+
+// commentedLocked bumps the versions a new comment on post affects and
+// emits the event. The caller holds e.mu.
+func (e *RedditEngine) commentedLocked(ctx context.Context, post *Post, comment *Comment) {
+    post.touch(comment.CreatedAt)
+    e.SubReddits[post.SubRedditID].touch(comment.CreatedAt)
+    e.emit(ctx, Event{Type: EventCommentCreated, Time: comment.CreatedAt, UserID: comment.Author.ID, SubRedditID: post.SubRedditID, PostID: post.ID, CommentID: comment.ID})
+}
+
+// GetComments returns a copy of the post's top-level comments.
+func (e *RedditEngine) GetComments(post *Post) []*Comment {
+    return e.GetCommentsContext(context.Background(), post)
+}
+
+// GetCommentsContext is GetComments on behalf of the request in ctx.
+func (e *RedditEngine) GetCommentsContext(ctx context.Context, post *Post) []*Comment {
+    ctx, span := tracing.Start(ctx, "engine.GetComments")
+    defer span.End()
+    e.lockContext(ctx)
+    defer e.mu.Unlock()
+    comments := make([]*Comment, len(post.Comments))
+    copy(comments, post.Comments)
+    return comments
 }
 
 func (e *RedditEngine) Vote(post *Post, upvote bool) {
-    e.mu.Lock()
+    e.VoteContext(context.Background(), post, upvote)
+}
+
+// VoteContext is Vote on behalf of the request in ctx.
+func (e *RedditEngine) VoteContext(ctx context.Context, post *Post, upvote bool) {
+    ctx, span := tracing.Start(ctx, "engine.Vote")
+    defer span.End()
+    if b := e.votes.Load(); b != nil {
+        delta := -1
+        if upvote {
+            delta = 1
+        }
+        b.castAnonymous(post.ID, delta)
+        return
+    }
+    e.lockContext(ctx)
     defer e.mu.Unlock()
     if upvote {
         post.Votes++
@@ -69,113 +312,352 @@ func (e *RedditEngine) Vote(post *Post, upvote bool) {
         post.Votes--
         post.Author.Karma--
     }
+    e.votedLocked(ctx, post, 0)
+}
+
+// votedLocked bumps the versions a vote on post affects and emits the event.
+// voterID is zero for anonymous votes and batches of votes; voters are the
+// users whose votes changed. The caller holds e.mu.
+func (e *RedditEngine) votedLocked(ctx context.Context, post *Post, voterID int, voters ...int) {
+    now := e.now()
+    post.touch(now)
+    post.Author.touch(now)
+    e.SubReddits[post.SubRedditID].touch(now)
+    e.emitVotes(ctx, Event{Type: EventVoteCast, Time: now, UserID: voterID, SubRedditID: post.SubRedditID, PostID: post.ID}, voters)
+}
+
+// CastVote records user's vote on post, replacing any earlier vote by the
+// same user. direction is 1 for an upvote, -1 for a downvote and 0 to clear.
+// When votes are buffered the vote is only recorded once the voter has been
+// checked; see BufferVotes.
+func (e *RedditEngine) CastVote(user *User, post *Post, direction int) error {
+    return e.CastVoteContext(context.Background(), user, post, direction)
+}
+
+// CastVoteContext is CastVote on behalf of the request in ctx.
+func (e *RedditEngine) CastVoteContext(ctx context.Context, user *User, post *Post, direction int) error {
+    ctx, span := tracing.Start(ctx, "engine.CastVote")
+    defer span.End()
+    if direction < -1 || direction > 1 {
+        return errorf(ErrInvalid, "vote direction must be -1, 0 or 1")
+    }
+    if b := e.votes.Load(); b != nil {
+        // The vote is checked again when it is applied, so a user
+        // suspended in between loses it then.
+        if err := e.checkNotSuspendedUnlocked(user); err != nil {
+            return err
+        }
+        e.recordVote(ctx, user, post, direction)
+        b.cast(post.ID, user.ID, direction)
+        return nil
+    }
+    e.lockContext(ctx)
+    defer e.mu.Unlock()
+    if err := e.checkNotSuspended(user); err != nil {
+        return err
+    }
+    e.recordVote(ctx, user, post, direction)
+    if !setVote(post, user.ID, direction) {
+        return nil
+    }
+    e.votedLocked(ctx, post, user.ID, user.ID)
+    return nil
 }
 
+// setVote records userID's vote on post and updates the score and the
+// author's karma, unless the user's votes on post are discounted. It reports
+// whether the vote changed. The caller holds e.mu.
+func setVote(post *Post, userID, direction int) bool {
+    previous := post.Voters[userID]
+    if direction == previous {
+        return false
+    }
+    if direction == 0 {
+        delete(post.Voters, userID)
+    } else {
+        post.Voters[userID] = direction
+    }
+    if !post.Discounted[userID] {
+        post.Votes += direction - previous
+        post.Author.Karma += direction - previous
+    }
+    return true
+}
+
+// View runs fn while holding the engine lock, so it can read several
+// entities' fields consistently. fn must not call other engine methods.
+func (e *RedditEngine) View(fn func()) {
+    e.ViewContext(context.Background(), fn)
+}
+
+// ViewContext is View on behalf of the request in ctx.
+func (e *RedditEngine) ViewContext(ctx context.Context, fn func()) {
+    ctx, span := tracing.Start(ctx, "engine.View")
+    defer span.End()
+    e.lockContext(ctx)
+    defer e.mu.Unlock()
+    fn()
+}
+
+// GetFeed returns a copy of the subreddit's posts in creation order.
 func (e *RedditEngine) GetFeed(sr *SubReddit) []*Post {
-    e.mu.Lock()
+    return e.GetFeedContext(context.Background(), sr)
+}
+
+// GetFeedContext is GetFeed on behalf of the request in ctx.
+func (e *RedditEngine) GetFeedContext(ctx context.Context, sr *SubReddit) []*Post {
+    ctx, span := tracing.Start(ctx, "engine.GetFeed")
+    defer span.End()
+    e.lockContext(ctx)
     defer e.mu.Unlock()
-    return sr.Posts
+    posts := make([]*Post, len(sr.Posts))
+    copy(posts, sr.Posts)
+    return posts
 }
 
-func (e *RedditEngine) SendMessage(from, to *User, content string) *Message {
-    e.mu.Lock()
+func (e *RedditEngine) SendMessage(from, to *User, content string) (*Message, error) {
+    return e.SendMessageContext(context.Background(), from, to, content)
+}
+
+// SendMessageContext is SendMessage on behalf of the request in ctx.
+func (e *RedditEngine) SendMessageContext(ctx context.Context, from, to *User, content string) (*Message, error) {
+    ctx, span := tracing.Start(ctx, "engine.SendMessage")
+    defer span.End()
+    var v validator
+    v.text("content", content, true, MaxMessageLength)
+    if err := v.err(); err != nil {
+        return nil, err
+    }
+    e.lockContext(ctx)
     defer e.mu.Unlock()
+    if err := e.checkNotSuspended(from); err != nil {
+        return nil, err
+    }
+    var s screening
+    e.screenLocked(&s, nil, "content", &content)
+    if err := s.v.err(); err != nil {
+        return nil, err
+    }
+    now := e.now()
     msg := &Message{
-        ID:      len(e.Messages) + 1,
-        From:    from,
-        To:      to,
-        Content: content,
+        ID:        e.localID(len(e.Messages) + 1),
+        From:      from,
+        To:        to,
+        Content:   content,
+        CreatedAt: now,
+    }
+    if s.hold != "" {
+        msg.Removed, msg.RemovalReason, msg.Held = true, s.hold, true
     }
     e.Messages[msg.ID] = msg
-    return msg
+    e.emit(ctx, Event{Type: EventMessageSent, Time: now, UserID: from.ID, MessageID: msg.ID})
+    return msg, nil
 }
 
 func (e *RedditEngine) GetMessages(user *User) []*Message {
-    e.mu.Lock()
+    return e.GetMessagesContext(context.Background(), user)
+}
+
+// GetMessagesContext is GetMessages on behalf of the request in ctx.
+func (e *RedditEngine) GetMessagesContext(ctx context.Context, user *User) []*Message {
+    ctx, span := tracing.Start(ctx, "engine.GetMessages")
+    defer span.End()
+    e.lockContext(ctx)
     defer e.mu.Unlock()
     var messages []*Message
     for _, msg := range e.Messages {
-        if msg.To == user {
+        // Held messages reach their recipient once an admin restores them.
+        if msg.To == user && !msg.Held {
             messages = append(messages, msg)
         }
     }
+    sort.Slice(messages, func(i, j int) bool { return messages[i].ID < messages[j].ID })
     return messages
 }
 
 func (e *RedditEngine) GetSubRedditByName(name string) *SubReddit {
-	e.mu.Lock()
+    return e.GetSubRedditByNameContext(context.Background(), name)
+}
+
+// GetSubRedditByNameContext is GetSubRedditByName on behalf of the request in ctx.
+func (e *RedditEngine) GetSubRedditByNameContext(ctx context.Context, name string) *SubReddit {
+	ctx, span := tracing.Start(ctx, "engine.GetSubRedditByName")
+	defer span.End()
+	e.lockContext(ctx)
 	defer e.mu.Unlock()
-	for _, sr := range e.SubReddits {
-		if sr.Name == name {
-			return sr
-		}
-	}
-	return nil
+	return e.subRedditsByName[nameKey(name)]
 }
 
 func (e *RedditEngine) GetUserByUsername(username string) *User {
-	e.mu.Lock()
-	defer e.mu.Unlock()
-	for _, user := range e.Users {
-		if user.Username == username {
-			return user
-		}
-	}
-	return nil
+    return e.GetUserByUsernameContext(context.Background(), username)
+}
+
+// GetUserByUsernameContext is GetUserByUsername on behalf of the request in ctx.
+func (e *RedditEngine) GetUserByUsernameContext(ctx context.Context, username string) *User {
+	user, _ := e.userByName(ctx, username)
+	return user
 }
 
 func (e *RedditEngine) GetPostByID(id int) *Post {
-    e.mu.Lock()
+    return e.GetPostByIDContext(context.Background(), id)
+}
+
+// GetPostByIDContext is GetPostByID on behalf of the request in ctx.
+func (e *RedditEngine) GetPostByIDContext(ctx context.Context, id int) *Post {
+    ctx, span := tracing.Start(ctx, "engine.GetPostByID")
+    defer span.End()
+    e.lockContext(ctx)
+    defer e.mu.Unlock()
+    return e.posts[id]
+}
+
+func (e *RedditEngine) GetAllPosts() []*Post {
+    return e.GetAllPostsContext(context.Background())
+}
+
+// GetAllPostsContext is GetAllPosts on behalf of the request in ctx.
+func (e *RedditEngine) GetAllPostsContext(ctx context.Context) []*Post {
+    ctx, span := tracing.Start(ctx, "engine.GetAllPosts")
+    defer span.End()
+    e.lockContext(ctx)
     defer e.mu.Unlock()
-    for _, sr := range e.SubReddits {
-        for _, post := range sr.Posts {
-            if post.ID == id {
-                return post
-            }
+    return sortedByID(e.posts)
+}
+
+// GetAllUsers returns every registered user ordered by ID. A partition of
+// a sharded site leaves out the users it resolved from other partitions.
+func (e *RedditEngine) GetAllUsers() []*User {
+    return e.GetAllUsersContext(context.Background())
+}
+
+// GetAllUsersContext is GetAllUsers on behalf of the request in ctx.
+func (e *RedditEngine) GetAllUsersContext(ctx context.Context) []*User {
+    ctx, span := tracing.Start(ctx, "engine.GetAllUsers")
+    defer span.End()
+    e.lockContext(ctx)
+    defer e.mu.Unlock()
+    users := make([]*User, 0, len(e.Users))
+    for _, user := range sortedByID(e.Users) {
+        if e.isHomeLocked(user) {
+            users = append(users, user)
         }
     }
-    return nil
+    return users
 }
 
-func (e *RedditEngine) GetAllPosts() []*Post {
-    e.mu.Lock()
+// GetAllSubReddits returns every subreddit ordered by ID.
+func (e *RedditEngine) GetAllSubReddits() []*SubReddit {
+    return e.GetAllSubRedditsContext(context.Background())
+}
+
+// GetAllSubRedditsContext is GetAllSubReddits on behalf of the request in ctx.
+func (e *RedditEngine) GetAllSubRedditsContext(ctx context.Context) []*SubReddit {
+    ctx, span := tracing.Start(ctx, "engine.GetAllSubReddits")
+    defer span.End()
+    e.lockContext(ctx)
     defer e.mu.Unlock()
-    
-    allPosts := make([]*Post, 0)
-    for _, subreddit := range e.SubReddits {
-        allPosts = append(allPosts, subreddit.Posts...)
+    return sortedByID(e.SubReddits)
+}
+
+// LookupUser is GetUserByUsername for callers that want an ErrNotFound error.
+func (e *RedditEngine) LookupUser(username string) (*User, error) {
+    return e.LookupUserContext(context.Background(), username)
+}
+
+// LookupUserContext is LookupUser on behalf of the request in ctx.
+func (e *RedditEngine) LookupUserContext(ctx context.Context, username string) (*User, error) {
+    user, err := e.userByName(ctx, username)
+    if err != nil {
+        return nil, err
+    }
+    if user != nil {
+        return user, nil
+    }
+    return nil, errorf(ErrNotFound, "user %q not found", username)
+}
+
+// LookupSubReddit is GetSubRedditByName with an ErrNotFound error.
+func (e *RedditEngine) LookupSubReddit(name string) (*SubReddit, error) {
+    return e.LookupSubRedditContext(context.Background(), name)
+}
+
+// LookupSubRedditContext is LookupSubReddit on behalf of the request in ctx.
+func (e *RedditEngine) LookupSubRedditContext(ctx context.Context, name string) (*SubReddit, error) {
+    if sr := e.GetSubRedditByNameContext(ctx, name); sr != nil {
+        return sr, nil
     }
-    
-    return allPosts
+    return nil, errorf(ErrNotFound, "subreddit %q not found", name)
+}
+
+// LookupPost is GetPostByID with an ErrNotFound error.
+func (e *RedditEngine) LookupPost(id int) (*Post, error) {
+    return e.LookupPostContext(context.Background(), id)
+}
+
+// LookupPostContext is LookupPost on behalf of the request in ctx.
+func (e *RedditEngine) LookupPostContext(ctx context.Context, id int) (*Post, error) {
+    if post := e.GetPostByIDContext(ctx, id); post != nil {
+        return post, nil
+    }
+    return nil, errorf(ErrNotFound, "post %d not found", id)
 }
 
 func (e *RedditEngine) UserExists(username string) bool {
-    e.mu.Lock()
+    return e.UserExistsContext(context.Background(), username)
+}
+
+// UserExistsContext is UserExists on behalf of the request in ctx.
+func (e *RedditEngine) UserExistsContext(ctx context.Context, username string) bool {
+    ctx, span := tracing.Start(ctx, "engine.UserExists")
+    defer span.End()
+    e.lockContext(ctx)
     defer e.mu.Unlock()
-    for _, user := range e.Users {
-        if user.Username == username {
-            return true
-        }
-    }
-    return false
+    _, exists := e.usersByName[nameKey(username)]
+    return exists
 }
 
 func (e *RedditEngine) JoinSubReddit(user *User, sr *SubReddit) error {
-    e.mu.Lock()
+    return e.JoinSubRedditContext(context.Background(), user, sr)
+}
+
+// JoinSubRedditContext is JoinSubReddit on behalf of the request in ctx.
+func (e *RedditEngine) JoinSubRedditContext(ctx context.Context, user *User, sr *SubReddit) error {
+    ctx, span := tracing.Start(ctx, "engine.JoinSubReddit")
+    defer span.End()
+    e.lockContext(ctx)
     defer e.mu.Unlock()
+    if err := e.checkNotSuspended(user); err != nil {
+        return err
+    }
+    if err := checkNotBanned(user, sr); err != nil {
+        return err
+    }
     if _, exists := sr.Members[user.ID]; exists {
-        return fmt.Errorf("user already a member of this subreddit")
+        return errorf(ErrConflict, "user already a member of this subreddit")
     }
     sr.Members[user.ID] = user
+    now := e.now()
+    sr.touch(now)
+    e.emit(ctx, Event{Type: EventMemberJoined, Time: now, UserID: user.ID, SubRedditID: sr.ID})
     return nil
 }
 
 func (e *RedditEngine) LeaveSubReddit(user *User, sr *SubReddit) error {
-    e.mu.Lock()
+    return e.LeaveSubRedditContext(context.Background(), user, sr)
+}
+
+// LeaveSubRedditContext is LeaveSubReddit on behalf of the request in ctx.
+func (e *RedditEngine) LeaveSubRedditContext(ctx context.Context, user *User, sr *SubReddit) error {
+    ctx, span := tracing.Start(ctx, "engine.LeaveSubReddit")
+    defer span.End()
+    e.lockContext(ctx)
     defer e.mu.Unlock()
     if _, exists := sr.Members[user.ID]; !exists {
-        return fmt.Errorf("user is not a member of this subreddit")
+        return errorf(ErrNotFound, "user is not a member of this subreddit")
     }
     delete(sr.Members, user.ID)
+    now := e.now()
+    sr.touch(now)
+    e.emit(ctx, Event{Type: EventMemberLeft, Time: now, UserID: user.ID, SubRedditID: sr.ID})
     return nil
 }
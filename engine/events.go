@@ -0,0 +1,133 @@
+package engine
+
+import (
+	"context"
+	"log/slog"
+	"reddit-clone/logging"
+	"time"
+)
+
+type EventType string
+
+const (
+	EventUserCreated         EventType = "user_created"
+	EventSubRedditCreated    EventType = "subreddit_created"
+	EventPostCreated         EventType = "post_created"
+	EventCommentCreated      EventType = "comment_created"
+	EventVoteCast            EventType = "vote_cast"
+	EventMessageSent         EventType = "message_sent"
+	EventMemberJoined        EventType = "member_joined"
+	EventMemberLeft          EventType = "member_left"
+	EventRoleChanged         EventType = "role_changed"
+	EventModeratorAdded      EventType = "moderator_added"
+	EventModeratorRemoved    EventType = "moderator_removed"
+	EventUserBanned          EventType = "user_banned"
+	EventUserUnbanned        EventType = "user_unbanned"
+	EventPostRemoved         EventType = "post_removed"
+	EventPostRestored        EventType = "post_restored"
+	EventCommentRemoved      EventType = "comment_removed"
+	EventCommentRestored     EventType = "comment_restored"
+	EventMessageRemoved      EventType = "message_removed"
+	EventMessageRestored     EventType = "message_restored"
+	EventUserSuspended       EventType = "user_suspended"
+	EventUserUnsuspended     EventType = "user_unsuspended"
+	EventUserRenamed         EventType = "user_renamed"
+	EventSubRedditRenamed    EventType = "subreddit_renamed"
+	EventDataImported        EventType = "data_imported"
+	EventVotesDiscounted     EventType = "votes_discounted"
+	EventVotesRestored       EventType = "votes_restored"
+	EventRepostPolicyChanged EventType = "repost_policy_changed"
+	// EventWordFiltersChanged has no SubRedditID when the site's word
+	// filters changed.
+	EventWordFiltersChanged EventType = "word_filters_changed"
+	// EventStateRestored reports that the whole state was replaced from a
+	// snapshot. It is not journaled.
+	EventStateRestored EventType = "state_restored"
+)
+
+// Event describes a mutation of the engine. IDs that do not apply to the
+// event type are zero.
+type Event struct {
+	Type        EventType `json:"type"`
+	Time        time.Time `json:"time"`
+	UserID      int       `json:"userId,omitempty"`
+	SubRedditID int       `json:"subredditId,omitempty"`
+	PostID      int       `json:"postId,omitempty"`
+	CommentID   int       `json:"commentId,omitempty"`
+	MessageID   int       `json:"messageId,omitempty"`
+	// RequestID identifies the API request that caused the event, if any.
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// Subscribe registers fn to be called after every mutation. fn runs while
+// the engine lock is held, so it must be quick and must not call back into
+// the engine.
+func (e *RedditEngine) Subscribe(fn func(Event)) {
+	e.lock()
+	defer e.mu.Unlock()
+	e.listeners = append(e.listeners, fn)
+}
+
+// Revision returns a counter that increases with every mutation, and the
+// time of the latest mutation.
+func (e *RedditEngine) Revision() (uint64, time.Time) {
+	e.lock()
+	defer e.mu.Unlock()
+	return e.version, e.updatedAt
+}
+
+// emit records a mutation, logs it and notifies subscribers. Mutations made
+// through the ...Context methods carry the request ID from ctx into the
+// event and the log record. The caller holds e.mu.
+func (e *RedditEngine) emit(ctx context.Context, ev Event) {
+	e.emitVotes(ctx, ev, nil)
+}
+
+// emitVotes is emit for EventVoteCast, whose journal entry also needs the
+// users whose votes on the post changed. The caller holds e.mu.
+func (e *RedditEngine) emitVotes(ctx context.Context, ev Event, voters []int) {
+	ev.RequestID = logging.RequestID(ctx)
+	e.notify(ctx, ev)
+	if e.journal != nil {
+		e.journal.append(e.mutationLocked(ev, voters))
+	}
+}
+
+// notify is emit without journaling, for mutations applied from another
+// engine's journal. The caller holds e.mu.
+func (e *RedditEngine) notify(ctx context.Context, ev Event) {
+	if e.logger.Enabled(ctx, slog.LevelDebug) {
+		e.logger.LogAttrs(ctx, slog.LevelDebug, "engine event", eventAttrs(ev)...)
+	}
+	e.version++
+	e.updatedAt = ev.Time
+	for _, fn := range e.listeners {
+		fn(ev)
+	}
+}
+
+// SetLogger sets the logger engine events are written to at debug level.
+func (e *RedditEngine) SetLogger(l *slog.Logger) {
+	e.lock()
+	defer e.mu.Unlock()
+	e.logger = logging.OrDiscard(l)
+}
+
+func eventAttrs(ev Event) []slog.Attr {
+	attrs := []slog.Attr{slog.String("event", string(ev.Type))}
+	for _, id := range []struct {
+		key   string
+		value int
+	}{
+		{"user_id", ev.UserID},
+		{"subreddit_id", ev.SubRedditID},
+		{"post_id", ev.PostID},
+		{"comment_id", ev.CommentID},
+		{"message_id", ev.MessageID},
+	} {
+		if id.value != 0 {
+			attrs = append(attrs, slog.Int(id.key, id.value))
+		}
+	}
+	return attrs
+}
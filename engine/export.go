@@ -0,0 +1,690 @@
+package engine
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reddit-clone/tracing"
+	"sort"
+	"time"
+)
+
+// The export format is JSON Lines: one record per line, each with a "type".
+// A header comes first and a trailer with the number of records last, so a
+// truncated file is detected. Records refer to each other by the IDs they
+// had in the exporting engine, and each record only refers to records
+// before it: users, then subreddits, memberships, posts, comments (parents
+// before replies), votes and messages.
+
+// ExportFormat names the format in the header record.
+const ExportFormat = "reddit-clone"
+
+// exportVersion is bumped whenever the export format changes incompatibly.
+const exportVersion = 1
+
+// Record types of the export format.
+const (
+	RecordHeader     = "header"
+	RecordUser       = "user"
+	RecordSubReddit  = "subreddit"
+	RecordMembership = "membership"
+	RecordPost       = "post"
+	RecordComment    = "comment"
+	RecordVote       = "vote"
+	RecordMessage    = "message"
+	RecordTrailer    = "trailer"
+)
+
+type exportHeader struct {
+	Type       string    `json:"type"`
+	Format     string    `json:"format"`
+	Version    int       `json:"version"`
+	ExportedAt time.Time `json:"exportedAt"`
+}
+
+type exportTrailer struct {
+	Type    string `json:"type"`
+	Records int    `json:"records"`
+}
+
+type exportUser struct {
+	Type       string      `json:"type"`
+	ID         int         `json:"id"`
+	Username   string      `json:"username"`
+	Karma      int         `json:"karma"`
+	Suspension *Suspension `json:"suspension,omitempty"`
+	CreatedAt  time.Time   `json:"createdAt"`
+}
+
+type exportSubReddit struct {
+	Type         string               `json:"type"`
+	ID           int                  `json:"id"`
+	Name         string               `json:"name"`
+	ModeratorIDs []int                `json:"moderatorIds,omitempty"`
+	Bans         map[int]string       `json:"bans,omitempty"`
+	RepostAction string               `json:"repostAction,omitempty"`
+	RepostWindow time.Duration        `json:"repostWindow,omitempty"`
+	WordFilters  []WordFilterSnapshot `json:"wordFilters,omitempty"`
+	CreatedAt    time.Time            `json:"createdAt"`
+}
+
+type exportMembership struct {
+	Type        string `json:"type"`
+	SubRedditID int    `json:"subredditId"`
+	UserID      int    `json:"userId"`
+}
+
+type exportPost struct {
+	Type        string    `json:"type"`
+	ID          int       `json:"id"`
+	SubRedditID int       `json:"subredditId"`
+	AuthorID    int       `json:"authorId"`
+	Title       string    `json:"title"`
+	Content     string    `json:"content"`
+	Votes       int       `json:"votes"`
+	Removed     bool      `json:"removed,omitempty"`
+	Reason      string    `json:"removalReason,omitempty"`
+	Held        bool      `json:"held,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+type exportComment struct {
+	Type   string `json:"type"`
+	PostID int    `json:"postId"`
+	ID     int    `json:"id"`
+	// ParentID is the comment this one replies to, or 0.
+	ParentID  int       `json:"parentId,omitempty"`
+	AuthorID  int       `json:"authorId"`
+	Content   string    `json:"content"`
+	Votes     int       `json:"votes"`
+	Removed   bool      `json:"removed,omitempty"`
+	Reason    string    `json:"removalReason,omitempty"`
+	Held      bool      `json:"held,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type exportVote struct {
+	Type      string `json:"type"`
+	PostID    int    `json:"postId"`
+	UserID    int    `json:"userId"`
+	Direction int    `json:"direction"`
+}
+
+type exportMessage struct {
+	Type      string    `json:"type"`
+	ID        int       `json:"id"`
+	FromID    int       `json:"fromId"`
+	ToID      int       `json:"toId"`
+	Content   string    `json:"content"`
+	Removed   bool      `json:"removed,omitempty"`
+	Reason    string    `json:"removalReason,omitempty"`
+	Held      bool      `json:"held,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Export writes the engine state to w in the export format, recording the
+// export in the audit log. actor nil means the server itself.
+func (e *RedditEngine) Export(ctx context.Context, actor *User, w io.Writer) error {
+	ctx, span := tracing.Start(ctx, "engine.Export")
+	defer span.End()
+	snap := e.Snapshot()
+	e.lockContext(ctx)
+	exportedAt := e.now()
+	e.audit(ctx, actor, AuditEntry{Action: AuditDataExport, After: map[string]any{
+		"users": len(snap.Users), "subreddits": len(snap.SubReddits), "posts": len(snap.Posts), "messages": len(snap.Messages),
+	}})
+	e.mu.Unlock()
+	return WriteNDJSON(w, snap, exportedAt)
+}
+
+// WriteNDJSON writes snap in the export format. Admin roles and the audit
+// log are left out: they belong to the environment, not to the content.
+func WriteNDJSON(w io.Writer, snap *Snapshot, exportedAt time.Time) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	records := 0
+	write := func(v any) error {
+		records++
+		return enc.Encode(v)
+	}
+	if err := write(exportHeader{Type: RecordHeader, Format: ExportFormat, Version: exportVersion, ExportedAt: exportedAt.UTC()}); err != nil {
+		return err
+	}
+	for _, u := range snap.Users {
+		if err := write(exportUser{Type: RecordUser, ID: u.ID, Username: u.Username, Karma: u.Karma, Suspension: u.Suspension, CreatedAt: u.CreatedAt}); err != nil {
+			return err
+		}
+	}
+	for _, sr := range snap.SubReddits {
+		if err := write(exportSubReddit{
+			Type: RecordSubReddit, ID: sr.ID, Name: sr.Name, ModeratorIDs: sr.ModeratorIDs, Bans: sr.Bans,
+			RepostAction: sr.RepostAction, RepostWindow: sr.RepostWindow, WordFilters: sr.WordFilters, CreatedAt: sr.CreatedAt,
+		}); err != nil {
+			return err
+		}
+	}
+	for _, sr := range snap.SubReddits {
+		for _, id := range sr.MemberIDs {
+			if err := write(exportMembership{Type: RecordMembership, SubRedditID: sr.ID, UserID: id}); err != nil {
+				return err
+			}
+		}
+	}
+	for _, p := range snap.Posts {
+		if err := write(exportPost{Type: RecordPost, ID: p.ID, SubRedditID: p.SubRedditID, AuthorID: p.AuthorID, Title: p.Title, Content: p.Content, Votes: p.Votes, Removed: p.Removed, Reason: p.Reason, Held: p.Held, CreatedAt: p.CreatedAt}); err != nil {
+			return err
+		}
+	}
+	var writeComments func(postID, parentID int, comments []CommentSnapshot) error
+	writeComments = func(postID, parentID int, comments []CommentSnapshot) error {
+		for _, c := range comments {
+			if err := write(exportComment{Type: RecordComment, PostID: postID, ID: c.ID, ParentID: parentID, AuthorID: c.AuthorID, Content: c.Content, Votes: c.Votes, Removed: c.Removed, Reason: c.Reason, Held: c.Held, CreatedAt: c.CreatedAt}); err != nil {
+				return err
+			}
+			if err := writeComments(postID, c.ID, c.Replies); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, p := range snap.Posts {
+		if err := writeComments(p.ID, 0, p.Comments); err != nil {
+			return err
+		}
+	}
+	for _, p := range snap.Posts {
+		voters := make([]int, 0, len(p.Voters))
+		for id := range p.Voters {
+			voters = append(voters, id)
+		}
+		sort.Ints(voters)
+		for _, id := range voters {
+			if err := write(exportVote{Type: RecordVote, PostID: p.ID, UserID: id, Direction: p.Voters[id]}); err != nil {
+				return err
+			}
+		}
+	}
+	for _, m := range snap.Messages {
+		if err := write(exportMessage{Type: RecordMessage, ID: m.ID, FromID: m.FromID, ToID: m.ToID, Content: m.Content, Removed: m.Removed, Reason: m.Reason, Held: m.Held, CreatedAt: m.CreatedAt}); err != nil {
+			return err
+		}
+	}
+	if err := write(exportTrailer{Type: RecordTrailer, Records: records + 1}); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// maxRecordBytes bounds a single line of an import. The largest valid
+// record is a post with MaxPostLength characters of content.
+const maxRecordBytes = 1 << 20
+
+// scanError reports a failure to read the given line. Lines that are too
+// long are invalid input; anything else is the reader's own error.
+func scanError(line int, err error) error {
+	if errors.Is(err, bufio.ErrTooLong) {
+		return errorf(ErrInvalid, "line %d: longer than %d bytes", line, maxRecordBytes)
+	}
+	return fmt.Errorf("reading line %d: %w", line, err)
+}
+
+// ReadNDJSON reads an export written by WriteNDJSON into a snapshot for
+// Import. It checks the structure of the file, reporting problems by line
+// number; the contents are validated by Import.
+func ReadNDJSON(r io.Reader) (*Snapshot, error) {
+	snap := &Snapshot{Version: snapshotVersion}
+	users := make(map[int]bool)
+	subreddits := make(map[int]*SubRedditSnapshot)
+	posts := make(map[int]*PostSnapshot)
+	// comments maps a post ID and comment ID to the comment's position in
+	// its post's tree, as the path of indexes from the top level.
+	type commentKey struct{ post, id int }
+	comments := make(map[commentKey][]int)
+	messages := make(map[int]bool)
+	var subredditOrder, postOrder []int
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), maxRecordBytes)
+	line, records, trailer := 0, 0, -1
+	for scanner.Scan() {
+		line++
+		data := scanner.Bytes()
+		if len(data) == 0 {
+			continue
+		}
+		records++
+		fail := func(format string, args ...any) error {
+			return errorf(ErrInvalid, "line %d: %s", line, fmt.Sprintf(format, args...))
+		}
+		var kind struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(data, &kind); err != nil {
+			return nil, fail("%v", err)
+		}
+		if records == 1 && kind.Type != RecordHeader {
+			return nil, fail("expected a header record, found %q", kind.Type)
+		}
+		if trailer >= 0 {
+			return nil, fail("record after the trailer")
+		}
+		decode := func(v any) error {
+			if err := json.Unmarshal(data, v); err != nil {
+				return fail("%v", err)
+			}
+			return nil
+		}
+		switch kind.Type {
+		case RecordHeader:
+			var h exportHeader
+			if err := decode(&h); err != nil {
+				return nil, err
+			}
+			if records != 1 {
+				return nil, fail("header is not the first record")
+			}
+			if h.Format != ExportFormat || h.Version != exportVersion {
+				return nil, fail("unsupported format %q version %d", h.Format, h.Version)
+			}
+		case RecordUser:
+			var u exportUser
+			if err := decode(&u); err != nil {
+				return nil, err
+			}
+			if users[u.ID] {
+				return nil, fail("duplicate user %d", u.ID)
+			}
+			users[u.ID] = true
+			snap.Users = append(snap.Users, UserSnapshot{ID: u.ID, Username: u.Username, Karma: u.Karma, Suspension: u.Suspension, CreatedAt: u.CreatedAt})
+		case RecordSubReddit:
+			var s exportSubReddit
+			if err := decode(&s); err != nil {
+				return nil, err
+			}
+			if subreddits[s.ID] != nil {
+				return nil, fail("duplicate subreddit %d", s.ID)
+			}
+			for _, id := range s.ModeratorIDs {
+				if !users[id] {
+					return nil, fail("subreddit %d has unknown moderator %d", s.ID, id)
+				}
+			}
+			for id := range s.Bans {
+				if !users[id] {
+					return nil, fail("subreddit %d bans unknown user %d", s.ID, id)
+				}
+			}
+			subreddits[s.ID] = &SubRedditSnapshot{
+				ID: s.ID, Name: s.Name, ModeratorIDs: s.ModeratorIDs, Bans: s.Bans,
+				RepostAction: s.RepostAction, RepostWindow: s.RepostWindow, WordFilters: s.WordFilters, CreatedAt: s.CreatedAt,
+			}
+			subredditOrder = append(subredditOrder, s.ID)
+		case RecordMembership:
+			var m exportMembership
+			if err := decode(&m); err != nil {
+				return nil, err
+			}
+			sr := subreddits[m.SubRedditID]
+			if sr == nil || !users[m.UserID] {
+				return nil, fail("membership of user %d in subreddit %d refers to an unknown record", m.UserID, m.SubRedditID)
+			}
+			sr.MemberIDs = append(sr.MemberIDs, m.UserID)
+		case RecordPost:
+			var p exportPost
+			if err := decode(&p); err != nil {
+				return nil, err
+			}
+			if posts[p.ID] != nil {
+				return nil, fail("duplicate post %d", p.ID)
+			}
+			if subreddits[p.SubRedditID] == nil || !users[p.AuthorID] {
+				return nil, fail("post %d refers to an unknown subreddit or author", p.ID)
+			}
+			posts[p.ID] = &PostSnapshot{ID: p.ID, SubRedditID: p.SubRedditID, AuthorID: p.AuthorID, Title: p.Title, Content: p.Content, Votes: p.Votes, Voters: make(map[int]int), Removed: p.Removed, Reason: p.Reason, Held: p.Held, CreatedAt: p.CreatedAt}
+			postOrder = append(postOrder, p.ID)
+		case RecordComment:
+			var c exportComment
+			if err := decode(&c); err != nil {
+				return nil, err
+			}
+			post := posts[c.PostID]
+			if post == nil || !users[c.AuthorID] {
+				return nil, fail("comment %d refers to an unknown post or author", c.ID)
+			}
+			key := commentKey{c.PostID, c.ID}
+			if comments[key] != nil {
+				return nil, fail("duplicate comment %d on post %d", c.ID, c.PostID)
+			}
+			cs := CommentSnapshot{ID: c.ID, AuthorID: c.AuthorID, Content: c.Content, Votes: c.Votes, Removed: c.Removed, Reason: c.Reason, Held: c.Held, CreatedAt: c.CreatedAt}
+			siblings := &post.Comments
+			var path []int
+			if c.ParentID != 0 {
+				path = comments[commentKey{c.PostID, c.ParentID}]
+				if path == nil {
+					return nil, fail("comment %d replies to comment %d, which does not come before it", c.ID, c.ParentID)
+				}
+				for _, i := range path {
+					siblings = &(*siblings)[i].Replies
+				}
+			}
+			*siblings = append(*siblings, cs)
+			comments[key] = append(append([]int(nil), path...), len(*siblings)-1)
+		case RecordVote:
+			var v exportVote
+			if err := decode(&v); err != nil {
+				return nil, err
+			}
+			post := posts[v.PostID]
+			if post == nil || !users[v.UserID] {
+				return nil, fail("vote by user %d on post %d refers to an unknown record", v.UserID, v.PostID)
+			}
+			if v.Direction != 1 && v.Direction != -1 {
+				return nil, fail("vote direction must be -1 or 1")
+			}
+			post.Voters[v.UserID] = v.Direction
+		case RecordMessage:
+			var m exportMessage
+			if err := decode(&m); err != nil {
+				return nil, err
+			}
+			if messages[m.ID] {
+				return nil, fail("duplicate message %d", m.ID)
+			}
+			if !users[m.FromID] || !users[m.ToID] {
+				return nil, fail("message %d refers to an unknown user", m.ID)
+			}
+			messages[m.ID] = true
+			snap.Messages = append(snap.Messages, MessageSnapshot{ID: m.ID, FromID: m.FromID, ToID: m.ToID, Content: m.Content, Removed: m.Removed, Reason: m.Reason, Held: m.Held, CreatedAt: m.CreatedAt})
+		case RecordTrailer:
+			var t exportTrailer
+			if err := decode(&t); err != nil {
+				return nil, err
+			}
+			if t.Records != records {
+				return nil, fail("trailer counts %d records, found %d", t.Records, records)
+			}
+			trailer = records
+		default:
+			return nil, fail("unknown record type %q", kind.Type)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, scanError(line+1, err)
+	}
+	if records == 0 {
+		return nil, errorf(ErrInvalid, "empty export")
+	}
+	if trailer < 0 {
+		return nil, errorf(ErrInvalid, "export is truncated: no trailer record")
+	}
+	for _, id := range subredditOrder {
+		snap.SubReddits = append(snap.SubReddits, *subreddits[id])
+	}
+	for _, id := range postOrder {
+		snap.Posts = append(snap.Posts, *posts[id])
+	}
+	return snap, nil
+}
+
+// ImportResult counts what an import added to the engine. Users and
+// subreddits whose names already existed are merged into the existing ones
+// and counted separately.
+type ImportResult struct {
+	Users            int `json:"users"`
+	MergedUsers      int `json:"mergedUsers"`
+	SubReddits       int `json:"subreddits"`
+	MergedSubReddits int `json:"mergedSubreddits"`
+	Memberships      int `json:"memberships"`
+	Posts            int `json:"posts"`
+	Comments         int `json:"comments"`
+	Votes            int `json:"votes"`
+	Messages         int `json:"messages"`
+}
+
+// Import adds the contents of snap to the engine, giving every entity a new
+// ID. Users and subreddits are matched by name: a name that already exists
+// receives the imported memberships, posts and karma instead of a new
+// entity, and keeps the earlier of the two creation times. Admin roles and
+// the audit log in snap are ignored. Everything is validated first, and
+// nothing is changed if any of it is invalid. actor is recorded in the
+// audit log; nil means the server itself.
+func (e *RedditEngine) Import(ctx context.Context, actor *User, snap *Snapshot) (ImportResult, error) {
+	ctx, span := tracing.Start(ctx, "engine.Import")
+	defer span.End()
+	if err := validateImport(snap); err != nil {
+		return ImportResult{}, err
+	}
+
+	e.lockContext(ctx)
+	defer e.mu.Unlock()
+	now := e.now()
+	var res ImportResult
+
+	users := make(map[int]*User, len(snap.Users))
+	for _, us := range snap.Users {
+		if u, ok := e.usersByName[nameKey(us.Username)]; ok {
+			u.Karma += us.Karma
+			if us.CreatedAt.Before(u.CreatedAt) {
+				u.CreatedAt = us.CreatedAt
+			}
+			u.touch(now)
+			users[us.ID] = u
+			res.MergedUsers++
+			continue
+		}
+		u := &User{ID: e.localID(len(e.Users) + 1), Username: us.Username, Karma: us.Karma, Suspension: us.Suspension, CreatedAt: us.CreatedAt, UpdatedAt: now, Version: 1}
+		e.Users[u.ID] = u
+		e.usersByName[nameKey(u.Username)] = u
+		users[us.ID] = u
+		res.Users++
+	}
+	e.publishSuspensionsLocked()
+
+	subreddits := make(map[int]*SubReddit, len(snap.SubReddits))
+	for _, ss := range snap.SubReddits {
+		sr, ok := e.subRedditsByName[nameKey(ss.Name)]
+		if ok {
+			if ss.CreatedAt.Before(sr.CreatedAt) {
+				sr.CreatedAt = ss.CreatedAt
+			}
+			res.MergedSubReddits++
+		} else {
+			// validateImport has checked the filters.
+			filters, _ := restoreWordFilters(ss.WordFilters)
+			sr = &SubReddit{
+				ID:          e.localID(len(e.SubReddits) + 1),
+				Name:        ss.Name,
+				Members:     make(map[int]*User),
+				Moderators:  make(map[int]*User),
+				Banned:      make(map[int]string),
+				Reposts:     RepostPolicy{Action: ss.RepostAction, Window: ss.RepostWindow},
+				WordFilters: filters,
+				CreatedAt:   ss.CreatedAt,
+				Version:     1,
+			}
+			e.SubReddits[sr.ID] = sr
+			e.subRedditsByName[nameKey(sr.Name)] = sr
+			res.SubReddits++
+		}
+		for _, id := range ss.MemberIDs {
+			u := users[id]
+			if !isBanned(sr, u) && sr.Members[u.ID] == nil {
+				sr.Members[u.ID] = u
+				res.Memberships++
+			}
+		}
+		for _, id := range ss.ModeratorIDs {
+			if u := users[id]; !isBanned(sr, u) {
+				sr.Moderators[u.ID] = u
+			}
+		}
+		for id, reason := range ss.Bans {
+			u := users[id]
+			if sr.Moderators[u.ID] == nil {
+				sr.Banned[u.ID] = reason
+				delete(sr.Members, u.ID)
+			}
+		}
+		sr.touch(now)
+		subreddits[ss.ID] = sr
+	}
+
+	// Posts get IDs in the order they were written, so listings by ID
+	// stay chronological within the import.
+	posts := append([]PostSnapshot(nil), snap.Posts...)
+	sort.SliceStable(posts, func(i, j int) bool { return posts[i].CreatedAt.Before(posts[j].CreatedAt) })
+	for _, ps := range posts {
+		sr := subreddits[ps.SubRedditID]
+		p := &Post{
+			ID:            e.newPostIDLocked(),
+			SubRedditID:   sr.ID,
+			Title:         ps.Title,
+			Content:       ps.Content,
+			Author:        users[ps.AuthorID],
+			Votes:         ps.Votes,
+			Voters:        make(map[int]int, len(ps.Voters)),
+			Removed:       ps.Removed,
+			RemovalReason: ps.Reason,
+			Held:          ps.Held,
+			CreatedAt:     ps.CreatedAt,
+			UpdatedAt:     now,
+			Version:       1,
+		}
+		for id, v := range ps.Voters {
+			p.Voters[users[id].ID] = v
+			res.Votes++
+		}
+		// Comment IDs are renumbered from 1 in tree order, as the engine
+		// numbers new comments after the existing ones.
+		next := 0
+		var importComments func(snaps []CommentSnapshot) []*Comment
+		importComments = func(snaps []CommentSnapshot) []*Comment {
+			var comments []*Comment
+			for _, cs := range snaps {
+				next++
+				c := &Comment{ID: next, Author: users[cs.AuthorID], Content: cs.Content, Votes: cs.Votes, Removed: cs.Removed, RemovalReason: cs.Reason, Held: cs.Held, CreatedAt: cs.CreatedAt}
+				c.Replies = importComments(cs.Replies)
+				comments = append(comments, c)
+			}
+			return comments
+		}
+		p.Comments = importComments(ps.Comments)
+		res.Comments += next
+		sr.Posts = append(sr.Posts, p)
+		e.posts[p.ID] = p
+		e.reposts.add(p, nil)
+		res.Posts++
+	}
+
+	messages := append([]MessageSnapshot(nil), snap.Messages...)
+	sort.SliceStable(messages, func(i, j int) bool { return messages[i].CreatedAt.Before(messages[j].CreatedAt) })
+	for _, ms := range messages {
+		m := restoreMessage(ms, users[ms.FromID], users[ms.ToID])
+		m.ID = e.localID(len(e.Messages) + 1)
+		e.Messages[m.ID] = m
+		res.Messages++
+	}
+
+	e.emit(ctx, Event{Type: EventDataImported, Time: now})
+	e.audit(ctx, actor, AuditEntry{Action: AuditDataImport, After: map[string]any{
+		"users": res.Users, "mergedUsers": res.MergedUsers, "subreddits": res.SubReddits, "mergedSubreddits": res.MergedSubReddits,
+		"memberships": res.Memberships, "posts": res.Posts, "comments": res.Comments, "votes": res.Votes, "messages": res.Messages,
+	}})
+	return res, nil
+}
+
+func isBanned(sr *SubReddit, u *User) bool {
+	_, banned := sr.Banned[u.ID]
+	return banned
+}
+
+// validateImport checks that snap is something the engine could have
+// created itself: valid names and content, unique names, and references
+// only to entities it contains.
+func validateImport(snap *Snapshot) error {
+	var v validator
+	users := make(map[int]bool, len(snap.Users))
+	names := make(map[string]bool, len(snap.Users))
+	for i, u := range snap.Users {
+		field := fmt.Sprintf("users[%d]", i)
+		validateUsername(&v, u.Username)
+		if n := len(v.fields); n > 0 && v.fields[n-1].Field == "username" {
+			v.fields[n-1].Field = field + ".username"
+		}
+		if users[u.ID] || names[nameKey(u.Username)] {
+			v.add(field, "duplicate user %d %q", u.ID, u.Username)
+		}
+		users[u.ID], names[nameKey(u.Username)] = true, true
+	}
+	subreddits := make(map[int]bool, len(snap.SubReddits))
+	names = make(map[string]bool, len(snap.SubReddits))
+	for i, sr := range snap.SubReddits {
+		field := fmt.Sprintf("subreddits[%d]", i)
+		validateSubRedditName(&v, sr.Name)
+		if n := len(v.fields); n > 0 && v.fields[n-1].Field == "name" {
+			v.fields[n-1].Field = field + ".name"
+		}
+		if subreddits[sr.ID] || names[nameKey(sr.Name)] {
+			v.add(field, "duplicate subreddit %d %q", sr.ID, sr.Name)
+		}
+		subreddits[sr.ID], names[nameKey(sr.Name)] = true, true
+		for _, ids := range [][]int{sr.MemberIDs, sr.ModeratorIDs} {
+			for _, id := range ids {
+				if !users[id] {
+					v.add(field, "refers to unknown user %d", id)
+				}
+			}
+		}
+		for id, reason := range sr.Bans {
+			if !users[id] {
+				v.add(field, "bans unknown user %d", id)
+			}
+			v.text(field+".bans", reason, false, MaxReasonLength)
+		}
+		for j, fs := range sr.WordFilters {
+			f := WordFilter{Kind: fs.Kind, Pattern: fs.Pattern, Action: fs.Action}
+			if err := f.compile(); err != nil {
+				v.add(fmt.Sprintf("%s.wordFilters[%d]", field, j), "%v", err)
+			}
+		}
+	}
+	var checkComments func(field string, comments []CommentSnapshot)
+	checkComments = func(field string, comments []CommentSnapshot) {
+		for i, c := range comments {
+			f := fmt.Sprintf("%s.comments[%d]", field, i)
+			v.text(f+".content", c.Content, true, MaxCommentLength)
+			if !users[c.AuthorID] {
+				v.add(f, "refers to unknown user %d", c.AuthorID)
+			}
+			checkComments(f, c.Replies)
+		}
+	}
+	for i, p := range snap.Posts {
+		field := fmt.Sprintf("posts[%d]", i)
+		v.text(field+".title", p.Title, true, MaxTitleLength)
+		v.text(field+".content", p.Content, false, MaxPostLength)
+		if !subreddits[p.SubRedditID] {
+			v.add(field, "refers to unknown subreddit %d", p.SubRedditID)
+		}
+		if !users[p.AuthorID] {
+			v.add(field, "refers to unknown user %d", p.AuthorID)
+		}
+		for id, dir := range p.Voters {
+			if !users[id] || (dir != 1 && dir != -1) {
+				v.add(field+".voters", "invalid vote %d by user %d", dir, id)
+			}
+		}
+		checkComments(field, p.Comments)
+	}
+	for i, m := range snap.Messages {
+		field := fmt.Sprintf("messages[%d]", i)
+		v.text(field+".content", m.Content, true, MaxMessageLength)
+		if !users[m.FromID] || !users[m.ToID] {
+			v.add(field, "refers to an unknown user")
+		}
+	}
+	return v.err()
+}
@@ -0,0 +1,586 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Mutation is an entry in the replication journal: the fields one engine
+// mutation changed, with their values after the change. Followers apply
+// mutations in sequence to stay identical to the leader. Lists that grow
+// with the site, such as a subreddit's members or a post's comments and
+// voters, are never journaled whole; only the entries that changed are.
+type Mutation struct {
+	Seq uint64 `json:"seq"`
+	// Epoch identifies the leader that recorded the mutation. It changes
+	// whenever a journal is started, so a follower can tell a restarted or
+	// newly promoted leader's history from the one it has applied.
+	Epoch int64 `json:"epoch"`
+	// Event is the event the mutation emitted. Audit-only mutations, such
+	// as logins, have none.
+	Event      *Event            `json:"event,omitempty"`
+	Users      []UserSnapshot    `json:"users,omitempty"`
+	SubReddits []SubRedditChange `json:"subreddits,omitempty"`
+	Posts      []PostChange      `json:"posts,omitempty"`
+	Comments   []CommentChange   `json:"comments,omitempty"`
+	Messages   []MessageSnapshot `json:"messages,omitempty"`
+	Audit      []AuditEntry      `json:"audit,omitempty"`
+	// WordFilters, if set, replaces the site's word filters.
+	WordFilters *[]WordFilterSnapshot `json:"wordFilters,omitempty"`
+	// Snapshot replaces the whole state, for mutations such as imports
+	// that change too much to list.
+	Snapshot *Snapshot `json:"snapshot,omitempty"`
+}
+
+// SubRedditChange is a subreddit's own fields, and whichever of its word
+// filters or its lists of members, moderators and bans the mutation
+// changed.
+type SubRedditChange struct {
+	ID           int           `json:"id"`
+	Name         string        `json:"name"`
+	RepostAction string        `json:"repostAction,omitempty"`
+	RepostWindow time.Duration `json:"repostWindow,omitempty"`
+	CreatedAt    time.Time     `json:"createdAt"`
+	// User, if set, is where one user now stands in the subreddit.
+	User *SubRedditUser `json:"user,omitempty"`
+	// WordFilters, if set, replaces the subreddit's word filters.
+	WordFilters *[]WordFilterSnapshot `json:"wordFilters,omitempty"`
+}
+
+// SubRedditUser says whether a user is a member and a moderator of a
+// subreddit and whether they are banned from it. All three are sent, since
+// some changes, such as a ban, affect more than one.
+type SubRedditUser struct {
+	UserID    int    `json:"userId"`
+	Member    bool   `json:"member,omitempty"`
+	Moderator bool   `json:"moderator,omitempty"`
+	Banned    bool   `json:"banned,omitempty"`
+	BanReason string `json:"banReason,omitempty"`
+}
+
+// PostChange is a post's own fields, without its comments, and the votes
+// the mutation changed.
+type PostChange struct {
+	ID          int       `json:"id"`
+	SubRedditID int       `json:"subredditId"`
+	AuthorID    int       `json:"authorId"`
+	Title       string    `json:"title"`
+	Content     string    `json:"content"`
+	Votes       int       `json:"votes"`
+	Removed     bool      `json:"removed,omitempty"`
+	Reason      string    `json:"removalReason,omitempty"`
+	Held        bool      `json:"held,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+	// Voters holds the votes that changed by voter; 0 clears a vote.
+	Voters map[int]int `json:"voters,omitempty"`
+	// Discounted, if set, replaces the post's discounted voters.
+	Discounted *[]int `json:"discounted,omitempty"`
+}
+
+// CommentChange is a comment's own fields, without its replies.
+type CommentChange struct {
+	PostID int `json:"postId"`
+	// ParentID is the comment a new reply answers. It is 0 for top-level
+	// comments and for changes to existing ones.
+	ParentID  int       `json:"parentId,omitempty"`
+	ID        int       `json:"id"`
+	AuthorID  int       `json:"authorId"`
+	Content   string    `json:"content"`
+	Votes     int       `json:"votes"`
+	Removed   bool      `json:"removed,omitempty"`
+	Reason    string    `json:"removalReason,omitempty"`
+	Held      bool      `json:"held,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// ErrJournalGap means a follower's position is not in the journal: it is
+// older than the journal keeps, ahead of it, or was recorded by a different
+// leader. The follower has to catch up from a snapshot.
+var ErrJournalGap = errors.New("position is not in the journal")
+
+// journal keeps the latest mutations in memory. It has its own lock so
+// followers can read it without holding up the engine; mutations are
+// appended with e.mu held.
+type journal struct {
+	mu      sync.Mutex
+	entries []Mutation
+	size    int
+	// head is the sequence number of the latest mutation, and epoch the
+	// epoch new mutations are recorded in.
+	head  uint64
+	epoch int64
+	// baseEpoch is the epoch of the newest mutation no longer kept, or of
+	// the position the journal was reset to.
+	baseEpoch int64
+	// changed is closed and replaced whenever a mutation is appended.
+	changed chan struct{}
+}
+
+func newJournal(size int) *journal {
+	epoch := newEpoch()
+	return &journal{size: max(size, 1), epoch: epoch, baseEpoch: epoch, changed: make(chan struct{})}
+}
+
+// newEpoch returns an epoch that is later than any earlier one on this
+// host.
+func newEpoch() int64 {
+	return time.Now().UnixNano()
+}
+
+// append records m, numbering it first if it is new.
+func (j *journal) append(m Mutation) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if m.Seq == 0 {
+		m.Seq, m.Epoch = j.head+1, j.epoch
+	}
+	j.entries = append(j.entries, m)
+	j.head = m.Seq
+	if len(j.entries) > j.size {
+		j.baseEpoch = j.entries[0].Epoch
+		j.entries[0] = Mutation{}
+		j.entries = j.entries[1:]
+	}
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+// reset empties the journal, positioning it at seq recorded in epoch.
+func (j *journal) reset(seq uint64, epoch int64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	clear(j.entries)
+	j.entries = j.entries[:0]
+	j.head, j.baseEpoch = seq, epoch
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+// position returns the latest sequence number and the epoch it was
+// recorded in.
+func (j *journal) position() (uint64, int64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.positionLocked()
+}
+
+func (j *journal) positionLocked() (uint64, int64) {
+	if n := len(j.entries); n > 0 {
+		return j.head, j.entries[n-1].Epoch
+	}
+	return j.head, j.baseEpoch
+}
+
+// JournalPosition is returned by the engine's journal methods.
+type JournalPosition struct {
+	Seq   uint64 `json:"seq"`
+	Epoch int64  `json:"epoch"`
+}
+
+// StartJournal makes the engine record its mutations for followers,
+// keeping the latest size of them. If the engine already has a journal, as
+// a follower does, it is kept and new mutations continue its sequence in a
+// new epoch: this is how a follower is promoted.
+func (e *RedditEngine) StartJournal(size int) {
+	e.lock()
+	defer e.mu.Unlock()
+	if e.journal == nil {
+		e.journal = newJournal(size)
+		return
+	}
+	e.journal.mu.Lock()
+	defer e.journal.mu.Unlock()
+	e.journal.epoch = newEpoch()
+}
+
+// JournalPosition returns the sequence number and epoch of the latest
+// mutation in the journal. It is zero if the engine has no journal.
+func (e *RedditEngine) JournalPosition() JournalPosition {
+	e.lock()
+	defer e.mu.Unlock()
+	if e.journal == nil {
+		return JournalPosition{}
+	}
+	seq, epoch := e.journal.position()
+	return JournalPosition{Seq: seq, Epoch: epoch}
+}
+
+// JournalSince returns up to limit mutations following after, and a channel
+// that is closed when another mutation is recorded. It fails with
+// ErrJournalGap if after is not in the journal.
+func (e *RedditEngine) JournalSince(after JournalPosition, limit int) ([]Mutation, <-chan struct{}, error) {
+	e.lock()
+	j := e.journal
+	e.mu.Unlock()
+	if j == nil {
+		return nil, nil, errorf(ErrNotFound, "the engine has no journal")
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	first := j.head - uint64(len(j.entries)) + 1
+	switch {
+	case after.Seq > j.head, after.Seq+1 < first:
+		return nil, nil, ErrJournalGap
+	case after.Seq+1 == first:
+		if after.Epoch != j.baseEpoch {
+			return nil, nil, ErrJournalGap
+		}
+	case j.entries[after.Seq-first].Epoch != after.Epoch:
+		return nil, nil, ErrJournalGap
+	}
+	pending := j.entries[after.Seq+1-first:]
+	if len(pending) > limit {
+		pending = pending[:limit]
+	}
+	return append([]Mutation(nil), pending...), j.changed, nil
+}
+
+// ReplicationSnapshot returns a snapshot for a new follower together with
+// the journal position it reflects.
+func (e *RedditEngine) ReplicationSnapshot() (*Snapshot, JournalPosition, error) {
+	e.lock()
+	defer e.mu.Unlock()
+	if e.journal == nil {
+		return nil, JournalPosition{}, errorf(ErrNotFound, "the engine has no journal")
+	}
+	e.applyVotesLocked()
+	seq, epoch := e.journal.position()
+	return e.snapshotLocked(), JournalPosition{Seq: seq, Epoch: epoch}, nil
+}
+
+// RestoreReplica replaces the engine state with a snapshot taken by the
+// leader at pos, so that the mutations following pos can be applied.
+func (e *RedditEngine) RestoreReplica(snap *Snapshot, pos JournalPosition) error {
+	fresh, err := restoreFresh(snap)
+	if err != nil {
+		return err
+	}
+	e.lock()
+	defer e.mu.Unlock()
+	if e.journal == nil {
+		return errorf(ErrNotFound, "the engine has no journal")
+	}
+	e.install(fresh)
+	e.journal.reset(pos.Seq, pos.Epoch)
+	return nil
+}
+
+// Apply applies a mutation recorded by the leader's journal, which must be
+// the one following the latest in this engine's journal. If it fails the
+// engine may be left part-way through the mutation and should be restored
+// from a snapshot.
+func (e *RedditEngine) Apply(ctx context.Context, m Mutation) error {
+	e.lockContext(ctx)
+	defer e.mu.Unlock()
+	if e.journal == nil {
+		return errorf(ErrNotFound, "the engine has no journal")
+	}
+	if head, _ := e.journal.position(); m.Seq != head+1 {
+		return ErrJournalGap
+	}
+	if err := e.applyLocked(ctx, m); err != nil {
+		return err
+	}
+	e.journal.append(m)
+	return nil
+}
+
+func (e *RedditEngine) applyLocked(ctx context.Context, m Mutation) error {
+	now := e.now()
+	if m.Event != nil {
+		now = m.Event.Time
+	}
+	if m.Snapshot != nil {
+		fresh, err := restoreFresh(m.Snapshot)
+		if err != nil {
+			return err
+		}
+		e.install(fresh)
+	}
+	for _, us := range m.Users {
+		e.applyUser(us, now)
+	}
+	if m.WordFilters != nil {
+		filters, err := restoreWordFilters(*m.WordFilters)
+		if err != nil {
+			return err
+		}
+		e.wordFilters = filters
+	}
+	for _, sc := range m.SubReddits {
+		if err := e.applySubReddit(sc, now); err != nil {
+			return err
+		}
+	}
+	for _, pc := range m.Posts {
+		if err := e.applyPost(pc, now); err != nil {
+			return err
+		}
+	}
+	for _, cc := range m.Comments {
+		if err := e.applyComment(cc, now); err != nil {
+			return err
+		}
+	}
+	for _, ms := range m.Messages {
+		if err := e.applyMessage(ms); err != nil {
+			return err
+		}
+	}
+	for _, a := range m.Audit {
+		prev := ""
+		if n := len(e.auditLog); n > 0 {
+			prev = e.auditLog[n-1].Hash
+		}
+		if a.ID != len(e.auditLog)+1 || a.PrevHash != prev || a.computeHash() != a.Hash {
+			return errorf(ErrInvalid, "audit entry %d does not continue the audit log", a.ID)
+		}
+		e.appendAudit(ctx, a)
+	}
+	if m.Event != nil {
+		// Whatever changed in a subreddit, its listings did too.
+		if sr := e.SubReddits[m.Event.SubRedditID]; sr != nil {
+			sr.touch(now)
+		}
+		e.notify(ctx, *m.Event)
+	}
+	return nil
+}
+
+func (e *RedditEngine) applyUser(us UserSnapshot, now time.Time) {
+	u, ok := e.Users[us.ID]
+	if !ok {
+		u = &User{ID: us.ID, CreatedAt: us.CreatedAt}
+		e.Users[u.ID] = u
+	} else if e.usersByName[nameKey(u.Username)] == u {
+		delete(e.usersByName, nameKey(u.Username))
+	}
+	u.Username, u.Karma, u.Role, u.Suspension = us.Username, us.Karma, us.Role, us.Suspension
+	e.usersByName[nameKey(u.Username)] = u
+	e.publishSuspensionLocked(u)
+	u.touch(now)
+}
+
+func (e *RedditEngine) applySubReddit(sc SubRedditChange, now time.Time) error {
+	sr, ok := e.SubReddits[sc.ID]
+	if !ok {
+		sr = &SubReddit{
+			ID: sc.ID, Name: sc.Name, CreatedAt: sc.CreatedAt,
+			Members: make(map[int]*User), Moderators: make(map[int]*User), Banned: make(map[int]string),
+		}
+		e.SubReddits[sr.ID] = sr
+	} else if sr.Name != sc.Name {
+		if e.subRedditsByName[nameKey(sr.Name)] == sr {
+			delete(e.subRedditsByName, nameKey(sr.Name))
+		}
+		// Posts show their subreddit's name.
+		for _, p := range sr.Posts {
+			p.touch(now)
+		}
+	}
+	sr.Name = sc.Name
+	sr.Reposts = RepostPolicy{Action: sc.RepostAction, Window: sc.RepostWindow}
+	if sc.WordFilters != nil {
+		filters, err := restoreWordFilters(*sc.WordFilters)
+		if err != nil {
+			return err
+		}
+		sr.WordFilters = filters
+	}
+	if su := sc.User; su != nil {
+		u, ok := e.Users[su.UserID]
+		if !ok {
+			return errorf(ErrInvalid, "r/%s changed for unknown user %d", sr.Name, su.UserID)
+		}
+		setMember(sr.Members, u, su.Member)
+		setMember(sr.Moderators, u, su.Moderator)
+		if su.Banned {
+			sr.Banned[u.ID] = su.BanReason
+		} else {
+			delete(sr.Banned, u.ID)
+		}
+	}
+	e.subRedditsByName[nameKey(sr.Name)] = sr
+	return nil
+}
+
+func setMember(users map[int]*User, u *User, in bool) {
+	if in {
+		users[u.ID] = u
+	} else {
+		delete(users, u.ID)
+	}
+}
+
+func (e *RedditEngine) applyPost(pc PostChange, now time.Time) error {
+	sr, ok := e.SubReddits[pc.SubRedditID]
+	if !ok {
+		return errorf(ErrInvalid, "post %d is in unknown subreddit %d", pc.ID, pc.SubRedditID)
+	}
+	author, ok := e.Users[pc.AuthorID]
+	if !ok {
+		return errorf(ErrInvalid, "post %d has unknown author %d", pc.ID, pc.AuthorID)
+	}
+	p, ok := e.posts[pc.ID]
+	if !ok {
+		p = &Post{ID: pc.ID, SubRedditID: sr.ID, Voters: make(map[int]int), CreatedAt: pc.CreatedAt}
+		sr.Posts = append(sr.Posts, p)
+		e.posts[p.ID] = p
+		e.nextPostID = max(e.nextPostID, p.ID)
+	}
+	p.Title, p.Content, p.Author, p.Votes = pc.Title, pc.Content, author, pc.Votes
+	p.Removed, p.RemovalReason, p.Held = pc.Removed, pc.Reason, pc.Held
+	for id, v := range pc.Voters {
+		if v == 0 {
+			delete(p.Voters, id)
+		} else {
+			p.Voters[id] = v
+		}
+	}
+	if pc.Discounted != nil {
+		p.Discounted = discountedSet(*pc.Discounted)
+	}
+	e.reposts.add(p, nil)
+	p.touch(now)
+	return nil
+}
+
+func (e *RedditEngine) applyComment(cc CommentChange, now time.Time) error {
+	p, ok := e.posts[cc.PostID]
+	if !ok {
+		return errorf(ErrInvalid, "comment %d is on unknown post %d", cc.ID, cc.PostID)
+	}
+	author, ok := e.Users[cc.AuthorID]
+	if !ok {
+		return errorf(ErrInvalid, "comment %d has unknown author %d", cc.ID, cc.AuthorID)
+	}
+	c := findComment(p.Comments, cc.ID)
+	if c == nil {
+		c = &Comment{ID: cc.ID, CreatedAt: cc.CreatedAt}
+		if cc.ParentID == 0 {
+			p.Comments = append(p.Comments, c)
+		} else if parent := findComment(p.Comments, cc.ParentID); parent != nil {
+			parent.Replies = append(parent.Replies, c)
+		} else {
+			return errorf(ErrInvalid, "comment %d replies to unknown comment %d", cc.ID, cc.ParentID)
+		}
+	}
+	c.Author, c.Content, c.Votes = author, cc.Content, cc.Votes
+	c.Removed, c.RemovalReason, c.Held = cc.Removed, cc.Reason, cc.Held
+	p.touch(now)
+	return nil
+}
+
+func (e *RedditEngine) applyMessage(ms MessageSnapshot) error {
+	from, okFrom := e.Users[ms.FromID]
+	to, okTo := e.Users[ms.ToID]
+	if !okFrom || !okTo {
+		return errorf(ErrInvalid, "message %d refers to an unknown user", ms.ID)
+	}
+	e.Messages[ms.ID] = restoreMessage(ms, from, to)
+	return nil
+}
+
+// mutationLocked captures the fields ev changed. voters are the users
+// whose votes changed, for EventVoteCast. The caller holds e.mu.
+func (e *RedditEngine) mutationLocked(ev Event, voters []int) Mutation {
+	m := Mutation{Event: &ev}
+	user, sr, post := e.Users[ev.UserID], e.SubReddits[ev.SubRedditID], e.posts[ev.PostID]
+	switch ev.Type {
+	case EventDataImported:
+		m.Snapshot = e.snapshotLocked()
+	case EventUserCreated, EventRoleChanged, EventUserSuspended, EventUserUnsuspended, EventUserRenamed:
+		m.Users = append(m.Users, snapshotUser(user))
+	case EventSubRedditCreated, EventSubRedditRenamed, EventRepostPolicyChanged:
+		m.SubReddits = append(m.SubReddits, subRedditChange(sr))
+	case EventMemberJoined, EventMemberLeft, EventModeratorAdded, EventModeratorRemoved, EventUserBanned, EventUserUnbanned:
+		sc := subRedditChange(sr)
+		_, member := sr.Members[user.ID]
+		_, moderator := sr.Moderators[user.ID]
+		reason, banned := sr.Banned[user.ID]
+		sc.User = &SubRedditUser{UserID: user.ID, Member: member, Moderator: moderator, Banned: banned, BanReason: reason}
+		m.SubReddits = append(m.SubReddits, sc)
+	case EventWordFiltersChanged:
+		filters := e.wordFilters
+		if sr != nil {
+			filters = sr.WordFilters
+		}
+		// An empty list is sent as [] rather than null, which would leave
+		// the field unset.
+		snaps := append([]WordFilterSnapshot{}, snapshotWordFilters(filters)...)
+		if sr == nil {
+			m.WordFilters = &snaps
+		} else {
+			sc := subRedditChange(sr)
+			sc.WordFilters = &snaps
+			m.SubReddits = append(m.SubReddits, sc)
+		}
+	case EventPostCreated, EventPostRemoved, EventPostRestored:
+		m.Posts = append(m.Posts, postChange(post))
+	case EventVoteCast:
+		pc := postChange(post)
+		if len(voters) > 0 {
+			pc.Voters = make(map[int]int, len(voters))
+			for _, id := range voters {
+				pc.Voters[id] = post.Voters[id]
+			}
+		}
+		// Votes change the karma of the post's author.
+		m.Users = append(m.Users, snapshotUser(post.Author))
+		m.Posts = append(m.Posts, pc)
+	case EventVotesDiscounted, EventVotesRestored:
+		pc := postChange(post)
+		discounted := make([]int, 0, len(post.Discounted))
+		for id := range post.Discounted {
+			discounted = append(discounted, id)
+		}
+		sort.Ints(discounted)
+		pc.Discounted = &discounted
+		m.Users = append(m.Users, snapshotUser(post.Author))
+		m.Posts = append(m.Posts, pc)
+	case EventCommentCreated, EventCommentRemoved, EventCommentRestored:
+		c := findComment(post.Comments, ev.CommentID)
+		cc := CommentChange{
+			PostID: post.ID, ID: c.ID, AuthorID: c.Author.ID, Content: c.Content, Votes: c.Votes,
+			Removed: c.Removed, Reason: c.RemovalReason, Held: c.Held, CreatedAt: c.CreatedAt,
+		}
+		if ev.Type == EventCommentCreated {
+			cc.ParentID = parentID(post.Comments, c.ID)
+		}
+		m.Comments = append(m.Comments, cc)
+	case EventMessageSent, EventMessageRemoved, EventMessageRestored:
+		m.Messages = append(m.Messages, snapshotMessage(e.Messages[ev.MessageID]))
+	}
+	return m
+}
+
+func subRedditChange(sr *SubReddit) SubRedditChange {
+	return SubRedditChange{
+		ID: sr.ID, Name: sr.Name, CreatedAt: sr.CreatedAt,
+		RepostAction: sr.Reposts.Action, RepostWindow: sr.Reposts.Window,
+	}
+}
+
+func postChange(p *Post) PostChange {
+	return PostChange{
+		ID: p.ID, SubRedditID: p.SubRedditID, AuthorID: p.Author.ID, Title: p.Title, Content: p.Content,
+		Votes: p.Votes, Removed: p.Removed, Reason: p.RemovalReason, Held: p.Held, CreatedAt: p.CreatedAt,
+	}
+}
+
+// parentID returns the ID of the comment id replies to, or 0 if it is a
+// top-level comment.
+func parentID(comments []*Comment, id int) int {
+	parent := 0
+	walkComments(comments, func(c *Comment) {
+		for _, r := range c.Replies {
+			if r.ID == id {
+				parent = c.ID
+			}
+		}
+	})
+	return parent
+}
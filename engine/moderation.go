@@ -0,0 +1,258 @@
+package engine
+
+import (
+	"context"
+	"reddit-clone/tracing"
+)
+
+// User roles.
+const (
+	RoleUser  = ""
+	RoleAdmin = "admin"
+)
+
+// IsAdmin reports whether the user has the admin role.
+func (u *User) IsAdmin() bool {
+	return u != nil && u.Role == RoleAdmin
+}
+
+// canModerate reports whether user may moderate sr. The caller holds e.mu.
+func canModerate(user *User, sr *SubReddit) bool {
+	if user.IsAdmin() {
+		return true
+	}
+	_, ok := sr.Moderators[user.ID]
+	return ok
+}
+
+// GrantAdmin gives user the admin role. actor must be an admin, or nil for
+// the server itself, which grants the admins named in its configuration.
+func (e *RedditEngine) GrantAdmin(ctx context.Context, actor, user *User) error {
+	ctx, span := tracing.Start(ctx, "engine.GrantAdmin")
+	defer span.End()
+	e.lockContext(ctx)
+	defer e.mu.Unlock()
+	if actor != nil && !actor.IsAdmin() {
+		return errorf(ErrForbidden, "only admins can grant the admin role")
+	}
+	if user.IsAdmin() {
+		return nil
+	}
+	before := user.Role
+	user.Role = RoleAdmin
+	now := e.now()
+	user.touch(now)
+	e.emit(ctx, Event{Type: EventRoleChanged, Time: now, UserID: user.ID})
+	e.audit(ctx, actor, AuditEntry{
+		Action: AuditAdminGrant, TargetType: TargetUser, TargetID: user.ID, Target: user.Username,
+		Before: map[string]any{"role": roleName(before)}, After: map[string]any{"role": RoleAdmin},
+	})
+	return nil
+}
+
+func roleName(role string) string {
+	if role == RoleUser {
+		return "user"
+	}
+	return role
+}
+
+// RecordLogin adds a login to the audit log.
+func (e *RedditEngine) RecordLogin(ctx context.Context, user *User) {
+	e.lockContext(ctx)
+	defer e.mu.Unlock()
+	e.audit(ctx, user, AuditEntry{Action: AuditAccountLogin, TargetType: TargetUser, TargetID: user.ID, Target: user.Username})
+}
+
+// AddModerator makes user a moderator of sr. actor must already moderate
+// sr, unless sr has no moderators yet, in which case anyone may claim it.
+func (e *RedditEngine) AddModerator(ctx context.Context, actor, user *User, sr *SubReddit) error {
+	ctx, span := tracing.Start(ctx, "engine.AddModerator")
+	defer span.End()
+	e.lockContext(ctx)
+	defer e.mu.Unlock()
+	return e.addModeratorLocked(ctx, actor, user, sr)
+}
+
+// addModeratorLocked is AddModerator for a caller that holds e.mu.
+func (e *RedditEngine) addModeratorLocked(ctx context.Context, actor, user *User, sr *SubReddit) error {
+	if len(sr.Moderators) > 0 && !canModerate(actor, sr) {
+		return errorf(ErrForbidden, "only moderators of r/%s can add moderators", sr.Name)
+	}
+	if _, ok := sr.Moderators[user.ID]; ok {
+		return errorf(ErrConflict, "%s already moderates r/%s", user.Username, sr.Name)
+	}
+	if _, banned := sr.Banned[user.ID]; banned {
+		return errorf(ErrConflict, "%s is banned from r/%s", user.Username, sr.Name)
+	}
+	sr.Moderators[user.ID] = user
+	now := e.now()
+	sr.touch(now)
+	e.emit(ctx, Event{Type: EventModeratorAdded, Time: now, UserID: user.ID, SubRedditID: sr.ID})
+	e.audit(ctx, actor, AuditEntry{
+		Action: AuditModeratorAdd, TargetType: TargetUser, TargetID: user.ID, Target: user.Username, SubRedditID: sr.ID,
+		Before: map[string]any{"moderator": false}, After: map[string]any{"moderator": true},
+	})
+	return nil
+}
+
+// RemoveModerator removes user's moderator status in sr.
+func (e *RedditEngine) RemoveModerator(ctx context.Context, actor, user *User, sr *SubReddit) error {
+	ctx, span := tracing.Start(ctx, "engine.RemoveModerator")
+	defer span.End()
+	e.lockContext(ctx)
+	defer e.mu.Unlock()
+	if !canModerate(actor, sr) {
+		return errorf(ErrForbidden, "only moderators of r/%s can remove moderators", sr.Name)
+	}
+	if _, ok := sr.Moderators[user.ID]; !ok {
+		return errorf(ErrNotFound, "%s does not moderate r/%s", user.Username, sr.Name)
+	}
+	delete(sr.Moderators, user.ID)
+	now := e.now()
+	sr.touch(now)
+	e.emit(ctx, Event{Type: EventModeratorRemoved, Time: now, UserID: user.ID, SubRedditID: sr.ID})
+	e.audit(ctx, actor, AuditEntry{
+		Action: AuditModeratorRemove, TargetType: TargetUser, TargetID: user.ID, Target: user.Username, SubRedditID: sr.ID,
+		Before: map[string]any{"moderator": true}, After: map[string]any{"moderator": false},
+	})
+	return nil
+}
+
+// BanUser bans user from sr, removing their membership. Banned users
+// cannot post, comment or join. Moderators cannot be banned.
+func (e *RedditEngine) BanUser(ctx context.Context, actor, user *User, sr *SubReddit, reason string) error {
+	ctx, span := tracing.Start(ctx, "engine.BanUser")
+	defer span.End()
+	var v validator
+	v.text("reason", reason, false, MaxReasonLength)
+	if err := v.err(); err != nil {
+		return err
+	}
+	e.lockContext(ctx)
+	defer e.mu.Unlock()
+	if !canModerate(actor, sr) {
+		return errorf(ErrForbidden, "only moderators of r/%s can ban users", sr.Name)
+	}
+	if _, ok := sr.Moderators[user.ID]; ok {
+		return errorf(ErrConflict, "%s moderates r/%s and cannot be banned", user.Username, sr.Name)
+	}
+	if _, banned := sr.Banned[user.ID]; banned {
+		return errorf(ErrConflict, "%s is already banned from r/%s", user.Username, sr.Name)
+	}
+	_, wasMember := sr.Members[user.ID]
+	sr.Banned[user.ID] = reason
+	delete(sr.Members, user.ID)
+	now := e.now()
+	sr.touch(now)
+	e.emit(ctx, Event{Type: EventUserBanned, Time: now, UserID: user.ID, SubRedditID: sr.ID})
+	e.audit(ctx, actor, AuditEntry{
+		Action: AuditUserBan, TargetType: TargetUser, TargetID: user.ID, Target: user.Username, SubRedditID: sr.ID, Reason: reason,
+		Before: map[string]any{"banned": false, "member": wasMember}, After: map[string]any{"banned": true, "member": false},
+	})
+	return nil
+}
+
+// UnbanUser lifts a ban. The user has to join again.
+func (e *RedditEngine) UnbanUser(ctx context.Context, actor, user *User, sr *SubReddit) error {
+	ctx, span := tracing.Start(ctx, "engine.UnbanUser")
+	defer span.End()
+	e.lockContext(ctx)
+	defer e.mu.Unlock()
+	if !canModerate(actor, sr) {
+		return errorf(ErrForbidden, "only moderators of r/%s can unban users", sr.Name)
+	}
+	reason, banned := sr.Banned[user.ID]
+	if !banned {
+		return errorf(ErrNotFound, "%s is not banned from r/%s", user.Username, sr.Name)
+	}
+	delete(sr.Banned, user.ID)
+	now := e.now()
+	sr.touch(now)
+	e.emit(ctx, Event{Type: EventUserUnbanned, Time: now, UserID: user.ID, SubRedditID: sr.ID})
+	e.audit(ctx, actor, AuditEntry{
+		Action: AuditUserUnban, TargetType: TargetUser, TargetID: user.ID, Target: user.Username, SubRedditID: sr.ID,
+		Before: map[string]any{"banned": true, "reason": reason}, After: map[string]any{"banned": false},
+	})
+	return nil
+}
+
+// RemovePost hides a post's title and content. The post keeps its ID,
+// comments and votes. Removing a post held for review confirms that it
+// stays removed.
+func (e *RedditEngine) RemovePost(ctx context.Context, actor *User, post *Post, reason string) error {
+	ctx, span := tracing.Start(ctx, "engine.RemovePost")
+	defer span.End()
+	var v validator
+	v.text("reason", reason, false, MaxReasonLength)
+	if err := v.err(); err != nil {
+		return err
+	}
+	e.lockContext(ctx)
+	defer e.mu.Unlock()
+	sr := e.SubReddits[post.SubRedditID]
+	if !canModerate(actor, sr) {
+		return errorf(ErrForbidden, "only moderators of r/%s can remove posts", sr.Name)
+	}
+	if post.Removed && !post.Held {
+		return errorf(ErrConflict, "post %d is already removed", post.ID)
+	}
+	before := map[string]any{"removed": false}
+	if post.Held {
+		before = removedValues(post.RemovalReason, true)
+	}
+	post.Removed, post.RemovalReason, post.Held = true, reason, false
+	now := e.now()
+	post.touch(now)
+	sr.touch(now)
+	e.emit(ctx, Event{Type: EventPostRemoved, Time: now, SubRedditID: sr.ID, PostID: post.ID})
+	e.audit(ctx, actor, AuditEntry{
+		Action: AuditPostRemove, TargetType: TargetPost, TargetID: post.ID, Target: post.Title, SubRedditID: sr.ID, Reason: reason,
+		Before: before, After: map[string]any{"removed": true},
+	})
+	return nil
+}
+
+// RestorePost reverses RemovePost, and approves a post held for review.
+func (e *RedditEngine) RestorePost(ctx context.Context, actor *User, post *Post) error {
+	ctx, span := tracing.Start(ctx, "engine.RestorePost")
+	defer span.End()
+	e.lockContext(ctx)
+	defer e.mu.Unlock()
+	sr := e.SubReddits[post.SubRedditID]
+	if !canModerate(actor, sr) {
+		return errorf(ErrForbidden, "only moderators of r/%s can restore posts", sr.Name)
+	}
+	if !post.Removed {
+		return errorf(ErrNotFound, "post %d is not removed", post.ID)
+	}
+	before := removedValues(post.RemovalReason, post.Held)
+	post.Removed, post.RemovalReason, post.Held = false, "", false
+	now := e.now()
+	post.touch(now)
+	sr.touch(now)
+	e.emit(ctx, Event{Type: EventPostRestored, Time: now, SubRedditID: sr.ID, PostID: post.ID})
+	e.audit(ctx, actor, AuditEntry{
+		Action: AuditPostRestore, TargetType: TargetPost, TargetID: post.ID, Target: post.Title, SubRedditID: sr.ID,
+		Before: before, After: map[string]any{"removed": false},
+	})
+	return nil
+}
+
+// removedValues describes removed content for the audit log.
+func removedValues(reason string, held bool) map[string]any {
+	values := map[string]any{"removed": true, "reason": reason}
+	if held {
+		values["held"] = true
+	}
+	return values
+}
+
+// checkNotBanned returns ErrForbidden if user is banned from sr. The caller
+// holds e.mu.
+func checkNotBanned(user *User, sr *SubReddit) error {
+	if _, banned := sr.Banned[user.ID]; banned {
+		return errorf(ErrForbidden, "%s is banned from r/%s", user.Username, sr.Name)
+	}
+	return nil
+}
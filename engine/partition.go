@@ -0,0 +1,97 @@
+package engine
+
+import (
+	"context"
+	"reddit-clone/tracing"
+	"time"
+)
+
+// partitionEpoch is the zero of the time-ordered post IDs of partitioned
+// engines.
+var partitionEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// UserResolver finds a user whose home is another partition. It returns nil
+// and no error when no partition has the user.
+type UserResolver func(ctx context.Context, username string) (*User, error)
+
+// SetPartition makes the engine partition p of n in a sharded site. The
+// engine then draws user, subreddit and message IDs from its own residue
+// class modulo n, and post IDs from the milliseconds since partitionEpoch,
+// so IDs are unique across partitions, id % n names the partition that owns
+// them, and post IDs sort by creation time site-wide.
+func (e *RedditEngine) SetPartition(p, n int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.partition, e.partitions = p, n
+}
+
+// SetUserResolver sets the function consulted when a username is not
+// registered here. Users it finds are registered here under the ID they have
+// at home, so that this partition can record their posts, comments and
+// votes.
+func (e *RedditEngine) SetUserResolver(resolve UserResolver) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.resolveUser = resolve
+}
+
+// localID turns the k-th ID of a kind handed out here into one unique
+// across partitions. The caller holds e.mu.
+func (e *RedditEngine) localID(k int) int {
+	if e.partitions == 0 {
+		return k
+	}
+	return k*e.partitions + e.partition
+}
+
+// isHomeLocked reports whether u registered with this engine rather than
+// with another partition. The caller holds e.mu.
+func (e *RedditEngine) isHomeLocked(u *User) bool {
+	return e.partitions == 0 || u.ID%e.partitions == e.partition
+}
+
+// newPostIDLocked returns the ID for a new post. The caller holds e.mu.
+func (e *RedditEngine) newPostIDLocked() int {
+	if e.partitions == 0 {
+		e.nextPostID++
+		return e.nextPostID
+	}
+	k := max(e.nextPostID/e.partitions+1, int(e.now().Sub(partitionEpoch).Milliseconds()))
+	e.nextPostID = k*e.partitions + e.partition
+	return e.nextPostID
+}
+
+// userByName looks username up here and then, if it is not registered,
+// with the user resolver.
+func (e *RedditEngine) userByName(ctx context.Context, username string) (*User, error) {
+	ctx, span := tracing.Start(ctx, "engine.GetUserByUsername")
+	defer span.End()
+	e.lockContext(ctx)
+	user, resolve := e.usersByName[nameKey(username)], e.resolveUser
+	e.mu.Unlock()
+	if user != nil || resolve == nil {
+		return user, nil
+	}
+	remote, err := resolve(ctx, username)
+	if err != nil || remote == nil {
+		return nil, err
+	}
+
+	e.lockContext(ctx)
+	defer e.mu.Unlock()
+	if user := e.usersByName[nameKey(remote.Username)]; user != nil {
+		return user, nil
+	}
+	if _, taken := e.Users[remote.ID]; taken {
+		return nil, errorf(ErrConflict, "user ID %d of %q is taken here", remote.ID, remote.Username)
+	}
+	now := e.now()
+	user = &User{ID: remote.ID, Username: remote.Username, CreatedAt: remote.CreatedAt, UpdatedAt: now, Version: 1}
+	if user.CreatedAt.IsZero() {
+		user.CreatedAt = now
+	}
+	e.Users[user.ID] = user
+	e.usersByName[nameKey(user.Username)] = user
+	e.emit(ctx, Event{Type: EventUserCreated, Time: now, UserID: user.ID})
+	return user, nil
+}
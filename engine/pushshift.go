@@ -0,0 +1,293 @@
+package engine
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Pushshift dumps hold one reddit submission or comment per line, as the
+// reddit API returned it. Only the fields below are read; everything else in
+// a line is ignored.
+
+type pushshiftItem struct {
+	ID        string          `json:"id"`
+	Author    string          `json:"author"`
+	Subreddit string          `json:"subreddit"`
+	Created   json.RawMessage `json:"created_utc"`
+	Score     int             `json:"score"`
+	// Submissions have a title and either a URL or a self text.
+	Title    *string `json:"title"`
+	Selftext string  `json:"selftext"`
+	URL      string  `json:"url"`
+	IsSelf   bool    `json:"is_self"`
+	// Comments have a body and the fullnames of their post and parent.
+	Body     *string `json:"body"`
+	LinkID   string  `json:"link_id"`
+	ParentID string  `json:"parent_id"`
+}
+
+// PushshiftDeletedUser is the author given to items whose author deleted
+// their account, which the dumps record as "[deleted]".
+const PushshiftDeletedUser = "deleted"
+
+// PushshiftStats counts the lines ReadPushshift read and those it skipped,
+// by reason.
+type PushshiftStats struct {
+	Submissions int            `json:"submissions"`
+	Comments    int            `json:"comments"`
+	Skipped     map[string]int `json:"skipped,omitempty"`
+}
+
+func (s *PushshiftStats) skip(reason string) {
+	if s.Skipped == nil {
+		s.Skipped = make(map[string]int)
+	}
+	s.Skipped[reason]++
+}
+
+// pushshiftNameInvalid matches what the engine does not allow in subreddit
+// names; reddit's own names are already almost always valid.
+var pushshiftNameInvalid = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// ReadPushshift reads a Pushshift-style dump of submissions and comments,
+// in any order, into a snapshot for Import. Lines that cannot be imported
+// are skipped and counted rather than failing the whole dump: comments on
+// posts that are not in the dump, items in subreddits with names the engine
+// does not allow, and so on. Authors are credited with the scores of their
+// items as karma. Removed items keep their place in comment trees but are
+// marked removed.
+func ReadPushshift(r io.Reader) (*Snapshot, PushshiftStats, error) {
+	var stats PushshiftStats
+	var submissions, comments []pushshiftItem
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), maxRecordBytes)
+	line := 0
+	for scanner.Scan() {
+		line++
+		data := scanner.Bytes()
+		if len(strings.TrimSpace(string(data))) == 0 {
+			continue
+		}
+		var item pushshiftItem
+		if err := json.Unmarshal(data, &item); err != nil {
+			stats.skip("malformed")
+			continue
+		}
+		switch {
+		case item.Title != nil:
+			submissions = append(submissions, item)
+		case item.Body != nil && item.LinkID != "":
+			comments = append(comments, item)
+		default:
+			stats.skip("not a submission or comment")
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, stats, scanError(line+1, err)
+	}
+
+	snap := &Snapshot{Version: snapshotVersion}
+	users := make(map[string]int)
+	user := func(name string, score int, created time.Time) (int, bool) {
+		if name == "" || name == "[deleted]" {
+			name = PushshiftDeletedUser
+		}
+		var v validator
+		validateUsername(&v, name)
+		if v.err() != nil {
+			return 0, false
+		}
+		key := nameKey(name)
+		i, ok := users[key]
+		if !ok {
+			snap.Users = append(snap.Users, UserSnapshot{ID: len(snap.Users) + 1, Username: name, CreatedAt: created})
+			i = len(snap.Users) - 1
+			users[key] = i
+		}
+		u := &snap.Users[i]
+		if name != PushshiftDeletedUser {
+			u.Karma += score
+		}
+		if created.Before(u.CreatedAt) {
+			u.CreatedAt = created
+		}
+		return u.ID, true
+	}
+	subreddits := make(map[string]int)
+	subreddit := func(name string, created time.Time) (*SubRedditSnapshot, bool) {
+		name = pushshiftNameInvalid.ReplaceAllString(name, "")
+		var v validator
+		validateSubRedditName(&v, name)
+		if v.err() != nil {
+			return nil, false
+		}
+		key := nameKey(name)
+		i, ok := subreddits[key]
+		if !ok {
+			snap.SubReddits = append(snap.SubReddits, SubRedditSnapshot{ID: len(snap.SubReddits) + 1, Name: name, CreatedAt: created})
+			i = len(snap.SubReddits) - 1
+			subreddits[key] = i
+		}
+		sr := &snap.SubReddits[i]
+		if created.Before(sr.CreatedAt) {
+			sr.CreatedAt = created
+		}
+		return sr, true
+	}
+	members := make(map[[2]int]bool)
+	join := func(sr *SubRedditSnapshot, userID int) {
+		if !members[[2]int{sr.ID, userID}] {
+			members[[2]int{sr.ID, userID}] = true
+			sr.MemberIDs = append(sr.MemberIDs, userID)
+		}
+	}
+
+	// Submissions first, so comments can find their posts.
+	sort.SliceStable(submissions, func(i, j int) bool {
+		return pushshiftTime(submissions[i].Created).Before(pushshiftTime(submissions[j].Created))
+	})
+	posts := make(map[string]int)
+	for _, item := range submissions {
+		created := pushshiftTime(item.Created)
+		if created.IsZero() || item.ID == "" {
+			stats.skip("missing id or created_utc")
+			continue
+		}
+		if _, dup := posts[item.ID]; dup {
+			stats.skip("duplicate")
+			continue
+		}
+		sr, ok := subreddit(item.Subreddit, created)
+		if !ok {
+			stats.skip("invalid subreddit name")
+			continue
+		}
+		authorID, ok := user(item.Author, item.Score, created)
+		if !ok {
+			stats.skip("invalid author name")
+			continue
+		}
+		content, removed := item.Selftext, false
+		if isRemovedText(content) {
+			content, removed = "", true
+		}
+		if !item.IsSelf && item.URL != "" {
+			content = item.URL
+		}
+		title := strings.TrimSpace(*item.Title)
+		if title == "" || !utf8.ValidString(title) || !utf8.ValidString(content) {
+			stats.skip("invalid text")
+			continue
+		}
+		p := PostSnapshot{
+			ID:          len(snap.Posts) + 1,
+			SubRedditID: sr.ID,
+			AuthorID:    authorID,
+			Title:       truncateRunes(title, MaxTitleLength),
+			Content:     truncateRunes(content, MaxPostLength),
+			Votes:       item.Score,
+			Voters:      make(map[int]int),
+			Removed:     removed,
+			CreatedAt:   created,
+		}
+		if removed {
+			p.Reason = "removed before import"
+		}
+		snap.Posts = append(snap.Posts, p)
+		posts[item.ID] = len(snap.Posts) - 1
+		join(sr, authorID)
+		stats.Submissions++
+	}
+
+	// Comments are attached to their parents in order of creation; a
+	// comment whose parent is not in the dump goes at the top level.
+	sort.SliceStable(comments, func(i, j int) bool {
+		return pushshiftTime(comments[i].Created).Before(pushshiftTime(comments[j].Created))
+	})
+	type placed struct {
+		post int
+		path []int
+	}
+	placedComments := make(map[string]placed)
+	nextComment := make(map[int]int)
+	for _, item := range comments {
+		created := pushshiftTime(item.Created)
+		if created.IsZero() || item.ID == "" {
+			stats.skip("missing id or created_utc")
+			continue
+		}
+		if _, dup := placedComments[item.ID]; dup {
+			stats.skip("duplicate")
+			continue
+		}
+		pi, ok := posts[strings.TrimPrefix(item.LinkID, "t3_")]
+		if !ok {
+			stats.skip("post not in dump")
+			continue
+		}
+		authorID, ok := user(item.Author, item.Score, created)
+		if !ok {
+			stats.skip("invalid author name")
+			continue
+		}
+		body, removed := strings.TrimSpace(*item.Body), false
+		if isRemovedText(body) {
+			removed = true
+		}
+		if body == "" || !utf8.ValidString(body) {
+			stats.skip("invalid text")
+			continue
+		}
+		post := &snap.Posts[pi]
+		siblings := &post.Comments
+		var path []int
+		if parent, ok := placedComments[strings.TrimPrefix(item.ParentID, "t1_")]; ok && strings.HasPrefix(item.ParentID, "t1_") && parent.post == pi {
+			path = parent.path
+			for _, i := range path {
+				siblings = &(*siblings)[i].Replies
+			}
+		}
+		nextComment[pi]++
+		c := CommentSnapshot{ID: nextComment[pi], AuthorID: authorID, Content: truncateRunes(body, MaxCommentLength), Votes: item.Score, Removed: removed, CreatedAt: created}
+		if removed {
+			c.Reason = "removed before import"
+		}
+		*siblings = append(*siblings, c)
+		placedComments[item.ID] = placed{pi, append(append([]int(nil), path...), len(*siblings)-1)}
+		join(&snap.SubReddits[post.SubRedditID-1], authorID)
+		stats.Comments++
+	}
+	return snap, stats, nil
+}
+
+// pushshiftTime parses created_utc, which dumps write as an integer, a
+// float or a string of either. It returns the zero time if it cannot.
+func pushshiftTime(raw json.RawMessage) time.Time {
+	s := strings.Trim(string(raw), `"`)
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f <= 0 || math.IsInf(f, 0) || f > 1<<40 {
+		return time.Time{}
+	}
+	sec, frac := math.Modf(f)
+	return time.Unix(int64(sec), int64(frac*1e9)).UTC()
+}
+
+func isRemovedText(s string) bool {
+	return s == "[removed]" || s == "[deleted]"
+}
+
+// truncateRunes shortens s to at most n characters.
+func truncateRunes(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
@@ -0,0 +1,374 @@
+package engine
+
+import (
+	"context"
+	"hash/fnv"
+	"net/url"
+	"reddit-clone/tracing"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Repost actions, chosen per subreddit; see SetRepostPolicy.
+const (
+	// RepostWarn lets a repost through and tells the submitter about the
+	// earlier posts. It is the default.
+	RepostWarn = "warn"
+	// RepostBlock refuses a repost.
+	RepostBlock = "block"
+	// RepostAllow does not check for reposts.
+	RepostAllow = "allow"
+)
+
+const (
+	// DefaultRepostWindow is how far back reposts are looked for when a
+	// subreddit has not set a window.
+	DefaultRepostWindow = 30 * 24 * time.Hour
+	// MaxRepostWindow is the longest window a subreddit can set.
+	MaxRepostWindow = 365 * 24 * time.Hour
+	// RepostSimilarity is the smallest estimated share of words two posts
+	// must have in common to be near-duplicates.
+	RepostSimilarity = 0.7
+	// minRepostWords is the fewest distinct words a post needs to be
+	// compared by text; shorter posts, such as a one-word title, only match
+	// by link.
+	minRepostWords = 4
+	// maxReposts bounds the posts Reposts returns.
+	maxReposts = 25
+)
+
+// Ways a repost matches an earlier post.
+const (
+	// RepostMatchLink: both posts link to the same normalized URL.
+	RepostMatchLink = "link"
+	// RepostMatchText: the posts' titles and content are near-duplicates.
+	RepostMatchText = "text"
+)
+
+// RepostPolicy is what a subreddit does about reposts.
+type RepostPolicy struct {
+	// Action is RepostWarn, RepostBlock or RepostAllow. Empty means
+	// RepostWarn.
+	Action string
+	// Window is how far back earlier posts count; zero means
+	// DefaultRepostWindow.
+	Window time.Duration
+}
+
+// WithDefaults returns p with an empty action and window filled in.
+func (p RepostPolicy) WithDefaults() RepostPolicy {
+	return RepostPolicy{Action: p.action(), Window: p.window()}
+}
+
+func (p RepostPolicy) action() string {
+	if p.Action == "" {
+		return RepostWarn
+	}
+	return p.Action
+}
+
+func (p RepostPolicy) window() time.Duration {
+	if p.Window == 0 {
+		return DefaultRepostWindow
+	}
+	return p.Window
+}
+
+// Repost is an earlier post that a post repeats.
+type Repost struct {
+	Post *Post
+	// Match is RepostMatchLink or RepostMatchText.
+	Match string
+	// Similarity estimates the share of words the posts have in common;
+	// it is 1 for link matches.
+	Similarity float64
+	// Flagged is set when the earlier post is in the same subreddit and
+	// within its repost window, so the subreddit's policy applies.
+	Flagged bool
+}
+
+// minhashes is the number of MinHash values in a fingerprint. They are
+// split into minhashBands bands for the index: two posts whose text is
+// RepostSimilarity alike share a band with probability above 99%.
+const (
+	minhashes    = 32
+	minhashBands = 8
+	minhashRows  = minhashes / minhashBands
+)
+
+// fingerprint identifies a post's content for repost detection.
+type fingerprint struct {
+	// urls are the normalized links in the title and content.
+	urls []string
+	// minhash is the MinHash signature of the words of the title and
+	// content, with links left out. words is zero if there were fewer
+	// than minRepostWords.
+	minhash [minhashes]uint32
+	words   int
+}
+
+var linkPattern = regexp.MustCompile(`https?://[^\s<>"'()]+`)
+
+// fingerprintPost computes the fingerprint of a post's title and content.
+func fingerprintPost(title, content string) fingerprint {
+	var fp fingerprint
+	text := title + "\n" + content
+	seen := make(map[string]bool)
+	for _, link := range linkPattern.FindAllString(text, -1) {
+		if u, ok := NormalizeURL(strings.TrimRight(link, ".,;:!?")); ok && !seen[u] {
+			seen[u] = true
+			fp.urls = append(fp.urls, u)
+		}
+	}
+	words := make(map[string]bool)
+	for _, w := range strings.FieldsFunc(linkPattern.ReplaceAllString(text, " "), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		words[strings.ToLower(w)] = true
+	}
+	if len(words) < minRepostWords {
+		return fp
+	}
+	fp.words = len(words)
+	for i := range fp.minhash {
+		fp.minhash[i] = ^uint32(0)
+	}
+	for w := range words {
+		h := fnv.New64a()
+		h.Write([]byte(w))
+		base := h.Sum64()
+		for i := range fp.minhash {
+			if v := uint32(mix64(base + uint64(i)*0x9e3779b97f4a7c15)); v < fp.minhash[i] {
+				fp.minhash[i] = v
+			}
+		}
+	}
+	return fp
+}
+
+// mix64 is the splitmix64 finalizer, used to derive the independent hash
+// functions of the MinHash signature from one word hash.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	return x ^ x>>31
+}
+
+// similarity estimates the Jaccard similarity of two posts' words.
+func (fp fingerprint) similarity(other fingerprint) float64 {
+	if fp.words == 0 || other.words == 0 {
+		return 0
+	}
+	same := 0
+	for i := range fp.minhash {
+		if fp.minhash[i] == other.minhash[i] {
+			same++
+		}
+	}
+	return float64(same) / minhashes
+}
+
+// band returns the index key of one band of the signature.
+func (fp fingerprint) band(i int) uint64 {
+	h := uint64(i)
+	for _, v := range fp.minhash[i*minhashRows : (i+1)*minhashRows] {
+		h = mix64(h ^ uint64(v))
+	}
+	return h
+}
+
+// trackingParams are query parameters that say where a link was shared
+// rather than what it points to.
+var trackingParams = map[string]bool{
+	"fbclid": true, "gclid": true, "igshid": true, "mc_cid": true, "mc_eid": true,
+	"ref": true, "ref_src": true, "si": true, "feature": true,
+}
+
+// NormalizeURL reduces a link to a form in which links to the same page
+// are equal: the scheme, "www." and "m." prefixes, default ports, fragments,
+// trailing slashes and tracking parameters are dropped, the host is
+// lowercased, the remaining query parameters are sorted, and youtu.be links
+// are rewritten to youtube.com. It reports false if raw is not an http or
+// https URL.
+func NormalizeURL(raw string) (string, bool) {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return "", false
+	}
+	host := strings.ToLower(u.Hostname())
+	host = strings.TrimPrefix(strings.TrimPrefix(host, "www."), "m.")
+	if port := u.Port(); port != "" && port != "80" && port != "443" {
+		host += ":" + port
+	}
+	path := strings.TrimRight(u.EscapedPath(), "/")
+	query := u.Query()
+	if host == "youtu.be" && path != "" {
+		host, path = "youtube.com", "/watch"
+		query.Set("v", strings.TrimPrefix(u.Path, "/"))
+	}
+	for key := range query {
+		if trackingParams[strings.ToLower(key)] || strings.HasPrefix(strings.ToLower(key), "utm_") {
+			query.Del(key)
+		}
+	}
+	normalized := host + path
+	if len(query) > 0 {
+		normalized += "?" + query.Encode()
+	}
+	return normalized, true
+}
+
+// repostIndex finds posts by fingerprint.
+type repostIndex struct {
+	fingerprints map[int]fingerprint
+	byURL        map[string][]*Post
+	byBand       [minhashBands]map[uint64][]*Post
+}
+
+func newRepostIndex() *repostIndex {
+	idx := &repostIndex{fingerprints: make(map[int]fingerprint), byURL: make(map[string][]*Post)}
+	for i := range idx.byBand {
+		idx.byBand[i] = make(map[uint64][]*Post)
+	}
+	return idx
+}
+
+// add indexes a post under fp, or under its own fingerprint if fp is nil.
+func (idx *repostIndex) add(p *Post, fp *fingerprint) {
+	if _, ok := idx.fingerprints[p.ID]; ok {
+		return
+	}
+	if fp == nil {
+		computed := fingerprintPost(p.Title, p.Content)
+		fp = &computed
+	}
+	idx.fingerprints[p.ID] = *fp
+	for _, u := range fp.urls {
+		idx.byURL[u] = append(idx.byURL[u], p)
+	}
+	if fp.words > 0 {
+		for i := range idx.byBand {
+			key := fp.band(i)
+			idx.byBand[i][key] = append(idx.byBand[i][key], p)
+		}
+	}
+}
+
+// indexPostsLocked rebuilds the repost index from scratch. The caller holds
+// e.mu.
+func (e *RedditEngine) indexPostsLocked() {
+	e.reposts = newRepostIndex()
+	for _, p := range sortedByID(e.posts) {
+		e.reposts.add(p, nil)
+	}
+}
+
+// repostsLocked returns the posts that fp, the fingerprint of post id
+// created in sr at the given time, repeats, newest first. Only posts made
+// before it count, and removed posts are skipped. A post in sr is flagged if
+// it falls in sr's repost window; with flaggedOnly set, only flagged posts
+// are returned. The caller holds e.mu.
+func (e *RedditEngine) repostsLocked(fp fingerprint, sr *SubReddit, at time.Time, id int, flaggedOnly bool) []Repost {
+	found := make(map[int]*Repost)
+	consider := func(p *Post, match string, similarity float64) {
+		earlier := p.CreatedAt.Before(at) || p.CreatedAt.Equal(at) && p.ID < id
+		if !earlier || p.Removed {
+			return
+		}
+		flagged := p.SubRedditID == sr.ID && sr.Reposts.action() != RepostAllow &&
+			at.Sub(p.CreatedAt) <= sr.Reposts.window()
+		if flaggedOnly && !flagged {
+			return
+		}
+		if r, ok := found[p.ID]; !ok || similarity > r.Similarity {
+			found[p.ID] = &Repost{Post: p, Match: match, Similarity: similarity, Flagged: flagged}
+		}
+	}
+	for _, u := range fp.urls {
+		for _, p := range e.reposts.byURL[u] {
+			consider(p, RepostMatchLink, 1)
+		}
+	}
+	if fp.words > 0 {
+		checked := make(map[int]bool)
+		for i := range e.reposts.byBand {
+			for _, p := range e.reposts.byBand[i][fp.band(i)] {
+				if checked[p.ID] {
+					continue
+				}
+				checked[p.ID] = true
+				if s := fp.similarity(e.reposts.fingerprints[p.ID]); s >= RepostSimilarity {
+					consider(p, RepostMatchText, s)
+				}
+			}
+		}
+	}
+	reposts := make([]Repost, 0, len(found))
+	for _, r := range found {
+		reposts = append(reposts, *r)
+	}
+	sort.Slice(reposts, func(i, j int) bool { return reposts[i].Post.ID > reposts[j].Post.ID })
+	if len(reposts) > maxReposts {
+		reposts = reposts[:maxReposts]
+	}
+	return reposts
+}
+
+// Reposts returns the earlier posts, in any subreddit, that post repeats:
+// those linking to the same page, or whose title and content are
+// near-duplicates. They are ordered newest first.
+func (e *RedditEngine) Reposts(ctx context.Context, post *Post) []Repost {
+	ctx, span := tracing.Start(ctx, "engine.Reposts")
+	defer span.End()
+	e.lockContext(ctx)
+	defer e.mu.Unlock()
+	fp, ok := e.reposts.fingerprints[post.ID]
+	if !ok {
+		fp = fingerprintPost(post.Title, post.Content)
+	}
+	return e.repostsLocked(fp, e.SubReddits[post.SubRedditID], post.CreatedAt, post.ID, false)
+}
+
+// SetRepostPolicy sets what sr does about reposts. A zero window means
+// DefaultRepostWindow.
+func (e *RedditEngine) SetRepostPolicy(ctx context.Context, actor *User, sr *SubReddit, policy RepostPolicy) error {
+	ctx, span := tracing.Start(ctx, "engine.SetRepostPolicy")
+	defer span.End()
+	var v validator
+	switch policy.Action {
+	case RepostWarn, RepostBlock, RepostAllow:
+	default:
+		v.add("action", "must be warn, block or allow")
+	}
+	if policy.Window < 0 || policy.Window > MaxRepostWindow {
+		v.add("window", "must be between 0 and 8760h")
+	}
+	if err := v.err(); err != nil {
+		return err
+	}
+	e.lockContext(ctx)
+	defer e.mu.Unlock()
+	if !canModerate(actor, sr) {
+		return errorf(ErrForbidden, "only moderators of r/%s can change its repost policy", sr.Name)
+	}
+	before := repostPolicyValues(sr.Reposts)
+	sr.Reposts = policy
+	now := e.now()
+	sr.touch(now)
+	e.emit(ctx, Event{Type: EventRepostPolicyChanged, Time: now, SubRedditID: sr.ID})
+	e.audit(ctx, actor, AuditEntry{
+		Action: AuditRepostPolicy, TargetType: TargetSubReddit, TargetID: sr.ID, Target: sr.Name, SubRedditID: sr.ID,
+		Before: before, After: repostPolicyValues(policy),
+	})
+	return nil
+}
+
+func repostPolicyValues(p RepostPolicy) map[string]any {
+	p = p.WithDefaults()
+	return map[string]any{"action": p.Action, "window": p.Window.String()}
+}
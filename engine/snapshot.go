@@ -0,0 +1,449 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// snapshotVersion is bumped whenever the snapshot format changes
+// incompatibly.
+const snapshotVersion = 1
+
+// Snapshot is the serialized form of the whole engine state. Entities refer
+// to each other by ID.
+type Snapshot struct {
+	Version    int                 `json:"version"`
+	Users      []UserSnapshot      `json:"users"`
+	SubReddits []SubRedditSnapshot `json:"subreddits"`
+	Posts      []PostSnapshot      `json:"posts"`
+	Messages   []MessageSnapshot   `json:"messages"`
+	Audit      []AuditEntry        `json:"audit,omitempty"`
+	// WordFilters are the site's word filters.
+	WordFilters []WordFilterSnapshot `json:"wordFilters,omitempty"`
+}
+
+type UserSnapshot struct {
+	ID         int         `json:"id"`
+	Username   string      `json:"username"`
+	Karma      int         `json:"karma"`
+	Role       string      `json:"role,omitempty"`
+	Suspension *Suspension `json:"suspension,omitempty"`
+	CreatedAt  time.Time   `json:"createdAt"`
+}
+
+type SubRedditSnapshot struct {
+	ID           int                  `json:"id"`
+	Name         string               `json:"name"`
+	MemberIDs    []int                `json:"memberIds"`
+	ModeratorIDs []int                `json:"moderatorIds,omitempty"`
+	Bans         map[int]string       `json:"bans,omitempty"`
+	RepostAction string               `json:"repostAction,omitempty"`
+	RepostWindow time.Duration        `json:"repostWindow,omitempty"`
+	WordFilters  []WordFilterSnapshot `json:"wordFilters,omitempty"`
+	CreatedAt    time.Time            `json:"createdAt"`
+}
+
+type WordFilterSnapshot struct {
+	ID        int       `json:"id"`
+	Kind      string    `json:"kind"`
+	Pattern   string    `json:"pattern"`
+	Action    string    `json:"action"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type PostSnapshot struct {
+	ID          int               `json:"id"`
+	SubRedditID int               `json:"subredditId"`
+	AuthorID    int               `json:"authorId"`
+	Title       string            `json:"title"`
+	Content     string            `json:"content"`
+	Votes       int               `json:"votes"`
+	Voters      map[int]int       `json:"voters,omitempty"`
+	Discounted  []int             `json:"discounted,omitempty"`
+	Comments    []CommentSnapshot `json:"comments,omitempty"`
+	Removed     bool              `json:"removed,omitempty"`
+	Reason      string            `json:"removalReason,omitempty"`
+	Held        bool              `json:"held,omitempty"`
+	CreatedAt   time.Time         `json:"createdAt"`
+}
+
+type CommentSnapshot struct {
+	ID        int               `json:"id"`
+	AuthorID  int               `json:"authorId"`
+	Content   string            `json:"content"`
+	Votes     int               `json:"votes"`
+	Replies   []CommentSnapshot `json:"replies,omitempty"`
+	Removed   bool              `json:"removed,omitempty"`
+	Reason    string            `json:"removalReason,omitempty"`
+	Held      bool              `json:"held,omitempty"`
+	CreatedAt time.Time         `json:"createdAt"`
+}
+
+type MessageSnapshot struct {
+	ID        int       `json:"id"`
+	FromID    int       `json:"fromId"`
+	ToID      int       `json:"toId"`
+	Content   string    `json:"content"`
+	Removed   bool      `json:"removed,omitempty"`
+	Reason    string    `json:"removalReason,omitempty"`
+	Held      bool      `json:"held,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Snapshot captures the current engine state, including buffered votes.
+func (e *RedditEngine) Snapshot() *Snapshot {
+	e.lock()
+	defer e.mu.Unlock()
+	e.applyVotesLocked()
+	return e.snapshotLocked()
+}
+
+// snapshotLocked is Snapshot for callers that hold e.mu.
+func (e *RedditEngine) snapshotLocked() *Snapshot {
+	snap := &Snapshot{Version: snapshotVersion}
+	for _, u := range sortedByID(e.Users) {
+		snap.Users = append(snap.Users, snapshotUser(u))
+	}
+	for _, sr := range sortedByID(e.SubReddits) {
+		snap.SubReddits = append(snap.SubReddits, snapshotSubReddit(sr))
+	}
+	for _, p := range sortedByID(e.posts) {
+		snap.Posts = append(snap.Posts, snapshotPost(p))
+	}
+	for _, m := range sortedByID(e.Messages) {
+		snap.Messages = append(snap.Messages, snapshotMessage(m))
+	}
+	snap.Audit = append([]AuditEntry(nil), e.auditLog...)
+	snap.WordFilters = snapshotWordFilters(e.wordFilters)
+	return snap
+}
+
+func snapshotUser(u *User) UserSnapshot {
+	return UserSnapshot{ID: u.ID, Username: u.Username, Karma: u.Karma, Role: u.Role, Suspension: u.Suspension, CreatedAt: u.CreatedAt}
+}
+
+func snapshotSubReddit(sr *SubReddit) SubRedditSnapshot {
+	ss := SubRedditSnapshot{
+		ID: sr.ID, Name: sr.Name, MemberIDs: sortedIDs(sr.Members),
+		RepostAction: sr.Reposts.Action, RepostWindow: sr.Reposts.Window,
+		WordFilters: snapshotWordFilters(sr.WordFilters), CreatedAt: sr.CreatedAt,
+	}
+	if len(sr.Moderators) > 0 {
+		ss.ModeratorIDs = sortedIDs(sr.Moderators)
+	}
+	if len(sr.Banned) > 0 {
+		ss.Bans = make(map[int]string, len(sr.Banned))
+		for id, reason := range sr.Banned {
+			ss.Bans[id] = reason
+		}
+	}
+	return ss
+}
+
+func snapshotPost(p *Post) PostSnapshot {
+	ps := PostSnapshot{
+		ID:          p.ID,
+		SubRedditID: p.SubRedditID,
+		AuthorID:    p.Author.ID,
+		Title:       p.Title,
+		Content:     p.Content,
+		Votes:       p.Votes,
+		Comments:    snapshotComments(p.Comments),
+		Removed:     p.Removed,
+		Reason:      p.RemovalReason,
+		Held:        p.Held,
+		CreatedAt:   p.CreatedAt,
+	}
+	if len(p.Voters) > 0 {
+		ps.Voters = make(map[int]int, len(p.Voters))
+		for id, v := range p.Voters {
+			ps.Voters[id] = v
+		}
+	}
+	for id := range p.Discounted {
+		ps.Discounted = append(ps.Discounted, id)
+	}
+	sort.Ints(ps.Discounted)
+	return ps
+}
+
+func snapshotMessage(m *Message) MessageSnapshot {
+	return MessageSnapshot{
+		ID: m.ID, FromID: m.From.ID, ToID: m.To.ID, Content: m.Content,
+		Removed: m.Removed, Reason: m.RemovalReason, Held: m.Held, CreatedAt: m.CreatedAt,
+	}
+}
+
+func snapshotWordFilters(filters []*WordFilter) []WordFilterSnapshot {
+	var snaps []WordFilterSnapshot
+	for _, f := range filters {
+		snaps = append(snaps, WordFilterSnapshot{ID: f.ID, Kind: f.Kind, Pattern: f.Pattern, Action: f.Action, CreatedAt: f.CreatedAt})
+	}
+	return snaps
+}
+
+func restoreWordFilters(snaps []WordFilterSnapshot) ([]*WordFilter, error) {
+	var filters []*WordFilter
+	for _, fs := range snaps {
+		f := &WordFilter{ID: fs.ID, Kind: fs.Kind, Pattern: fs.Pattern, Action: fs.Action, CreatedAt: fs.CreatedAt}
+		if err := f.compile(); err != nil {
+			return nil, errorf(ErrInvalid, "word filter %d: %v", f.ID, err)
+		}
+		filters = append(filters, f)
+	}
+	return filters, nil
+}
+
+func sortedIDs(users map[int]*User) []int {
+	ids := make([]int, 0, len(users))
+	for id := range users {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func snapshotComments(comments []*Comment) []CommentSnapshot {
+	var snaps []CommentSnapshot
+	for _, c := range comments {
+		snaps = append(snaps, CommentSnapshot{
+			ID:        c.ID,
+			AuthorID:  c.Author.ID,
+			Content:   c.Content,
+			Votes:     c.Votes,
+			Replies:   snapshotComments(c.Replies),
+			Removed:   c.Removed,
+			Reason:    c.RemovalReason,
+			Held:      c.Held,
+			CreatedAt: c.CreatedAt,
+		})
+	}
+	return snaps
+}
+
+// Restore replaces the engine state with snap. It fails without changing
+// anything if snap refers to entities it does not contain or its audit log
+// has been tampered with.
+func (e *RedditEngine) Restore(snap *Snapshot) error {
+	fresh, err := restoreFresh(snap)
+	if err != nil {
+		return err
+	}
+	e.lock()
+	defer e.mu.Unlock()
+	e.install(fresh)
+	if e.journal != nil {
+		e.journal.append(Mutation{Snapshot: snap})
+	}
+	return nil
+}
+
+// restoreFresh builds a new engine holding snap's state.
+func restoreFresh(snap *Snapshot) (*RedditEngine, error) {
+	if snap.Version != snapshotVersion {
+		return nil, errorf(ErrInvalid, "unsupported snapshot version %d", snap.Version)
+	}
+	fresh := NewRedditEngine()
+	for _, us := range snap.Users {
+		u := &User{ID: us.ID, Username: us.Username, Karma: us.Karma, CreatedAt: us.CreatedAt, UpdatedAt: us.CreatedAt, Version: 1}
+		u.Role, u.Suspension = us.Role, us.Suspension
+		fresh.Users[u.ID] = u
+		fresh.usersByName[nameKey(u.Username)] = u
+	}
+	for _, ss := range snap.SubReddits {
+		sr := &SubReddit{
+			ID:         ss.ID,
+			Name:       ss.Name,
+			Members:    make(map[int]*User),
+			Moderators: make(map[int]*User),
+			Banned:     make(map[int]string),
+			Reposts:    RepostPolicy{Action: ss.RepostAction, Window: ss.RepostWindow},
+			CreatedAt:  ss.CreatedAt,
+			UpdatedAt:  ss.CreatedAt,
+			Version:    1,
+		}
+		for _, id := range ss.MemberIDs {
+			u, ok := fresh.Users[id]
+			if !ok {
+				return nil, errorf(ErrInvalid, "subreddit %d has unknown member %d", sr.ID, id)
+			}
+			sr.Members[id] = u
+		}
+		for _, id := range ss.ModeratorIDs {
+			u, ok := fresh.Users[id]
+			if !ok {
+				return nil, errorf(ErrInvalid, "subreddit %d has unknown moderator %d", sr.ID, id)
+			}
+			sr.Moderators[id] = u
+		}
+		for id, reason := range ss.Bans {
+			if _, ok := fresh.Users[id]; !ok {
+				return nil, errorf(ErrInvalid, "subreddit %d bans unknown user %d", sr.ID, id)
+			}
+			sr.Banned[id] = reason
+		}
+		filters, err := restoreWordFilters(ss.WordFilters)
+		if err != nil {
+			return nil, err
+		}
+		sr.WordFilters = filters
+		fresh.SubReddits[sr.ID] = sr
+		fresh.subRedditsByName[nameKey(sr.Name)] = sr
+	}
+	for _, ps := range snap.Posts {
+		sr, ok := fresh.SubReddits[ps.SubRedditID]
+		if !ok {
+			return nil, errorf(ErrInvalid, "post %d is in unknown subreddit %d", ps.ID, ps.SubRedditID)
+		}
+		author, ok := fresh.Users[ps.AuthorID]
+		if !ok {
+			return nil, errorf(ErrInvalid, "post %d has unknown author %d", ps.ID, ps.AuthorID)
+		}
+		comments, err := fresh.restoreComments(ps.Comments)
+		if err != nil {
+			return nil, err
+		}
+		p := &Post{
+			ID:            ps.ID,
+			SubRedditID:   sr.ID,
+			Title:         ps.Title,
+			Content:       ps.Content,
+			Author:        author,
+			Votes:         ps.Votes,
+			Comments:      comments,
+			Voters:        make(map[int]int),
+			Removed:       ps.Removed,
+			RemovalReason: ps.Reason,
+			Held:          ps.Held,
+			CreatedAt:     ps.CreatedAt,
+			UpdatedAt:     ps.CreatedAt,
+			Version:       1,
+		}
+		for id, v := range ps.Voters {
+			p.Voters[id] = v
+		}
+		p.Discounted = discountedSet(ps.Discounted)
+		sr.Posts = append(sr.Posts, p)
+		fresh.posts[p.ID] = p
+		fresh.nextPostID = max(fresh.nextPostID, p.ID)
+		if p.CreatedAt.After(sr.UpdatedAt) {
+			sr.UpdatedAt = p.CreatedAt
+		}
+	}
+	for _, ms := range snap.Messages {
+		from, okFrom := fresh.Users[ms.FromID]
+		to, okTo := fresh.Users[ms.ToID]
+		if !okFrom || !okTo {
+			return nil, errorf(ErrInvalid, "message %d refers to an unknown user", ms.ID)
+		}
+		fresh.Messages[ms.ID] = restoreMessage(ms, from, to)
+	}
+	filters, err := restoreWordFilters(snap.WordFilters)
+	if err != nil {
+		return nil, err
+	}
+	fresh.wordFilters = filters
+	if err := VerifyAudit(snap.Audit); err != nil {
+		return nil, errorf(ErrInvalid, "%v", err)
+	}
+	fresh.auditLog = append([]AuditEntry(nil), snap.Audit...)
+	return fresh, nil
+}
+
+// install replaces the engine state with fresh's and tells subscribers.
+// The caller holds e.mu.
+func (e *RedditEngine) install(fresh *RedditEngine) {
+	// Votes buffered before the state is replaced count as cast before it.
+	e.applyVotesLocked()
+	e.auditLog = fresh.auditLog
+	e.Users, e.SubReddits, e.Messages, e.posts = fresh.Users, fresh.SubReddits, fresh.Messages, fresh.posts
+	e.usersByName, e.subRedditsByName = fresh.usersByName, fresh.subRedditsByName
+	e.nextPostID = fresh.nextPostID
+	e.wordFilters = fresh.wordFilters
+	e.indexPostsLocked()
+	e.publishSuspensionsLocked()
+	e.notify(context.Background(), Event{Type: EventStateRestored, Time: e.now()})
+}
+
+func restoreMessage(ms MessageSnapshot, from, to *User) *Message {
+	return &Message{ID: ms.ID, From: from, To: to, Content: ms.Content, Removed: ms.Removed, RemovalReason: ms.Reason, Held: ms.Held, CreatedAt: ms.CreatedAt}
+}
+
+func (e *RedditEngine) restoreComments(snaps []CommentSnapshot) ([]*Comment, error) {
+	var comments []*Comment
+	for _, cs := range snaps {
+		author, ok := e.Users[cs.AuthorID]
+		if !ok {
+			return nil, errorf(ErrInvalid, "comment %d has unknown author %d", cs.ID, cs.AuthorID)
+		}
+		replies, err := e.restoreComments(cs.Replies)
+		if err != nil {
+			return nil, err
+		}
+		comments = append(comments, &Comment{ID: cs.ID, Author: author, Content: cs.Content, Votes: cs.Votes, Replies: replies, Removed: cs.Removed, RemovalReason: cs.Reason, Held: cs.Held, CreatedAt: cs.CreatedAt})
+	}
+	return comments, nil
+}
+
+// WriteSnapshot writes the engine state as JSON.
+func (e *RedditEngine) WriteSnapshot(w io.Writer) error {
+	return json.NewEncoder(w).Encode(e.Snapshot())
+}
+
+// ReadSnapshot replaces the engine state with a snapshot written by
+// WriteSnapshot.
+func (e *RedditEngine) ReadSnapshot(r io.Reader) error {
+	var snap Snapshot
+	if err := json.NewDecoder(r).Decode(&snap); err != nil {
+		return fmt.Errorf("decoding snapshot: %w", err)
+	}
+	return e.Restore(&snap)
+}
+
+// SaveFile writes a snapshot to path atomically, so a crash while saving
+// leaves the previous snapshot intact.
+func (e *RedditEngine) SaveFile(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := e.WriteSnapshot(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadFile restores a snapshot saved by SaveFile.
+func (e *RedditEngine) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return e.ReadSnapshot(f)
+}
+
+// sortedByID returns the map's values ordered by key.
+func sortedByID[T any](m map[int]T) []T {
+	ids := make([]int, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	values := make([]T, 0, len(ids))
+	for _, id := range ids {
+		values = append(values, m[id])
+	}
+	return values
+}
@@ -0,0 +1,82 @@
+package engine
+
+import (
+	"context"
+	"reddit-clone/tracing"
+	"sync/atomic"
+	"time"
+)
+
+// lockStats counts acquisitions of the engine mutex and the total time
+// callers spent waiting for it.
+type lockStats struct {
+	acquisitions atomic.Uint64
+	waitNanos    atomic.Int64
+}
+
+// LockStats reports contention on the engine mutex.
+type LockStats struct {
+	Acquisitions uint64
+	Wait         time.Duration
+}
+
+// Counts holds the number of each kind of entity in the engine.
+type Counts struct {
+	Users      int
+	SubReddits int
+	Posts      int
+	Comments   int
+	Messages   int
+}
+
+// lock acquires e.mu, recording how long the caller waited for it.
+func (e *RedditEngine) lock() {
+	e.lockContext(context.Background())
+}
+
+// lockContext is lock with an "engine.lock" span covering the wait when ctx
+// is being traced.
+func (e *RedditEngine) lockContext(ctx context.Context) {
+	_, span := tracing.Start(ctx, "engine.lock")
+	start := time.Now()
+	e.mu.Lock()
+	wait := time.Since(start)
+	span.End()
+	e.lockStats.acquisitions.Add(1)
+	e.lockStats.waitNanos.Add(int64(wait))
+	if b := e.votes.Load(); b != nil && b.strict {
+		e.applyVotesLocked()
+	}
+}
+
+// LockStats returns the cumulative lock statistics.
+func (e *RedditEngine) LockStats() LockStats {
+	return LockStats{
+		Acquisitions: e.lockStats.acquisitions.Load(),
+		Wait:         time.Duration(e.lockStats.waitNanos.Load()),
+	}
+}
+
+// Counts returns the current entity totals.
+func (e *RedditEngine) Counts() Counts {
+	e.lock()
+	defer e.mu.Unlock()
+	c := Counts{
+		Users:      len(e.Users),
+		SubReddits: len(e.SubReddits),
+		Posts:      len(e.posts),
+		Messages:   len(e.Messages),
+	}
+	for _, p := range e.posts {
+		c.Comments += countComments(p.Comments)
+	}
+	return c
+}
+
+func countComments(comments []*Comment) int {
+	n := len(comments)
+	for _, c := range comments {
+		n += countComments(c.Replies)
+	}
+	return n
+}
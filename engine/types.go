@@ -1,49 +1,149 @@
 package engine
 
 import (
+    "io"
+    "log/slog"
     "sync"
+    "sync/atomic"
+    "time"
 )
 
+// Users, subreddits and posts carry a Version that is incremented, and an
+// UpdatedAt that is set, whenever anything visible about them changes. A
+// subreddit changes when any of its posts does.
+
 type User struct {
-    ID       int
-    Username string
-    Karma    int
+    ID        int
+    Username  string
+    Karma     int
+    // Role is RoleUser or RoleAdmin.
+    Role      string
+    // Suspension is nil unless the user has been suspended.
+    Suspension *Suspension
+    CreatedAt time.Time
+    UpdatedAt time.Time
+    Version   uint64
 }
 
 type SubReddit struct {
-    ID      int
-    Name    string
-    Members map[int]*User
-    Posts   []*Post
+    ID        int
+    Name      string
+    Members   map[int]*User
+    Moderators map[int]*User
+    // Banned maps the IDs of banned users to the reason given.
+    Banned    map[int]string
+    // Reposts says what happens to posts that repeat recent ones.
+    Reposts   RepostPolicy
+    // WordFilters apply to posts and comments in the subreddit, after the
+    // site's.
+    WordFilters []*WordFilter
+    Posts     []*Post
+    CreatedAt time.Time
+    UpdatedAt time.Time
+    Version   uint64
 }
 
 type Post struct {
-    ID       int
-    Title    string
-    Content  string
-    Author   *User
-    Votes    int
-    Comments []*Comment
+    ID          int
+    SubRedditID int
+    Title       string
+    Content     string
+    Author      *User
+    Votes       int
+    Comments    []*Comment
+    // Voters maps a user ID to that user's vote on the post (+1 or -1).
+    Voters      map[int]int
+    // Discounted marks voters found in a vote ring whose votes are left out
+    // of Votes and the author's karma; see DiscountVoteRing.
+    Discounted  map[int]bool
+    // Removed posts are hidden by a moderator; RemovalReason says why.
+    Removed       bool
+    RemovalReason string
+    // Held posts were removed by a word filter until a moderator reviews
+    // them; see ModQueue.
+    Held          bool
+    CreatedAt   time.Time
+    UpdatedAt   time.Time
+    Version     uint64
 }
 
 type Comment struct {
-    ID      int
-    Content string
-    Author  *User
-    Votes   int
-    Replies []*Comment
+    ID        int
+    Content   string
+    Author    *User
+    Votes     int
+    Replies   []*Comment
+    Removed       bool
+    RemovalReason string
+    Held          bool
+    CreatedAt time.Time
 }
 
 type Message struct {
-    ID      int
-    From    *User
-    To      *User
-    Content string
+    ID        int
+    From      *User
+    To        *User
+    Content   string
+    Removed   bool
+    RemovalReason string
+    // Held messages are kept from their recipient until an admin reviews
+    // them.
+    Held      bool
+    CreatedAt time.Time
 }
 
 type RedditEngine struct {
     Users      map[int]*User
     SubReddits map[int]*SubReddit
     Messages   map[int]*Message
+    posts      map[int]*Post
+    nextPostID int
+    // Users and subreddits indexed by nameKey of their name.
+    usersByName      map[string]*User
+    subRedditsByName map[string]*SubReddit
+    // version counts every mutation of the engine.
+    version    uint64
+    updatedAt  time.Time
+    listeners  []func(Event)
+    now        func() time.Time
     mu         sync.Mutex
-}
\ No newline at end of file
+    lockStats  lockStats
+    logger     *slog.Logger
+    // auditLog is the hash-chained audit log; auditWriter, if set,
+    // receives a copy of every new entry.
+    auditLog    []AuditEntry
+    auditWriter io.Writer
+    // journal, if set, records every mutation for replication.
+    journal *journal
+    // partition and partitions place the engine in a sharded site; see
+    // SetPartition. resolveUser finds users whose home is elsewhere.
+    partition   int
+    partitions  int
+    resolveUser UserResolver
+    // votes, if set, buffers votes; see BufferVotes.
+    votes atomic.Pointer[voteBuffer]
+    // suspended copies the users' suspensions for checks made without
+    // e.mu; see publishSuspensionLocked.
+    suspended atomic.Pointer[map[int]suspendedUser]
+    // voteLog keeps recent votes for DetectVoteRings.
+    voteLog voteLog
+    // reposts indexes posts by content for repost detection.
+    reposts *repostIndex
+    // wordFilters are the site's word filters.
+    wordFilters []*WordFilter
+}
+
+func (u *User) touch(now time.Time) {
+    u.Version++
+    u.UpdatedAt = now
+}
+
+func (sr *SubReddit) touch(now time.Time) {
+    sr.Version++
+    sr.UpdatedAt = now
+}
+
+func (p *Post) touch(now time.Time) {
+    p.Version++
+    p.UpdatedAt = now
+}
@@ -0,0 +1,78 @@
+package engine
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Limits on user-supplied content. Names are restricted to characters that
+// are safe in URL paths.
+const (
+	MinUsernameLength  = 3
+	MaxUsernameLength  = 20
+	MinSubRedditLength = 3
+	MaxSubRedditLength = 21
+	MaxTitleLength     = 300
+	MaxPostLength      = 40000
+	MaxCommentLength   = 10000
+	MaxMessageLength   = 10000
+	MaxReasonLength    = 500
+)
+
+var (
+	usernamePattern  = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	subredditPattern = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+)
+
+// validator collects field errors so that every problem with a request is
+// reported at once.
+type validator struct {
+	fields []FieldError
+}
+
+func (v *validator) add(field, format string, args ...any) {
+	v.fields = append(v.fields, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) name(field, value string, minLen, maxLen int, pattern *regexp.Regexp, charset string) {
+	switch n := utf8.RuneCountInString(value); {
+	case n < minLen || n > maxLen:
+		v.add(field, "must be between %d and %d characters", minLen, maxLen)
+	case !pattern.MatchString(value):
+		v.add(field, "may only contain %s", charset)
+	}
+}
+
+func (v *validator) text(field, value string, required bool, maxLen int) {
+	switch {
+	case required && strings.TrimSpace(value) == "":
+		v.add(field, "must not be empty")
+	case !utf8.ValidString(value):
+		v.add(field, "must be valid UTF-8")
+	case utf8.RuneCountInString(value) > maxLen:
+		v.add(field, "must be at most %d characters", maxLen)
+	}
+}
+
+func (v *validator) err() error {
+	if len(v.fields) == 0 {
+		return nil
+	}
+	return &ValidationError{Fields: v.fields}
+}
+
+func validateUsername(v *validator, username string) {
+	v.name("username", username, MinUsernameLength, MaxUsernameLength, usernamePattern, "letters, digits, '_' and '-'")
+}
+
+func validateSubRedditName(v *validator, name string) {
+	v.name("name", name, MinSubRedditLength, MaxSubRedditLength, subredditPattern, "letters, digits and '_'")
+}
+
+// nameKey is the key names are indexed and compared by, so that uniqueness
+// is case-insensitive.
+func nameKey(name string) string {
+	return strings.ToLower(name)
+}
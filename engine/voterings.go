@@ -0,0 +1,518 @@
+package engine
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"reddit-clone/tracing"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// voteLogSize is how many of the most recent votes DetectVoteRings can
+	// look at for timing and share links.
+	voteLogSize = 100000
+	// maxPairVoters bounds the posts whose voters are compared pairwise.
+	// Votes on more popular posts say little about who votes together.
+	maxPairVoters = 500
+	// MaxVoteRefLength is the longest share link reference kept with a vote.
+	MaxVoteRefLength = 64
+)
+
+// Signals that link the accounts of a vote ring.
+const (
+	// SignalCoVoting: the accounts voted the same way on most of the posts
+	// either of them voted on.
+	SignalCoVoting = "co-voting"
+	// SignalNewAccountBurst: most of their common votes were cast close
+	// together while both accounts were new.
+	SignalNewAccountBurst = "new-account-burst"
+	// SignalSharedLink: most of their common votes came through the same
+	// share link.
+	SignalSharedLink = "shared-link"
+)
+
+// VoteRecord is one vote as it was cast.
+type VoteRecord struct {
+	PostID    int
+	UserID    int
+	Direction int
+	Time      time.Time
+	// Ref is the share link the vote came through, if any.
+	Ref string
+}
+
+type voteRefKey struct{}
+
+// WithVoteRef returns a context recording the share link a vote came
+// through, for vote ring detection. Refs are cut to MaxVoteRefLength bytes.
+func WithVoteRef(ctx context.Context, ref string) context.Context {
+	if len(ref) > MaxVoteRefLength {
+		ref = ref[:MaxVoteRefLength]
+	}
+	return context.WithValue(ctx, voteRefKey{}, ref)
+}
+
+func voteRef(ctx context.Context) string {
+	ref, _ := ctx.Value(voteRefKey{}).(string)
+	return ref
+}
+
+// voteLog is a ring buffer of the latest votes. It has its own lock so that
+// buffered votes are recorded without taking the engine lock. It is not part
+// of snapshots.
+type voteLog struct {
+	mu      sync.Mutex
+	records []VoteRecord
+	next    int
+}
+
+func (l *voteLog) add(r VoteRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.records) < voteLogSize {
+		l.records = append(l.records, r)
+		return
+	}
+	l.records[l.next] = r
+	l.next = (l.next + 1) % voteLogSize
+}
+
+// snapshot returns the logged votes, oldest first.
+func (l *voteLog) snapshot() []VoteRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	records := make([]VoteRecord, 0, len(l.records))
+	records = append(records, l.records[l.next:]...)
+	return append(records, l.records[:l.next]...)
+}
+
+// recordVote adds a vote by user to the vote log.
+func (e *RedditEngine) recordVote(ctx context.Context, user *User, post *Post, direction int) {
+	e.voteLog.add(VoteRecord{PostID: post.ID, UserID: user.ID, Direction: direction, Time: e.now(), Ref: voteRef(ctx)})
+}
+
+// VoteRingOptions tune DetectVoteRings.
+type VoteRingOptions struct {
+	// MinMembers is the smallest group of accounts reported as a ring.
+	MinMembers int
+	// Two accounts are linked when they voted the same way on at least
+	// MinCommonPosts posts, and those posts are at least Similarity of all
+	// the posts either of them voted on.
+	MinCommonPosts int
+	Similarity     float64
+	// SignalWeight is taken off Similarity for each of the new account
+	// burst and shared link signals a pair shows.
+	SignalWeight float64
+	// Accounts younger than NewAccountAge are new. Votes cast within
+	// BurstWindow of each other are part of a burst.
+	NewAccountAge time.Duration
+	BurstWindow   time.Duration
+}
+
+// DefaultVoteRingOptions returns the options the admin report uses.
+func DefaultVoteRingOptions() VoteRingOptions {
+	return VoteRingOptions{
+		MinMembers:     3,
+		MinCommonPosts: 3,
+		Similarity:     0.8,
+		SignalWeight:   0.2,
+		NewAccountAge:  7 * 24 * time.Hour,
+		BurstWindow:    10 * time.Minute,
+	}
+}
+
+// VoteRing is a group of accounts that vote together.
+type VoteRing struct {
+	// ID is derived from the members, so the same ring gets the same ID
+	// in every report.
+	ID      string
+	Members []*User
+	// Posts are those at least two members voted on the same way.
+	Posts   []*Post
+	Signals []string
+	// Similarity is the mean similarity of the linked pairs of members.
+	Similarity float64
+	// Votes counts the members' votes on Posts, and Discounted how many of
+	// them are left out of scores.
+	Votes      int
+	Discounted int
+	// Refs are the share links members voted through.
+	Refs []string
+}
+
+// VoteRingReport is the result of DetectVoteRings.
+type VoteRingReport struct {
+	Time time.Time
+	// VotesAnalyzed counts the votes considered, and LoggedVotes those of
+	// them with their time and share link still in the vote log.
+	VotesAnalyzed int
+	LoggedVotes   int
+	// Rings are ordered by size, largest first.
+	Rings []VoteRing
+}
+
+// votePair is what two accounts have in common.
+type votePair struct {
+	common, burst, sharedLink int
+}
+
+// voteSnapshot is what vote ring detection reads from the engine, copied
+// so that the scan can run without holding e.mu.
+type voteSnapshot struct {
+	posts   []postVotes
+	users   map[int]*User
+	created map[int]time.Time
+}
+
+// postVotes are the votes on a post when the snapshot was taken.
+type postVotes struct {
+	post       *Post
+	voters     map[int]int
+	discounted map[int]bool
+}
+
+type ringEdge struct {
+	a, b       int
+	similarity float64
+	signals    []string
+}
+
+// DetectVoteRings looks for groups of accounts that vote together. Pairs of
+// accounts are linked by how alike their votes are, with a lower bar when
+// their common votes were cast in bursts by new accounts or came through the
+// same share link, and linked accounts form rings. Timing and share links
+// are only known for votes still in the vote log, which keeps the latest
+// 100,000 votes and starts empty when the server starts.
+func (e *RedditEngine) DetectVoteRings(ctx context.Context, opts VoteRingOptions) VoteRingReport {
+	ctx, span := tracing.Start(ctx, "engine.DetectVoteRings")
+	defer span.End()
+	records := e.voteLog.snapshot()
+	e.lockContext(ctx)
+	e.applyVotesLocked()
+	snap := e.voteSnapshotLocked()
+	e.mu.Unlock()
+	return e.detectVoteRings(snap, records, opts)
+}
+
+// voteSnapshotLocked copies the votes on every post, in ID order, and the
+// users' creation times. The caller holds e.mu.
+func (e *RedditEngine) voteSnapshotLocked() voteSnapshot {
+	snap := voteSnapshot{users: make(map[int]*User, len(e.Users)), created: make(map[int]time.Time, len(e.Users))}
+	for id, u := range e.Users {
+		snap.users[id], snap.created[id] = u, u.CreatedAt
+	}
+	for _, post := range sortedByID(e.posts) {
+		pv := postVotes{post: post, voters: make(map[int]int, len(post.Voters)), discounted: make(map[int]bool, len(post.Discounted))}
+		for id, v := range post.Voters {
+			pv.voters[id] = v
+		}
+		for id, d := range post.Discounted {
+			pv.discounted[id] = d
+		}
+		snap.posts = append(snap.posts, pv)
+	}
+	return snap
+}
+
+// detectVoteRings does the work of DetectVoteRings on a snapshot, without
+// holding e.mu.
+func (e *RedditEngine) detectVoteRings(snap voteSnapshot, records []VoteRecord, opts VoteRingOptions) VoteRingReport {
+	report := VoteRingReport{Time: e.now()}
+	latest := make(map[voteKey]VoteRecord, len(records))
+	for _, r := range records {
+		latest[voteKey{r.PostID, r.UserID}] = r
+	}
+	isNew := func(id int, at time.Time) bool {
+		created, ok := snap.created[id]
+		return ok && at.Sub(created) < opts.NewAccountAge
+	}
+
+	voted := make(map[int]int)
+	pairs := make(map[[2]int]*votePair)
+	for _, pv := range snap.posts {
+		post := pv.post
+		voters := make([]int, 0, len(pv.voters))
+		for id := range pv.voters {
+			voters = append(voters, id)
+			voted[id]++
+			if r, ok := latest[voteKey{post.ID, id}]; ok && r.Direction == pv.voters[id] {
+				report.LoggedVotes++
+			}
+		}
+		report.VotesAnalyzed += len(voters)
+		if len(voters) > maxPairVoters {
+			continue
+		}
+		sort.Ints(voters)
+		for i, a := range voters {
+			for _, b := range voters[i+1:] {
+				if pv.voters[a] != pv.voters[b] {
+					continue
+				}
+				pair := pairs[[2]int{a, b}]
+				if pair == nil {
+					pair = &votePair{}
+					pairs[[2]int{a, b}] = pair
+				}
+				pair.common++
+				ra, okA := latest[voteKey{post.ID, a}]
+				rb, okB := latest[voteKey{post.ID, b}]
+				if !okA || !okB || ra.Direction != pv.voters[a] || rb.Direction != pv.voters[b] {
+					continue
+				}
+				if ra.Ref != "" && ra.Ref == rb.Ref {
+					pair.sharedLink++
+				}
+				gap := ra.Time.Sub(rb.Time)
+				if gap < 0 {
+					gap = -gap
+				}
+				if gap <= opts.BurstWindow && isNew(a, ra.Time) && isNew(b, rb.Time) {
+					pair.burst++
+				}
+			}
+		}
+	}
+
+	parent := make(map[int]int)
+	var find func(int) int
+	find = func(id int) int {
+		p, ok := parent[id]
+		if !ok || p == id {
+			parent[id] = id
+			return id
+		}
+		root := find(p)
+		parent[id] = root
+		return root
+	}
+	var edges []ringEdge
+	for key, pair := range pairs {
+		if pair.common < opts.MinCommonPosts {
+			continue
+		}
+		threshold := opts.Similarity
+		signals := []string{SignalCoVoting}
+		if 2*pair.burst > pair.common {
+			threshold -= opts.SignalWeight
+			signals = append(signals, SignalNewAccountBurst)
+		}
+		if 2*pair.sharedLink > pair.common {
+			threshold -= opts.SignalWeight
+			signals = append(signals, SignalSharedLink)
+		}
+		similarity := float64(pair.common) / float64(voted[key[0]]+voted[key[1]]-pair.common)
+		if similarity < threshold {
+			continue
+		}
+		parent[find(key[0])] = find(key[1])
+		edges = append(edges, ringEdge{key[0], key[1], similarity, signals})
+	}
+
+	groups := make(map[int][]ringEdge)
+	for _, edge := range edges {
+		root := find(edge.a)
+		groups[root] = append(groups[root], edge)
+	}
+	for _, group := range groups {
+		members := make(map[int]*User)
+		signals := make(map[string]bool)
+		var similarity float64
+		for _, edge := range group {
+			members[edge.a], members[edge.b] = snap.users[edge.a], snap.users[edge.b]
+			for _, s := range edge.signals {
+				signals[s] = true
+			}
+			similarity += edge.similarity
+		}
+		if len(members) < max(opts.MinMembers, 2) {
+			continue
+		}
+		ring := VoteRing{Members: sortedByID(members), Similarity: similarity / float64(len(group))}
+		for _, s := range []string{SignalCoVoting, SignalNewAccountBurst, SignalSharedLink} {
+			if signals[s] {
+				ring.Signals = append(ring.Signals, s)
+			}
+		}
+		fillVoteRing(&ring, snap, latest)
+		report.Rings = append(report.Rings, ring)
+	}
+	sort.Slice(report.Rings, func(i, j int) bool {
+		a, b := report.Rings[i], report.Rings[j]
+		if len(a.Members) != len(b.Members) {
+			return len(a.Members) > len(b.Members)
+		}
+		return a.ID < b.ID
+	})
+	return report
+}
+
+// fillVoteRing sets the ID, posts, vote counts and share links of a ring
+// from its members.
+func fillVoteRing(ring *VoteRing, snap voteSnapshot, latest map[voteKey]VoteRecord) {
+	h := sha256.New()
+	for _, m := range ring.Members {
+		h.Write(strconv.AppendInt(nil, int64(m.ID), 10))
+		h.Write([]byte{','})
+	}
+	ring.ID = hex.EncodeToString(h.Sum(nil))[:12]
+	refs := make(map[string]bool)
+	for _, pv := range snap.posts {
+		var up, down int
+		for _, m := range ring.Members {
+			switch pv.voters[m.ID] {
+			case 1:
+				up++
+			case -1:
+				down++
+			}
+		}
+		if up < 2 && down < 2 {
+			continue
+		}
+		ring.Posts = append(ring.Posts, pv.post)
+		for _, m := range ring.Members {
+			if pv.voters[m.ID] == 0 {
+				continue
+			}
+			ring.Votes++
+			if pv.discounted[m.ID] {
+				ring.Discounted++
+			}
+			if r := latest[voteKey{pv.post.ID, m.ID}]; r.Ref != "" {
+				refs[r.Ref] = true
+			}
+		}
+	}
+	for ref := range refs {
+		ring.Refs = append(ring.Refs, ref)
+	}
+	sort.Strings(ring.Refs)
+}
+
+// DiscountVoteRing leaves the votes of the ring with the given ID, as found
+// by DetectVoteRings with opts, out of the scores of the posts it voted on
+// and of their authors' karma. The votes themselves are kept, and later
+// votes by the members on those posts stay discounted until RestoreVoteRing.
+func (e *RedditEngine) DiscountVoteRing(ctx context.Context, actor *User, id string, opts VoteRingOptions) (VoteRing, error) {
+	ctx, span := tracing.Start(ctx, "engine.DiscountVoteRing")
+	defer span.End()
+	return e.discountVoteRing(ctx, actor, id, opts, true)
+}
+
+// RestoreVoteRing counts a discounted ring's votes again.
+func (e *RedditEngine) RestoreVoteRing(ctx context.Context, actor *User, id string, opts VoteRingOptions) (VoteRing, error) {
+	ctx, span := tracing.Start(ctx, "engine.RestoreVoteRing")
+	defer span.End()
+	return e.discountVoteRing(ctx, actor, id, opts, false)
+}
+
+func (e *RedditEngine) discountVoteRing(ctx context.Context, actor *User, id string, opts VoteRingOptions, discount bool) (VoteRing, error) {
+	records := e.voteLog.snapshot()
+	e.lockContext(ctx)
+	if err := requireAdmin(actor); err != nil {
+		e.mu.Unlock()
+		return VoteRing{}, err
+	}
+	e.applyVotesLocked()
+	snap := e.voteSnapshotLocked()
+	e.mu.Unlock()
+	var ring VoteRing
+	for _, r := range e.detectVoteRings(snap, records, opts).Rings {
+		if r.ID == id {
+			ring = r
+		}
+	}
+	if ring.ID == "" {
+		return VoteRing{}, errorf(ErrNotFound, "no vote ring %q", id)
+	}
+
+	// Votes may have changed during the scan, so the ring's discounted
+	// votes are counted again from the posts as they are now.
+	e.lockContext(ctx)
+	defer e.mu.Unlock()
+	if err := requireAdmin(actor); err != nil {
+		return VoteRing{}, err
+	}
+	ring.Discounted = 0
+	for _, post := range ring.Posts {
+		for _, m := range ring.Members {
+			if post.Voters[m.ID] != 0 && post.Discounted[m.ID] {
+				ring.Discounted++
+			}
+		}
+	}
+	before := ring.Discounted
+	now := e.now()
+	for _, post := range ring.Posts {
+		changed := false
+		for _, m := range ring.Members {
+			v := post.Voters[m.ID]
+			if post.Discounted[m.ID] == discount || discount && v == 0 {
+				continue
+			}
+			if discount {
+				if post.Discounted == nil {
+					post.Discounted = make(map[int]bool)
+				}
+				post.Discounted[m.ID] = true
+				post.Votes -= v
+				post.Author.Karma -= v
+				ring.Discounted++
+			} else {
+				delete(post.Discounted, m.ID)
+				post.Votes += v
+				post.Author.Karma += v
+				ring.Discounted--
+			}
+			changed = true
+		}
+		if !changed {
+			continue
+		}
+		post.touch(now)
+		post.Author.touch(now)
+		e.SubReddits[post.SubRedditID].touch(now)
+		typ := EventVotesDiscounted
+		if !discount {
+			typ = EventVotesRestored
+		}
+		e.emit(ctx, Event{Type: typ, Time: now, SubRedditID: post.SubRedditID, PostID: post.ID})
+	}
+	if ring.Discounted == before {
+		if discount {
+			return VoteRing{}, errorf(ErrConflict, "vote ring %s is already discounted", id)
+		}
+		return VoteRing{}, errorf(ErrNotFound, "vote ring %s has no discounted votes", id)
+	}
+	action := AuditVoteRingDiscount
+	if !discount {
+		action = AuditVoteRingRestore
+	}
+	members := make([]string, len(ring.Members))
+	for i, m := range ring.Members {
+		members[i] = m.Username
+	}
+	e.audit(ctx, actor, AuditEntry{
+		Action: action, TargetType: TargetVoteRing, Target: id,
+		Before: map[string]any{"discounted": before},
+		After:  map[string]any{"discounted": ring.Discounted, "members": members, "posts": len(ring.Posts)},
+	})
+	return ring, nil
+}
+
+// discountedSet turns a snapshot's discounted voters into a set.
+func discountedSet(ids []int) map[int]bool {
+	if len(ids) == 0 {
+		return nil
+	}
+	set := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+	return set
+}
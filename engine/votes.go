@@ -0,0 +1,228 @@
+package engine
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// VoteBuffering configures buffered vote ingestion; see BufferVotes.
+type VoteBuffering struct {
+	// Shards is the number of independently locked parts of the buffer.
+	// Votes on a post always go to the same shard.
+	Shards int
+	// Strict applies buffered votes whenever the engine lock is taken, so
+	// every read sees every vote cast before it.
+	Strict bool
+}
+
+// VoteStats count what the vote buffer has done since buffering was
+// enabled.
+type VoteStats struct {
+	// Buffered counts votes taken into the buffer, and Pending those not
+	// applied yet. A vote that replaces a pending vote by the same user on
+	// the same post is counted once in Pending.
+	Buffered int64
+	Pending  int64
+	// Applied counts votes applied to post scores and karma, and Dropped
+	// those discarded because the post or user no longer existed or the
+	// user had been suspended.
+	Applied int64
+	Dropped int64
+	// Flushes counts the times buffered votes were applied.
+	Flushes int64
+}
+
+// voteBuffer collects votes between flushes. Each shard holds the latest
+// direction per user and post, and the sum of anonymous votes per post.
+type voteBuffer struct {
+	shards []voteShard
+	strict bool
+
+	buffered, pending, applied, dropped, flushes atomic.Int64
+}
+
+type voteShard struct {
+	mu        sync.Mutex
+	votes     map[voteKey]int
+	anonymous map[int]anonymousVotes
+}
+
+// anonymousVotes are the anonymous votes buffered for a post.
+type anonymousVotes struct {
+	delta, count int
+}
+
+type voteKey struct {
+	postID, userID int
+}
+
+// BufferVotes makes CastVote and Vote record votes in a sharded buffer
+// instead of applying them under the engine lock. Buffered votes are applied
+// to scores and karma, in one event per post, by FlushVotes, or on every
+// access to the engine when cfg.Strict is set. A user's pending vote is
+// visible to that user through PendingVote. Votes of users who are
+// suspended by the time their vote is applied are dropped.
+//
+// A zero cfg turns buffering off, applying what is buffered first.
+func (e *RedditEngine) BufferVotes(cfg VoteBuffering) {
+	e.lock()
+	defer e.mu.Unlock()
+	e.applyVotesLocked()
+	if cfg.Shards <= 0 {
+		e.votes.Store(nil)
+		return
+	}
+	b := &voteBuffer{shards: make([]voteShard, cfg.Shards), strict: cfg.Strict}
+	for i := range b.shards {
+		b.shards[i].reset()
+	}
+	e.votes.Store(b)
+}
+
+// FlushVotes applies the buffered votes and returns how many it applied.
+func (e *RedditEngine) FlushVotes() int {
+	e.lock()
+	defer e.mu.Unlock()
+	return e.applyVotesLocked()
+}
+
+// RunVoteFlusher applies buffered votes every interval until ctx is done.
+func (e *RedditEngine) RunVoteFlusher(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			e.FlushVotes()
+		}
+	}
+}
+
+// VoteStats returns the vote buffer's counters, which are zero when votes
+// are not buffered.
+func (e *RedditEngine) VoteStats() VoteStats {
+	b := e.votes.Load()
+	if b == nil {
+		return VoteStats{}
+	}
+	return VoteStats{
+		Buffered: b.buffered.Load(),
+		Pending:  b.pending.Load(),
+		Applied:  b.applied.Load(),
+		Dropped:  b.dropped.Load(),
+		Flushes:  b.flushes.Load(),
+	}
+}
+
+// PendingVote returns user's buffered vote on post, if there is one that
+// has not been applied yet. It does not take the engine lock, so it may be
+// called from View.
+func (e *RedditEngine) PendingVote(post *Post, user *User) (int, bool) {
+	b := e.votes.Load()
+	if b == nil || user == nil {
+		return 0, false
+	}
+	s := b.shard(post.ID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	direction, ok := s.votes[voteKey{post.ID, user.ID}]
+	return direction, ok
+}
+
+func (b *voteBuffer) shard(postID int) *voteShard {
+	return &b.shards[uint(postID)%uint(len(b.shards))]
+}
+
+// cast buffers user's vote on post, replacing any pending one.
+func (b *voteBuffer) cast(postID, userID, direction int) {
+	s := b.shard(postID)
+	s.mu.Lock()
+	key := voteKey{postID, userID}
+	if _, ok := s.votes[key]; !ok {
+		b.pending.Add(1)
+	}
+	s.votes[key] = direction
+	s.mu.Unlock()
+	b.buffered.Add(1)
+}
+
+// castAnonymous buffers an anonymous vote of delta on post.
+func (b *voteBuffer) castAnonymous(postID, delta int) {
+	s := b.shard(postID)
+	s.mu.Lock()
+	votes, ok := s.anonymous[postID]
+	if !ok {
+		b.pending.Add(1)
+	}
+	s.anonymous[postID] = anonymousVotes{votes.delta + delta, votes.count + 1}
+	s.mu.Unlock()
+	b.buffered.Add(1)
+}
+
+// take empties the shard and returns what it held.
+func (s *voteShard) take() (map[voteKey]int, map[int]anonymousVotes) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	votes, anonymous := s.votes, s.anonymous
+	if len(votes) > 0 || len(anonymous) > 0 {
+		s.reset()
+	}
+	return votes, anonymous
+}
+
+func (s *voteShard) reset() {
+	s.votes = make(map[voteKey]int)
+	s.anonymous = make(map[int]anonymousVotes)
+}
+
+// applyVotesLocked applies the buffered votes and emits one EventVoteCast,
+// with no UserID, for every post whose score changed. The shards are
+// emptied while e.mu is held, so readers see each vote either pending or
+// applied. The caller holds e.mu.
+func (e *RedditEngine) applyVotesLocked() int {
+	b := e.votes.Load()
+	if b == nil || b.pending.Load() == 0 {
+		return 0
+	}
+	now := e.now()
+	changed := make(map[int]*Post)
+	voters := make(map[int][]int)
+	applied := 0
+	for i := range b.shards {
+		votes, anonymous := b.shards[i].take()
+		b.pending.Add(-int64(len(votes) + len(anonymous)))
+		for key, direction := range votes {
+			post, user := e.posts[key.postID], e.Users[key.userID]
+			if post == nil || user == nil || user.Suspended(now) {
+				b.dropped.Add(1)
+				continue
+			}
+			applied++
+			if setVote(post, user.ID, direction) {
+				changed[post.ID] = post
+				voters[post.ID] = append(voters[post.ID], user.ID)
+			}
+		}
+		for postID, votes := range anonymous {
+			post := e.posts[postID]
+			if post == nil {
+				b.dropped.Add(int64(votes.count))
+				continue
+			}
+			applied += votes.count
+			post.Votes += votes.delta
+			post.Author.Karma += votes.delta
+			changed[post.ID] = post
+		}
+	}
+	for _, post := range sortedByID(changed) {
+		e.votedLocked(context.Background(), post, 0, voters[post.ID]...)
+	}
+	b.applied.Add(int64(applied))
+	b.flushes.Add(1)
+	return applied
+}
@@ -0,0 +1,569 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"reddit-clone/tracing"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Word filter kinds.
+const (
+	// FilterWord matches a word or phrase. The words of a phrase may be
+	// separated by any spaces and punctuation.
+	FilterWord = "word"
+	// FilterWildcard is a word or phrase in which "*" stands for any
+	// letters and digits, such as "darn*".
+	FilterWildcard = "wildcard"
+	// FilterRegex is a regular expression in RE2 syntax, matched anywhere
+	// in the normalized text and ignoring case.
+	FilterRegex = "regex"
+)
+
+// Word filter actions. When filters disagree, rejecting wins over holding
+// for review, and matches are masked either way.
+const (
+	// FilterReject refuses the post, comment or message.
+	FilterReject = "reject"
+	// FilterMask replaces each character of a match with an asterisk.
+	FilterMask = "mask"
+	// FilterReview accepts the submission but holds it, removed, until a
+	// moderator restores it; see ModQueue.
+	FilterReview = "review"
+)
+
+const (
+	// MaxFilterPatternLength bounds the pattern of a word filter.
+	MaxFilterPatternLength = 200
+	// MaxWordFilters bounds the word filters of a subreddit, and those of
+	// the site.
+	MaxWordFilters = 500
+	// maxExcerpt bounds how much of a match error messages and hold
+	// reasons quote.
+	maxExcerpt = 40
+)
+
+// WordFilter rejects, masks or holds for review the submissions that
+// contain a word, phrase or pattern. The site's filters apply to posts,
+// comments and messages, and a subreddit's to posts and comments in it.
+type WordFilter struct {
+	ID        int
+	Kind      string
+	Pattern   string
+	Action    string
+	CreatedAt time.Time
+	// re matches the filter in normalized text.
+	re *regexp.Regexp
+}
+
+// compile validates the filter and prepares it for matching.
+func (f *WordFilter) compile() error {
+	var v validator
+	switch f.Action {
+	case FilterReject, FilterMask, FilterReview:
+	default:
+		v.add("action", "must be reject, mask or review")
+	}
+	v.text("pattern", f.Pattern, true, MaxFilterPatternLength)
+	if len(v.fields) > 0 {
+		return v.err()
+	}
+	switch f.Kind {
+	case FilterWord, FilterWildcard:
+		expr, ok := wordPattern(f.Pattern, f.Kind == FilterWildcard)
+		if !ok {
+			v.add("pattern", "must be made of words of letters and digits")
+			break
+		}
+		f.re = regexp.MustCompile(expr)
+	case FilterRegex:
+		re, err := regexp.Compile("(?i)" + f.Pattern)
+		switch {
+		case err != nil:
+			v.add("pattern", "is not a valid regular expression")
+		case re.MatchString(""):
+			v.add("pattern", "must not match empty text")
+		default:
+			f.re = re
+		}
+	default:
+		v.add("kind", "must be word, wildcard or regex")
+	}
+	return v.err()
+}
+
+// wordPattern turns the pattern of a word or wildcard filter into a
+// regular expression over normalized text. It reports false if the pattern
+// has no words, or a word made only of wildcards.
+func wordPattern(pattern string, wildcards bool) (string, bool) {
+	words := strings.FieldsFunc(normalizeText(pattern).text, func(r rune) bool {
+		return !isWordRune(r) && !(wildcards && r == '*')
+	})
+	if len(words) == 0 {
+		return "", false
+	}
+	for i, w := range words {
+		if strings.Trim(w, "*") == "" {
+			return "", false
+		}
+		parts := strings.Split(w, "*")
+		for j := range parts {
+			parts[j] = regexp.QuoteMeta(parts[j])
+		}
+		words[i] = strings.Join(parts, `[\pL\pN]*`)
+	}
+	return strings.Join(words, `[^\pL\pN]+`), true
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsNumber(r)
+}
+
+// find returns the byte ranges of n.text that the filter matches. Word and
+// wildcard filters only match whole words.
+func (f *WordFilter) find(n normalized) [][2]int {
+	var found [][2]int
+	if f.Kind == FilterRegex {
+		for _, m := range f.re.FindAllStringIndex(n.text, -1) {
+			if m[1] > m[0] {
+				found = append(found, [2]int{m[0], m[1]})
+			}
+		}
+		return found
+	}
+	for pos := 0; pos < len(n.text); {
+		m := f.re.FindStringIndex(n.text[pos:])
+		if m == nil {
+			break
+		}
+		start, end := pos+m[0], pos+m[1]
+		if end > start && !n.wordBefore(start) && !n.wordAt(end) {
+			found = append(found, [2]int{start, end})
+			pos = end
+			continue
+		}
+		_, size := utf8.DecodeRuneInString(n.text[start:])
+		pos = start + size
+	}
+	return found
+}
+
+// normalized is text folded by normalizeText, with the bytes of the
+// original text that each of its bytes came from.
+type normalized struct {
+	text string
+	// from[i] and to[i] delimit the original bytes text[i] came from.
+	from, to []int
+}
+
+func (n normalized) wordAt(i int) bool {
+	r, _ := utf8.DecodeRuneInString(n.text[i:])
+	return i < len(n.text) && isWordRune(r)
+}
+
+func (n normalized) wordBefore(i int) bool {
+	r, _ := utf8.DecodeLastRuneInString(n.text[:i])
+	return i > 0 && isWordRune(r)
+}
+
+// normalizeText folds s so that look-alikes read as what they imitate:
+//
+//   - Invisible formatting characters, such as zero-width spaces and
+//     joiners, are dropped, and so are combining marks.
+//   - Fullwidth, mathematical and circled letters and digits become plain
+//     ones.
+//   - Letters are lowercased. Accented Latin letters lose their accents,
+//     and Cyrillic and Greek letters that look like Latin ones are
+//     replaced by them.
+//   - In words that contain a letter, the digits and symbols of leetspeak
+//     become the letters they stand for, so "h3ll0" reads "hello".
+func normalizeText(s string) normalized {
+	type folded struct {
+		r        rune
+		from, to int
+	}
+	var runes []folded
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r = foldRune(r); r >= 0 {
+			runes = append(runes, folded{r, i, i + size})
+		}
+		i += size
+	}
+	for start := 0; start < len(runes); {
+		end, letters := start, false
+		for ; end < len(runes) && (isWordRune(runes[end].r) || leet[runes[end].r] != 0); end++ {
+			letters = letters || unicode.IsLetter(runes[end].r)
+		}
+		for i := start; letters && i < end; i++ {
+			if plain := leet[runes[i].r]; plain != 0 {
+				runes[i].r = plain
+			}
+		}
+		start = max(end, start+1)
+	}
+	var n normalized
+	var b strings.Builder
+	for _, f := range runes {
+		b.WriteRune(f.r)
+		for i := utf8.RuneLen(f.r); i > 0; i-- {
+			n.from = append(n.from, f.from)
+			n.to = append(n.to, f.to)
+		}
+	}
+	n.text = b.String()
+	return n
+}
+
+// foldRune returns the rune r reads as, or -1 if it is invisible.
+func foldRune(r rune) rune {
+	switch {
+	case unicode.In(r, unicode.Cf, unicode.Mn, unicode.Me):
+		return -1
+	case r >= 0xFF01 && r <= 0xFF5E: // fullwidth ASCII
+		r -= 0xFF01 - '!'
+	case r >= 0x1D400 && r <= 0x1D6A3: // mathematical letters, 52 to a style
+		r = 'a' + (r-0x1D400)%52%26
+	case r >= 0x1D7CE && r <= 0x1D7FF: // mathematical digits, 10 to a style
+		r = '0' + (r-0x1D7CE)%10
+	case r >= 0x24B6 && r <= 0x24E9: // circled letters, capitals first
+		r = 'a' + (r-0x24B6)%26
+	}
+	if plain, ok := capitalLookalikes[r]; ok {
+		return plain
+	}
+	r = unicode.ToLower(r)
+	if plain, ok := lookalikes[r]; ok {
+		return plain
+	}
+	return r
+}
+
+// capitalLookalikes maps Cyrillic and Greek capitals to the Latin letters
+// they look like. They are looked up before lowercasing, since several
+// lowercase to letters that look different.
+var capitalLookalikes = lookalikeTable(map[rune]string{
+	'a': "АΑ", 'b': "ВΒ", 'c': "С", 'e': "ЕΕ", 'h': "НΗ", 'i': "ІΙ", 'j': "Ј", 'k': "КΚ", 'm': "МΜ",
+	'n': "Ν", 'o': "ОΟ", 'p': "РΡ", 's': "Ѕ", 't': "ТΤ", 'x': "ХΧ", 'y': "УΥ", 'z': "Ζ",
+})
+
+// lookalikes maps accented Latin letters, and Cyrillic and Greek letters
+// that look like Latin ones, to plain Latin letters. Keys are lowercase.
+var lookalikes = lookalikeTable(map[rune]string{
+	'a': "àáâãäåāăąǎаα",
+	'b': "ƀ",
+	'c': "çćĉċčсϲ",
+	'd': "ďđԁ",
+	'e': "èéêëēĕėęěеёєε",
+	'g': "ĝğġģǧ",
+	'h': "ĥħһ",
+	'i': "ìíîïĩīĭįıǐіїιί",
+	'j': "ĵј",
+	'k': "ķκ",
+	'l': "ĺļľŀłӏ",
+	'n': "ñńņňŉ",
+	'o': "òóôõöøōŏőǒоοό",
+	'p': "рρ",
+	'q': "ԛ",
+	'r': "ŕŗř",
+	's': "śŝşšѕ",
+	't': "ţťŧ",
+	'u': "ùúûüũūŭůűųǔυ",
+	'v': "ν",
+	'w': "ŵԝ",
+	'x': "хχ",
+	'y': "ýÿŷу",
+	'z': "źżž",
+})
+
+func lookalikeTable(letters map[rune]string) map[rune]rune {
+	table := make(map[rune]rune)
+	for plain, alikes := range letters {
+		for _, r := range alikes {
+			table[r] = plain
+		}
+	}
+	return table
+}
+
+// leet maps the digits and symbols of leetspeak to the letters they stand
+// for.
+var leet = map[rune]rune{'0': 'o', '1': 'i', '3': 'e', '4': 'a', '5': 's', '7': 't', '@': 'a', '$': 's'}
+
+// screening collects what the word filters said about the fields of a
+// submission.
+type screening struct {
+	v validator
+	// hold is why the submission is held for review, if it is.
+	hold string
+}
+
+// screenLocked applies the site's word filters, and sr's if sr is not nil,
+// to text, the named field of a submission. Rejections are added to s.v,
+// and the first review filter to match sets s.hold. Masked matches are
+// replaced in text. The caller holds e.mu.
+func (e *RedditEngine) screenLocked(s *screening, sr *SubReddit, field string, text *string) {
+	type list struct {
+		filters []*WordFilter
+		owner   string
+	}
+	lists := []list{{e.wordFilters, "this site"}}
+	if sr != nil {
+		lists = append(lists, list{sr.WordFilters, "r/" + sr.Name})
+	}
+	var n *normalized
+	var masks [][2]int
+	for _, l := range lists {
+		for _, f := range l.filters {
+			if n == nil {
+				folded := normalizeText(*text)
+				n = &folded
+			}
+			for _, m := range f.find(*n) {
+				from, to := n.from[m[0]], n.to[m[1]-1]
+				switch f.Action {
+				case FilterReject:
+					s.v.add(field, "contains %q, which %s does not allow", excerpt((*text)[from:to]), l.owner)
+					return
+				case FilterReview:
+					if s.hold == "" {
+						s.hold = fmt.Sprintf("Held for review: the %s contains %q", field, excerpt((*text)[from:to]))
+					}
+				case FilterMask:
+					masks = append(masks, [2]int{from, to})
+				}
+			}
+		}
+	}
+	if len(masks) > 0 {
+		*text = mask(*text, masks)
+	}
+}
+
+// excerpt returns a match as it is quoted to people: without invisible
+// characters, and shortened if it is long.
+func excerpt(s string) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range s {
+		if foldRune(r) < 0 {
+			continue
+		}
+		if n++; n > maxExcerpt {
+			b.WriteString("…")
+			break
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// mask replaces the characters in the given byte ranges of s with
+// asterisks, dropping invisible ones.
+func mask(s string, ranges [][2]int) string {
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+	var b strings.Builder
+	last := 0
+	for _, r := range ranges {
+		if r[1] <= last {
+			continue
+		}
+		start := max(r[0], last)
+		b.WriteString(s[last:start])
+		for _, c := range s[start:r[1]] {
+			if foldRune(c) >= 0 {
+				b.WriteByte('*')
+			}
+		}
+		last = r[1]
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+// wordFiltersLocked returns the list of word filters of sr, or the site's
+// if sr is nil, after checking that actor may manage it. The caller holds
+// e.mu.
+func (e *RedditEngine) wordFiltersLocked(actor *User, sr *SubReddit) (*[]*WordFilter, error) {
+	if sr == nil {
+		if err := requireAdmin(actor); err != nil {
+			return nil, err
+		}
+		return &e.wordFilters, nil
+	}
+	if !canModerate(actor, sr) {
+		return nil, errorf(ErrForbidden, "only moderators of r/%s can manage its word filters", sr.Name)
+	}
+	return &sr.WordFilters, nil
+}
+
+// WordFilters returns the word filters of sr, or the site's if sr is nil.
+// Only sr's moderators, or admins for the site's, may see them.
+func (e *RedditEngine) WordFilters(ctx context.Context, actor *User, sr *SubReddit) ([]WordFilter, error) {
+	ctx, span := tracing.Start(ctx, "engine.WordFilters")
+	defer span.End()
+	e.lockContext(ctx)
+	defer e.mu.Unlock()
+	list, err := e.wordFiltersLocked(actor, sr)
+	if err != nil {
+		return nil, err
+	}
+	filters := make([]WordFilter, 0, len(*list))
+	for _, f := range *list {
+		filters = append(filters, *f)
+	}
+	return filters, nil
+}
+
+// AddWordFilter adds f to the word filters of sr, or to the site's if sr
+// is nil, and returns it with its ID.
+func (e *RedditEngine) AddWordFilter(ctx context.Context, actor *User, sr *SubReddit, f WordFilter) (WordFilter, error) {
+	ctx, span := tracing.Start(ctx, "engine.AddWordFilter")
+	defer span.End()
+	if err := f.compile(); err != nil {
+		return WordFilter{}, err
+	}
+	e.lockContext(ctx)
+	defer e.mu.Unlock()
+	list, err := e.wordFiltersLocked(actor, sr)
+	if err != nil {
+		return WordFilter{}, err
+	}
+	owner := filterOwner(sr)
+	if len(*list) >= MaxWordFilters {
+		return WordFilter{}, errorf(ErrConflict, "%s already has %d word filters", owner, MaxWordFilters)
+	}
+	for _, other := range *list {
+		if other.Kind == f.Kind && other.Pattern == f.Pattern {
+			return WordFilter{}, errorf(ErrConflict, "%s already has word filter %d for %q", owner, other.ID, f.Pattern)
+		}
+	}
+	now := e.now()
+	f.ID, f.CreatedAt = 1, now
+	if n := len(*list); n > 0 {
+		f.ID = (*list)[n-1].ID + 1
+	}
+	*list = append(*list, &f)
+	e.wordFiltersChangedLocked(ctx, actor, sr, AuditWordFilterAdd, &f, now)
+	return f, nil
+}
+
+// RemoveWordFilter removes filter id from the word filters of sr, or from
+// the site's if sr is nil.
+func (e *RedditEngine) RemoveWordFilter(ctx context.Context, actor *User, sr *SubReddit, id int) error {
+	ctx, span := tracing.Start(ctx, "engine.RemoveWordFilter")
+	defer span.End()
+	e.lockContext(ctx)
+	defer e.mu.Unlock()
+	list, err := e.wordFiltersLocked(actor, sr)
+	if err != nil {
+		return err
+	}
+	for i, f := range *list {
+		if f.ID == id {
+			*list = append((*list)[:i:i], (*list)[i+1:]...)
+			e.wordFiltersChangedLocked(ctx, actor, sr, AuditWordFilterRemove, f, e.now())
+			return nil
+		}
+	}
+	return errorf(ErrNotFound, "%s has no word filter %d", filterOwner(sr), id)
+}
+
+// wordFiltersChangedLocked records that f was added to or removed from a
+// list of word filters. The caller holds e.mu.
+func (e *RedditEngine) wordFiltersChangedLocked(ctx context.Context, actor *User, sr *SubReddit, action string, f *WordFilter, now time.Time) {
+	entry := AuditEntry{Action: action, TargetType: TargetWordFilter, TargetID: f.ID, Target: f.Pattern}
+	values := map[string]any{"kind": f.Kind, "pattern": f.Pattern, "action": f.Action}
+	if action == AuditWordFilterAdd {
+		entry.After = values
+	} else {
+		entry.Before = values
+	}
+	ev := Event{Type: EventWordFiltersChanged, Time: now}
+	if sr != nil {
+		sr.touch(now)
+		ev.SubRedditID, entry.SubRedditID = sr.ID, sr.ID
+	}
+	e.emit(ctx, ev)
+	e.audit(ctx, actor, entry)
+}
+
+func filterOwner(sr *SubReddit) string {
+	if sr == nil {
+		return "the site"
+	}
+	return "r/" + sr.Name
+}
+
+// QueueItem is a post, comment or message that a word filter held for
+// review. For a comment, Post is the post it is on.
+type QueueItem struct {
+	Post    *Post
+	Comment *Comment
+	Message *Message
+}
+
+// CreatedAt returns when the held post, comment or message was made.
+func (q QueueItem) CreatedAt() time.Time {
+	switch {
+	case q.Message != nil:
+		return q.Message.CreatedAt
+	case q.Comment != nil:
+		return q.Comment.CreatedAt
+	}
+	return q.Post.CreatedAt
+}
+
+// ModQueue returns the posts and comments in sr that word filters held for
+// review, newest first. Moderators approve them with RestorePost and
+// RestoreComment, and confirm their removal with RemovePost and
+// RemoveComment. If sr is nil, ModQueue returns everything held on the
+// site, including messages, and only admins may see it.
+func (e *RedditEngine) ModQueue(ctx context.Context, actor *User, sr *SubReddit) ([]QueueItem, error) {
+	ctx, span := tracing.Start(ctx, "engine.ModQueue")
+	defer span.End()
+	e.lockContext(ctx)
+	defer e.mu.Unlock()
+	var posts []*Post
+	switch {
+	case sr == nil:
+		if err := requireAdmin(actor); err != nil {
+			return nil, err
+		}
+		posts = sortedByID(e.posts)
+	case !canModerate(actor, sr):
+		return nil, errorf(ErrForbidden, "only moderators of r/%s can see its moderation queue", sr.Name)
+	default:
+		posts = sr.Posts
+	}
+	var queue []QueueItem
+	var walk func(p *Post, comments []*Comment)
+	walk = func(p *Post, comments []*Comment) {
+		for _, c := range comments {
+			if c.Held {
+				queue = append(queue, QueueItem{Post: p, Comment: c})
+			}
+			walk(p, c.Replies)
+		}
+	}
+	for _, p := range posts {
+		if p.Held {
+			queue = append(queue, QueueItem{Post: p})
+		}
+		walk(p, p.Comments)
+	}
+	if sr == nil {
+		for _, m := range sortedByID(e.Messages) {
+			if m.Held {
+				queue = append(queue, QueueItem{Message: m})
+			}
+		}
+	}
+	sort.SliceStable(queue, func(i, j int) bool { return queue[i].CreatedAt().After(queue[j].CreatedAt()) })
+	return queue, nil
+}
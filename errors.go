@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reddit-clone/engine"
+	"reddit-clone/logging"
+	"regexp"
+)
+
+// ErrorResponse is the body of every error response.
+type ErrorResponse struct {
+	Error ErrorBody `json:"error"`
+}
+
+type ErrorBody struct {
+	Code      string              `json:"code"`
+	Message   string              `json:"message"`
+	Details   []engine.FieldError `json:"details,omitempty"`
+	RequestID string              `json:"requestId,omitempty"`
+}
+
+// Error codes are part of the API contract; clients match on them rather
+// than on messages.
+const (
+	codeInvalidRequest   = "invalid_request"
+	codeValidationFailed = "validation_failed"
+	codeUnauthorized     = "unauthorized"
+	codeNotFound         = "not_found"
+	codeMethodNotAllowed = "method_not_allowed"
+	codeConflict         = "conflict"
+	codePayloadTooLarge  = "payload_too_large"
+	codeUnsupportedMedia = "unsupported_media_type"
+	codeForbidden        = "forbidden"
+	codeRateLimited      = "rate_limited"
+	codeReadOnly         = "read_only"
+	codeReplicaStale     = "replica_stale"
+	codeJournalGap       = "journal_gap"
+	codeNotImplemented   = "not_implemented"
+	codePartitionMoving  = "partition_moving"
+	codeNodeUnavailable  = "node_unavailable"
+	codeInternal         = "internal_error"
+)
+
+// apiError is an error raised by the HTTP layer itself, such as a malformed
+// body or path parameter.
+type apiError struct {
+	status int
+	code   string
+	msg    string
+}
+
+func (e *apiError) Error() string { return e.msg }
+
+func badRequest(msg string) error {
+	return &apiError{status: http.StatusBadRequest, code: codeInvalidRequest, msg: msg}
+}
+
+// writeError writes err as a JSON error response.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	status, body := errorBody(err)
+	body.RequestID = logging.RequestID(r.Context())
+	noteError(r, err)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: body})
+}
+
+// errorStatus returns the HTTP status err is reported with.
+func errorStatus(err error) int {
+	status, _ := errorBody(err)
+	return status
+}
+
+// errorBody is the single place where errors are mapped to HTTP statuses
+// and error codes.
+func errorBody(err error) (int, ErrorBody) {
+	status, body := http.StatusInternalServerError, ErrorBody{Code: codeInternal, Message: "internal server error"}
+
+	var apiErr *apiError
+	var validationErr *engine.ValidationError
+	switch {
+	case errors.As(err, &apiErr):
+		status, body.Code, body.Message = apiErr.status, apiErr.code, apiErr.msg
+	case errors.As(err, &validationErr):
+		status, body.Code, body.Message = http.StatusBadRequest, codeValidationFailed, "request failed validation"
+		body.Details = validationErr.Fields
+	case errors.Is(err, engine.ErrInvalid):
+		status, body.Code, body.Message = http.StatusBadRequest, codeInvalidRequest, err.Error()
+	case errors.Is(err, engine.ErrNotFound):
+		status, body.Code, body.Message = http.StatusNotFound, codeNotFound, err.Error()
+	case errors.Is(err, engine.ErrConflict):
+		status, body.Code, body.Message = http.StatusConflict, codeConflict, err.Error()
+	case errors.Is(err, engine.ErrForbidden):
+		status, body.Code, body.Message = http.StatusForbidden, codeForbidden, err.Error()
+	case errors.Is(err, engine.ErrRateLimited):
+		status, body.Code, body.Message = http.StatusTooManyRequests, codeRateLimited, err.Error()
+	}
+	return status, body
+}
+
+// maxBodyBytes bounds request bodies. The largest valid body is a post with
+// MaxPostLength characters of content, which fits comfortably.
+const maxBodyBytes = 512 << 10
+
+// decodeJSON decodes the request body into v.
+func decodeJSON(r *http.Request, v any) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return bodyError(err)
+	}
+	return nil
+}
+
+// bodyError converts an error from reading or decoding the request body.
+func bodyError(err error) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return &apiError{
+			status: http.StatusRequestEntityTooLarge,
+			code:   codePayloadTooLarge,
+			msg:    fmt.Sprintf("request body exceeds %d bytes", tooLarge.Limit),
+		}
+	}
+	return badRequest("invalid JSON body: " + err.Error())
+}
+
+// validRequestID limits client-supplied request IDs to something safe to
+// echo back and log.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// withRequestID tags each request with an ID, reusing the client's
+// X-Request-ID when it is well formed, and echoes it in the response.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(logging.WithRequestID(r.Context(), id)))
+	})
+}
+
+func newRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
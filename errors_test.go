@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// TestErrorResponses checks that failures of every kind are reported with
+// their status and code in the error envelope, tagged with the request ID.
+func TestErrorResponses(t *testing.T) {
+	c := newAPIClient(t, newTestAPI(newFixture(t).e))
+	for _, tc := range []struct {
+		method, path, user, body string
+		status                   int
+		code                     string
+	}{
+		{"GET", "/api/v1/users/nobody", "", "", http.StatusNotFound, codeNotFound},
+		{"GET", "/api/v1/nothing", "", "", http.StatusNotFound, codeNotFound},
+		{"DELETE", "/api/v1/users", "", "", http.StatusMethodNotAllowed, codeMethodNotAllowed},
+		{"POST", "/api/v1/users", "", `{"username":`, http.StatusBadRequest, codeInvalidRequest},
+		{"POST", "/api/v1/users", "", `{"username":""}`, http.StatusBadRequest, codeValidationFailed},
+		{"POST", "/api/v1/r", "", `{"name":"news"}`, http.StatusConflict, codeConflict},
+		{"POST", "/api/v1/users", "", `{"username":"` + strings.Repeat("x", maxBodyBytes) + `"}`, http.StatusRequestEntityTooLarge, codePayloadTooLarge},
+		{"PUT", "/api/v1/r/news/moderators/alice", "alice", "", http.StatusForbidden, codeForbidden},
+	} {
+		rec := c.do(tc.method, tc.path, tc.user, tc.body, "X-Request-ID", "req-1")
+		var resp ErrorResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Errorf("%s %s: body is not an error envelope: %s", tc.method, tc.path, rec.Body)
+			continue
+		}
+		if rec.Code != tc.status || resp.Error.Code != tc.code || resp.Error.Message == "" {
+			t.Errorf("%s %s: status %d, error %+v; want %d %s", tc.method, tc.path, rec.Code, resp.Error, tc.status, tc.code)
+		}
+		if resp.Error.RequestID != "req-1" || rec.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%s %s: request ID %q, Content-Type %q", tc.method, tc.path, resp.Error.RequestID, rec.Header().Get("Content-Type"))
+		}
+		if tc.code == codeValidationFailed && (len(resp.Error.Details) != 1 || resp.Error.Details[0].Field != "username") {
+			t.Errorf("validation details: %+v", resp.Error.Details)
+		}
+	}
+
+	// Malformed request IDs are replaced rather than echoed.
+	rec := c.do("GET", "/api/v1/users/nobody", "", "", "X-Request-ID", "bad id\n")
+	var resp ErrorResponse
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if id := rec.Header().Get("X-Request-ID"); id == "" || id != resp.Error.RequestID || strings.Contains(id, " ") {
+		t.Errorf("replaced request ID: header %q, body %q", id, resp.Error.RequestID)
+	}
+
+	// Errors nobody mapped are reported without their message.
+	status, body := errorBody(errors.New("database password is hunter2"))
+	if status != http.StatusInternalServerError || body.Code != codeInternal || strings.Contains(body.Message, "hunter2") {
+		t.Errorf("unmapped error: %d %+v", status, body)
+	}
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"reddit-clone/engine"
+	"reddit-clone/tracing"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Syndication feeds are built from the same engine data as the site's
+// pages into a feed, which is then written as RSS 2.0 or Atom depending on
+// the extension of the requested path.
+
+// feedLength is how many items a feed carries.
+const feedLength = 25
+
+// Feed formats, by path extension.
+const (
+	formatRSS  = "rss"
+	formatAtom = "atom"
+)
+
+// feedNamespace is the UUID namespace entry IDs are derived in, so that an
+// item keeps its ID when the site moves to another host.
+var feedNamespace = [16]byte{0x5c, 0x2e, 0x8f, 0x41, 0x0b, 0x7d, 0x4e, 0x93, 0xa6, 0x1f, 0xd2, 0x38, 0x6b, 0xc4, 0x90, 0x57}
+
+type feed struct {
+	ID          string
+	Title       string
+	Description string
+	// Link is the page the feed follows.
+	Link    string
+	Updated time.Time
+	Items   []feedItem
+}
+
+type feedItem struct {
+	ID        string
+	Title     string
+	Link      string
+	Author    string
+	Published time.Time
+	// HTML is the item's content as escaped HTML.
+	HTML string
+}
+
+// feedRoutes registers the feeds on the site router, each in both formats.
+func (s *site) feedRoutes() {
+	rt := s.router
+	for _, format := range []string{formatRSS, formatAtom} {
+		rt.Handle("GET", "/r/{name}/feed."+format, "feed.subreddit."+format, s.subredditFeed)
+		rt.Handle("GET", "/u/{username}/submitted."+format, "feed.submitted."+format, s.submittedFeed)
+		rt.Handle("GET", "/u/{username}/comments."+format, "feed.userComments."+format, s.userCommentsFeed)
+		rt.Handle("GET", "/posts/{id}/comments."+format, "feed.postComments."+format, s.postCommentsFeed)
+	}
+}
+
+// entryID returns a URN that identifies an entity for as long as it
+// exists: a version 5 UUID of its kind and ID.
+func entryID(kind string, ids ...int) string {
+	name := kind
+	for _, id := range ids {
+		name += "/" + strconv.Itoa(id)
+	}
+	h := sha1.New()
+	h.Write(feedNamespace[:])
+	h.Write([]byte(name))
+	u := h.Sum(nil)[:16]
+	u[6] = u[6]&0x0f | 0x50
+	u[8] = u[8]&0x3f | 0x80
+	return fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
+
+// baseURL is the scheme and host the request was made to, for the
+// absolute links feeds need.
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// feedFormat returns the format named by the path's extension.
+func feedFormat(r *http.Request) string {
+	if strings.HasSuffix(r.URL.Path, "."+formatAtom) {
+		return formatAtom
+	}
+	return formatRSS
+}
+
+// textHTML turns plain text into HTML paragraphs, escaping everything in
+// it, so user content cannot inject markup into feed readers.
+func textHTML(text string) string {
+	var b strings.Builder
+	for _, para := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n\n") {
+		if para = strings.TrimSpace(para); para != "" {
+			b.WriteString("<p>" + strings.ReplaceAll(html.EscapeString(para), "\n", "<br>") + "</p>")
+		}
+	}
+	return b.String()
+}
+
+// feedNotModified sets the feed's validators from an entity version and
+// reports whether the client's copy is current.
+func feedNotModified(w http.ResponseWriter, r *http.Request, kind string, id int, version uint64, modified time.Time) bool {
+	return checkFresh(w, r, etagFor(r, kind+"."+feedFormat(r), id, version), modified, cacheFeed)
+}
+
+func (s *site) feedError(w http.ResponseWriter, r *http.Request, err error) {
+	noteError(r, err)
+	status := errorStatus(err)
+	s.render(w, r, status, "error", http.StatusText(status), nil, err.Error())
+}
+
+func (s *site) subredditFeed(w http.ResponseWriter, r *http.Request) {
+	sr, err := s.api.engine.LookupSubRedditContext(r.Context(), pathParam(r, "name"))
+	if err != nil {
+		s.feedError(w, r, err)
+		return
+	}
+	order, err := parseSort(r.URL.Query().Get("sort"))
+	if err != nil {
+		s.feedError(w, r, err)
+		return
+	}
+	var version uint64
+	var modified time.Time
+	s.api.engine.ViewContext(r.Context(), func() { version, modified = sr.Version, sr.UpdatedAt })
+	if feedNotModified(w, r, "subreddit-feed", sr.ID, version, modified) {
+		return
+	}
+	posts := s.api.engine.GetFeedContext(r.Context(), sr)
+	base := baseURL(r)
+	var f feed
+	s.api.engine.ViewContext(r.Context(), func() {
+		page := base + "/r/" + url.PathEscape(sr.Name)
+		f = feed{
+			ID:          entryID("subreddit-feed-"+order, sr.ID),
+			Title:       "r/" + sr.Name + " (" + order + ")",
+			Description: "Posts in r/" + sr.Name + ", sorted by " + order,
+			Link:        page + "?sort=" + order,
+			Updated:     sr.UpdatedAt,
+		}
+		sortPosts(posts, order)
+		for _, p := range posts {
+			if len(f.Items) == feedLength {
+				break
+			}
+			if !p.Removed {
+				f.Items = append(f.Items, s.postItem(base, p))
+			}
+		}
+	})
+	writeFeed(w, r, &f)
+}
+
+func (s *site) submittedFeed(w http.ResponseWriter, r *http.Request) {
+	s.userFeed(w, r, "submitted", func(base string, user *engine.User, h engine.UserHistory, f *feed) {
+		f.Title = "Posts by " + user.Username
+		f.Description = "Posts submitted by " + user.Username
+		for _, p := range h.Posts {
+			if len(f.Items) == feedLength {
+				break
+			}
+			if !p.Removed {
+				f.Items = append(f.Items, s.postItem(base, p))
+			}
+		}
+	})
+}
+
+func (s *site) userCommentsFeed(w http.ResponseWriter, r *http.Request) {
+	s.userFeed(w, r, "comments", func(base string, user *engine.User, h engine.UserHistory, f *feed) {
+		f.Title = "Comments by " + user.Username
+		f.Description = "Comments written by " + user.Username
+		for _, ref := range h.Comments {
+			if len(f.Items) == feedLength {
+				break
+			}
+			if !ref.Comment.Removed && !ref.Post.Removed {
+				f.Items = append(f.Items, commentItem(base, ref.Post, ref.Comment))
+			}
+		}
+	})
+}
+
+// userFeed serves a feed of a user's contributions filled in by fill,
+// which runs inside View. A user's posts and comments are spread over the
+// whole engine, so the engine's revision is the feed's version.
+func (s *site) userFeed(w http.ResponseWriter, r *http.Request, kind string, fill func(base string, user *engine.User, h engine.UserHistory, f *feed)) {
+	user, err := s.api.engine.LookupUserContext(r.Context(), pathParam(r, "username"))
+	if err != nil {
+		s.feedError(w, r, err)
+		return
+	}
+	version, modified := s.api.engine.Revision()
+	if feedNotModified(w, r, kind+"-feed", user.ID, version, modified) {
+		return
+	}
+	h := s.api.engine.UserHistory(r.Context(), user)
+	base := baseURL(r)
+	f := feed{ID: entryID(kind+"-feed", user.ID), Link: base + "/", Updated: modified}
+	s.api.engine.ViewContext(r.Context(), func() { fill(base, user, h, &f) })
+	writeFeed(w, r, &f)
+}
+
+func (s *site) postCommentsFeed(w http.ResponseWriter, r *http.Request) {
+	post, err := s.api.postFromPath(r)
+	if err != nil {
+		s.feedError(w, r, err)
+		return
+	}
+	var version uint64
+	var modified time.Time
+	s.api.engine.ViewContext(r.Context(), func() { version, modified = post.Version, post.UpdatedAt })
+	if feedNotModified(w, r, "comments-feed", post.ID, version, modified) {
+		return
+	}
+	base := baseURL(r)
+	var f feed
+	s.api.engine.ViewContext(r.Context(), func() {
+		title := post.Title
+		if post.Removed {
+			title = "[removed]"
+		}
+		f = feed{
+			ID:          entryID("comments-feed", post.ID),
+			Title:       "Comments on " + title,
+			Description: "New comments on " + title,
+			Link:        base + "/posts/" + strconv.Itoa(post.ID),
+			Updated:     post.UpdatedAt,
+		}
+		var comments []*engine.Comment
+		walkComments(post.Comments, func(c *engine.Comment) {
+			if !c.Removed {
+				comments = append(comments, c)
+			}
+		})
+		sort.SliceStable(comments, func(i, j int) bool { return comments[i].CreatedAt.After(comments[j].CreatedAt) })
+		for _, c := range comments[:min(len(comments), feedLength)] {
+			f.Items = append(f.Items, commentItem(base, post, c))
+		}
+	})
+	writeFeed(w, r, &f)
+}
+
+// walkComments calls fn for every comment and reply, depth first.
+func walkComments(comments []*engine.Comment, fn func(*engine.Comment)) {
+	for _, c := range comments {
+		fn(c)
+		walkComments(c.Replies, fn)
+	}
+}
+
+// postItem is a post as a feed item. It must be called inside View.
+func (s *site) postItem(base string, p *engine.Post) feedItem {
+	link := base + "/posts/" + strconv.Itoa(p.ID)
+	subreddit := ""
+	if sr := s.api.engine.SubReddits[p.SubRedditID]; sr != nil {
+		subreddit = sr.Name
+	}
+	n := countComments(p.Comments)
+	return feedItem{
+		ID:        entryID("post", p.ID),
+		Title:     p.Title,
+		Link:      link,
+		Author:    p.Author.Username,
+		Published: p.CreatedAt,
+		HTML: textHTML(p.Content) + fmt.Sprintf(`<p>submitted by %s to <a href="%s">r/%s</a> · <a href="%s">%d comments</a></p>`,
+			html.EscapeString(p.Author.Username), html.EscapeString(base+"/r/"+url.PathEscape(subreddit)),
+			html.EscapeString(subreddit), html.EscapeString(link), n),
+	}
+}
+
+// commentItem is a comment as a feed item. It must be called inside View.
+func commentItem(base string, p *engine.Post, c *engine.Comment) feedItem {
+	title := p.Title
+	if p.Removed {
+		title = "[removed]"
+	}
+	return feedItem{
+		ID:        entryID("comment", p.ID, c.ID),
+		Title:     c.Author.Username + " on " + title,
+		Link:      base + "/posts/" + strconv.Itoa(p.ID) + "#c" + strconv.Itoa(c.ID),
+		Author:    c.Author.Username,
+		Published: c.CreatedAt,
+		HTML:      textHTML(c.Content),
+	}
+}
+
+// writeFeed writes f in the format the path asks for. The XML encoder
+// escapes the items' HTML, and replaces characters XML cannot carry.
+func writeFeed(w http.ResponseWriter, r *http.Request, f *feed) {
+	_, span := tracing.Start(r.Context(), "encode feed")
+	defer span.End()
+	self := baseURL(r) + r.URL.RequestURI()
+	var doc any
+	if feedFormat(r) == formatAtom {
+		w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+		doc = atomDocument(f, self)
+	} else {
+		w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+		doc = rssDocument(f, self)
+	}
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		noteError(r, err)
+	}
+}
+
+type rss struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	AtomNS  string     `xml:"xmlns:atom,attr"`
+	DCNS    string     `xml:"xmlns:dc,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	Self          atomLink  `xml:"atom:link"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	GUID        rssGUID `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+	Creator     string  `xml:"dc:creator"`
+	Description string  `xml:"description"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	ID          string `xml:",chardata"`
+}
+
+func rssDocument(f *feed, self string) *rss {
+	doc := &rss{
+		Version: "2.0",
+		AtomNS:  "http://www.w3.org/2005/Atom",
+		DCNS:    "http://purl.org/dc/elements/1.1/",
+		Channel: rssChannel{
+			Title:       f.Title,
+			Link:        f.Link,
+			Description: f.Description,
+			Self:        atomLink{Href: self, Rel: "self", Type: "application/rss+xml"},
+		},
+	}
+	if !f.Updated.IsZero() {
+		doc.Channel.LastBuildDate = f.Updated.UTC().Format(time.RFC1123Z)
+	}
+	for _, item := range f.Items {
+		doc.Channel.Items = append(doc.Channel.Items, rssItem{
+			Title:       item.Title,
+			Link:        item.Link,
+			GUID:        rssGUID{ID: item.ID},
+			PubDate:     item.Published.UTC().Format(time.RFC1123Z),
+			Creator:     item.Author,
+			Description: item.HTML,
+		})
+	}
+	return doc
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomEntry struct {
+	ID        string      `xml:"id"`
+	Title     string      `xml:"title"`
+	Updated   string      `xml:"updated"`
+	Published string      `xml:"published"`
+	Link      atomLink    `xml:"link"`
+	Author    atomAuthor  `xml:"author"`
+	Content   atomContent `xml:"content"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// atomDocument converts f to Atom. Entries are not edited once published
+// as far as a reader is concerned, so they are updated when published.
+func atomDocument(f *feed, self string) *atomFeed {
+	doc := &atomFeed{
+		ID:    f.ID,
+		Title: f.Title,
+		Links: []atomLink{
+			{Href: f.Link, Rel: "alternate", Type: "text/html"},
+			{Href: self, Rel: "self", Type: "application/atom+xml"},
+		},
+	}
+	updated := f.Updated
+	for _, item := range f.Items {
+		published := item.Published.UTC().Format(time.RFC3339)
+		doc.Entries = append(doc.Entries, atomEntry{
+			ID:        item.ID,
+			Title:     item.Title,
+			Updated:   published,
+			Published: published,
+			Link:      atomLink{Href: item.Link, Rel: "alternate", Type: "text/html"},
+			Author:    atomAuthor{Name: item.Author},
+			Content:   atomContent{Type: "html", Body: item.HTML},
+		})
+		if item.Published.After(updated) {
+			updated = item.Published
+		}
+	}
+	doc.Updated = updated.UTC().Format(time.RFC3339)
+	return doc
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"reddit-clone/engine"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// serverEnv makes the test binary run the server with the arguments it
+// holds instead of the tests, so that tests can run servers as real
+// processes.
+const serverEnv = "REDDIT_TEST_SERVER"
+
+func TestMain(m *testing.M) {
+	if args := os.Getenv(serverEnv); args != "" {
+		os.Args = append(os.Args[:1], strings.Fields(args)...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// serverProcess is an API server running in its own process.
+type serverProcess struct {
+	url  string
+	cmd  *exec.Cmd
+	once sync.Once
+}
+
+// startServer runs an API server listening on addr with the extra flags in
+// args, and waits until it is ready. It is stopped when the test ends.
+func startServer(t *testing.T, addr, args string) *serverProcess {
+	t.Helper()
+	s := &serverProcess{url: "http://" + addr, cmd: exec.Command(os.Args[0])}
+	s.cmd.Env = append(os.Environ(), serverEnv+"=-api -log-level off -addr "+addr+" "+args)
+	s.cmd.Stderr = os.Stderr
+	if err := s.cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.stop)
+	waitFor(t, "server "+addr+" is ready", func() bool {
+		resp, err := http.Get(s.url + "/readyz")
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	})
+	return s
+}
+
+// stop shuts the server down and waits for it to exit.
+func (s *serverProcess) stop() {
+	s.once.Do(func() {
+		s.cmd.Process.Signal(os.Interrupt)
+		s.cmd.Wait()
+	})
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// fixture is the small site API tests start from: alice; bob, an admin
+// who moderates and belongs to news; bob's post in news with a comment by
+// alice; and a message from bob to alice. Tests add whatever else they
+// need themselves.
+type fixture struct {
+	e       *engine.RedditEngine
+	alice   *engine.User
+	bob     *engine.User
+	news    *engine.SubReddit
+	post    *engine.Post
+	comment *engine.Comment
+	message *engine.Message
+}
+
+func newFixture(t testing.TB) *fixture {
+	t.Helper()
+	ctx := context.Background()
+	f := &fixture{e: engine.NewRedditEngine()}
+	e := f.e
+	var err error
+	check := func(what string) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("fixture: %s: %v", what, err)
+		}
+	}
+	f.alice, err = e.RegisterAccount("alice")
+	check("registering alice")
+	f.bob, err = e.RegisterAccount("bob")
+	check("registering bob")
+	err = e.GrantAdmin(ctx, nil, f.bob)
+	check("granting bob the admin role")
+	f.news, err = e.CreateSubReddit("news")
+	check("creating news")
+	err = e.AddModerator(ctx, f.bob, f.bob, f.news)
+	check("making bob a moderator")
+	err = e.JoinSubReddit(f.bob, f.news)
+	check("joining news")
+	f.post, err = e.CreatePost(f.bob, f.news, "Welcome", "First post")
+	check("posting")
+	f.comment, err = e.CreateComment(f.alice, f.post, "Thanks")
+	check("commenting")
+	f.message, err = e.SendMessage(f.bob, f.alice, "Hello")
+	check("sending a message")
+	return f
+}
+
+// testAdminToken is the admin token of APIs made with newTestAPI.
+const testAdminToken = "admin-secret"
+
+// newTestAPI returns an API for e that accepts testAdminToken.
+func newTestAPI(e *engine.RedditEngine) *API {
+	api := NewAPI(e)
+	api.SetAdminToken(testAdminToken)
+	return api
+}
+
+// apiClient sends requests straight to an API handler in tests, naming the
+// acting user in the X-Username header. It sends testAdminToken too, which
+// only matters when the user is an admin; pass an empty Authorization
+// header to leave it out.
+type apiClient struct {
+	t testing.TB
+	h http.Handler
+}
+
+func newAPIClient(t testing.TB, h http.Handler) *apiClient {
+	return &apiClient{t: t, h: h}
+}
+
+// do sends a request as user, or anonymously if user is empty. Extra
+// headers are given as name, value pairs.
+func (c *apiClient) do(method, path, user, body string, header ...string) *httptest.ResponseRecorder {
+	c.t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if user != "" {
+		req.Header.Set("X-Username", user)
+	}
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	rec := httptest.NewRecorder()
+	c.h.ServeHTTP(rec, req)
+	return rec
+}
+
+// mustDo is do for requests that have to succeed. The response is decoded
+// into resp unless it is nil.
+func (c *apiClient) mustDo(method, path, user, body string, resp any) *httptest.ResponseRecorder {
+	c.t.Helper()
+	rec := c.do(method, path, user, body)
+	if rec.Code != http.StatusOK {
+		c.t.Fatalf("%s %s: status %d\n%s", method, path, rec.Code, rec.Body)
+	}
+	if resp != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), resp); err != nil {
+			c.t.Fatalf("%s %s: decoding response: %v\n%s", method, path, err, rec.Body)
+		}
+	}
+	return rec
+}
+
+// browser sends form posts and page requests to the HTML pages, keeping
+// the cookies they set.
+type browser struct {
+	h       http.Handler
+	cookies []*http.Cookie
+}
+
+// do sends a request with form as its body, or no body if form is nil.
+// Extra headers are given as name, value pairs.
+func (b *browser) do(method, path string, form url.Values, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	for _, c := range b.cookies {
+		req.AddCookie(c)
+	}
+	rec := httptest.NewRecorder()
+	b.h.ServeHTTP(rec, req)
+	b.cookies = append(b.cookies, rec.Result().Cookies()...)
+	return rec
+}
+
+var csrfField = regexp.MustCompile(`name="csrf" value="([^"]+)"`)
+
+// csrfToken returns the CSRF token in the forms of a rendered page.
+func csrfToken(t testing.TB, page *httptest.ResponseRecorder) string {
+	t.Helper()
+	token := csrfField.FindStringSubmatch(page.Body.String())
+	if token == nil {
+		t.Fatalf("page has no CSRF token:\n%s", page.Body)
+	}
+	return token[1]
+}
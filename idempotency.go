@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultIdempotencyWindow is how long a response is kept for replay.
+const defaultIdempotencyWindow = 24 * time.Hour
+
+const maxIdempotencyKeyLength = 255
+
+// maxIdempotencyEntries caps the responses kept for replay. Once it is
+// reached the oldest stored responses are dropped before the window ends;
+// requests still in flight are never dropped.
+const maxIdempotencyEntries = 10000
+
+const (
+	codeIdempotencyInFlight = "idempotency_in_flight"
+	codeIdempotencyMismatch = "idempotency_key_reused"
+	codeIdempotencyFull     = "idempotency_store_full"
+)
+
+// idempotencyStore remembers the first response to each POST carrying an
+// Idempotency-Key header, scoped by the acting user, and replays it to
+// retries of the same request within the window.
+type idempotencyStore struct {
+	mu      sync.Mutex
+	window  time.Duration
+	entries map[idempotencyScope]*idempotencyEntry
+	// order lists the scopes in entries by creation time, so expired
+	// entries can be dropped from the front.
+	order *list.List
+	// max is the most entries kept.
+	max int
+	now func() time.Time
+}
+
+type idempotencyScope struct {
+	user string
+	key  string
+}
+
+type idempotencyEntry struct {
+	fingerprint [sha256.Size]byte
+	created     time.Time
+	done        bool
+	status      int
+	header      http.Header
+	body        []byte
+	// elem is the entry's place in the store's order.
+	elem *list.Element
+}
+
+func newIdempotencyStore(window time.Duration) *idempotencyStore {
+	return &idempotencyStore{
+		window:  window,
+		entries: make(map[idempotencyScope]*idempotencyEntry),
+		order:   list.New(),
+		max:     maxIdempotencyEntries,
+		now:     time.Now,
+	}
+}
+
+// SetIdempotencyWindow sets how long responses to requests with an
+// Idempotency-Key are kept for replay.
+func (api *API) SetIdempotencyWindow(window time.Duration) {
+	api.idempotency.mu.Lock()
+	defer api.idempotency.mu.Unlock()
+	api.idempotency.window = window
+}
+
+// middleware deduplicates POST requests that carry an Idempotency-Key.
+func (s *idempotencyStore) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if r.Method != http.MethodPost || key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			writeError(w, r, badRequest("Idempotency-Key is too long"))
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, r, bodyError(err))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		scope := idempotencyScope{user: actingUser(r, body), key: key}
+		fingerprint := sha256.Sum256(append([]byte(r.Method+" "+r.URL.RequestURI()+"\n"), body...))
+
+		entry, existed, ok := s.begin(scope, fingerprint)
+		if !ok {
+			writeError(w, r, &apiError{status: http.StatusServiceUnavailable, code: codeIdempotencyFull,
+				msg: "too many requests with an Idempotency-Key are being processed"})
+			return
+		}
+		if existed {
+			switch {
+			case entry.fingerprint != fingerprint:
+				writeError(w, r, &apiError{status: http.StatusUnprocessableEntity, code: codeIdempotencyMismatch,
+					msg: "Idempotency-Key was already used for a different request"})
+			case !entry.done:
+				writeError(w, r, &apiError{status: http.StatusConflict, code: codeIdempotencyInFlight,
+					msg: "a request with this Idempotency-Key is still being processed"})
+			default:
+				for name, values := range entry.header {
+					if name != "X-Request-Id" {
+						w.Header()[name] = values
+					}
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(entry.status)
+				w.Write(entry.body)
+			}
+			return
+		}
+
+		defer func() {
+			// A panicking handler leaves no response to replay, so the key
+			// must not stay in flight.
+			if p := recover(); p != nil {
+				s.abandon(scope)
+				panic(p)
+			}
+		}()
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		s.finish(scope, rec)
+	})
+}
+
+// begin returns the entry for scope, creating an in-flight one if there is
+// none. existed reports whether the entry was already there. At the cap the
+// oldest stored responses make room for the new entry; ok is false if every
+// entry is still in flight.
+func (s *idempotencyStore) begin(scope idempotencyScope, fingerprint [sha256.Size]byte) (entry idempotencyEntry, existed, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+	if e, ok := s.entries[scope]; ok {
+		return *e, true, true
+	}
+	for elem := s.order.Front(); elem != nil && len(s.entries) >= s.max; {
+		next := elem.Next()
+		if old := elem.Value.(idempotencyScope); s.entries[old].done {
+			s.remove(old)
+		}
+		elem = next
+	}
+	if len(s.entries) >= s.max {
+		return idempotencyEntry{}, false, false
+	}
+	s.entries[scope] = &idempotencyEntry{fingerprint: fingerprint, created: s.now(), elem: s.order.PushBack(scope)}
+	return idempotencyEntry{}, false, true
+}
+
+// finish stores the response. Server errors are not stored, so the client
+// can retry them with the same key.
+func (s *idempotencyStore) finish(scope idempotencyScope, rec *responseRecorder) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[scope]
+	if !ok {
+		return
+	}
+	if rec.status >= 500 {
+		s.remove(scope)
+		return
+	}
+	entry.done = true
+	entry.status = rec.status
+	entry.header = rec.Header().Clone()
+	entry.body = rec.body.Bytes()
+}
+
+// abandon forgets the in-flight request for scope, so the client can retry
+// it with the same key.
+func (s *idempotencyStore) abandon(scope idempotencyScope) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry, ok := s.entries[scope]; ok && !entry.done {
+		s.remove(scope)
+	}
+}
+
+// expire drops entries older than the window. The caller holds s.mu.
+func (s *idempotencyStore) expire() {
+	cutoff := s.now().Add(-s.window)
+	for elem := s.order.Front(); elem != nil; elem = s.order.Front() {
+		scope := elem.Value.(idempotencyScope)
+		if s.entries[scope].created.After(cutoff) {
+			break
+		}
+		s.remove(scope)
+	}
+}
+
+// remove drops the entry for scope. The caller holds s.mu.
+func (s *idempotencyStore) remove(scope idempotencyScope) {
+	if entry, ok := s.entries[scope]; ok {
+		s.order.Remove(entry.elem)
+		delete(s.entries, scope)
+	}
+}
+
+// actingUser identifies who is making a request: the X-Username header, or
+// failing that the username or sender named in the JSON body.
+func actingUser(r *http.Request, body []byte) string {
+	if user := r.Header.Get("X-Username"); user != "" {
+		return user
+	}
+	var fields struct {
+		Username string `json:"username"`
+		From     string `json:"from"`
+	}
+	json.Unmarshal(body, &fields)
+	if fields.Username != "" {
+		return fields.Username
+	}
+	return fields.From
+}
+
+// responseRecorder passes a response through while keeping a copy.
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status = status
+		rec.wroteHeader = true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	rec.wroteHeader = true
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestIdempotency checks that a retried POST with the same Idempotency-Key
+// is answered from the first response, and that reusing a key for another
+// request, or while the first is running, is refused.
+func TestIdempotency(t *testing.T) {
+	f := newFixture(t)
+	c := newAPIClient(t, newTestAPI(f.e))
+	submit := func(key, title string) *httptest.ResponseRecorder {
+		return c.do("POST", "/api/v1/r/news/posts", "bob", `{"title":"`+title+`","username":"bob"}`, "Idempotency-Key", key)
+	}
+
+	first := submit("k1", "Once")
+	retry := submit("k1", "Once")
+	if first.Code != http.StatusOK || retry.Code != http.StatusOK || retry.Body.String() != first.Body.String() {
+		t.Fatalf("retry: status %d then %d\n%s\n%s", first.Code, retry.Code, first.Body, retry.Body)
+	}
+	if retry.Header().Get("Idempotent-Replayed") != "true" || first.Header().Get("Idempotent-Replayed") != "" {
+		t.Error("only the retry should be marked as replayed")
+	}
+	if n := len(f.e.GetFeed(f.news)); n != 2 {
+		t.Errorf("news has %d posts after a retry, want 2", n)
+	}
+	if rec := submit("k1", "Twice"); rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), codeIdempotencyMismatch) {
+		t.Errorf("key reused for another body: status %d\n%s", rec.Code, rec.Body)
+	}
+	// Keys are scoped by user.
+	if rec := c.do("POST", "/api/v1/r/news/posts", "alice", `{"title":"Once","username":"alice"}`, "Idempotency-Key", "k1"); rec.Code != http.StatusOK || rec.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("same key from another user: status %d, replayed %q", rec.Code, rec.Header().Get("Idempotent-Replayed"))
+	}
+	if rec := submit(strings.Repeat("k", maxIdempotencyKeyLength+1), "Long"); rec.Code != http.StatusBadRequest {
+		t.Errorf("overlong key: status %d", rec.Code)
+	}
+}
+
+// TestIdempotencyStore checks the store on its own: in-flight requests,
+// server errors and panics, expiry, and the cap on entries.
+func TestIdempotencyStore(t *testing.T) {
+	now := time.Unix(0, 0)
+	s := newIdempotencyStore(time.Hour)
+	s.now = func() time.Time { return now }
+	var calls atomic.Int32
+	started, release := make(chan struct{}), make(chan struct{})
+	status := http.StatusOK
+	h := s.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		switch r.URL.Path {
+		case "/slow":
+			started <- struct{}{}
+			<-release
+		case "/panic":
+			panic("boom")
+		}
+		w.WriteHeader(status)
+		fmt.Fprint(w, calls.Load())
+	}))
+	post := func(path, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, nil)
+		req.Header.Set("Idempotency-Key", key)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- post("/slow", "slow") }()
+	<-started
+	if rec := post("/slow", "slow"); rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), codeIdempotencyInFlight) {
+		t.Errorf("retry while in flight: status %d\n%s", rec.Code, rec.Body)
+	}
+	release <- struct{}{}
+	if rec := <-done; rec.Code != http.StatusOK {
+		t.Errorf("slow request: status %d", rec.Code)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("the handler's panic was swallowed")
+			}
+		}()
+		post("/panic", "panic")
+	}()
+	if _, ok := s.entries[idempotencyScope{key: "panic"}]; ok {
+		t.Error("a panicking request left its key in flight")
+	}
+
+	status = http.StatusServiceUnavailable
+	post("/", "error")
+	status = http.StatusOK
+	if rec := post("/", "error"); rec.Code != http.StatusOK || rec.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("retry after a server error: status %d, replayed %q", rec.Code, rec.Header().Get("Idempotent-Replayed"))
+	}
+
+	before := calls.Load()
+	if rec := post("/", "error"); rec.Header().Get("Idempotent-Replayed") != "true" || calls.Load() != before {
+		t.Error("a stored response was not replayed")
+	}
+	now = now.Add(time.Hour)
+	if post("/", "error"); calls.Load() != before+1 {
+		t.Error("an expired response was replayed")
+	}
+
+	s.max = 3
+	for i := 0; i < 5; i++ {
+		post("/", fmt.Sprint("cap", i))
+	}
+	if len(s.entries) != 3 {
+		t.Errorf("%d entries kept, want 3", len(s.entries))
+	}
+	if _, ok := s.entries[idempotencyScope{key: "cap0"}]; ok {
+		t.Error("the oldest entry was kept past the cap")
+	}
+	// Requests in flight are not dropped to make room, and when nothing
+	// else can be dropped new keys are refused.
+	go func() { done <- post("/slow", "held") }()
+	<-started
+	post("/", "cap5")
+	post("/", "cap6")
+	if _, ok := s.entries[idempotencyScope{key: "held"}]; !ok {
+		t.Error("an in-flight request was dropped at the cap")
+	}
+	s.max = 1
+	if rec := post("/", "full"); rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), codeIdempotencyFull) {
+		t.Errorf("new key with every entry in flight: status %d\n%s", rec.Code, rec.Body)
+	}
+	release <- struct{}{}
+	<-done
+	if s.order.Len() != len(s.entries) {
+		t.Errorf("%d scopes in order for %d entries", s.order.Len(), len(s.entries))
+	}
+}
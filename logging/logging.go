@@ -0,0 +1,126 @@
+// Package logging builds the structured loggers used by the server and the
+// simulator, and carries the request ID through contexts so that every log
+// record made while serving a request can be tied back to it.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// Options configures a logger.
+type Options struct {
+	// Level is "debug", "info", "warn", "error" or "off".
+	Level string
+	// Format is "text" or "json".
+	Format string
+	// File is the log file. Empty means standard error.
+	File string
+	// MaxSize rotates the file once it reaches this many bytes. Zero
+	// disables size-based rotation.
+	MaxSize int64
+	// MaxAge rotates the file once it is this old. Zero disables age-based
+	// rotation.
+	MaxAge time.Duration
+	// MaxBackups is how many rotated files are kept. Zero keeps them all.
+	MaxBackups int
+}
+
+// New returns a logger for opts and a Closer for its file, if any.
+func New(opts Options) (*slog.Logger, io.Closer, error) {
+	if strings.EqualFold(opts.Level, "off") {
+		return Discard(), nopCloser{}, nil
+	}
+	var level slog.Level
+	if opts.Level != "" {
+		if err := level.UnmarshalText([]byte(opts.Level)); err != nil {
+			return nil, nil, fmt.Errorf("log level: %w", err)
+		}
+	}
+
+	var w io.Writer = os.Stderr
+	var closer io.Closer = nopCloser{}
+	if opts.File != "" {
+		rw, err := NewRotatingWriter(opts.File, opts.MaxSize, opts.MaxAge, opts.MaxBackups)
+		if err != nil {
+			return nil, nil, err
+		}
+		w, closer = rw, rw
+	}
+
+	handlerOpts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	switch strings.ToLower(opts.Format) {
+	case "", "text":
+		h = slog.NewTextHandler(w, handlerOpts)
+	case "json":
+		h = slog.NewJSONHandler(w, handlerOpts)
+	default:
+		closer.Close()
+		return nil, nil, fmt.Errorf("log format %q: want text or json", opts.Format)
+	}
+	return slog.New(ContextHandler{h}), closer, nil
+}
+
+// Discard returns a logger that drops every record.
+func Discard() *slog.Logger {
+	return slog.New(discardHandler{})
+}
+
+// OrDiscard returns l, or a discarding logger if l is nil.
+func OrDiscard(l *slog.Logger) *slog.Logger {
+	if l == nil {
+		return Discard()
+	}
+	return l
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a context carrying the request ID.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID carried by ctx, or "".
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// ContextHandler adds the request ID from the record's context to every
+// record logged with a ...Context method.
+type ContextHandler struct {
+	slog.Handler
+}
+
+func (h ContextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h ContextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return ContextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h ContextHandler) WithGroup(name string) slog.Handler {
+	return ContextHandler{h.Handler.WithGroup(name)}
+}
+
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
@@ -0,0 +1,146 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupLayout is the timestamp suffix of rotated files. It sorts
+// chronologically.
+const backupLayout = "20060102T150405.000000000"
+
+// RotatingWriter appends to a file and, once the file reaches a maximum size
+// or age, renames it with a timestamp suffix and starts a new one. It is
+// safe for concurrent use.
+type RotatingWriter struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+	now    func() time.Time
+}
+
+// NewRotatingWriter opens path for appending. Zero limits disable the
+// corresponding rotation, and maxBackups of zero keeps every rotated file.
+func NewRotatingWriter(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*RotatingWriter, error) {
+	w := &RotatingWriter{path: path, maxSize: maxSize, maxAge: maxAge, maxBackups: maxBackups, now: time.Now}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *RotatingWriter) open() error {
+	f, err := os.OpenFile(w.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("opening log file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.file, w.size = f, info.Size()
+	// An existing file is as old as its last modification, so a restart
+	// does not postpone age-based rotation indefinitely.
+	w.opened = w.now()
+	if info.Size() > 0 {
+		w.opened = info.ModTime()
+	}
+	return nil
+}
+
+func (w *RotatingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return 0, os.ErrClosed
+	}
+	if w.due(len(p)) {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// due reports whether writing n more bytes should go to a new file.
+func (w *RotatingWriter) due(n int) bool {
+	if w.size == 0 {
+		return false
+	}
+	if w.maxSize > 0 && w.size+int64(n) > w.maxSize {
+		return true
+	}
+	return w.maxAge > 0 && w.now().Sub(w.opened) >= w.maxAge
+}
+
+// Rotate starts a new file immediately.
+func (w *RotatingWriter) Rotate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.rotate()
+}
+
+func (w *RotatingWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	backup := w.path + "." + w.now().UTC().Format(backupLayout)
+	if err := os.Rename(w.path, backup); err != nil {
+		return err
+	}
+	if err := w.open(); err != nil {
+		return err
+	}
+	w.opened = w.now()
+	return w.prune()
+}
+
+// prune removes the oldest rotated files beyond maxBackups.
+func (w *RotatingWriter) prune() error {
+	if w.maxBackups <= 0 {
+		return nil
+	}
+	matches, err := filepath.Glob(w.path + ".*")
+	if err != nil {
+		return err
+	}
+	var backups []string
+	for _, m := range matches {
+		if _, err := time.Parse(backupLayout, strings.TrimPrefix(m, w.path+".")); err == nil {
+			backups = append(backups, m)
+		}
+	}
+	sort.Strings(backups)
+	for len(backups) > w.maxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+func (w *RotatingWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
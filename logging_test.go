@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reddit-clone/logging"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestLogRotation checks that the log file is rotated by size and by age,
+// including the age of a file left by an earlier run, and that only
+// MaxBackups rotated files are kept.
+func TestLogRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "server.log")
+	backups := func() []string {
+		t.Helper()
+		matches, err := filepath.Glob(path + ".*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return matches
+	}
+
+	w, err := logging.NewRotatingWriter(path, 10, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n", "five\n", "six\n"} {
+		if _, err := w.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A write that does not fit starts a new file, keeping lines whole.
+	if b, _ := os.ReadFile(path); string(b) != "six\n" {
+		t.Errorf("current file %q", b)
+	}
+	if n := len(backups()); n != 2 {
+		t.Errorf("%d rotated files kept, want 2", n)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("late\n")); err == nil {
+		t.Error("write after Close succeeded")
+	}
+
+	// A file last written to two hours ago is rotated on the first write.
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+	w, err = logging.NewRotatingWriter(path, 0, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	w.Write([]byte("fresh\n"))
+	if b, _ := os.ReadFile(path); string(b) != "fresh\n" {
+		t.Errorf("file after age rotation %q", b)
+	}
+	if err := w.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(backups()); n != 4 {
+		t.Errorf("%d rotated files with no limit, want 4", n)
+	}
+}
+
+// TestLogRequestID checks that records logged while serving a request carry
+// its ID.
+func TestLogRequestID(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.log")
+	logger, closer, err := logging.New(logging.Options{Level: "info", Format: "json", File: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.InfoContext(logging.WithRequestID(context.Background(), "req-1"), "served")
+	logger.Debug("hidden")
+	closer.Close()
+
+	b, _ := os.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	var record map[string]any
+	if len(lines) != 1 || json.Unmarshal([]byte(lines[0]), &record) != nil {
+		t.Fatalf("log file:\n%s", b)
+	}
+	if record["msg"] != "served" || record["request_id"] != "req-1" {
+		t.Errorf("record %v", record)
+	}
+	if _, _, err := logging.New(logging.Options{Format: "xml"}); err == nil {
+		t.Error("unknown log format accepted")
+	}
+}
@@ -1,14 +1,25 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
 	"io/ioutil"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"reddit-clone/client"
 	"reddit-clone/engine"
+	"reddit-clone/logging"
+	"slices"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -19,8 +30,19 @@ type SimulationConfig struct {
 	NumComments int `json:"numComments"`
 	NumVotes    int `json:"numVotes"`
 	NumMessages int `json:"numMessages"`
+	// NumVoteRings vote rings of VoteRingSize accounts are injected after
+	// the run to test vote ring detection.
+	NumVoteRings int `json:"numVoteRings,omitempty"`
+	VoteRingSize int `json:"voteRingSize,omitempty"`
+	// RepostRate is the share of posts that repeat an earlier post, to
+	// test repost detection.
+	RepostRate float64 `json:"repostRate,omitempty"`
 }
 
+// defaultVoteRingSize is the size of injected vote rings when the
+// configuration does not give one.
+const defaultVoteRingSize = 5
+
 type Config struct {
 	Simulations []SimulationConfig `json:"simulations"`
 }
@@ -39,18 +61,49 @@ func readConfig(filePath string) (*Config, error) {
 }
 
 func main() {
+	if runCommand(os.Args[1:]) {
+		return
+	}
 	loggingFlag := flag.Bool("logging", true, "Enable or disable logging (true/false)")
 	apiFlag := flag.Bool("api", false, "Start the REST API server")
+	metricsAddrFlag := flag.String("metrics-addr", "", "Serve the simulator's metrics on this address while it runs, e.g. :9100")
+	metricsURLFlag := flag.String("metrics-url", "", "Metrics endpoint the simulator scrapes for its report (defaults to its own)")
+	serverFlags := registerServerFlags(flag.CommandLine)
 	flag.Parse()
 
+	cfg, err := loadServerConfig(serverFlags)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if !*loggingFlag {
+		cfg.Log.Level = "off"
+	}
+	if !*apiFlag && cfg.Log.File == "" {
+		// The simulator's own output goes to stdout, so its log goes to a
+		// file unless told otherwise.
+		cfg.Log.File = "reddit_simulation.log"
+	}
+	logger, logCloser, err := logging.New(cfg.Log.options())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	defer logCloser.Close()
+
 	if *apiFlag {
-		startAPIServer(*loggingFlag)
+		if err := startAPIServer(logger, cfg); err != nil {
+			logger.Error("server stopped", "err", err)
+			fmt.Fprintln(os.Stderr, err)
+			logCloser.Close()
+			os.Exit(1)
+		}
 	} else {
-		runSimulation(*loggingFlag)
+		runSimulation(logger, *metricsAddrFlag, *metricsURLFlag)
 	}
 }
 
-func runSimulation(loggingEnabled bool) {
+func runSimulation(logger *slog.Logger, metricsAddr, metricsURL string) {
 	configFile := "sim_config.json"
 	if _, err := os.Stat(configFile); os.IsNotExist(err) {
 		fmt.Println("Configuration file not found.")
@@ -64,55 +117,282 @@ func runSimulation(loggingEnabled bool) {
 	}
 
 	fmt.Printf("Loaded %d simulations from config.\n", len(config.Simulations))
-	for i, simConfig := range config.Simulations {
-		client.LoggingEnabled = loggingEnabled
-		if client.LoggingEnabled {
-			fmt.Println("Logging is enabled.")
-		} else {
-			fmt.Println("Logging is disabled.")
-		}
 
+	// The metrics endpoint serves whichever simulation is running.
+	var current atomic.Pointer[client.Simulator]
+	if metricsAddr != "" {
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if sim := current.Load(); sim != nil {
+				sim.Metrics.Handler().ServeHTTP(w, r)
+			}
+		})
+		go func() {
+			if err := http.ListenAndServe(metricsAddr, handler); err != nil {
+				fmt.Printf("Metrics server: %v\n", err)
+			}
+		}()
+		if metricsURL == "" {
+			metricsURL = "http://" + metricsHost(metricsAddr) + "/metrics"
+		}
+	}
+	for i, simConfig := range config.Simulations {
 		fmt.Printf("\nRunning simulation #%d with parameters: %+v\n", i+1, simConfig)
-		sim := client.NewSimulator()
+		sim := client.NewSimulator(logger.With("simulation", i+1))
+		sim.RepostRate = simConfig.RepostRate
+		current.Store(sim)
 		start := time.Now()
 		sim.Run(simConfig.NumUsers, simConfig.NumSRs, simConfig.NumPosts, simConfig.NumComments, simConfig.NumVotes, simConfig.NumMessages)
 		elapsed := time.Since(start)
 		fmt.Printf("Simulation #%d completed in %s\n", i+1, elapsed)
+		if simConfig.NumVoteRings > 0 {
+			size := simConfig.VoteRingSize
+			if size == 0 {
+				size = defaultVoteRingSize
+			}
+			injected := sim.InjectVoteRings(simConfig.NumVoteRings, size)
+			found, falsePositives := sim.CheckVoteRings(injected)
+			fmt.Printf("Vote rings: %d injected, %d detected, %d other accounts flagged\n", len(injected), found, falsePositives)
+		}
+		if simConfig.RepostRate > 0 {
+			submitted, detected, falseMatches := sim.CheckReposts()
+			fmt.Printf("Reposts: %d submitted, %d detected, %d original posts matched\n", submitted, detected, falseMatches)
+		}
 		fmt.Printf("Users: %d\n", len(sim.Engine.Users))
 		fmt.Printf("SubReddits: %d\n", len(sim.Engine.SubReddits))
 		fmt.Printf("Messages: %d\n", len(sim.Engine.Messages))
+		if samples, err := sim.ScrapeMetrics(metricsURL); err != nil {
+			fmt.Printf("Scraping metrics: %v\n", err)
+		} else {
+			client.WriteMetricsReport(os.Stdout, samples)
+		}
 		fmt.Println("-------------------------------")
 	}
 }
 
-func startAPIServer(loggingEnabled bool) {
+// metricsHost turns a listen address such as ":9100" into one that can be
+// dialled.
+func metricsHost(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// grantAdmins gives the configured users the admin role, registering any
+// that do not exist yet.
+func grantAdmins(e *engine.RedditEngine, names []string) error {
+	ctx := context.Background()
+	for _, name := range names {
+		user := e.GetUserByUsername(name)
+		if user == nil {
+			var err error
+			if user, err = e.RegisterAccount(name); err != nil {
+				return fmt.Errorf("admin %q: %w", name, err)
+			}
+		}
+		if err := e.GrantAdmin(ctx, nil, user); err != nil {
+			return fmt.Errorf("admin %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// startAPIServer serves the API until SIGINT or SIGTERM, then stops
+// accepting connections, waits for in-flight requests and saves the engine
+// state to the data file.
+func startAPIServer(logger *slog.Logger, cfg ServerConfig) error {
 	redditEngine := engine.NewRedditEngine()
+	redditEngine.SetLogger(logger)
+	// A follower's state comes from its leader, so it neither loads the
+	// data file nor grants admins; it still saves its copy on shutdown. A
+	// cluster node keeps its state in its partitions instead.
+	following := cfg.Replication.Follow != ""
+	clustered := cfg.Cluster.enabled()
+	if cfg.DataFile != "" && !following && !clustered {
+		err := redditEngine.LoadFile(cfg.DataFile)
+		switch {
+		case err == nil:
+			logger.Info("loaded state", "file", cfg.DataFile)
+		case !errors.Is(err, fs.ErrNotExist):
+			return fmt.Errorf("loading %s: %w", cfg.DataFile, err)
+		}
+	}
+	if cfg.AuditFile != "" {
+		auditFile, err := os.OpenFile(cfg.AuditFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return fmt.Errorf("opening audit file: %w", err)
+		}
+		defer auditFile.Close()
+		redditEngine.SetAuditWriter(auditFile)
+	}
 	api := NewAPI(redditEngine)
+	var replica *replicator
+	if cfg.Replication.enabled() {
+		replica = newReplicator(api, cfg.Replication, logger)
+		defer replica.Close()
+	}
+	if !following {
+		if err := grantAdmins(redditEngine, cfg.Admins); err != nil {
+			return err
+		}
+	}
+	api.SetIdempotencyWindow(time.Duration(cfg.IdempotencyWindow))
+	api.SetLogger(logger)
+	api.SetSessionSecret(cfg.SessionSecret)
+	api.SetAdminToken(cfg.AdminToken)
+	tracer, traces := cfg.Tracing.tracer(logger)
+	api.SetTracer(tracer)
+	var node *cluster
+	if clustered {
+		var err error
+		node, err = newCluster(api, cfg.Cluster, cfg.DataFile, logger, func(p *API) {
+			p.SetIdempotencyWindow(time.Duration(cfg.IdempotencyWindow))
+			p.SetLogger(logger)
+			p.SetTracer(tracer)
+		})
+		if err != nil {
+			return err
+		}
+	}
 
-	if loggingEnabled {
-		fmt.Println("Logging is enabled.")
+	tlsConfig, err := cfg.tlsConfig()
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	if node != nil {
+		// The HTML pages and the console read a single engine, so a
+		// cluster serves the API only.
+		mux.Handle("/api/", corsMiddleware(cfg.AllowedOrigins, node))
+		mux.Handle("/cluster/", node.Handler())
 	} else {
-		fmt.Println("Logging is disabled.")
+		mux.Handle("/api/", corsMiddleware(cfg.AllowedOrigins, api))
+		mux.Handle("/admin/", api.Console())
+		mux.Handle("/", api.Site())
+	}
+	mux.Handle("/metrics", api.MetricsHandler())
+	mux.HandleFunc("/healthz", api.Healthz)
+	mux.HandleFunc("/readyz", api.Readyz)
+	mux.Handle("/debug/traces", traces.Handler())
+	handler := http.Handler(mux)
+	if replica != nil {
+		mux.Handle("/replication/", replica.Handler())
+		handler = replica.Guard(mux)
+	}
+	server := &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           handler,
+		TLSConfig:         tlsConfig,
+		ReadTimeout:       time.Duration(cfg.ReadTimeout),
+		ReadHeaderTimeout: time.Duration(cfg.ReadHeaderTimeout),
+		WriteTimeout:      time.Duration(cfg.WriteTimeout),
+		IdleTimeout:       time.Duration(cfg.IdleTimeout),
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
 	}
 
-	http.Handle("/api/", corsMiddleware(api))
-	fmt.Println("REST API server is running on :8080")
-	http.ListenAndServe(":8080", nil)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// Cluster partitions move between nodes as snapshots, so they apply
+	// votes as they are cast.
+	if cfg.Votes.FlushInterval > 0 && !clustered {
+		redditEngine.BufferVotes(engine.VoteBuffering{Shards: cfg.Votes.Shards, Strict: cfg.Votes.Strict})
+		go redditEngine.RunVoteFlusher(ctx, time.Duration(cfg.Votes.FlushInterval))
+	}
+
+	listener, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		return fmt.Errorf("API server: %w", err)
+	}
+	scheme := "http"
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+		scheme = "https"
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(listener)
+	}()
+	api.SetReady(true)
+	logger.Info("REST API server is running", "addr", cfg.Addr, "scheme", scheme)
+	if replica != nil {
+		// Followers' log streams would hold up shutdown until it times out.
+		server.RegisterOnShutdown(replica.Close)
+		if following {
+			replica.Follow(cfg.Replication.Follow)
+		}
+	}
+
+	select {
+	case err := <-serveErr:
+		return fmt.Errorf("API server: %w", err)
+	case <-ctx.Done():
+	}
+	stop()
+
+	api.SetReady(false)
+	logger.Info("shutting down", "timeout", time.Duration(cfg.ShutdownTimeout))
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout))
+	defer cancel()
+	shutdownErr := server.Shutdown(shutdownCtx)
+	if shutdownErr != nil {
+		shutdownErr = fmt.Errorf("draining requests: %w", shutdownErr)
+	}
+	if err := tracer.Shutdown(shutdownCtx); err != nil {
+		logger.Warn("flushing traces", "err", err)
+	}
+	// Apply the votes cast since the flusher stopped, so followers get them
+	// too.
+	redditEngine.FlushVotes()
+
+	if node != nil {
+		if err := node.Save(); err != nil {
+			return errors.Join(shutdownErr, err)
+		}
+	} else if cfg.DataFile != "" {
+		if err := redditEngine.SaveFile(cfg.DataFile); err != nil {
+			return errors.Join(shutdownErr, fmt.Errorf("saving %s: %w", cfg.DataFile, err))
+		}
+		logger.Info("saved state", "file", cfg.DataFile)
+	}
+	return shutdownErr
 }
 
-// CORS Middleware
-func corsMiddleware(next http.Handler) http.Handler {
+// corsMiddleware allows cross-origin requests from the allowed origins. "*"
+// in the list allows any origin.
+func corsMiddleware(allowedOrigins []string, next http.Handler) http.Handler {
+	anyOrigin := slices.Contains(allowedOrigins, "*")
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		origin := r.Header.Get("Origin")
+		if origin != "" {
+			w.Header().Add("Vary", "Origin")
+		}
+		allowed := anyOrigin || (origin != "" && slices.Contains(allowedOrigins, origin))
+		if allowed {
+			if anyOrigin {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+			}
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Username, X-Request-ID, Idempotency-Key")
+			w.Header().Set("Access-Control-Expose-Headers", "Link, X-Total-Count, X-Request-ID, Idempotent-Replayed")
+		}
 
-		// Handle preflight (OPTIONS) requests
-		if r.Method == http.MethodOptions {
+		// Answer CORS preflights here; any other OPTIONS request goes to
+		// the router, which lists the methods the path allows.
+		if r.Method == http.MethodOptions && origin != "" && r.Header.Get("Access-Control-Request-Method") != "" {
+			if !allowed {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
 			w.WriteHeader(http.StatusOK)
 			return
 		}
 
 		next.ServeHTTP(w, r)
 	})
-}
\ No newline at end of file
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net/http"
+	"reddit-clone/cache"
+	"reddit-clone/metrics"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// readinessTimeout bounds how long /readyz waits for the engine lock.
+const readinessTimeout = 2 * time.Second
+
+// apiMetrics records per-route request counts and latencies.
+type apiMetrics struct {
+	registry *metrics.Registry
+	requests *metrics.CounterVec
+	duration *metrics.HistogramVec
+	inFlight atomic.Int64
+}
+
+func newAPIMetrics(api *API) *apiMetrics {
+	reg := metrics.NewRegistry()
+	m := &apiMetrics{
+		registry: reg,
+		requests: reg.NewCounterVec("http_requests_total", "HTTP requests by route and status.", "route", "status"),
+		duration: reg.NewHistogramVec("http_request_duration_seconds", "HTTP request latency by route and status.",
+			metrics.DefaultBuckets, "route", "status"),
+	}
+	reg.NewGaugeFunc("http_requests_in_flight", "HTTP requests currently being served.", func() float64 {
+		return float64(m.inFlight.Load())
+	})
+	metrics.RegisterEngine(reg, api.engine)
+	metrics.RegisterRuntime(reg)
+	registerCaches(reg, map[string]func() cache.Stats{
+		"responses": api.responses.Stats,
+		"listings":  api.listings.Stats,
+	})
+	return m
+}
+
+// registerCaches registers the counters and sizes of the caches, labelled
+// with their names.
+func registerCaches(reg *metrics.Registry, caches map[string]func() cache.Stats) {
+	stat := func(field func(cache.Stats) float64) func() map[string]float64 {
+		return func() map[string]float64 {
+			values := make(map[string]float64, len(caches))
+			for name, stats := range caches {
+				values[name] = field(stats())
+			}
+			return values
+		}
+	}
+	reg.NewCounterVecFunc("reddit_cache_hits_total", "Cache lookups answered from the cache.", "cache",
+		stat(func(s cache.Stats) float64 { return float64(s.Hits) }))
+	reg.NewCounterVecFunc("reddit_cache_misses_total", "Cache lookups that loaded the value.", "cache",
+		stat(func(s cache.Stats) float64 { return float64(s.Misses) }))
+	reg.NewCounterVecFunc("reddit_cache_shared_loads_total", "Cache lookups that waited for another request's load.", "cache",
+		stat(func(s cache.Stats) float64 { return float64(s.Shared) }))
+	reg.NewCounterVecFunc("reddit_cache_evictions_total", "Entries evicted to make room.", "cache",
+		stat(func(s cache.Stats) float64 { return float64(s.Evictions) }))
+	reg.NewCounterVecFunc("reddit_cache_invalidations_total", "Entries dropped because what they show changed.", "cache",
+		stat(func(s cache.Stats) float64 { return float64(s.Invalidations) }))
+	reg.NewGaugeVecFunc("reddit_cache_entries", "Entries in the cache.", "cache",
+		stat(func(s cache.Stats) float64 { return float64(s.Entries) }))
+	reg.NewGaugeVecFunc("reddit_cache_cost", "Total cost of the cached entries: bytes for responses, entries for listings.", "cache",
+		stat(func(s cache.Stats) float64 { return float64(s.Cost) }))
+}
+
+// middleware records every request under the name of the route that served
+// it, or "unmatched".
+func (m *apiMetrics) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.inFlight.Add(1)
+		defer m.inFlight.Add(-1)
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		route := routeSlotFrom(r.Context()).name()
+		status := strconv.Itoa(rec.status)
+		m.requests.Inc(route, status)
+		m.duration.Observe(time.Since(start).Seconds(), route, status)
+	})
+}
+
+// MetricsHandler serves the API and engine metrics in the Prometheus text
+// format.
+func (api *API) MetricsHandler() http.Handler {
+	return api.metrics.registry.Handler()
+}
+
+// SetReady marks the server as ready or not ready to receive traffic.
+func (api *API) SetReady(ready bool) {
+	api.ready.Store(ready)
+}
+
+type healthResponse struct {
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Healthz reports that the process is alive.
+func (api *API) Healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, healthResponse{Status: "ok"})
+}
+
+// Readyz reports whether the server should receive traffic: it has finished
+// starting, is not shutting down, is not a follower too far behind its
+// leader, and the engine lock can be acquired.
+func (api *API) Readyz(w http.ResponseWriter, r *http.Request) {
+	notReady := func(reason string) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		writeJSON(w, r, healthResponse{Status: "unavailable", Reason: reason})
+	}
+	if !api.ready.Load() {
+		notReady("starting or shutting down")
+		return
+	}
+	if api.replica != nil {
+		if reason := api.replica.unavailable(); reason != "" {
+			notReady(reason)
+			return
+		}
+	}
+	acquired := make(chan struct{})
+	go func() {
+		api.engine.View(func() {})
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		writeJSON(w, r, healthResponse{Status: "ready"})
+	case <-time.After(readinessTimeout):
+		notReady("engine is not responding")
+	}
+}
+
+// statusRecorder remembers the status code and body size written through
+// it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	bytes       int64
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status = status
+		rec.wroteHeader = true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	rec.wroteHeader = true
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += int64(n)
+	return n, err
+}
@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"reddit-clone/engine"
+	"runtime"
+)
+
+// RegisterEngine registers operation counters, lock contention, the vote
+// buffer and entity totals for e.
+func RegisterEngine(reg *Registry, e *engine.RedditEngine) {
+	ops := reg.NewCounterVec("reddit_engine_operations_total", "Engine mutations by event type.", "op")
+	e.Subscribe(func(ev engine.Event) {
+		ops.Inc(string(ev.Type))
+	})
+	reg.NewCounterFunc("reddit_engine_lock_acquisitions_total", "Number of times the engine mutex was acquired.", func() float64 {
+		return float64(e.LockStats().Acquisitions)
+	})
+	reg.NewCounterFunc("reddit_engine_lock_wait_seconds_total", "Total time spent waiting for the engine mutex.", func() float64 {
+		return e.LockStats().Wait.Seconds()
+	})
+	reg.NewCounterFunc("reddit_votes_buffered_total", "Votes taken into the vote buffer.", func() float64 {
+		return float64(e.VoteStats().Buffered)
+	})
+	reg.NewCounterFunc("reddit_votes_applied_total", "Buffered votes applied to scores and karma.", func() float64 {
+		return float64(e.VoteStats().Applied)
+	})
+	reg.NewCounterFunc("reddit_votes_dropped_total", "Buffered votes discarded when they were applied.", func() float64 {
+		return float64(e.VoteStats().Dropped)
+	})
+	reg.NewCounterFunc("reddit_vote_flushes_total", "Times buffered votes were applied.", func() float64 {
+		return float64(e.VoteStats().Flushes)
+	})
+	reg.NewGaugeFunc("reddit_votes_pending", "Buffered votes not applied yet.", func() float64 {
+		return float64(e.VoteStats().Pending)
+	})
+	reg.NewGaugeVecFunc("reddit_entities", "Number of stored entities by kind.", "kind", func() map[string]float64 {
+		c := e.Counts()
+		return map[string]float64{
+			"users":      float64(c.Users),
+			"subreddits": float64(c.SubReddits),
+			"posts":      float64(c.Posts),
+			"comments":   float64(c.Comments),
+			"messages":   float64(c.Messages),
+		}
+	})
+}
+
+// RegisterRuntime registers Go runtime metrics.
+func RegisterRuntime(reg *Registry) {
+	reg.NewGaugeFunc("go_goroutines", "Number of goroutines that currently exist.", func() float64 {
+		return float64(runtime.NumGoroutine())
+	})
+	reg.NewGaugeFunc("go_memstats_heap_alloc_bytes", "Bytes of allocated heap objects.", func() float64 {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		return float64(m.HeapAlloc)
+	})
+}
@@ -0,0 +1,377 @@
+// Package metrics is a small Prometheus-compatible metrics registry. It
+// supports labelled counters and histograms, and gauges and counters whose
+// values are read from a callback at scrape time, rendered in the Prometheus
+// text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are latency histogram bounds in seconds.
+var DefaultBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+// Registry holds metrics in registration order.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	name() string
+	write(w io.Writer)
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (reg *Registry) register(m metric) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	for _, existing := range reg.metrics {
+		if existing.name() == m.name() {
+			panic("metrics: duplicate metric " + m.name())
+		}
+	}
+	reg.metrics = append(reg.metrics, m)
+}
+
+// WriteText writes every metric in the Prometheus text format.
+func (reg *Registry) WriteText(w io.Writer) {
+	reg.mu.Lock()
+	metrics := append([]metric(nil), reg.metrics...)
+	reg.mu.Unlock()
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// Handler serves the registry for scraping.
+func (reg *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		reg.WriteText(w)
+	})
+}
+
+// CounterVec is a set of counters partitioned by label values.
+type CounterVec struct {
+	desc
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// NewCounterVec registers a counter with the given label names.
+func (reg *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{desc: desc{n: name, help: help, kind: "counter", labels: labels}, values: make(map[string]float64)}
+	reg.register(c)
+	return c
+}
+
+// Add increases the counter for the label values by delta.
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	key := c.key(labelValues)
+	c.mu.Lock()
+	c.values[key] += delta
+	c.mu.Unlock()
+}
+
+// Inc increases the counter for the label values by one.
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.header(w)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.n, key, formatFloat(c.values[key]))
+	}
+}
+
+// HistogramVec is a set of histograms partitioned by label values.
+type HistogramVec struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogramVec registers a histogram with the given upper bucket bounds
+// and label names.
+func (reg *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		desc:    desc{n: name, help: help, kind: "histogram", labels: labels},
+		buckets: buckets,
+		values:  make(map[string]*histogram),
+	}
+	reg.register(h)
+	return h
+}
+
+// Observe records a value for the label values.
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	key := h.key(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			hist.counts[i]++
+		}
+	}
+	hist.count++
+	hist.sum += v
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.header(w)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, key := range sortedKeys(h.values) {
+		hist := h.values[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.n, withLabel(key, "le", formatFloat(bound)), hist.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.n, withLabel(key, "le", "+Inf"), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.n, key, formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.n, key, hist.count)
+	}
+}
+
+// funcMetric reads its values from a callback at scrape time.
+type funcMetric struct {
+	desc
+	fn func() map[string]float64
+}
+
+// NewGaugeFunc registers a gauge whose value is fn's result.
+func (reg *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	reg.register(&funcMetric{desc: desc{n: name, help: help, kind: "gauge"}, fn: func() map[string]float64 {
+		return map[string]float64{"": fn()}
+	}})
+}
+
+// NewCounterFunc registers a counter whose value is fn's result. fn must
+// never return less than it did before.
+func (reg *Registry) NewCounterFunc(name, help string, fn func() float64) {
+	reg.register(&funcMetric{desc: desc{n: name, help: help, kind: "counter"}, fn: func() map[string]float64 {
+		return map[string]float64{"": fn()}
+	}})
+}
+
+// NewGaugeVecFunc registers a gauge with a single label whose values are
+// read from fn, keyed by label value.
+func (reg *Registry) NewGaugeVecFunc(name, help, label string, fn func() map[string]float64) {
+	d := desc{n: name, help: help, kind: "gauge", labels: []string{label}}
+	reg.register(&funcMetric{desc: d, fn: func() map[string]float64 {
+		values := make(map[string]float64)
+		for value, v := range fn() {
+			values[d.key([]string{value})] = v
+		}
+		return values
+	}})
+}
+
+// NewCounterVecFunc registers a counter with a single label whose values
+// are read from fn, keyed by label value. No value may ever decrease.
+func (reg *Registry) NewCounterVecFunc(name, help, label string, fn func() map[string]float64) {
+	d := desc{n: name, help: help, kind: "counter", labels: []string{label}}
+	reg.register(&funcMetric{desc: d, fn: func() map[string]float64 {
+		values := make(map[string]float64)
+		for value, v := range fn() {
+			values[d.key([]string{value})] = v
+		}
+		return values
+	}})
+}
+
+func (m *funcMetric) write(w io.Writer) {
+	m.header(w)
+	values := m.fn()
+	for _, key := range sortedKeys(values) {
+		fmt.Fprintf(w, "%s%s %s\n", m.n, key, formatFloat(values[key]))
+	}
+}
+
+// desc is the name, help text and label names shared by every metric type.
+type desc struct {
+	n      string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (d *desc) name() string { return d.n }
+
+func (d *desc) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.n, escapeHelp(d.help), d.n, d.kind)
+}
+
+// key renders label values as the {name="value",...} suffix of a sample.
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", d.n, len(d.labels), len(values)))
+	}
+	if len(values) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, label := range d.labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=%q", label, values[i])
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// withLabel adds a label to a rendered key.
+func withLabel(key, label, value string) string {
+	pair := fmt.Sprintf("%s=%q", label, value)
+	if key == "" {
+		return "{" + pair + "}"
+	}
+	return key[:len(key)-1] + "," + pair + "}"
+}
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Sample is one line of a scraped exposition.
+type Sample struct {
+	Name   string
+	Labels map[string]string
+	Value  float64
+}
+
+// Parse reads samples in the Prometheus text format, skipping comments.
+func Parse(r io.Reader) ([]Sample, error) {
+	var samples []Sample
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		s, err := parseSample(text)
+		if err != nil {
+			return nil, fmt.Errorf("metrics line %d: %w", line, err)
+		}
+		samples = append(samples, s)
+	}
+	return samples, scanner.Err()
+}
+
+func parseSample(text string) (Sample, error) {
+	s := Sample{Labels: make(map[string]string)}
+	rest := text
+	if i := strings.IndexAny(rest, "{ "); i < 0 {
+		return s, fmt.Errorf("missing value")
+	} else {
+		s.Name, rest = rest[:i], rest[i:]
+	}
+	if strings.HasPrefix(rest, "{") {
+		rest = rest[1:]
+		for !strings.HasPrefix(rest, "}") {
+			name, after, ok := strings.Cut(rest, "=")
+			if !ok {
+				return s, fmt.Errorf("malformed labels")
+			}
+			value, err := strconv.QuotedPrefix(after)
+			if err != nil {
+				return s, fmt.Errorf("malformed label value: %w", err)
+			}
+			s.Labels[strings.TrimSpace(name)], _ = strconv.Unquote(value)
+			rest = strings.TrimPrefix(after[len(value):], ",")
+		}
+		rest = rest[1:]
+	}
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return s, fmt.Errorf("missing value")
+	}
+	v, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return s, err
+	}
+	s.Value = v
+	return s, nil
+}
+
+// Scrape fetches and parses the metrics served at url.
+func Scrape(url string) ([]Sample, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("scraping %s: %s", url, resp.Status)
+	}
+	return Parse(resp.Body)
+}
+
+// Sum adds up the samples named name whose labels include every pair in
+// match.
+func Sum(samples []Sample, name string, match map[string]string) float64 {
+	total := 0.0
+	for _, s := range samples {
+		if s.Name != name {
+			continue
+		}
+		ok := true
+		for k, v := range match {
+			if s.Labels[k] != v {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			total += s.Value
+		}
+	}
+	return total
+}
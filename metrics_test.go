@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reddit-clone/metrics"
+	"testing"
+)
+
+// TestMetrics checks that requests are counted by route and status, that
+// engine operations and totals are exported, and the health endpoints.
+func TestMetrics(t *testing.T) {
+	f := newFixture(t)
+	api := newTestAPI(f.e)
+	c := newAPIClient(t, api)
+	c.mustDo("GET", "/api/v1/posts/1", "", "", nil)
+	c.mustDo("GET", "/api/v1/posts/1", "", "", nil)
+	c.do("GET", "/api/v1/users/nobody", "", "")
+	c.do("GET", "/api/v1/nothing", "", "")
+	c.mustDo("POST", "/api/v1/r/news/posts", "", `{"title":"Counted","username":"bob"}`, nil)
+
+	rec := httptest.NewRecorder()
+	api.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("Content-Type %q", ct)
+	}
+	samples, err := metrics.Parse(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []struct {
+		name   string
+		labels map[string]string
+		value  float64
+	}{
+		{"http_requests_total", map[string]string{"route": "getPost", "status": "200"}, 2},
+		{"http_requests_total", map[string]string{"route": "getUser", "status": "404"}, 1},
+		{"http_requests_total", map[string]string{"route": "unmatched", "status": "404"}, 1},
+		{"http_request_duration_seconds_count", map[string]string{"route": "getPost"}, 2},
+		{"http_request_duration_seconds_bucket", map[string]string{"route": "getPost", "le": "+Inf"}, 2},
+		{"reddit_engine_operations_total", map[string]string{"op": "post_created"}, 1},
+		{"reddit_entities", map[string]string{"kind": "posts"}, 2},
+		{"reddit_entities", map[string]string{"kind": "users"}, 2},
+		{"http_requests_in_flight", nil, 0},
+	} {
+		if got := metrics.Sum(samples, want.name, want.labels); got != want.value {
+			t.Errorf("%s%v = %v, want %v", want.name, want.labels, got, want.value)
+		}
+	}
+	if metrics.Sum(samples, "reddit_engine_lock_acquisitions_total", nil) == 0 {
+		t.Error("no engine lock acquisitions counted")
+	}
+
+	health := func(h http.HandlerFunc) int {
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest("GET", "/", nil))
+		return rec.Code
+	}
+	if status := health(api.Healthz); status != http.StatusOK {
+		t.Errorf("/healthz: %d", status)
+	}
+	if status := health(api.Readyz); status != http.StatusServiceUnavailable {
+		t.Errorf("/readyz while starting: %d", status)
+	}
+	api.SetReady(true)
+	if status := health(api.Readyz); status != http.StatusOK {
+		t.Errorf("/readyz when ready: %d", status)
+	}
+}
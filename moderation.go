@@ -0,0 +1,471 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"reddit-clone/engine"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// moderationRoutes registers subreddit moderation and the audit log. The
+// acting moderator or admin is named by the X-Username header; admins also
+// send the admin token.
+func (api *API) moderationRoutes() {
+	rt := api.router
+	rt.Handle("PUT", "/api/v1/r/{name}/moderators/{username}", "addModerator", api.addModerator).
+		Doc("Make a user a moderator; anyone may claim a subreddit with no moderators").Authenticated()
+	rt.Handle("DELETE", "/api/v1/r/{name}/moderators/{username}", "removeModerator", api.removeModerator).
+		Doc("Remove a moderator").Authenticated()
+	rt.Handle("PUT", "/api/v1/r/{name}/bans/{username}", "banUser", api.banUser).
+		Doc("Ban a user from a subreddit").Accepts(ModerationRequest{}).Authenticated()
+	rt.Handle("DELETE", "/api/v1/r/{name}/bans/{username}", "unbanUser", api.unbanUser).
+		Doc("Lift a ban").Authenticated()
+	rt.Handle("PUT", "/api/v1/r/{name}/repost-policy", "setRepostPolicy", api.setRepostPolicy).
+		Doc("Choose whether reposts are allowed, warned about or blocked").
+		Accepts(RepostPolicyRequest{}).Returns(SubredditResponse{}).Authenticated()
+	rt.Handle("GET", "/api/v1/r/{name}/filters", "listWordFilters", api.listWordFilters).
+		Doc("List a subreddit's word filters").Returns([]WordFilterResponse{}).Authenticated()
+	rt.Handle("POST", "/api/v1/r/{name}/filters", "addWordFilter", api.addWordFilter).
+		Doc("Reject, mask or hold for review posts and comments containing a word, wildcard or regex").
+		Accepts(WordFilterRequest{}).Returns(WordFilterResponse{}).Authenticated()
+	rt.Handle("DELETE", "/api/v1/r/{name}/filters/{filter}", "removeWordFilter", api.removeWordFilter).
+		Doc("Remove a word filter").Authenticated()
+	rt.Handle("GET", "/api/v1/r/{name}/modqueue", "getModQueue", api.getModQueue).
+		Doc("List the posts and comments held for review, newest first").Returns(ModQueueResponse{}).Authenticated()
+	rt.Handle("GET", "/api/v1/r/{name}/modlog", "getModLog", api.getModLog).
+		Doc("List a subreddit's moderation actions, newest first").ReturnsPage(ModLogEntry{})
+	rt.Handle("PUT", "/api/v1/posts/{id}/removal", "removePost", api.removePost).
+		Doc("Remove a post").Accepts(ModerationRequest{}).Authenticated()
+	rt.Handle("DELETE", "/api/v1/posts/{id}/removal", "restorePost", api.restorePost).
+		Doc("Restore a removed post, or approve one held for review").Authenticated()
+	rt.Handle("PUT", "/api/v1/posts/{id}/comments/{commentId}/removal", "removeComment", api.removeComment).
+		Doc("Remove a comment").Accepts(ModerationRequest{}).Authenticated()
+	rt.Handle("DELETE", "/api/v1/posts/{id}/comments/{commentId}/removal", "restoreComment", api.restoreComment).
+		Doc("Restore a removed comment, or approve one held for review").Authenticated()
+
+	rt.Handle("GET", "/api/v1/admin/audit", "listAuditLog", api.adminOnly(api.listAuditLog)).
+		Doc("List the site-wide audit log, newest first").ReturnsPage(AuditEntryResponse{}).
+		WithQuery("subreddit", "actor", "action").AdminOnly()
+	rt.Handle("GET", "/api/v1/admin/audit/export", "exportAuditLog", api.adminOnly(api.exportAuditLog)).
+		Doc("Export the audit log as NDJSON, oldest first").WithQuery("subreddit", "actor", "action").AdminOnly()
+	rt.Handle("GET", "/api/v1/admin/audit/verify", "verifyAuditLog", api.adminOnly(api.verifyAuditLog)).
+		Doc("Check the audit log's hash chain").Returns(AuditVerifyResponse{}).AdminOnly()
+}
+
+// actor returns the user named by the X-Username header. The header alone
+// proves nothing, so an admin must also send the admin token. Anyone else
+// is taken at their word, and so is the name recorded as the actor in the
+// audit log: it shows who a request claimed to act as. The admin token is
+// shared, so even for admins it only proves the caller holds it.
+func (api *API) actor(r *http.Request) (*engine.User, error) {
+	name := r.Header.Get("X-Username")
+	if name == "" {
+		return nil, &apiError{status: http.StatusUnauthorized, code: codeUnauthorized, msg: "X-Username header required"}
+	}
+	user := api.engine.GetUserByUsernameContext(r.Context(), name)
+	if user == nil {
+		return nil, &apiError{status: http.StatusUnauthorized, code: codeUnauthorized, msg: "unknown user " + name}
+	}
+	var admin bool
+	api.engine.ViewContext(r.Context(), func() { admin = user.IsAdmin() })
+	if admin && !api.adminAuthorized(r) {
+		return nil, api.adminTokenError()
+	}
+	return user, nil
+}
+
+// SetAdminToken sets the secret admins send as a bearer token with admin
+// requests and give when logging in to the console. Without one, admin
+// accounts can not act as admins at all. It must be called before the API
+// serves requests.
+func (api *API) SetAdminToken(token string) {
+	api.adminToken = token
+}
+
+// adminAuthorized reports whether the request carries the admin token.
+func (api *API) adminAuthorized(r *http.Request) bool {
+	given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && api.validAdminToken(given)
+}
+
+func (api *API) validAdminToken(token string) bool {
+	return api.adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(api.adminToken)) == 1
+}
+
+// adminTokenError is returned to admins who did not send the admin token.
+func (api *API) adminTokenError() error {
+	if api.adminToken == "" {
+		return &apiError{status: http.StatusForbidden, code: codeForbidden, msg: "admin access is disabled; start the server with -admin-token"}
+	}
+	return &apiError{status: http.StatusUnauthorized, code: codeUnauthorized, msg: "a valid admin token is required"}
+}
+
+// adminOnly rejects requests without the admin token or whose actor is not
+// an admin.
+func (api *API) adminOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !api.adminAuthorized(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeError(w, r, api.adminTokenError())
+			return
+		}
+		actor, err := api.actor(r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		var admin bool
+		api.engine.ViewContext(r.Context(), func() { admin = actor.IsAdmin() })
+		if !admin {
+			writeError(w, r, &apiError{status: http.StatusForbidden, code: codeForbidden, msg: "admin role required"})
+			return
+		}
+		h(w, r)
+	}
+}
+
+// remoteIP is the address recorded in the audit log. Forwarding headers are
+// ignored since they are trivially spoofed.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (api *API) addModerator(w http.ResponseWriter, r *http.Request) {
+	api.moderateMember(w, r, func(actor, user *engine.User, sr *engine.SubReddit) error {
+		return api.engine.AddModerator(r.Context(), actor, user, sr)
+	})
+}
+
+func (api *API) removeModerator(w http.ResponseWriter, r *http.Request) {
+	api.moderateMember(w, r, func(actor, user *engine.User, sr *engine.SubReddit) error {
+		return api.engine.RemoveModerator(r.Context(), actor, user, sr)
+	})
+}
+
+func (api *API) banUser(w http.ResponseWriter, r *http.Request) {
+	var req ModerationRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	api.moderateMember(w, r, func(actor, user *engine.User, sr *engine.SubReddit) error {
+		return api.engine.BanUser(r.Context(), actor, user, sr, req.Reason)
+	})
+}
+
+func (api *API) unbanUser(w http.ResponseWriter, r *http.Request) {
+	api.moderateMember(w, r, func(actor, user *engine.User, sr *engine.SubReddit) error {
+		return api.engine.UnbanUser(r.Context(), actor, user, sr)
+	})
+}
+
+// moderateMember resolves the actor and the "{name}" and "{username}" path
+// parameters and applies fn to them.
+func (api *API) moderateMember(w http.ResponseWriter, r *http.Request, fn func(actor, user *engine.User, sr *engine.SubReddit) error) {
+	actor, err := api.actor(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	user, subreddit, err := api.membershipFromPath(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := fn(actor, user, subreddit); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (api *API) setRepostPolicy(w http.ResponseWriter, r *http.Request) {
+	var req RepostPolicyRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	policy := engine.RepostPolicy{Action: req.Action}
+	if req.Window != "" {
+		window, err := time.ParseDuration(req.Window)
+		if err != nil {
+			writeError(w, r, badRequest("window must be a Go duration such as 168h"))
+			return
+		}
+		policy.Window = window
+	}
+	actor, err := api.actor(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	sr, err := api.engine.LookupSubRedditContext(r.Context(), pathParam(r, "name"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := api.engine.SetRepostPolicy(r.Context(), actor, sr, policy); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, mapOne(r.Context(), api.engine, sr, api.newMapper(r).subreddit))
+}
+
+// filterSubreddit returns the subreddit named in the path, or nil for the
+// site-wide routes, which have no name.
+func (api *API) filterSubreddit(r *http.Request) (*engine.SubReddit, error) {
+	name := pathParam(r, "name")
+	if name == "" {
+		return nil, nil
+	}
+	return api.engine.LookupSubRedditContext(r.Context(), name)
+}
+
+func (api *API) listWordFilters(w http.ResponseWriter, r *http.Request) {
+	actor, err := api.actor(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	sr, err := api.filterSubreddit(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	filters, err := api.engine.WordFilters(r.Context(), actor, sr)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Cache-Control", cachePrivate)
+	writeJSON(w, r, wordFiltersResponse(filters))
+}
+
+func (api *API) addWordFilter(w http.ResponseWriter, r *http.Request) {
+	var req WordFilterRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	actor, err := api.actor(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	sr, err := api.filterSubreddit(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	f, err := api.engine.AddWordFilter(r.Context(), actor, sr, engine.WordFilter{Kind: req.Kind, Pattern: req.Pattern, Action: req.Action})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, wordFilterResponse(f))
+}
+
+func (api *API) removeWordFilter(w http.ResponseWriter, r *http.Request) {
+	actor, err := api.actor(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	sr, err := api.filterSubreddit(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	id, err := strconv.Atoi(pathParam(r, "filter"))
+	if err != nil {
+		writeError(w, r, badRequest("invalid filter ID"))
+		return
+	}
+	if err := api.engine.RemoveWordFilter(r.Context(), actor, sr, id); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (api *API) getModQueue(w http.ResponseWriter, r *http.Request) {
+	actor, err := api.actor(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	sr, err := api.filterSubreddit(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	queue, err := api.engine.ModQueue(r.Context(), actor, sr)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Cache-Control", cachePrivate)
+	writeJSON(w, r, mapOne(r.Context(), api.engine, queue, api.newMapper(r).modQueue))
+}
+
+func (api *API) removePost(w http.ResponseWriter, r *http.Request) {
+	var req ModerationRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	api.moderatePost(w, r, func(actor *engine.User, post *engine.Post) error {
+		return api.engine.RemovePost(r.Context(), actor, post, req.Reason)
+	})
+}
+
+func (api *API) restorePost(w http.ResponseWriter, r *http.Request) {
+	api.moderatePost(w, r, func(actor *engine.User, post *engine.Post) error {
+		return api.engine.RestorePost(r.Context(), actor, post)
+	})
+}
+
+func (api *API) moderatePost(w http.ResponseWriter, r *http.Request, fn func(actor *engine.User, post *engine.Post) error) {
+	actor, err := api.actor(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	post, err := api.postFromPath(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := fn(actor, post); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (api *API) removeComment(w http.ResponseWriter, r *http.Request) {
+	var req ModerationRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	api.moderateComment(w, r, func(actor *engine.User, post *engine.Post, comment *engine.Comment) error {
+		return api.engine.RemoveComment(r.Context(), actor, post, comment, req.Reason)
+	})
+}
+
+func (api *API) restoreComment(w http.ResponseWriter, r *http.Request) {
+	api.moderateComment(w, r, func(actor *engine.User, post *engine.Post, comment *engine.Comment) error {
+		return api.engine.RestoreComment(r.Context(), actor, post, comment)
+	})
+}
+
+func (api *API) moderateComment(w http.ResponseWriter, r *http.Request, fn func(actor *engine.User, post *engine.Post, comment *engine.Comment) error) {
+	api.moderatePost(w, r, func(actor *engine.User, post *engine.Post) error {
+		id, err := strconv.Atoi(pathParam(r, "commentId"))
+		if err != nil {
+			return badRequest("invalid comment ID")
+		}
+		comment, err := api.engine.LookupComment(r.Context(), post, id)
+		if err != nil {
+			return err
+		}
+		return fn(actor, post, comment)
+	})
+}
+
+func (api *API) getModLog(w http.ResponseWriter, r *http.Request) {
+	subreddit, err := api.engine.LookupSubRedditContext(r.Context(), pathParam(r, "name"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	var version uint64
+	var modified time.Time
+	api.engine.ViewContext(r.Context(), func() { version, modified = subreddit.Version, subreddit.UpdatedAt })
+	if checkFresh(w, r, etagFor(r, "modlog", subreddit.ID, version), modified, cachePolicy(r, cacheRevalidate)) {
+		return
+	}
+	p, err := parsePageParams(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	entries := paginate(newestEntriesFirst(api.engine.ModLog(r.Context(), subreddit)), auditID, true, p)
+	writePage(w, r, mapPage(r.Context(), api.engine, entries, api.newMapper(r).modLogEntry), p.Limit)
+}
+
+func (api *API) listAuditLog(w http.ResponseWriter, r *http.Request) {
+	filter, err := api.auditFilter(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	p, err := parsePageParams(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Cache-Control", cachePrivate)
+	entries := paginate(newestEntriesFirst(api.engine.AuditLog(r.Context(), filter)), auditID, true, p)
+	writePage(w, r, mapPage(r.Context(), api.engine, entries, api.newMapper(r).auditEntry), p.Limit)
+}
+
+// exportAuditLog streams entries in the engine's own encoding, hashes
+// included, so an export can be verified offline.
+func (api *API) exportAuditLog(w http.ResponseWriter, r *http.Request) {
+	filter, err := api.auditFilter(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit.ndjson"`)
+	w.Header().Set("Cache-Control", cachePrivate)
+	if err := api.engine.WriteAuditNDJSON(r.Context(), w, filter); err != nil {
+		noteError(r, err)
+	}
+}
+
+func (api *API) verifyAuditLog(w http.ResponseWriter, r *http.Request) {
+	n, err := api.engine.VerifyAuditLog(r.Context())
+	resp := AuditVerifyResponse{Valid: err == nil, Entries: n}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	w.Header().Set("Cache-Control", cachePrivate)
+	writeJSON(w, r, resp)
+}
+
+// auditFilter reads the subreddit, actor and action query parameters.
+func (api *API) auditFilter(r *http.Request) (engine.AuditFilter, error) {
+	q := r.URL.Query()
+	filter := engine.AuditFilter{Actor: q.Get("actor"), Action: q.Get("action")}
+	if name := q.Get("subreddit"); name != "" {
+		sr, err := api.engine.LookupSubRedditContext(r.Context(), name)
+		if err != nil {
+			return filter, err
+		}
+		filter.SubRedditID = sr.ID
+	}
+	return filter, nil
+}
+
+// newestEntriesFirst reverses audit entries, which the engine returns
+// oldest first.
+func newestEntriesFirst(entries []engine.AuditEntry) []engine.AuditEntry {
+	reversed := make([]engine.AuditEntry, len(entries))
+	for i, a := range entries {
+		reversed[len(entries)-1-i] = a
+	}
+	return reversed
+}
+
+func auditID(a engine.AuditEntry) int { return a.ID }
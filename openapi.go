@@ -0,0 +1,278 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The OpenAPI document is generated from the router: every route's pattern,
+// documentation and request/response types, with schemas derived from the
+// DTO structs by reflection. There is no hand-maintained copy to go stale.
+
+//go:embed static/explorer.html
+var explorerHTML []byte
+
+type OpenAPIDocument struct {
+	OpenAPI    string                           `json:"openapi"`
+	Info       OpenAPIInfo                      `json:"info"`
+	Paths      map[string]map[string]*Operation `json:"paths"`
+	Components Components                       `json:"components"`
+}
+
+type OpenAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type Operation struct {
+	OperationID string                `json:"operationId"`
+	Summary     string                `json:"summary,omitempty"`
+	Deprecated  bool                  `json:"deprecated,omitempty"`
+	Parameters  []Parameter           `json:"parameters,omitempty"`
+	RequestBody *RequestBody          `json:"requestBody,omitempty"`
+	Responses   map[string]*Response  `json:"responses"`
+	Security    []map[string][]string `json:"security,omitempty"`
+}
+
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required"`
+	Schema      *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Required bool                  `json:"required"`
+	Content  map[string]*MediaType `json:"content"`
+}
+
+type Response struct {
+	Ref         string                `json:"$ref,omitempty"`
+	Description string                `json:"description,omitempty"`
+	Headers     map[string]*Header    `json:"headers,omitempty"`
+	Content     map[string]*MediaType `json:"content,omitempty"`
+}
+
+type Header struct {
+	Description string  `json:"description"`
+	Schema      *Schema `json:"schema"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+type Components struct {
+	Schemas         map[string]*Schema         `json:"schemas"`
+	Responses       map[string]*Response       `json:"responses"`
+	SecuritySchemes map[string]*SecurityScheme `json:"securitySchemes,omitempty"`
+}
+
+type SecurityScheme struct {
+	Type        string `json:"type"`
+	Scheme      string `json:"scheme"`
+	Description string `json:"description,omitempty"`
+}
+
+// Schema is the subset of JSON Schema used by the API.
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+	Example              any                `json:"example,omitempty"`
+}
+
+// queryParameters describes the optional query parameters routes can list
+// with WithQuery.
+var queryParameters = map[string]Parameter{
+	"limit":     {Description: "Maximum number of items to return", Schema: &Schema{Type: "integer"}},
+	"after":     {Description: "Cursor from the next link of the previous page", Schema: &Schema{Type: "string"}},
+	"before":    {Description: "Cursor from the prev link of the previous page", Schema: &Schema{Type: "string"}},
+	"expand":    {Description: "Comma-separated nested data to include: members, posts, comments, replies", Schema: &Schema{Type: "string"}},
+	"viewer":    {Description: "Username whose vote is reported as viewerVote", Schema: &Schema{Type: "string"}},
+	"actor":     {Description: "Only entries by this username", Schema: &Schema{Type: "string"}},
+	"action":    {Description: "Only entries with this action, such as post.remove", Schema: &Schema{Type: "string"}},
+	"subreddit": {Description: "Only entries in this subreddit", Schema: &Schema{Type: "string"}},
+	"days":      {Description: "Number of days of growth to report (default 30)", Schema: &Schema{Type: "integer"}},
+}
+
+func (api *API) openAPI(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, api.openAPIDocument())
+}
+
+func (api *API) explorer(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(explorerHTML)
+}
+
+// openAPIDocument builds the OpenAPI 3 document for every documented route.
+func (api *API) openAPIDocument() *OpenAPIDocument {
+	doc := &OpenAPIDocument{
+		OpenAPI: "3.0.3",
+		Info:    OpenAPIInfo{Title: "Community Discussion Platform API", Version: "1.0.0"},
+		Paths:   make(map[string]map[string]*Operation),
+		Components: Components{
+			Schemas: make(map[string]*Schema),
+			Responses: map[string]*Response{
+				"Error": {Description: "Error", Content: jsonContent(&Schema{Ref: "#/components/schemas/ErrorResponse"})},
+			},
+			SecuritySchemes: map[string]*SecurityScheme{
+				"adminToken": {Type: "http", Scheme: "bearer", Description: "The admin token the server was started with"},
+			},
+		},
+	}
+	schemaFor(reflect.TypeOf(ErrorResponse{}), doc.Components.Schemas)
+
+	for _, route := range api.router.Routes() {
+		if route.Summary == "" && route.Request == nil && route.Response == nil {
+			continue
+		}
+		op := &Operation{
+			OperationID: route.Name,
+			Summary:     route.Summary,
+			Deprecated:  route.Deprecated,
+			Responses:   map[string]*Response{"default": {Ref: "#/components/responses/Error"}},
+		}
+		for _, part := range route.parts {
+			if strings.HasPrefix(part, "{") {
+				op.Parameters = append(op.Parameters, Parameter{
+					Name: strings.Trim(part, "{}"), In: "path", Required: true, Schema: &Schema{Type: "string"},
+				})
+			}
+		}
+		query := route.Query
+		if route.Paged {
+			query = append([]string{"limit", "after", "before"}, query...)
+		}
+		for _, name := range query {
+			param := queryParameters[name]
+			param.Name, param.In = name, "query"
+			op.Parameters = append(op.Parameters, param)
+		}
+		if route.Auth {
+			op.Parameters = append(op.Parameters, Parameter{
+				Name: "X-Username", In: "header", Required: true,
+				Description: "Username of the user making the request",
+				Schema:      &Schema{Type: "string"},
+			})
+		}
+		if route.Admin {
+			op.Security = []map[string][]string{{"adminToken": {}}}
+		}
+		if route.Method == http.MethodPost {
+			op.Parameters = append(op.Parameters, Parameter{
+				Name: "Idempotency-Key", In: "header",
+				Description: "Retries with the same key replay the first response instead of repeating the request",
+				Schema:      &Schema{Type: "string"},
+			})
+		}
+		if route.Request != nil {
+			op.RequestBody = &RequestBody{Required: true, Content: jsonContent(schemaFor(route.Request, doc.Components.Schemas))}
+		}
+
+		ok := &Response{Description: "OK"}
+		if route.Response != nil {
+			schema := schemaFor(route.Response, doc.Components.Schemas)
+			if route.Paged {
+				schema = &Schema{Type: "array", Items: schema}
+				ok.Headers = map[string]*Header{
+					"X-Total-Count": {Description: "Total number of items", Schema: &Schema{Type: "integer"}},
+					"Link":          {Description: "Links to the next and previous pages", Schema: &Schema{Type: "string"}},
+				}
+			}
+			ok.Content = jsonContent(schema)
+		}
+		op.Responses["200"] = ok
+		if route.Method == http.MethodGet && route.Response != nil {
+			op.Responses["304"] = &Response{Description: "Not modified since the ETag in If-None-Match or the If-Modified-Since time"}
+		}
+
+		if doc.Paths[route.Pattern] == nil {
+			doc.Paths[route.Pattern] = make(map[string]*Operation)
+		}
+		doc.Paths[route.Pattern][strings.ToLower(route.Method)] = op
+	}
+	return doc
+}
+
+func jsonContent(schema *Schema) map[string]*MediaType {
+	return map[string]*MediaType{"application/json": {Schema: schema}}
+}
+
+// schemaFor returns the schema for t, registering named structs as
+// components and referring to them by $ref.
+func schemaFor(t reflect.Type, components map[string]*Schema) *Schema {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == reflect.TypeOf(time.Time{}) {
+		return &Schema{Type: "string", Format: "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: schemaFor(t.Elem(), components)}
+	case reflect.Map:
+		return &Schema{Type: "object"}
+	case reflect.Struct:
+		ref := &Schema{Ref: "#/components/schemas/" + t.Name()}
+		if _, ok := components[t.Name()]; ok {
+			return ref
+		}
+		closed := false
+		schema := &Schema{Type: "object", Properties: make(map[string]*Schema), AdditionalProperties: &closed}
+		components[t.Name()] = schema
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, opts, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if !field.IsExported() || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			prop := schemaFor(field.Type, components)
+			if example, ok := field.Tag.Lookup("example"); ok {
+				prop.Example = parseExample(field.Type, example)
+			}
+			schema.Properties[name] = prop
+			if !strings.Contains(opts, "omitempty") && field.Type.Kind() != reflect.Pointer {
+				schema.Required = append(schema.Required, name)
+			}
+		}
+		return ref
+	}
+	return &Schema{}
+}
+
+func parseExample(t reflect.Type, example string) any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		b, _ := strconv.ParseBool(example)
+		return b
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, _ := strconv.Atoi(example)
+		return n
+	}
+	return example
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reddit-clone/engine"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestOpenAPIMatchesHandlers calls every operation in the published document
+// with its example request body and checks the handler's response against
+// the documented schema, so the spec cannot drift from the handlers.
+func TestOpenAPIMatchesHandlers(t *testing.T) {
+	doc := fetchOpenAPI(t, NewAPI(engine.NewRedditEngine()))
+
+	documented := 0
+	for path, ops := range doc.Paths {
+		for method, op := range ops {
+			documented++
+			t.Run(op.OperationID, func(t *testing.T) {
+				f := newFixture(t)
+				if setup := exampleSetup[op.OperationID]; setup != nil {
+					setup(t, f)
+				}
+				api := newTestAPI(f.e)
+				url := path
+				header := make(http.Header)
+				for _, param := range op.Parameters {
+					switch param.In {
+					case "path":
+						value := examplePathParams[param.Name]
+						if param.Name == "ring" {
+							value = exampleVoteRing(t)
+						}
+						url = strings.Replace(url, "{"+param.Name+"}", value, 1)
+					case "header":
+						if value, ok := exampleHeaders[param.Name]; ok && param.Required {
+							header.Set(param.Name, value)
+						}
+					}
+				}
+				// bob is an admin, so he sends the admin token whenever he acts.
+				if header.Get("X-Username") != "" {
+					header.Set("Authorization", "Bearer "+testAdminToken)
+				}
+				var body bytes.Buffer
+				if op.RequestBody != nil {
+					example := exampleValue(op.RequestBody.Content["application/json"].Schema, doc.Components.Schemas)
+					json.NewEncoder(&body).Encode(example)
+				}
+				if op.OperationID == "importData" {
+					// The body is NDJSON, which the document does not describe.
+					engine.WriteNDJSON(&body, newFixture(t).e.Snapshot(), time.Now())
+				}
+
+				rec := httptest.NewRecorder()
+				req := httptest.NewRequest(strings.ToUpper(method), url, &body)
+				req.Header = header
+				api.ServeHTTP(rec, req)
+				if rec.Code != http.StatusOK {
+					t.Fatalf("%s %s: status %d, body %s", strings.ToUpper(method), url, rec.Code, rec.Body)
+				}
+
+				media := op.Responses["200"].Content["application/json"]
+				if media == nil {
+					if method != "get" && rec.Body.Len() != 0 {
+						t.Fatalf("undocumented response body: %s", rec.Body)
+					}
+					return
+				}
+				var got any
+				if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+					t.Fatalf("response is not JSON: %v", err)
+				}
+				if err := validateSchema(got, media.Schema, doc.Components.Schemas, "$"); err != nil {
+					t.Fatalf("response does not match spec: %v\n%s", err, rec.Body)
+				}
+			})
+		}
+	}
+
+	if routes := len(NewAPI(engine.NewRedditEngine()).router.Routes()); documented != routes {
+		t.Errorf("%d routes registered but %d documented", routes, documented)
+	}
+}
+
+// TestOpenAPIErrorShape checks that error responses use the documented
+// error envelope.
+func TestOpenAPIErrorShape(t *testing.T) {
+	api := NewAPI(engine.NewRedditEngine())
+	doc := fetchOpenAPI(t, api)
+
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/users/nobody", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("status %d, want 404", rec.Code)
+	}
+	var got any
+	json.Unmarshal(rec.Body.Bytes(), &got)
+	schema := doc.Components.Responses["Error"].Content["application/json"].Schema
+	if err := validateSchema(got, schema, doc.Components.Schemas, "$"); err != nil {
+		t.Fatalf("error response does not match spec: %v\n%s", err, rec.Body)
+	}
+}
+
+var examplePathParams = map[string]string{
+	"username":  "alice",
+	"name":      "news",
+	"id":        "1",
+	"commentId": "1",
+	"filter":    "1",
+}
+
+// exampleHeaders are sent for required header parameters. Authenticated
+// operations act as bob, an admin who moderates news.
+var exampleHeaders = map[string]string{
+	"X-Username": "bob",
+}
+
+// exampleSetup prepares the fixture for operations that need more than it
+// holds. alice is a member of news only when the operation is leaving it,
+// and is a moderator, banned, suspended or an admin, or has a comment
+// removed, only when the operation undoes that.
+var exampleSetup = map[string]func(t *testing.T, f *fixture){
+	"leaveSubreddit":       joinAlice,
+	"legacyLeaveSubreddit": joinAlice,
+	"removeModerator": func(t *testing.T, f *fixture) {
+		f.e.AddModerator(context.Background(), f.bob, f.alice, f.news)
+	},
+	"unbanUser": func(t *testing.T, f *fixture) {
+		f.e.BanUser(context.Background(), f.bob, f.alice, f.news, "Spam")
+	},
+	"restorePost": func(t *testing.T, f *fixture) {
+		f.e.RemovePost(context.Background(), f.bob, f.post, "Off topic")
+	},
+	"restoreComment": func(t *testing.T, f *fixture) {
+		f.e.RemoveComment(context.Background(), f.bob, f.post, f.comment, "Off topic")
+	},
+	"restoreMessage": func(t *testing.T, f *fixture) {
+		f.e.RemoveMessage(context.Background(), f.bob, f.message, "Spam")
+	},
+	"removeWordFilter": func(t *testing.T, f *fixture) {
+		f.e.AddWordFilter(context.Background(), f.bob, f.news, engine.WordFilter{Kind: engine.FilterWord, Pattern: "darn", Action: engine.FilterMask})
+	},
+	"removeSiteWordFilter": func(t *testing.T, f *fixture) {
+		f.e.AddWordFilter(context.Background(), f.bob, nil, engine.WordFilter{Kind: engine.FilterWord, Pattern: "darn", Action: engine.FilterMask})
+	},
+	"unsuspendUser": func(t *testing.T, f *fixture) {
+		f.e.SuspendUser(context.Background(), f.bob, f.alice, "Spam", time.Time{})
+	},
+	"revokeAdmin": func(t *testing.T, f *fixture) {
+		f.e.GrantAdmin(context.Background(), f.bob, f.alice)
+	},
+	"getVoteRings": func(t *testing.T, f *fixture) {
+		seedVoteRing(t, f)
+	},
+	"discountVoteRing": func(t *testing.T, f *fixture) {
+		seedVoteRing(t, f)
+	},
+	"restoreVoteRing": func(t *testing.T, f *fixture) {
+		f.e.DiscountVoteRing(context.Background(), f.bob, seedVoteRing(t, f), engine.DefaultVoteRingOptions())
+	},
+}
+
+func joinAlice(t *testing.T, f *fixture) {
+	f.e.JoinSubReddit(f.alice, f.news)
+}
+
+// exampleVoteRing returns the ID of the vote ring seedVoteRing adds, which
+// is the same in every fixture.
+func exampleVoteRing(t *testing.T) string {
+	t.Helper()
+	return seedVoteRing(t, newFixture(t))
+}
+
+// seedVoteRing adds three accounts that upvote three of alice's posts
+// together and returns the ID of the ring they form.
+func seedVoteRing(t *testing.T, f *fixture) string {
+	t.Helper()
+	e := f.e
+	ring := make([]*engine.User, 3)
+	for i := range ring {
+		ring[i], _ = e.RegisterAccount(fmt.Sprintf("puppet%d", i))
+	}
+	for i := 0; i < 3; i++ {
+		post, _ := e.CreatePost(f.alice, f.news, fmt.Sprintf("Boosted %d", i), "")
+		for _, u := range ring {
+			e.CastVote(u, post, 1)
+		}
+	}
+	report := e.DetectVoteRings(context.Background(), engine.DefaultVoteRingOptions())
+	if len(report.Rings) != 1 {
+		t.Fatalf("seeded %d vote rings, want 1", len(report.Rings))
+	}
+	return report.Rings[0].ID
+}
+
+func fetchOpenAPI(t *testing.T, api *API) *OpenAPIDocument {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, httptest.NewRequest("GET", "/api/openapi.json", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /api/openapi.json: status %d", rec.Code)
+	}
+	var doc OpenAPIDocument
+	if err := json.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("decoding OpenAPI document: %v", err)
+	}
+	return &doc
+}
+
+func resolve(schema *Schema, components map[string]*Schema) *Schema {
+	for schema.Ref != "" {
+		schema = components[strings.TrimPrefix(schema.Ref, "#/components/schemas/")]
+	}
+	return schema
+}
+
+// exampleValue builds a request body from the schema's examples.
+func exampleValue(schema *Schema, components map[string]*Schema) any {
+	schema = resolve(schema, components)
+	if schema.Example != nil {
+		return schema.Example
+	}
+	switch schema.Type {
+	case "object":
+		obj := make(map[string]any)
+		for name, prop := range schema.Properties {
+			obj[name] = exampleValue(prop, components)
+		}
+		return obj
+	case "array":
+		return []any{}
+	case "integer", "number":
+		return 0
+	case "boolean":
+		return false
+	}
+	return ""
+}
+
+// validateSchema checks a decoded JSON value against the subset of JSON
+// Schema used in the document.
+func validateSchema(value any, schema *Schema, components map[string]*Schema, path string) error {
+	schema = resolve(schema, components)
+	switch schema.Type {
+	case "object":
+		obj, ok := value.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s: want object, got %T", path, value)
+		}
+		for _, name := range schema.Required {
+			if _, ok := obj[name]; !ok {
+				return fmt.Errorf("%s: missing required field %q", path, name)
+			}
+		}
+		names := make([]string, 0, len(obj))
+		for name := range obj {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			prop, ok := schema.Properties[name]
+			if !ok {
+				if schema.AdditionalProperties != nil && !*schema.AdditionalProperties {
+					return fmt.Errorf("%s: undocumented field %q", path, name)
+				}
+				continue
+			}
+			if err := validateSchema(obj[name], prop, components, path+"."+name); err != nil {
+				return err
+			}
+		}
+	case "array":
+		items, ok := value.([]any)
+		if !ok {
+			return fmt.Errorf("%s: want array, got %T", path, value)
+		}
+		for i, item := range items {
+			if err := validateSchema(item, schema.Items, components, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case "integer":
+		if n, ok := value.(float64); !ok || n != float64(int64(n)) {
+			return fmt.Errorf("%s: want integer, got %v", path, value)
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			return fmt.Errorf("%s: want number, got %T", path, value)
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			return fmt.Errorf("%s: want string, got %T", path, value)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s: want boolean, got %T", path, value)
+		}
+	}
+	return nil
+}
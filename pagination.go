@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 200
+)
+
+// pageParams are the paging query parameters accepted by every listing
+// endpoint. Cursors are opaque to clients but encode the ID of the item at
+// the edge of the previous page, so pages stay stable while new content is
+// written.
+type pageParams struct {
+	Limit  int
+	After  int
+	Before int
+}
+
+// page is one slice of an ordered listing.
+type page[T any] struct {
+	Items []T
+	Total int
+	Next  string
+	Prev  string
+}
+
+// unpagedKey marks requests to legacy listings, which predate paging and
+// list everything unless the client asks for a page.
+type unpagedKey struct{}
+
+// unpagedByDefault adapts a listing handler for a legacy route.
+func unpagedByDefault(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		next(w, r.WithContext(context.WithValue(r.Context(), unpagedKey{}, true)))
+	}
+}
+
+// unpaged reports whether r is a legacy listing request without any paging
+// parameters.
+func unpaged(r *http.Request) bool {
+	if legacy, _ := r.Context().Value(unpagedKey{}).(bool); !legacy {
+		return false
+	}
+	q := r.URL.Query()
+	return q.Get("limit") == "" && q.Get("after") == "" && q.Get("before") == ""
+}
+
+func parsePageParams(r *http.Request) (pageParams, error) {
+	if unpaged(r) {
+		return pageParams{Limit: math.MaxInt}, nil
+	}
+	q := r.URL.Query()
+	p := pageParams{Limit: defaultPageLimit}
+	if s := q.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit < 1 {
+			return p, badRequest("limit must be a positive integer")
+		}
+		p.Limit = min(limit, maxPageLimit)
+	}
+	if q.Get("after") != "" && q.Get("before") != "" {
+		return p, badRequest("after and before cannot be combined")
+	}
+	var err error
+	if s := q.Get("after"); s != "" {
+		if p.After, err = decodeCursor(s); err != nil {
+			return p, err
+		}
+	}
+	if s := q.Get("before"); s != "" {
+		if p.Before, err = decodeCursor(s); err != nil {
+			return p, err
+		}
+	}
+	return p, nil
+}
+
+func encodeCursor(id int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte("id:" + strconv.Itoa(id)))
+}
+
+func decodeCursor(cursor string) (int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || !strings.HasPrefix(string(raw), "id:") {
+		return 0, badRequest("invalid cursor")
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(string(raw), "id:"))
+	if err != nil {
+		return 0, badRequest("invalid cursor")
+	}
+	return id, nil
+}
+
+// paginate slices items, which must be sorted by ID (descending when desc is
+// set), according to p.
+func paginate[T any](items []T, id func(T) int, desc bool, p pageParams) page[T] {
+	// precedes reports whether an item with ID a is listed before ID b.
+	precedes := func(a, b int) bool {
+		if desc {
+			return a > b
+		}
+		return a < b
+	}
+
+	start, end := 0, len(items)
+	switch {
+	case p.After != 0:
+		for start < len(items) && !precedes(p.After, id(items[start])) {
+			start++
+		}
+		end = min(start+p.Limit, len(items))
+	case p.Before != 0:
+		for end > 0 && !precedes(id(items[end-1]), p.Before) {
+			end--
+		}
+		start = max(end-p.Limit, 0)
+	default:
+		end = min(p.Limit, len(items))
+	}
+
+	result := page[T]{Items: items[start:end], Total: len(items)}
+	if end < len(items) && end > start {
+		result.Next = encodeCursor(id(items[end-1]))
+	}
+	if start > 0 && end > start {
+		result.Prev = encodeCursor(id(items[start]))
+	}
+	return result
+}
+
+// writePage sends a page as a JSON array, with the total count and the
+// neighbouring pages in headers.
+func writePage[T any](w http.ResponseWriter, r *http.Request, p page[T], limit int) {
+	w.Header().Set("X-Total-Count", strconv.Itoa(p.Total))
+	var links []string
+	if p.Next != "" {
+		links = append(links, pageLink(r, "after", p.Next, limit, "next"))
+	}
+	if p.Prev != "" {
+		links = append(links, pageLink(r, "before", p.Prev, limit, "prev"))
+	}
+	if len(links) > 0 {
+		w.Header().Add("Link", strings.Join(links, ", "))
+	}
+	items := p.Items
+	if items == nil {
+		items = []T{}
+	}
+	writeJSON(w, r, items)
+}
+
+func pageLink(r *http.Request, param, cursor string, limit int, rel string) string {
+	u := *r.URL
+	q := u.Query()
+	q.Del("after")
+	q.Del("before")
+	q.Set(param, cursor)
+	q.Set("limit", strconv.Itoa(limit))
+	u.RawQuery = q.Encode()
+	return fmt.Sprintf("<%s>; rel=%q", u.RequestURI(), rel)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+var nextLink = regexp.MustCompile(`<([^>]+)>; rel="next"`)
+
+// TestPagination walks a listing page by page through its Link headers and
+// checks the default and maximum limits, cursors going backwards, and that
+// legacy listings stay unpaged.
+func TestPagination(t *testing.T) {
+	f := newFixture(t)
+	for i := 0; i < 60; i++ {
+		if _, err := f.e.RegisterAccount(fmt.Sprintf("user%02d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := newAPIClient(t, newTestAPI(f.e))
+
+	var seen []string
+	path := "/api/v1/users?limit=25"
+	for path != "" {
+		var users []UserResponse
+		rec := c.mustDo("GET", path, "", "", &users)
+		if rec.Header().Get("X-Total-Count") != "62" {
+			t.Errorf("%s: X-Total-Count %q", path, rec.Header().Get("X-Total-Count"))
+		}
+		for _, u := range users {
+			seen = append(seen, u.Username)
+		}
+		path = ""
+		if m := nextLink.FindStringSubmatch(rec.Header().Get("Link")); m != nil {
+			path = m[1]
+		}
+	}
+	if len(seen) != 62 || seen[0] != "alice" || seen[61] != "user59" {
+		t.Fatalf("walked %d users: %v", len(seen), seen)
+	}
+
+	var users []UserResponse
+	if c.mustDo("GET", "/api/v1/users", "", "", &users); len(users) != defaultPageLimit {
+		t.Errorf("default page has %d users, want %d", len(users), defaultPageLimit)
+	}
+	var last []UserResponse
+	c.mustDo("GET", "/api/v1/users?before="+encodeCursor(5)+"&limit=2", "", "", &last)
+	if len(last) != 2 || last[0].ID != 3 || last[1].ID != 4 {
+		t.Errorf("page before user 5: %+v", last)
+	}
+
+	for _, query := range []string{"limit=0", "limit=x", "after=bogus", "after=" + encodeCursor(1) + "&before=" + encodeCursor(9)} {
+		if rec := c.do("GET", "/api/v1/users?"+query, "", ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("?%s: status %d, want 400", query, rec.Code)
+		}
+	}
+	if p, _ := parsePageParams(httptest.NewRequest("GET", "/api/v1/users?limit=1000", nil)); p.Limit != maxPageLimit {
+		t.Errorf("limit 1000 became %d, want %d", p.Limit, maxPageLimit)
+	}
+
+	// Legacy listings list everything unless a page is asked for.
+	rec := c.mustDo("GET", "/api/getusers", "", "", &users)
+	if len(users) != 62 || rec.Header().Get("Link") != `</api/v1/users>; rel="successor-version"` {
+		t.Errorf("legacy listing: %d users, Link %q", len(users), rec.Header().Get("Link"))
+	}
+	if c.mustDo("GET", "/api/getusers?limit=10", "", "", &users); len(users) != 10 {
+		t.Errorf("legacy listing with a limit: %d users", len(users))
+	}
+	var posts []PostResponse
+	for i := 0; i < 60; i++ {
+		f.e.CreatePost(f.bob, f.news, fmt.Sprintf("Post %d", i), "")
+	}
+	if c.mustDo("GET", "/api/news/feed", "", "", &posts); len(posts) != 61 {
+		t.Errorf("legacy feed: %d posts, want 61", len(posts))
+	}
+	if c.mustDo("GET", "/api/v1/r/news/posts", "", "", &posts); len(posts) != defaultPageLimit {
+		t.Errorf("feed after the legacy one was cached: %d posts, want %d", len(posts), defaultPageLimit)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"math"
+	"reddit-clone/engine"
+	"sort"
+)
+
+// Orders posts can be listed in.
+const (
+	sortHot = "hot"
+	sortNew = "new"
+	sortTop = "top"
+)
+
+var postSorts = []string{sortHot, sortNew, sortTop}
+
+// hotEpoch and hotPeriod set how fast posts fall in the hot ranking: a
+// post needs ten times the score to rank level with one submitted
+// hotPeriod seconds later.
+const (
+	hotEpoch  = 1134028003
+	hotPeriod = 45000
+)
+
+// parseSort returns the order named by the ?sort= parameter, hot by default.
+func parseSort(value string) (string, error) {
+	if value == "" {
+		return sortHot, nil
+	}
+	for _, s := range postSorts {
+		if value == s {
+			return s, nil
+		}
+	}
+	return "", badRequest("sort must be hot, new or top")
+}
+
+// sortPosts orders posts in place. It reads their scores, so it must run
+// inside RedditEngine.View.
+func sortPosts(posts []*engine.Post, order string) {
+	var less func(a, b *engine.Post) bool
+	switch order {
+	case sortNew:
+		less = func(a, b *engine.Post) bool { return a.ID > b.ID }
+	case sortTop:
+		less = func(a, b *engine.Post) bool {
+			if a.Votes != b.Votes {
+				return a.Votes > b.Votes
+			}
+			return a.ID > b.ID
+		}
+	default:
+		less = func(a, b *engine.Post) bool {
+			if ha, hb := hotness(a), hotness(b); ha != hb {
+				return ha > hb
+			}
+			return a.ID > b.ID
+		}
+	}
+	sort.Slice(posts, func(i, j int) bool { return less(posts[i], posts[j]) })
+}
+
+// hotness ranks a post by the order of magnitude of its score, plus a
+// bonus that grows with how recently it was submitted.
+func hotness(p *engine.Post) float64 {
+	score := float64(p.Votes)
+	order := math.Log10(math.Max(math.Abs(score), 1))
+	sign := 0.0
+	if score > 0 {
+		sign = 1
+	} else if score < 0 {
+		sign = -1
+	}
+	return sign*order + float64(p.CreatedAt.Unix()-hotEpoch)/hotPeriod
+}
@@ -0,0 +1,426 @@
+// Package replay reads the logs written by the simulator and by client.go
+// back into engine operations, and replays them against an engine or a
+// running API server.
+package replay
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kind is the kind of an operation.
+type Kind string
+
+const (
+	CreateUser      Kind = "create_user"
+	CreateSubReddit Kind = "create_subreddit"
+	Join            Kind = "join"
+	Leave           Kind = "leave"
+	SubmitPost      Kind = "post"
+	Comment         Kind = "comment"
+	Vote            Kind = "vote"
+	SendMessage     Kind = "message"
+)
+
+// PostRef identifies a post the way the log did: by the ID the original run
+// gave it, by its title, or both. Titles are all the simulator's older log
+// format recorded.
+type PostRef struct {
+	ID    int
+	Title string
+}
+
+func (p PostRef) String() string {
+	switch {
+	case p.ID != 0:
+		return fmt.Sprintf("post %d", p.ID)
+	case p.Title != "":
+		return fmt.Sprintf("post %q", p.Title)
+	}
+	return "unrecorded post"
+}
+
+// Op is one operation read from a log. Fields the log did not record are
+// empty; replaying such an operation reports a divergence rather than
+// guessing.
+type Op struct {
+	// Line is the line of the log the operation was read from.
+	Line int
+	// Time is when the operation was logged, or zero if the line has no
+	// time stamp.
+	Time time.Time
+	// Run counts the simulations in the log, from 1. IDs in PostRef refer
+	// to posts of the same run.
+	Run  int
+	Kind Kind
+	// User is the acting user. Votes without one are anonymous.
+	User      string
+	To        string
+	SubReddit string
+	Post      PostRef
+	Title     string
+	Content   string
+	Upvote    bool
+	// LoggedID is the ID the original run gave the post, comment or
+	// message the operation created, if the log recorded it.
+	LoggedID int
+}
+
+// Log is the result of parsing a log file.
+type Log struct {
+	Ops []Op
+	// Runs is the number of simulations in the log.
+	Runs int
+	// Ignored counts lines that are not operations, such as errors and
+	// listings.
+	Ignored int
+
+	runOps int
+}
+
+// maxLineBytes bounds a line of a log; the longest lines are client.go's
+// dumps of whole feeds.
+const maxLineBytes = 4 << 20
+
+// Parse reads a log in any of the formats the simulator and client.go have
+// written: the standard library logger's "2024/11/26 23:16:17 file.go:48:
+// message" lines, and log/slog's text and JSON output. Formats may be mixed
+// in one file, as happens when a log is appended to across versions.
+func Parse(r io.Reader) (*Log, error) {
+	log := &Log{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), maxLineBytes)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		rec, ok := parseRecord(text)
+		if !ok {
+			log.Ignored++
+			continue
+		}
+		op, ok := log.classify(rec)
+		if !ok {
+			log.Ignored++
+			continue
+		}
+		// The server numbers users from 1, so the first user of a fresh
+		// server starts a new run even where nothing else marks it.
+		if op.Kind == CreateUser && op.LoggedID == 1 {
+			log.startRun()
+		}
+		if log.Runs == 0 {
+			log.Runs = 1
+		}
+		op.Line, op.Time, op.Run = line, rec.time, log.Runs
+		log.Ops = append(log.Ops, op)
+		log.runOps++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("line %d: %w", line+1, err)
+	}
+	return log, nil
+}
+
+// startRun begins a new run, unless the current one is still empty.
+func (log *Log) startRun() {
+	if log.Runs == 0 || log.runOps > 0 {
+		log.Runs++
+		log.runOps = 0
+	}
+}
+
+// record is a log line split into its time, message and attributes.
+// Attribute values are strings, or maps for the Go map dumps of client.go
+// and nested JSON objects.
+type record struct {
+	time  time.Time
+	msg   string
+	attrs map[string]any
+}
+
+var stdlogLine = regexp.MustCompile(`^(\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}(?:\.\d+)?) (?:[\w.-]+\.go:\d+: )?(.*)$`)
+
+func parseRecord(text string) (record, bool) {
+	if strings.HasPrefix(text, "{") {
+		return parseJSONRecord(text)
+	}
+	if strings.HasPrefix(text, "time=") {
+		return parseTextRecord(text)
+	}
+	m := stdlogLine.FindStringSubmatch(text)
+	if m == nil {
+		return record{}, false
+	}
+	t, _ := time.Parse("2006/01/02 15:04:05", m[1])
+	if t.IsZero() {
+		t, _ = time.Parse("2006/01/02 15:04:05.999999", m[1])
+	}
+	return record{time: t, msg: m[2]}, true
+}
+
+func parseJSONRecord(text string) (record, bool) {
+	var fields map[string]any
+	if err := json.Unmarshal([]byte(text), &fields); err != nil {
+		return record{}, false
+	}
+	rec := record{attrs: make(map[string]any)}
+	for k, v := range fields {
+		switch k {
+		case "time":
+			s, _ := v.(string)
+			rec.time, _ = time.Parse(time.RFC3339Nano, s)
+		case "msg":
+			rec.msg, _ = v.(string)
+		case "level", "source":
+		default:
+			rec.attrs[k] = jsonValue(v)
+		}
+	}
+	return rec, rec.msg != ""
+}
+
+// jsonValue converts decoded JSON to the record's representation: objects
+// stay maps and everything else becomes its string form.
+func jsonValue(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		m := make(map[string]any, len(v))
+		for k, x := range v {
+			m[k] = jsonValue(x)
+		}
+		return m
+	case string:
+		return v
+	case nil:
+		return ""
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+// parseTextRecord reads slog's key=value format, where values containing
+// spaces or quotes are Go-quoted.
+func parseTextRecord(text string) (record, bool) {
+	rec := record{attrs: make(map[string]any)}
+	for text != "" {
+		eq := strings.IndexByte(text, '=')
+		if eq <= 0 {
+			return record{}, false
+		}
+		key, rest := text[:eq], text[eq+1:]
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			quoted, err := strconv.QuotedPrefix(rest)
+			if err != nil {
+				return record{}, false
+			}
+			value, _ = strconv.Unquote(quoted)
+			rest = rest[len(quoted):]
+		} else if i := strings.IndexByte(rest, ' '); i >= 0 {
+			value, rest = rest[:i], rest[i:]
+		} else {
+			value, rest = rest, ""
+		}
+		text = strings.TrimLeft(rest, " ")
+		switch key {
+		case "time":
+			rec.time, _ = time.Parse(time.RFC3339Nano, value)
+		case "msg":
+			rec.msg = value
+		case "level", "source":
+		default:
+			if m, ok := parseGoMap(value); ok {
+				rec.attrs[key] = m
+			} else {
+				rec.attrs[key] = value
+			}
+		}
+	}
+	return rec, rec.msg != ""
+}
+
+// parseGoMap reads a map printed by fmt, such as
+// "map[Author:map[ID:1 Username:User1] Content:This is a post ID:1]".
+// Values are not quoted, so a value ends where a key follows at the same
+// depth; fmt prints keys in sorted order, so only a key that sorts after
+// the current one counts, which keeps most colons inside values from
+// splitting them.
+func parseGoMap(s string) (map[string]any, bool) {
+	if !strings.HasPrefix(s, "map[") || !strings.HasSuffix(s, "]") {
+		return nil, false
+	}
+	body := s[len("map[") : len(s)-1]
+	m := make(map[string]any)
+	for body != "" {
+		colon := strings.IndexByte(body, ':')
+		if colon <= 0 || strings.ContainsAny(body[:colon], " []") {
+			return nil, false
+		}
+		key := body[:colon]
+		body = body[colon+1:]
+		end := valueEnd(body, key)
+		value := body[:end]
+		if nested, ok := parseGoMap(value); ok {
+			m[key] = nested
+		} else if value == "<nil>" {
+			m[key] = ""
+		} else {
+			m[key] = value
+		}
+		body = strings.TrimPrefix(body[end:], " ")
+	}
+	return m, true
+}
+
+var mapKey = regexp.MustCompile(`^ ([A-Za-z_][A-Za-z0-9_]*):`)
+
+// valueEnd returns the length of the value at the start of s, which
+// belongs to key.
+func valueEnd(s, key string) int {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ' ':
+			if depth == 0 {
+				if m := mapKey.FindStringSubmatch(s[i:]); m != nil && m[1] > key {
+					return i
+				}
+			}
+		}
+	}
+	return len(s)
+}
+
+// The simulator's older log format, written with the standard library
+// logger.
+var (
+	legacyCreatedUser      = regexp.MustCompile(`^Created user: (\S+)$`)
+	legacyCreatedSubReddit = regexp.MustCompile(`^Created subreddit: (\S+)$`)
+	legacyPost             = regexp.MustCompile(`^User (\S+) created a post in subreddit (\S+): (.*)$`)
+	legacyComment          = regexp.MustCompile(`^User (\S+) commented on post '(.*)': (.*)$`)
+	legacyVote             = regexp.MustCompile(`^User (\S+) (upvoted|downvoted) post '(.*)'$`)
+	legacyMessage          = regexp.MustCompile(`^User (\S+) sent message to user (\S+): (.*)$`)
+	legacyStart            = regexp.MustCompile(`^Starting simulation\b`)
+
+	// client.go before it used log/slog wrote "Message: map[...]".
+	legacyClient = regexp.MustCompile(`^([A-Z][A-Za-z ]+?)!?: (.*)$`)
+)
+
+// classify turns a record into an operation. Records that are not
+// operations, such as listings and errors, return false; a record starting
+// a new simulation also counts the run.
+func (log *Log) classify(rec record) (Op, bool) {
+	msg := rec.msg
+	if m := legacyCreatedUser.FindStringSubmatch(msg); m != nil {
+		return Op{Kind: CreateUser, User: m[1]}, true
+	}
+	if m := legacyCreatedSubReddit.FindStringSubmatch(msg); m != nil {
+		return Op{Kind: CreateSubReddit, SubReddit: m[1]}, true
+	}
+	if m := legacyPost.FindStringSubmatch(msg); m != nil {
+		return Op{Kind: SubmitPost, User: m[1], SubReddit: m[2], Title: m[3], Content: "Content"}, true
+	}
+	if m := legacyComment.FindStringSubmatch(msg); m != nil {
+		return Op{Kind: Comment, User: m[1], Post: PostRef{Title: m[2]}, Content: m[3]}, true
+	}
+	if m := legacyVote.FindStringSubmatch(msg); m != nil {
+		return Op{Kind: Vote, User: m[1], Post: PostRef{Title: m[3]}, Upvote: m[2] == "upvoted"}, true
+	}
+	if m := legacyMessage.FindStringSubmatch(msg); m != nil {
+		return Op{Kind: SendMessage, User: m[1], To: m[2], Content: m[3]}, true
+	}
+	if legacyStart.MatchString(msg) || msg == "starting simulation" {
+		log.startRun()
+		return Op{}, false
+	}
+
+	attrs := rec.attrs
+	if m := legacyClient.FindStringSubmatch(msg); m != nil && rec.attrs == nil {
+		msg = m[1]
+		if result, ok := parseGoMap(m[2]); ok {
+			attrs = map[string]any{"result": result}
+		} else {
+			attrs = map[string]any{"value": m[2]}
+		}
+	}
+	str := func(key string) string { return attrString(attrs, key) }
+	result, _ := attrs["result"].(map[string]any)
+	author, _ := result["Author"].(map[string]any)
+
+	switch strings.TrimSuffix(msg, "!") {
+	// The simulator, since it logs with log/slog.
+	case "created user":
+		return Op{Kind: CreateUser, User: str("user")}, true
+	case "created subreddit":
+		return Op{Kind: CreateSubReddit, SubReddit: str("subreddit")}, true
+	case "created post":
+		return Op{Kind: SubmitPost, User: str("user"), SubReddit: str("subreddit"), Title: str("title"), Content: "Content", LoggedID: atoi(str("post_id"))}, true
+	case "created comment":
+		return Op{Kind: Comment, User: str("user"), Post: PostRef{ID: atoi(str("post_id"))}, Content: "Comment", LoggedID: atoi(str("comment_id"))}, true
+	case "voted":
+		return Op{Kind: Vote, User: str("user"), Post: PostRef{ID: atoi(str("post_id"))}, Upvote: str("upvote") == "true"}, true
+	case "sent message":
+		return Op{Kind: SendMessage, User: str("from"), To: str("to"), Content: "Message", LoggedID: atoi(str("message_id"))}, true
+
+	// client.go, which logs the API's responses.
+	case "User created":
+		return Op{Kind: CreateUser, User: attrString(result, "Username"), LoggedID: atoi(attrString(result, "ID"))}, true
+	case "Subreddit created":
+		return Op{Kind: CreateSubReddit, SubReddit: attrString(result, "Name")}, true
+	case "Post submitted":
+		return Op{
+			Kind:      SubmitPost,
+			User:      attrString(author, "Username"),
+			SubReddit: str("subreddit"),
+			Title:     attrString(result, "Title"),
+			Content:   attrString(result, "Content"),
+			LoggedID:  atoi(attrString(result, "ID")),
+		}, true
+	case "Comment created":
+		return Op{
+			Kind:     Comment,
+			User:     attrString(author, "Username"),
+			Post:     PostRef{ID: atoi(str("post_id"))},
+			Content:  attrString(result, "Content"),
+			LoggedID: atoi(attrString(result, "ID")),
+		}, true
+	case "Vote successful":
+		return Op{Kind: Vote, User: str("username"), Post: PostRef{ID: atoi(str("post_id"))}, Upvote: str("upvote") != "false"}, true
+	case "Joined subreddit", "Left subreddit":
+		sr := str("subreddit")
+		if sr == "" {
+			sr = str("value")
+		}
+		kind := Join
+		if strings.HasPrefix(msg, "Left") {
+			kind = Leave
+		}
+		return Op{Kind: kind, User: str("username"), SubReddit: sr}, true
+	}
+	return Op{}, false
+}
+
+func attrString(attrs map[string]any, key string) string {
+	s, _ := attrs[key].(string)
+	return s
+}
+
+func atoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
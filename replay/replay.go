@@ -0,0 +1,288 @@
+package replay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reddit-clone/engine"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Target is what operations are replayed against. Users, subreddits and
+// posts are named the way the target knows them; methods that create a
+// post, comment or message return its ID on the target. Errors should wrap
+// the engine's error kinds, so that missing users and posts are reported
+// as unresolved rather than as failures.
+type Target interface {
+	CreateUser(ctx context.Context, username string) error
+	CreateSubReddit(ctx context.Context, name string) error
+	Join(ctx context.Context, username, subreddit string) error
+	Leave(ctx context.Context, username, subreddit string) error
+	SubmitPost(ctx context.Context, username, subreddit, title, content string) (int, error)
+	Comment(ctx context.Context, username string, postID int, content string) (int, error)
+	// Vote votes on behalf of username, or anonymously if it is empty.
+	Vote(ctx context.Context, username string, postID int, upvote bool) error
+	SendMessage(ctx context.Context, from, to, content string) (int, error)
+}
+
+// Options control the pace of a replay.
+type Options struct {
+	// Speed scales the time between operations: 1 keeps the original
+	// timing, 10 replays ten times as fast. 0 replays as fast as the target
+	// allows.
+	Speed float64
+	// MaxGap, if set, caps the wait between two operations, so that idle
+	// stretches of a log do not stall a timed replay.
+	MaxGap time.Duration
+	// Progress, if set, is called after every operation.
+	Progress func(done, total int)
+}
+
+// Divergence kinds.
+const (
+	// Unresolved means the operation refers to something that does not
+	// exist: a post the log did not identify or that was never created, or
+	// a user or subreddit the target does not know.
+	Unresolved = "unresolved"
+	// Failed means the target rejected the operation.
+	Failed = "failed"
+	// Mismatch means the operation succeeded but created something with a
+	// different ID than in the original run.
+	Mismatch = "mismatch"
+)
+
+// Divergence is an operation that did not replay the way it was logged.
+type Divergence struct {
+	Line   int    `json:"line"`
+	Op     Kind   `json:"op"`
+	Kind   string `json:"kind"`
+	Detail string `json:"detail"`
+}
+
+func (d Divergence) String() string {
+	return fmt.Sprintf("line %d: %s %s: %s", d.Line, d.Op, d.Kind, d.Detail)
+}
+
+// Report summarises a replay.
+type Report struct {
+	Ops         int           `json:"ops"`
+	Applied     int           `json:"applied"`
+	Divergences []Divergence  `json:"divergences"`
+	Elapsed     time.Duration `json:"elapsed"`
+}
+
+// Add adds the results of another replay to r.
+func (r *Report) Add(other *Report) {
+	r.Ops += other.Ops
+	r.Applied += other.Applied
+	r.Divergences = append(r.Divergences, other.Divergences...)
+	r.Elapsed += other.Elapsed
+}
+
+// Counts returns the number of divergences of each kind.
+func (r *Report) Counts() map[string]int {
+	counts := make(map[string]int)
+	for _, d := range r.Divergences {
+		counts[d.Kind]++
+	}
+	return counts
+}
+
+// Summary is a one-line description of the report.
+func (r *Report) Summary() string {
+	counts := r.Counts()
+	kinds := make([]string, 0, len(counts))
+	for kind := range counts {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	parts := make([]string, 0, len(kinds))
+	for _, kind := range kinds {
+		parts = append(parts, fmt.Sprintf("%d %s", counts[kind], kind))
+	}
+	s := fmt.Sprintf("replayed %d of %d operations in %s", r.Applied, r.Ops, r.Elapsed.Round(time.Millisecond))
+	if len(parts) > 0 {
+		s += "; divergences: " + strings.Join(parts, ", ")
+	}
+	return s
+}
+
+// Run replays ops against target in order. It stops early only if ctx is
+// cancelled, returning the report so far and the context's error.
+func Run(ctx context.Context, target Target, ops []Op, opts Options) (*Report, error) {
+	r := &replayer{target: target, report: &Report{Ops: len(ops)}}
+	start := time.Now()
+	defer func() { r.report.Elapsed = time.Since(start) }()
+
+	var due time.Time
+	var last time.Time
+	for i, op := range ops {
+		if opts.Speed > 0 && !op.Time.IsZero() {
+			if due.IsZero() {
+				due = time.Now()
+			} else if gap := op.Time.Sub(last); gap > 0 {
+				wait := time.Duration(float64(gap) / opts.Speed)
+				if opts.MaxGap > 0 && wait > opts.MaxGap {
+					wait = opts.MaxGap
+				}
+				due = due.Add(wait)
+			}
+			last = op.Time
+			if err := sleepUntil(ctx, due); err != nil {
+				return r.report, err
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return r.report, err
+		}
+		r.apply(ctx, op)
+		if opts.Progress != nil {
+			opts.Progress(i+1, len(ops))
+		}
+	}
+	return r.report, nil
+}
+
+func sleepUntil(ctx context.Context, t time.Time) error {
+	d := time.Until(t)
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type replayer struct {
+	target Target
+	report *Report
+	// run is the simulation the maps below belong to; they start over with
+	// each run, whose IDs start over too.
+	run int
+	// posts maps post IDs in the log to IDs on the target, and titles maps
+	// titles to the latest post with that title.
+	posts  map[int]int
+	titles map[string]int
+	// subreddits lists those created in this run.
+	subreddits []string
+}
+
+func (r *replayer) diverge(op Op, kind, format string, args ...any) {
+	r.report.Divergences = append(r.report.Divergences, Divergence{Line: op.Line, Op: op.Kind, Kind: kind, Detail: fmt.Sprintf(format, args...)})
+}
+
+// fail records a failed operation, as unresolved if the target could not
+// find something it refers to.
+func (r *replayer) fail(op Op, err error) {
+	kind := Failed
+	if errors.Is(err, engine.ErrNotFound) {
+		kind = Unresolved
+	}
+	r.diverge(op, kind, "%v", err)
+}
+
+// checkID records a mismatch if the target gave a different ID than the
+// original run.
+func (r *replayer) checkID(op Op, what string, id int) {
+	if op.LoggedID != 0 && id != op.LoggedID {
+		r.diverge(op, Mismatch, "%s %d in the log is %d here", what, op.LoggedID, id)
+	}
+}
+
+// resolvePost finds the target's ID for the post op refers to.
+func (r *replayer) resolvePost(op Op) (int, bool) {
+	var id int
+	var ok bool
+	switch {
+	case op.Post.ID != 0:
+		id, ok = r.posts[op.Post.ID]
+	case op.Post.Title != "":
+		id, ok = r.titles[op.Post.Title]
+	default:
+		r.diverge(op, Unresolved, "the log does not say which post")
+		return 0, false
+	}
+	if !ok {
+		r.diverge(op, Unresolved, "%s was not created earlier in the log", op.Post)
+	}
+	return id, ok
+}
+
+func (r *replayer) apply(ctx context.Context, op Op) {
+	if op.Run != r.run {
+		r.run = op.Run
+		r.posts, r.titles, r.subreddits = make(map[int]int), make(map[string]int), nil
+	}
+	var err error
+	switch op.Kind {
+	case CreateUser:
+		err = r.target.CreateUser(ctx, op.User)
+	case CreateSubReddit:
+		if err = r.target.CreateSubReddit(ctx, op.SubReddit); err == nil {
+			r.subreddits = append(r.subreddits, op.SubReddit)
+		}
+	case Join, Leave:
+		if op.User == "" {
+			r.diverge(op, Unresolved, "the log does not say which user")
+			return
+		}
+		if op.Kind == Join {
+			err = r.target.Join(ctx, op.User, op.SubReddit)
+		} else {
+			err = r.target.Leave(ctx, op.User, op.SubReddit)
+		}
+	case SubmitPost:
+		subreddit := op.SubReddit
+		if subreddit == "" {
+			// Older client.go logs leave the subreddit out; it can only
+			// be inferred if there is just one.
+			if len(r.subreddits) != 1 {
+				r.diverge(op, Unresolved, "the log does not say which subreddit")
+				return
+			}
+			subreddit = r.subreddits[0]
+		}
+		var id int
+		if id, err = r.target.SubmitPost(ctx, op.User, subreddit, op.Title, op.Content); err == nil {
+			if op.LoggedID != 0 {
+				r.posts[op.LoggedID] = id
+			}
+			r.titles[op.Title] = id
+			r.checkID(op, "post", id)
+		}
+	case Comment:
+		postID, ok := r.resolvePost(op)
+		if !ok {
+			return
+		}
+		var id int
+		if id, err = r.target.Comment(ctx, op.User, postID, op.Content); err == nil {
+			r.checkID(op, "comment", id)
+		}
+	case Vote:
+		postID, ok := r.resolvePost(op)
+		if !ok {
+			return
+		}
+		err = r.target.Vote(ctx, op.User, postID, op.Upvote)
+	case SendMessage:
+		var id int
+		if id, err = r.target.SendMessage(ctx, op.User, op.To, op.Content); err == nil {
+			r.checkID(op, "message", id)
+		}
+	default:
+		err = fmt.Errorf("unknown operation %q", op.Kind)
+	}
+	if err != nil {
+		r.fail(op, err)
+		return
+	}
+	r.report.Applied++
+}
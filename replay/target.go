@@ -0,0 +1,246 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reddit-clone/engine"
+	"strconv"
+	"strings"
+)
+
+// EngineTarget replays operations directly against an engine.
+type EngineTarget struct {
+	Engine *engine.RedditEngine
+}
+
+func (t EngineTarget) CreateUser(ctx context.Context, username string) error {
+	_, err := t.Engine.RegisterAccountContext(ctx, username)
+	return err
+}
+
+func (t EngineTarget) CreateSubReddit(ctx context.Context, name string) error {
+	_, err := t.Engine.CreateSubRedditContext(ctx, name)
+	return err
+}
+
+func (t EngineTarget) Join(ctx context.Context, username, subreddit string) error {
+	user, sr, err := t.member(ctx, username, subreddit)
+	if err != nil {
+		return err
+	}
+	return t.Engine.JoinSubRedditContext(ctx, user, sr)
+}
+
+func (t EngineTarget) Leave(ctx context.Context, username, subreddit string) error {
+	user, sr, err := t.member(ctx, username, subreddit)
+	if err != nil {
+		return err
+	}
+	return t.Engine.LeaveSubRedditContext(ctx, user, sr)
+}
+
+func (t EngineTarget) member(ctx context.Context, username, subreddit string) (*engine.User, *engine.SubReddit, error) {
+	user, err := t.Engine.LookupUserContext(ctx, username)
+	if err != nil {
+		return nil, nil, err
+	}
+	sr, err := t.Engine.LookupSubRedditContext(ctx, subreddit)
+	if err != nil {
+		return nil, nil, err
+	}
+	return user, sr, nil
+}
+
+func (t EngineTarget) SubmitPost(ctx context.Context, username, subreddit, title, content string) (int, error) {
+	user, sr, err := t.member(ctx, username, subreddit)
+	if err != nil {
+		return 0, err
+	}
+	post, err := t.Engine.CreatePostContext(ctx, user, sr, title, content)
+	if err != nil {
+		return 0, err
+	}
+	return post.ID, nil
+}
+
+func (t EngineTarget) Comment(ctx context.Context, username string, postID int, content string) (int, error) {
+	user, err := t.Engine.LookupUserContext(ctx, username)
+	if err != nil {
+		return 0, err
+	}
+	post, err := t.Engine.LookupPostContext(ctx, postID)
+	if err != nil {
+		return 0, err
+	}
+	comment, err := t.Engine.CreateCommentContext(ctx, user, post, content)
+	if err != nil {
+		return 0, err
+	}
+	return comment.ID, nil
+}
+
+func (t EngineTarget) Vote(ctx context.Context, username string, postID int, upvote bool) error {
+	post, err := t.Engine.LookupPostContext(ctx, postID)
+	if err != nil {
+		return err
+	}
+	if username == "" {
+		t.Engine.VoteContext(ctx, post, upvote)
+		return nil
+	}
+	user, err := t.Engine.LookupUserContext(ctx, username)
+	if err != nil {
+		return err
+	}
+	direction := -1
+	if upvote {
+		direction = 1
+	}
+	return t.Engine.CastVoteContext(ctx, user, post, direction)
+}
+
+func (t EngineTarget) SendMessage(ctx context.Context, from, to, content string) (int, error) {
+	sender, err := t.Engine.LookupUserContext(ctx, from)
+	if err != nil {
+		return 0, err
+	}
+	recipient, err := t.Engine.LookupUserContext(ctx, to)
+	if err != nil {
+		return 0, err
+	}
+	msg, err := t.Engine.SendMessageContext(ctx, sender, recipient, content)
+	if err != nil {
+		return 0, err
+	}
+	return msg.ID, nil
+}
+
+// APITarget replays operations against a running server through the REST
+// API. Creating a user that already exists logs in as that user, as the
+// API does.
+type APITarget struct {
+	// BaseURL is the server's address, e.g. "http://localhost:8080".
+	BaseURL string
+	Client  *http.Client
+}
+
+func (t APITarget) CreateUser(ctx context.Context, username string) error {
+	return t.do(ctx, "POST", "/api/v1/users", map[string]any{"username": username}, nil)
+}
+
+func (t APITarget) CreateSubReddit(ctx context.Context, name string) error {
+	return t.do(ctx, "POST", "/api/v1/r", map[string]any{"name": name}, nil)
+}
+
+func (t APITarget) Join(ctx context.Context, username, subreddit string) error {
+	return t.do(ctx, "PUT", "/api/v1/r/"+url.PathEscape(subreddit)+"/members/"+url.PathEscape(username), nil, nil)
+}
+
+func (t APITarget) Leave(ctx context.Context, username, subreddit string) error {
+	return t.do(ctx, "DELETE", "/api/v1/r/"+url.PathEscape(subreddit)+"/members/"+url.PathEscape(username), nil, nil)
+}
+
+// created is the part of the API's responses the replay needs.
+type created struct {
+	ID int `json:"id"`
+}
+
+func (t APITarget) SubmitPost(ctx context.Context, username, subreddit, title, content string) (int, error) {
+	var resp created
+	err := t.do(ctx, "POST", "/api/v1/r/"+url.PathEscape(subreddit)+"/posts", map[string]any{"title": title, "content": content, "username": username}, &resp)
+	return resp.ID, err
+}
+
+func (t APITarget) Comment(ctx context.Context, username string, postID int, content string) (int, error) {
+	var resp created
+	err := t.do(ctx, "POST", "/api/v1/posts/"+strconv.Itoa(postID)+"/comments", map[string]any{"content": content, "username": username}, &resp)
+	return resp.ID, err
+}
+
+func (t APITarget) Vote(ctx context.Context, username string, postID int, upvote bool) error {
+	direction := -1
+	if upvote {
+		direction = 1
+	}
+	body := map[string]any{"direction": direction}
+	if username != "" {
+		body["username"] = username
+	}
+	return t.do(ctx, "POST", "/api/v1/posts/"+strconv.Itoa(postID)+"/votes", body, nil)
+}
+
+func (t APITarget) SendMessage(ctx context.Context, from, to, content string) (int, error) {
+	var resp created
+	err := t.do(ctx, "POST", "/api/v1/users/"+url.PathEscape(to)+"/messages", map[string]any{"from": from, "content": content}, &resp)
+	return resp.ID, err
+}
+
+func (t APITarget) do(ctx context.Context, method, path string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(t.BaseURL, "/")+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	client := t.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return apiError(resp)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// apiError converts an error response to an error of the matching engine
+// kind.
+func apiError(resp *http.Response) error {
+	var envelope struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&envelope)
+	msg := envelope.Error.Message
+	if msg == "" {
+		msg = resp.Status
+	}
+	var kind error
+	switch resp.StatusCode {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		kind = engine.ErrInvalid
+	case http.StatusNotFound:
+		kind = engine.ErrNotFound
+	case http.StatusConflict:
+		kind = engine.ErrConflict
+	case http.StatusForbidden:
+		kind = engine.ErrForbidden
+	case http.StatusTooManyRequests:
+		kind = engine.ErrRateLimited
+	default:
+		return fmt.Errorf("%s %s: %s", resp.Request.Method, resp.Request.URL.Path, msg)
+	}
+	return &engine.Error{Kind: kind, Msg: msg}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"reddit-clone/engine"
+	"reddit-clone/replay"
+	"strings"
+	"testing"
+)
+
+// TestReplay parses a log mixing the simulator's old and new formats with
+// client.go's, and replays it into an engine and through the API.
+func TestReplay(t *testing.T) {
+	log := strings.Join([]string{
+		`2024/11/26 23:16:17 simulator.go:39: Starting simulation with 2 users`,
+		`2024/11/26 23:16:17 simulator.go:48: Created user: alice`,
+		`2024/11/26 23:16:17 simulator.go:48: Created user: bob`,
+		`2024/11/26 23:16:17 simulator.go:57: Created subreddit: news`,
+		`2024/11/26 23:16:18 simulator.go:75: User alice created a post in subreddit news: Hello`,
+		`2024/11/26 23:16:18 simulator.go:90: User bob commented on post 'Hello': Hi`,
+		`2024/11/26 23:16:18 simulator.go:99: User bob upvoted post 'Hello'`,
+		`2024/11/26 23:16:18 simulator.go:99: User bob upvoted post 'Missing'`,
+		`time=2024-11-27T10:00:00.000Z level=INFO msg="starting simulation" users=2`,
+		`time=2024-11-27T10:00:00.000Z level=INFO msg="created user" user=carol`,
+		`{"time":"2024-11-27T10:00:01Z","level":"INFO","msg":"created subreddit","subreddit":"golang"}`,
+		`{"time":"2024-11-27T10:00:01Z","level":"INFO","msg":"created post","user":"carol","subreddit":"golang","post_id":1,"title":"Gophers"}`,
+		`time=2024-11-27T10:00:02.000Z level=INFO msg=voted user=carol post_id=1 upvote=false`,
+		`time=2024-11-27T10:00:02.000Z level=INFO msg="created comment" user=carol post_id=1 comment_id=2`,
+		`time=2024-11-27T10:00:03.000Z level=INFO msg="Joined subreddit" subreddit=golang`,
+		`time=2024-11-27T10:00:03.000Z level=INFO msg="sent message" from=carol to=dave message_id=1`,
+	}, "\n")
+	parsed, err := replay.Parse(strings.NewReader(log))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed.Ops) != 14 || parsed.Runs != 2 {
+		t.Fatalf("parsed %d operations in %d runs, want 14 in 2", len(parsed.Ops), parsed.Runs)
+	}
+
+	want := map[int]string{
+		8:  replay.Unresolved, // 'Missing' was never posted
+		12: replay.Mismatch,   // both runs share the target, so this is post 2
+		14: replay.Mismatch,   // the first comment is 1 here
+		15: replay.Unresolved, // no username
+		16: replay.Unresolved, // dave does not exist
+	}
+	check := func(name string, report *replay.Report) {
+		t.Helper()
+		got := make(map[int]string)
+		for _, d := range report.Divergences {
+			got[d.Line] = d.Kind
+		}
+		for line, kind := range want {
+			if got[line] != kind {
+				t.Errorf("%s: line %d diverged as %q, want %q", name, line, got[line], kind)
+			}
+		}
+		if len(got) != len(want) {
+			t.Errorf("%s: divergences %v", name, report.Divergences)
+		}
+		if report.Applied != 11 {
+			t.Errorf("%s: applied %d operations, want 11", name, report.Applied)
+		}
+	}
+
+	ctx := context.Background()
+	e := engine.NewRedditEngine()
+	report, err := replay.Run(ctx, replay.EngineTarget{Engine: e}, parsed.Ops, replay.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("engine", report)
+	if post, err := e.LookupPost(1); err != nil || post.Votes != 1 || len(post.Comments) != 1 {
+		t.Errorf("post 1 not replayed: %+v", post)
+	}
+
+	srv := httptest.NewServer(NewAPI(engine.NewRedditEngine()))
+	defer srv.Close()
+	report, err = replay.Run(ctx, replay.APITarget{BaseURL: srv.URL}, parsed.Ops, replay.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("api", report)
+}
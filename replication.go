@@ -0,0 +1,522 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"reddit-clone/engine"
+	"reddit-clone/logging"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultJournalSize is how many mutations a leader keeps for followers
+	// that fall behind; older followers catch up from a snapshot.
+	defaultJournalSize = 100000
+	// defaultMaxStaleness is how long a follower may go without confirming
+	// it has everything the leader has before it stops serving reads.
+	defaultMaxStaleness = 5 * time.Second
+	// heartbeatInterval is how often the leader reports its position on an
+	// idle log stream.
+	heartbeatInterval = time.Second
+	// journalBatch bounds the mutations written between two heartbeats.
+	journalBatch = 256
+)
+
+// replicationFrame is a line of the log stream: a mutation, or a heartbeat
+// with the leader's latest position.
+type replicationFrame struct {
+	Mutation  *engine.Mutation        `json:"mutation,omitempty"`
+	Heartbeat *engine.JournalPosition `json:"heartbeat,omitempty"`
+}
+
+// replicationSnapshot is the body of /replication/snapshot.
+type replicationSnapshot struct {
+	Position engine.JournalPosition `json:"position"`
+	Snapshot *engine.Snapshot       `json:"snapshot"`
+}
+
+// ReplicationStatus is the body of /replication/status.
+type ReplicationStatus struct {
+	Role     string                 `json:"role"`
+	Leader   string                 `json:"leader,omitempty"`
+	Position engine.JournalPosition `json:"position"`
+	// LeaderSeq, Lag and Staleness are only reported by followers.
+	LeaderSeq uint64  `json:"leaderSeq,omitempty"`
+	Lag       uint64  `json:"lag"`
+	Staleness float64 `json:"stalenessSeconds"`
+	Followers int64   `json:"followers"`
+	Snapshots int64   `json:"snapshots"`
+	Errors    int64   `json:"errors"`
+}
+
+// replicator serves the engine's journal to followers and, while the
+// server is a follower, keeps the engine in step with its leader. Followers
+// serve reads only, and stop serving them once they are more than
+// maxStaleness behind.
+type replicator struct {
+	engine       *engine.RedditEngine
+	token        string
+	maxStaleness time.Duration
+	heartbeat    time.Duration
+	client       *http.Client
+	logger       *slog.Logger
+
+	mu     sync.Mutex
+	leader string
+	stop   context.CancelFunc
+	done   chan struct{}
+	// closed ends the log streams when the server shuts down.
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	leaderSeq atomic.Uint64
+	// caughtUp is when the follower last had everything the leader
+	// reported, in Unix nanoseconds; following is when it started.
+	caughtUp  atomic.Int64
+	following atomic.Int64
+	followers atomic.Int64
+	snapshots atomic.Int64
+	errors    atomic.Int64
+}
+
+// newReplicator starts the engine's journal and registers the replication
+// metrics with api. The server leads until Follow is called.
+func newReplicator(api *API, cfg ReplicationConfig, logger *slog.Logger) *replicator {
+	r := &replicator{
+		engine:       api.engine,
+		token:        cfg.Token,
+		maxStaleness: time.Duration(cfg.MaxStaleness),
+		heartbeat:    heartbeatInterval,
+		client:       &http.Client{},
+		logger:       logging.OrDiscard(logger),
+		closed:       make(chan struct{}),
+	}
+	if r.maxStaleness <= 0 {
+		r.maxStaleness = defaultMaxStaleness
+	}
+	size := cfg.JournalSize
+	if size <= 0 {
+		size = defaultJournalSize
+	}
+	r.engine.StartJournal(size)
+	api.replica = r
+
+	reg := api.metrics.registry
+	reg.NewGaugeFunc("replication_leader", "1 if the server is the replication leader, 0 if it follows one.", func() float64 {
+		if r.Leader() == "" {
+			return 1
+		}
+		return 0
+	})
+	reg.NewGaugeFunc("replication_position", "Sequence number of the latest mutation recorded or applied.", func() float64 {
+		return float64(r.engine.JournalPosition().Seq)
+	})
+	reg.NewGaugeFunc("replication_leader_position", "Latest sequence number the leader reported to this follower.", func() float64 {
+		return float64(r.leaderSeq.Load())
+	})
+	reg.NewGaugeFunc("replication_lag_mutations", "Mutations the leader has that this follower has not applied.", func() float64 {
+		return float64(r.Status().Lag)
+	})
+	reg.NewGaugeFunc("replication_staleness_seconds", "Time since this follower last had everything its leader had.", func() float64 {
+		return r.staleness().Seconds()
+	})
+	reg.NewGaugeFunc("replication_followers", "Followers currently streaming the journal.", func() float64 {
+		return float64(r.followers.Load())
+	})
+	reg.NewCounterFunc("replication_snapshots_total", "Times this follower caught up from a snapshot.", func() float64 {
+		return float64(r.snapshots.Load())
+	})
+	reg.NewCounterFunc("replication_errors_total", "Failed attempts to fetch or apply the leader's journal.", func() float64 {
+		return float64(r.errors.Load())
+	})
+	return r
+}
+
+// Leader returns the URL of the leader being followed, or "" if the server
+// is the leader.
+func (r *replicator) Leader() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.leader
+}
+
+// Follow makes the server a read-only follower of the leader at leaderURL,
+// replacing any leader it followed before.
+func (r *replicator) Follow(leaderURL string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stopLocked()
+	ctx, cancel := context.WithCancel(context.Background())
+	r.leader, r.stop, r.done = strings.TrimSuffix(leaderURL, "/"), cancel, make(chan struct{})
+	r.caughtUp.Store(0)
+	r.following.Store(time.Now().UnixNano())
+	go r.run(ctx, r.leader, r.done)
+}
+
+// Promote stops following and makes the server a leader. Mutations
+// continue the journal's sequence in a new epoch, so other followers can be
+// pointed at the promoted server without a snapshot if they were no further
+// ahead.
+func (r *replicator) Promote() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stopLocked()
+	r.leader = ""
+	r.engine.StartJournal(0)
+	r.logger.Info("promoted to replication leader", "position", r.engine.JournalPosition().Seq)
+}
+
+// Close stops following and ends the followers' log streams.
+func (r *replicator) Close() {
+	r.closeOnce.Do(func() { close(r.closed) })
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stopLocked()
+}
+
+func (r *replicator) stopLocked() {
+	if r.stop != nil {
+		r.stop()
+		<-r.done
+		r.stop, r.done = nil, nil
+	}
+}
+
+// staleness is how long ago the follower last had everything the leader
+// reported. It is zero on a leader.
+func (r *replicator) staleness() time.Duration {
+	if r.Leader() == "" {
+		return 0
+	}
+	since := r.caughtUp.Load()
+	if since == 0 {
+		since = r.following.Load()
+	}
+	return time.Since(time.Unix(0, since))
+}
+
+// unavailable returns why a follower should not serve reads, or "".
+func (r *replicator) unavailable() string {
+	if r.Leader() == "" {
+		return ""
+	}
+	if r.caughtUp.Load() == 0 {
+		return "replica has not caught up with its leader"
+	}
+	if stale := r.staleness(); stale > r.maxStaleness {
+		return fmt.Sprintf("replica is %s behind its leader", stale.Round(time.Millisecond))
+	}
+	return ""
+}
+
+// Status reports the server's replication state.
+func (r *replicator) Status() ReplicationStatus {
+	pos := r.engine.JournalPosition()
+	s := ReplicationStatus{
+		Role:      "leader",
+		Leader:    r.Leader(),
+		Position:  pos,
+		Followers: r.followers.Load(),
+		Snapshots: r.snapshots.Load(),
+		Errors:    r.errors.Load(),
+	}
+	if s.Leader != "" {
+		s.Role = "follower"
+		s.LeaderSeq = r.leaderSeq.Load()
+		if s.LeaderSeq > pos.Seq {
+			s.Lag = s.LeaderSeq - pos.Seq
+		}
+		s.Staleness = r.staleness().Seconds()
+	}
+	return s
+}
+
+// Guard wraps the server's handler so that a follower rejects writes, and
+// rejects reads while it is too far behind. Health checks, metrics and the
+// replication endpoints are always served.
+func (r *replicator) Guard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		leader := r.Leader()
+		if leader == "" || alwaysServed(req.URL.Path) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		switch {
+		case auditedRead(req):
+			// The audit entry would fork the follower's audit log from
+			// the leader's.
+			w.Header().Set("X-Replication-Leader", leader)
+			writeError(w, req, &apiError{status: http.StatusServiceUnavailable, code: codeReadOnly, msg: "this request is audited, so only the leader serves it; send it to " + leader})
+		case req.Method == http.MethodGet || req.Method == http.MethodHead || req.Method == http.MethodOptions:
+			if reason := r.unavailable(); reason != "" {
+				w.Header().Set("Retry-After", "1")
+				writeError(w, req, &apiError{status: http.StatusServiceUnavailable, code: codeReplicaStale, msg: reason})
+				return
+			}
+			next.ServeHTTP(w, req)
+		default:
+			w.Header().Set("X-Replication-Leader", leader)
+			writeError(w, req, &apiError{status: http.StatusServiceUnavailable, code: codeReadOnly, msg: "this server is a read-only replica; send writes to " + leader})
+		}
+	})
+}
+
+// auditedRead reports whether req reads but still adds to the audit log.
+func auditedRead(req *http.Request) bool {
+	return req.URL.Path == "/api/v1/admin/export"
+}
+
+func alwaysServed(path string) bool {
+	switch path {
+	case "/healthz", "/readyz", "/metrics":
+		return true
+	}
+	return strings.HasPrefix(path, "/replication/") || strings.HasPrefix(path, "/debug/")
+}
+
+// Handler serves the replication endpoints under /replication/.
+func (r *replicator) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !r.authorized(req) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="replication"`)
+			writeError(w, req, &apiError{status: http.StatusUnauthorized, code: codeUnauthorized, msg: "a valid replication token is required"})
+			return
+		}
+		route := req.Method + " " + req.URL.Path
+		switch route {
+		case "GET /replication/log":
+			r.serveLog(w, req)
+		case "GET /replication/snapshot":
+			r.serveSnapshot(w, req)
+		case "GET /replication/status":
+			writeJSON(w, req, r.Status())
+		case "POST /replication/promote":
+			r.Promote()
+			writeJSON(w, req, r.Status())
+		case "POST /replication/follow":
+			r.serveFollow(w, req)
+		default:
+			writeError(w, req, &apiError{status: http.StatusNotFound, code: codeNotFound, msg: "no such route"})
+		}
+	})
+}
+
+func (r *replicator) serveFollow(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Leader string `json:"leader"`
+	}
+	if err := decodeJSON(req, &body); err != nil {
+		writeError(w, req, err)
+		return
+	}
+	if !isHTTPURL(body.Leader) {
+		writeError(w, req, badRequest("leader must be an http or https URL"))
+		return
+	}
+	r.Follow(body.Leader)
+	writeJSON(w, req, r.Status())
+}
+
+// authorized reports whether the request carries the replication token.
+// Without a token nothing is authorized; validate refuses to start
+// replication without one.
+func (r *replicator) authorized(req *http.Request) bool {
+	if r.token == "" {
+		return false
+	}
+	given, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(given), []byte(r.token)) == 1
+}
+
+func (r *replicator) serveSnapshot(w http.ResponseWriter, req *http.Request) {
+	snap, pos, err := r.engine.ReplicationSnapshot()
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	writeJSON(w, req, replicationSnapshot{Position: pos, Snapshot: snap})
+}
+
+// serveLog streams the journal after the position in the query as NDJSON
+// frames until the follower disconnects. It answers 410 Gone if that
+// position is not in the journal, telling the follower to fetch a snapshot.
+func (r *replicator) serveLog(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	seq, errSeq := strconv.ParseUint(q.Get("after"), 10, 64)
+	epoch, errEpoch := strconv.ParseInt(q.Get("epoch"), 10, 64)
+	if errSeq != nil || errEpoch != nil {
+		writeError(w, req, badRequest("after and epoch must be integers"))
+		return
+	}
+	pos := engine.JournalPosition{Seq: seq, Epoch: epoch}
+	batch, changed, err := r.engine.JournalSince(pos, journalBatch)
+	if errors.Is(err, engine.ErrJournalGap) {
+		writeError(w, req, &apiError{status: http.StatusGone, code: codeJournalGap, msg: fmt.Sprintf("position %d is not in the journal; fetch a snapshot", seq)})
+		return
+	}
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+
+	// The stream outlives the server's write timeout.
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	r.followers.Add(1)
+	defer r.followers.Add(-1)
+	enc := json.NewEncoder(w)
+	ticker := time.NewTicker(r.heartbeat)
+	defer ticker.Stop()
+	for {
+		for i := range batch {
+			if err := enc.Encode(replicationFrame{Mutation: &batch[i]}); err != nil {
+				return
+			}
+			pos = engine.JournalPosition{Seq: batch[i].Seq, Epoch: batch[i].Epoch}
+		}
+		head := r.engine.JournalPosition()
+		if err := enc.Encode(replicationFrame{Heartbeat: &head}); err != nil {
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+		if len(batch) < journalBatch {
+			select {
+			case <-changed:
+			case <-ticker.C:
+			case <-req.Context().Done():
+				return
+			case <-r.closed:
+				return
+			}
+		}
+		// A snapshot restored on a cascading follower resets its journal;
+		// the follower reconnects and is told to catch up.
+		if batch, changed, err = r.engine.JournalSince(pos, journalBatch); err != nil {
+			return
+		}
+	}
+}
+
+// run follows leader until ctx is cancelled, catching up from a snapshot
+// whenever the leader no longer has the follower's position.
+func (r *replicator) run(ctx context.Context, leader string, done chan struct{}) {
+	defer close(done)
+	r.logger.Info("following replication leader", "leader", leader)
+	for ctx.Err() == nil {
+		err := r.stream(ctx, leader)
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, engine.ErrJournalGap) {
+			r.logger.Info("catching up from the leader's snapshot", "leader", leader)
+			if err = r.catchUp(ctx, leader); err == nil {
+				continue
+			}
+		}
+		r.errors.Add(1)
+		r.logger.Warn("replication failed", "leader", leader, "err", err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(r.heartbeat):
+		}
+	}
+}
+
+// stream applies the leader's journal from the engine's position until the
+// connection fails or goes quiet for three heartbeats.
+func (r *replicator) stream(ctx context.Context, leader string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	pos := r.engine.JournalPosition()
+	q := url.Values{"after": {strconv.FormatUint(pos.Seq, 10)}, "epoch": {strconv.FormatInt(pos.Epoch, 10)}}
+	resp, err := r.get(ctx, leader+"/replication/log?"+q.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	idle := time.AfterFunc(3*r.heartbeat, cancel)
+	defer idle.Stop()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var frame replicationFrame
+		if err := dec.Decode(&frame); err != nil {
+			return fmt.Errorf("reading the journal: %w", err)
+		}
+		idle.Reset(3 * r.heartbeat)
+		switch {
+		case frame.Mutation != nil:
+			if err := r.engine.Apply(ctx, *frame.Mutation); err != nil {
+				// The engine may be half-way through the mutation, so it
+				// has to be restored.
+				return fmt.Errorf("applying mutation %d: %w: %w", frame.Mutation.Seq, engine.ErrJournalGap, err)
+			}
+		case frame.Heartbeat != nil:
+			r.leaderSeq.Store(frame.Heartbeat.Seq)
+			if r.engine.JournalPosition().Seq >= frame.Heartbeat.Seq {
+				r.caughtUp.Store(time.Now().UnixNano())
+			}
+		}
+	}
+}
+
+// catchUp restores the leader's snapshot.
+func (r *replicator) catchUp(ctx context.Context, leader string) error {
+	resp, err := r.get(ctx, leader+"/replication/snapshot")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var body replicationSnapshot
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return fmt.Errorf("reading the snapshot: %w", err)
+	}
+	if body.Snapshot == nil {
+		return errors.New("reading the snapshot: no snapshot in the response")
+	}
+	if err := r.engine.RestoreReplica(body.Snapshot, body.Position); err != nil {
+		return fmt.Errorf("restoring the snapshot: %w", err)
+	}
+	r.snapshots.Add(1)
+	r.leaderSeq.Store(body.Position.Seq)
+	return nil
+}
+
+// get requests a replication endpoint of the leader. A 410 Gone response
+// is returned as ErrJournalGap.
+func (r *replicator) get(ctx context.Context, u string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if r.token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		return nil, engine.ErrJournalGap
+	}
+	var body ErrorResponse
+	json.NewDecoder(resp.Body).Decode(&body)
+	return nil, fmt.Errorf("%s: %s %s", u, resp.Status, body.Error.Message)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reddit-clone/engine"
+	"strings"
+	"testing"
+)
+
+// TestReplication runs a leader and a follower in their own processes: the
+// follower catches up from a snapshot, then applies the journal as the
+// leader changes, rejects writes, stops serving reads once the leader is
+// gone, and takes writes after being promoted.
+func TestReplication(t *testing.T) {
+	request := func(url, method, path, body string, out any) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, url+path, strings.NewReader(body))
+		req.Header.Set("X-Username", "bob")
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if out != nil {
+			json.NewDecoder(resp.Body).Decode(out)
+		}
+		return resp
+	}
+	status := func(url string) ReplicationStatus {
+		t.Helper()
+		var s ReplicationStatus
+		if resp := request(url, "GET", "/replication/status", "", &s); resp.StatusCode != http.StatusOK {
+			t.Fatalf("replication status of %s: %d", url, resp.StatusCode)
+		}
+		return s
+	}
+	snapshot := func(url string) replicationSnapshot {
+		t.Helper()
+		var snap replicationSnapshot
+		if resp := request(url, "GET", "/replication/snapshot", "", &snap); resp.StatusCode != http.StatusOK {
+			t.Fatalf("snapshot of %s: %d", url, resp.StatusCode)
+		}
+		return snap
+	}
+
+	dataFile := filepath.Join(t.TempDir(), "reddit.json")
+	if err := newFixture(t).e.SaveFile(dataFile); err != nil {
+		t.Fatal(err)
+	}
+	leader := startServer(t, freeAddr(t), "-data-file "+dataFile+" -replication -replication-token secret -journal-size 16 -admin-token secret")
+	// Registering and then logging in journals a mutation and an
+	// audit-only one.
+	for i := 0; i < 2; i++ {
+		request(leader.url, "POST", "/api/v1/users", `{"username":"carol"}`, nil)
+	}
+
+	// The leader sends a heartbeat every second, so the follower must
+	// allow more staleness than that.
+	follower := startServer(t, freeAddr(t), "-follow "+leader.url+" -replication-token secret -max-staleness 1500ms -admin-token secret")
+	same := func() bool {
+		a, b := snapshot(leader.url), snapshot(follower.url)
+		x, _ := json.Marshal(a.Snapshot)
+		y, _ := json.Marshal(b.Snapshot)
+		return a.Position.Seq == b.Position.Seq && string(x) == string(y)
+	}
+	waitFor(t, "the follower catches up", same)
+	if s := status(follower.url); s.Snapshots != 1 || s.Role != "follower" {
+		t.Errorf("follower status after catching up: %+v", s)
+	}
+
+	// More changes than the journal keeps arrive through the stream, since
+	// the follower keeps up. Between them they change every kind of field
+	// the journal records.
+	for _, req := range []struct{ method, path, body string }{
+		{"POST", "/api/v1/posts/1/votes", `{"direction":-1}`},
+		{"POST", "/api/v1/posts/1/votes", `{"direction":1,"username":"alice"}`},
+		{"POST", "/api/v1/posts/1/comments", `{"content":"Streamed","username":"bob"}`},
+		{"POST", "/api/v1/posts/1/comments", `{"content":"Reply","username":"bob","parentId":2}`},
+		{"PUT", "/api/v1/posts/1/comments/3/removal", `{"reason":"Off topic"}`},
+		{"POST", "/api/v1/r/news/posts", `{"title":"Second","content":"Body","username":"bob"}`},
+		{"PUT", "/api/v1/admin/users/carol/username", `{"name":"caroline"}`},
+		{"PUT", "/api/v1/posts/2/removal", `{"reason":"Spam"}`},
+		{"POST", "/api/v1/users/alice/messages", `{"content":"Hi","from":"bob"}`},
+		{"PUT", "/api/v1/r/news/members/alice", ""},
+		{"PUT", "/api/v1/r/news/moderators/caroline", ""},
+		{"PUT", "/api/v1/r/news/bans/alice", `{"reason":"Spam"}`},
+		{"POST", "/api/v1/r/news/filters", `{"kind":"word","pattern":"darn","action":"mask"}`},
+		{"POST", "/api/v1/admin/filters", `{"kind":"word","pattern":"heck","action":"review"}`},
+		{"PUT", "/api/v1/r/news/repost-policy", `{"action":"block","window":"24h"}`},
+		{"PUT", "/api/v1/admin/users/alice/suspension", `{"reason":"Spam"}`},
+		{"PUT", "/api/v1/admin/r/news/name", `{"name":"headlines"}`},
+	} {
+		if resp := request(leader.url, req.method, req.path, req.body, nil); resp.StatusCode >= 300 {
+			t.Fatalf("%s %s: %d", req.method, req.path, resp.StatusCode)
+		}
+	}
+	waitFor(t, "the follower applies the journal", same)
+	if s := status(follower.url); s.Snapshots != 1 || s.Lag != 0 {
+		t.Errorf("follower status after streaming: %+v", s)
+	}
+	if resp := request(follower.url, "GET", "/api/v1/users/caroline", "", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("renamed user on the follower: %d", resp.StatusCode)
+	}
+	var verified AuditVerifyResponse
+	request(follower.url, "GET", "/api/v1/admin/audit/verify", "", &verified)
+	if !verified.Valid || verified.Entries == 0 {
+		t.Errorf("follower audit log: %+v", verified)
+	}
+
+	if resp := request(follower.url, "GET", "/api/v1/posts/2", "", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("read from follower: %d", resp.StatusCode)
+	}
+	if resp := request(follower.url, "POST", "/api/v1/r/headlines/posts", `{"title":"Nope","username":"bob"}`, nil); resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("X-Replication-Leader") != leader.url {
+		t.Errorf("write to follower: %d", resp.StatusCode)
+	}
+	if resp := request(follower.url, "GET", "/api/v1/admin/export", "", nil); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("audited export from follower: %d", resp.StatusCode)
+	}
+	if resp, _ := http.Post(follower.url+"/replication/promote", "", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("promote without the token: %d", resp.StatusCode)
+	}
+
+	leader.stop()
+	waitFor(t, "the follower goes stale", func() bool {
+		resp, err := http.Get(follower.url + "/readyz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusServiceUnavailable
+	})
+	if resp := request(follower.url, "GET", "/api/v1/posts/2", "", nil); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("read from a stale follower: %d", resp.StatusCode)
+	}
+
+	before := status(follower.url).Position
+	if resp := request(follower.url, "POST", "/replication/promote", "", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("promote: %d", resp.StatusCode)
+	}
+	if resp := request(follower.url, "POST", "/api/v1/r/headlines/posts", `{"title":"Promoted","username":"bob"}`, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("write after promotion: %d", resp.StatusCode)
+	}
+	if after := status(follower.url).Position; after.Seq <= before.Seq || after.Epoch == before.Epoch {
+		t.Errorf("position after promotion %+v, before %+v", after, before)
+	}
+}
+
+// TestReplicationNeedsToken checks that replication does not run without a
+// token, since its endpoints hand out the whole site.
+func TestReplicationNeedsToken(t *testing.T) {
+	cfg := defaultServerConfig()
+	cfg.Replication.Enabled = true
+	if err := cfg.validate(); err == nil {
+		t.Error("replication without a token passed validation")
+	}
+	cfg.Replication.Token = "secret"
+	if err := cfg.validate(); err != nil {
+		t.Errorf("replication with a token: %v", err)
+	}
+
+	r := newReplicator(NewAPI(engine.NewRedditEngine()), ReplicationConfig{Enabled: true}, nil)
+	defer r.Close()
+	for _, auth := range []string{"", "Bearer "} {
+		req := httptest.NewRequest("GET", "/replication/snapshot", nil)
+		req.Header.Set("Authorization", auth)
+		rec := httptest.NewRecorder()
+		r.Handler().ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("snapshot from a leader without a token, Authorization %q: %d", auth, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reddit-clone/client"
+	"reddit-clone/engine"
+	"testing"
+	"time"
+)
+
+func TestNormalizeURL(t *testing.T) {
+	tests := []struct {
+		raw, want string
+	}{
+		{"https://example.com/a", "example.com/a"},
+		{"http://WWW.Example.com/a/", "example.com/a"},
+		{"https://m.example.com:443/a#comments", "example.com/a"},
+		{"https://example.com:8080/a", "example.com:8080/a"},
+		{"https://example.com/a?utm_source=x&b=2&a=1&fbclid=y", "example.com/a?a=1&b=2"},
+		{"https://youtu.be/abc123?si=share", "youtube.com/watch?v=abc123"},
+		{"https://www.youtube.com/watch?v=abc123&feature=share", "youtube.com/watch?v=abc123"},
+	}
+	for _, tt := range tests {
+		if got, ok := engine.NormalizeURL(tt.raw); !ok || got != tt.want {
+			t.Errorf("NormalizeURL(%q) = %q, %v; want %q", tt.raw, got, ok, tt.want)
+		}
+	}
+	for _, raw := range []string{"ftp://example.com/a", "not a link", "https://"} {
+		if got, ok := engine.NormalizeURL(raw); ok {
+			t.Errorf("NormalizeURL(%q) = %q, want an error", raw, got)
+		}
+	}
+}
+
+// TestReposts checks that a repost is returned with the posts it repeats,
+// listed under the earlier post's reposts, and refused once the subreddit
+// blocks reposts.
+func TestReposts(t *testing.T) {
+	e := newFixture(t).e
+	c := newAPIClient(t, newTestAPI(e))
+	submit := func(user, title, content string) *httptest.ResponseRecorder {
+		t.Helper()
+		body, _ := json.Marshal(SubmitPostRequest{Title: title, Content: content, Username: user})
+		return c.do("POST", "/api/v1/r/news/posts", user, string(body))
+	}
+	const text = "The city council votes on the new bridge plan tonight after months of debate"
+	if rec := submit("alice", "Bridge vote tonight", text+" https://example.com/bridge"); rec.Code != http.StatusOK {
+		t.Fatalf("submit: status %d\n%s", rec.Code, rec.Body)
+	}
+
+	previously := func(rec *httptest.ResponseRecorder) []RepostResponse {
+		var resp PostResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return resp.PreviouslyPosted
+	}
+	if reposts := previously(submit("bob", "Bridge vote is tonight", text)); len(reposts) != 1 || reposts[0].Post.ID != 2 || reposts[0].Match != engine.RepostMatchText {
+		t.Fatalf("previously posted: %+v", reposts)
+	}
+	if reposts := previously(submit("bob", "Look at this", "http://www.example.com/bridge/?utm_source=feed")); len(reposts) != 1 || reposts[0].Match != engine.RepostMatchLink {
+		t.Fatalf("previously posted: %+v", reposts)
+	}
+	if reposts := previously(submit("bob", "Something else entirely", "Nothing to do with bridges at all")); len(reposts) != 0 {
+		t.Fatalf("previously posted: %+v", reposts)
+	}
+
+	var reposts []RepostResponse
+	json.Unmarshal(c.do("GET", "/api/v1/posts/4/reposts", "bob", "").Body.Bytes(), &reposts)
+	if len(reposts) != 1 || reposts[0].Post.ID != 2 || !reposts[0].Flagged {
+		t.Fatalf("reposts of post 4: %+v", reposts)
+	}
+
+	policy := `{"action":"block","window":"1h"}`
+	if rec := c.do("PUT", "/api/v1/r/news/repost-policy", "alice", policy); rec.Code != http.StatusForbidden {
+		t.Errorf("non-moderator set policy: status %d", rec.Code)
+	}
+	if rec := c.do("PUT", "/api/v1/r/news/repost-policy", "bob", `{"action":"ignore"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown action: status %d", rec.Code)
+	}
+	if rec := c.do("PUT", "/api/v1/r/news/repost-policy", "bob", policy); rec.Code != http.StatusOK {
+		t.Fatalf("set policy: status %d\n%s", rec.Code, rec.Body)
+	}
+	if rec := submit("alice", "Bridge vote tonight", text); rec.Code != http.StatusConflict {
+		t.Errorf("blocked repost: status %d\n%s", rec.Code, rec.Body)
+	}
+
+	// Earlier posts outside the window no longer count.
+	for id := 1; id <= 5; id++ {
+		post, _ := e.LookupPost(id)
+		post.CreatedAt = post.CreatedAt.Add(-2 * time.Hour)
+	}
+	if rec := submit("alice", "Bridge vote tonight", text); rec.Code != http.StatusOK {
+		t.Errorf("repost after the window: status %d\n%s", rec.Code, rec.Body)
+	}
+
+	// The policy survives a snapshot, and the restored engine still knows
+	// the earlier posts.
+	var buf bytes.Buffer
+	e.WriteSnapshot(&buf)
+	restored := engine.NewRedditEngine()
+	if err := restored.ReadSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	news := restored.GetSubRedditByName("news")
+	if news.Reposts != (engine.RepostPolicy{Action: engine.RepostBlock, Window: time.Hour}) {
+		t.Errorf("restored policy: %+v", news.Reposts)
+	}
+	if _, err := restored.CreatePost(restored.GetUserByUsername("alice"), news, "Bridge vote tonight", text); err == nil {
+		t.Error("restored engine accepted a blocked repost")
+	}
+}
+
+// TestSimulatedReposts checks that reposts made by the simulator are
+// found, and that no original post is taken for a repost.
+func TestSimulatedReposts(t *testing.T) {
+	sim := client.NewSimulator(nil)
+	sim.RepostRate = 0.2
+	sim.Run(20, 5, 300, 0, 0, 0)
+	submitted, detected, falseMatches := sim.CheckReposts()
+	if submitted == 0 || detected != submitted || falseMatches != 0 {
+		t.Fatalf("%d reposts submitted, %d detected, %d original posts matched", submitted, detected, falseMatches)
+	}
+}
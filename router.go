@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"reddit-clone/tracing"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Router dispatches requests on method and path. Patterns are
+// slash-separated segments where a "{name}" segment captures exactly one
+// path segment, e.g. "/api/v1/r/{name}/posts". OPTIONS requests for a path
+// with routes are answered with 204 and the Allow header.
+type Router struct {
+	routes []*Route
+
+	// NotFound and MethodNotAllowed replace the plain-text defaults when set.
+	// The Allow header is already set when MethodNotAllowed is called.
+	NotFound         http.HandlerFunc
+	MethodNotAllowed http.HandlerFunc
+}
+
+// Route is a single method and pattern registered on a Router. The
+// documentation fields are filled in with the builder methods below and are
+// used to generate the OpenAPI document.
+type Route struct {
+	Method  string
+	Pattern string
+	Name    string
+	handler http.HandlerFunc
+	parts   []string
+
+	Summary    string
+	Request    reflect.Type
+	Response   reflect.Type
+	Paged      bool
+	Query      []string
+	Deprecated bool
+	Auth       bool
+	// Admin routes also need the server's admin token.
+	Admin bool
+	// BodyLimit overrides the default limit on request bodies when set.
+	BodyLimit int64
+}
+
+type paramsKey struct{}
+
+// routeSlotKey holds a *routeSlot the router fills in with the matched
+// route, so middleware outside the router can tell which route served a
+// request.
+type routeSlotKey struct{}
+
+type routeSlot struct {
+	route *Route
+}
+
+// name returns the matched route's name, or "unmatched".
+func (slot *routeSlot) name() string {
+	if slot == nil || slot.route == nil {
+		return "unmatched"
+	}
+	return slot.route.Name
+}
+
+// withRouteSlot returns a request whose matched route can be read back with
+// routeSlotFrom once the router has served it.
+func withRouteSlot(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), routeSlotKey{}, &routeSlot{}))
+}
+
+// routeSlotFrom returns the slot added by withRouteSlot, or nil.
+func routeSlotFrom(ctx context.Context) *routeSlot {
+	slot, _ := ctx.Value(routeSlotKey{}).(*routeSlot)
+	return slot
+}
+
+func NewRouter() *Router {
+	return &Router{}
+}
+
+// Handle registers h for the given method and pattern. The name is a stable
+// identifier for the operation.
+func (rt *Router) Handle(method, pattern, name string, h http.HandlerFunc) *Route {
+	route := &Route{
+		Method:  method,
+		Pattern: pattern,
+		Name:    name,
+		handler: h,
+		parts:   splitPath(pattern),
+	}
+	rt.routes = append(rt.routes, route)
+	return route
+}
+
+// Doc sets a one-line summary of the operation.
+func (route *Route) Doc(summary string) *Route {
+	route.Summary = summary
+	return route
+}
+
+// Accepts records the type of the JSON request body.
+func (route *Route) Accepts(body any) *Route {
+	route.Request = reflect.TypeOf(body)
+	return route
+}
+
+// Returns records the type of the JSON response body.
+func (route *Route) Returns(body any) *Route {
+	route.Response = reflect.TypeOf(body)
+	return route
+}
+
+// ReturnsPage records that the response is a paginated array of item.
+func (route *Route) ReturnsPage(item any) *Route {
+	route.Paged = true
+	return route.Returns(item)
+}
+
+// WithQuery records optional query parameters the operation understands.
+func (route *Route) WithQuery(names ...string) *Route {
+	route.Query = append(route.Query, names...)
+	return route
+}
+
+// Authenticated records that the operation acts on behalf of the user
+// named by the X-Username header.
+func (route *Route) Authenticated() *Route {
+	route.Auth = true
+	return route
+}
+
+// AdminOnly records that the operation is for admins, who send the
+// server's admin token as a bearer token along with X-Username.
+func (route *Route) AdminOnly() *Route {
+	route.Auth = true
+	route.Admin = true
+	return route
+}
+
+// DeprecatedBy marks the route as superseded by another path. Responses
+// carry a Deprecation header and a Link to the successor.
+func (route *Route) DeprecatedBy(successor string) *Route {
+	route.Deprecated = true
+	next := route.handler
+	route.handler = func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+successor+`>; rel="successor-version"`)
+		next(w, r)
+	}
+	return route
+}
+
+// LimitBody raises or lowers the request body limit for this route, for
+// operations such as bulk imports that need more than the default.
+func (route *Route) LimitBody(n int64) *Route {
+	route.BodyLimit = n
+	return route
+}
+
+// Routes returns the registered routes in registration order.
+func (rt *Router) Routes() []*Route {
+	return rt.routes
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	best, bestParams, allowed := rt.find(r)
+	if best != nil {
+		if slot := routeSlotFrom(r.Context()); slot != nil {
+			slot.route = best
+		}
+		ctx, span := tracing.Start(r.Context(), "handler "+best.Name)
+		defer span.End()
+		ctx = context.WithValue(ctx, paramsKey{}, bestParams)
+		best.handler(w, r.WithContext(ctx))
+		return
+	}
+	if len(allowed) > 0 {
+		w.Header().Set("Allow", allowHeader(allowed))
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if rt.MethodNotAllowed != nil {
+			rt.MethodNotAllowed(w, r)
+			return
+		}
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if rt.NotFound != nil {
+		rt.NotFound(w, r)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// Lookup returns the route that would serve r, or nil.
+func (rt *Router) Lookup(r *http.Request) *Route {
+	route, _, _ := rt.find(r)
+	return route
+}
+
+// find returns the best matching route for r and its path parameters. If
+// no route matches, allowed holds the methods the path does support.
+func (rt *Router) find(r *http.Request) (best *Route, params map[string]string, allowed map[string]bool) {
+	parts := splitPath(r.URL.EscapedPath())
+	for i, part := range parts {
+		if unescaped, err := url.PathUnescape(part); err == nil {
+			parts[i] = unescaped
+		}
+	}
+
+	bestScore := -1
+	allowed = make(map[string]bool)
+	for _, route := range rt.routes {
+		routeParams, score, ok := route.match(parts)
+		if !ok {
+			continue
+		}
+		if route.Method != r.Method && !(r.Method == http.MethodHead && route.Method == http.MethodGet) {
+			allowed[route.Method] = true
+			continue
+		}
+		if score > bestScore {
+			best, params, bestScore = route, routeParams, score
+		}
+	}
+	return best, params, allowed
+}
+
+// match reports whether the route matches the path segments. The score is
+// the number of literal segments, so "/posts/new" wins over "/posts/{id}".
+func (route *Route) match(parts []string) (map[string]string, int, bool) {
+	if len(parts) != len(route.parts) {
+		return nil, 0, false
+	}
+	params := make(map[string]string)
+	score := 0
+	for i, part := range route.parts {
+		if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") {
+			if parts[i] == "" {
+				return nil, 0, false
+			}
+			params[part[1:len(part)-1]] = parts[i]
+			continue
+		}
+		if part != parts[i] {
+			return nil, 0, false
+		}
+		score++
+	}
+	return params, score, true
+}
+
+// pathParam returns the value captured for a "{name}" segment.
+func pathParam(r *http.Request, name string) string {
+	params, _ := r.Context().Value(paramsKey{}).(map[string]string)
+	return params[name]
+}
+
+// withPathParam returns a copy of r with an extra captured path parameter.
+func withPathParam(r *http.Request, name, value string) *http.Request {
+	old, _ := r.Context().Value(paramsKey{}).(map[string]string)
+	params := make(map[string]string, len(old)+1)
+	for k, v := range old {
+		params[k] = v
+	}
+	params[name] = value
+	return r.WithContext(context.WithValue(r.Context(), paramsKey{}, params))
+}
+
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+func allowHeader(allowed map[string]bool) string {
+	if allowed[http.MethodGet] {
+		allowed[http.MethodHead] = true
+	}
+	allowed[http.MethodOptions] = true
+	methods := make([]string, 0, len(allowed))
+	for method := range allowed {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	return strings.Join(methods, ", ")
+}
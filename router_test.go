@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// TestRouter checks method dispatch on a path: unsupported methods get 405
+// with the Allow header, OPTIONS lists the methods, and HEAD is served by
+// the GET route.
+func TestRouter(t *testing.T) {
+	c := newAPIClient(t, newTestAPI(newFixture(t).e))
+
+	rec := c.do("DELETE", "/api/v1/users", "", "")
+	if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != "GET, HEAD, OPTIONS, POST" {
+		t.Errorf("DELETE /api/v1/users: status %d, Allow %q", rec.Code, rec.Header().Get("Allow"))
+	}
+	var body ErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Error.Code != codeMethodNotAllowed {
+		t.Errorf("405 body: %s", rec.Body)
+	}
+
+	rec = c.do("OPTIONS", "/api/v1/r/news/members/alice", "", "")
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Allow") != "DELETE, OPTIONS, PUT" || rec.Body.Len() != 0 {
+		t.Errorf("OPTIONS: status %d, Allow %q, body %q", rec.Code, rec.Header().Get("Allow"), rec.Body)
+	}
+	if rec := c.do("OPTIONS", "/api/v1/nothing", "", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("OPTIONS on an unknown path: status %d", rec.Code)
+	}
+
+	if rec := c.do("HEAD", "/api/v1/posts/1", "", ""); rec.Code != http.StatusOK {
+		t.Errorf("HEAD on a GET route: status %d", rec.Code)
+	}
+}
+
+// TestServerOptions checks OPTIONS through the handler main builds: CORS
+// preflights are answered before the API, and any other OPTIONS request
+// reaches the router.
+func TestServerOptions(t *testing.T) {
+	s := startServer(t, freeAddr(t), "-allowed-origins https://example.com")
+	options := func(path, origin string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest("OPTIONS", s.url+path, nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+			req.Header.Set("Access-Control-Request-Method", "PUT")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	if resp := options("/api/v1/r/news/members/alice", ""); resp.StatusCode != http.StatusNoContent || resp.Header.Get("Allow") != "DELETE, OPTIONS, PUT" {
+		t.Errorf("OPTIONS: status %d, Allow %q", resp.StatusCode, resp.Header.Get("Allow"))
+	}
+	if resp := options("/api/v1/nothing", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("OPTIONS on an unknown path: status %d", resp.StatusCode)
+	}
+	resp := options("/api/v1/r/news/members/alice", "https://example.com")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Access-Control-Allow-Origin") != "https://example.com" {
+		t.Errorf("preflight: status %d, allowed origin %q", resp.StatusCode, resp.Header.Get("Access-Control-Allow-Origin"))
+	}
+	if resp := options("/api/v1/r/news/members/alice", "https://evil.example"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("preflight from another origin: status %d", resp.StatusCode)
+	}
+}
+
+// TestLegacyRoutes checks that the pre-v1 paths are served by their
+// successors' handlers and point clients at them.
+func TestLegacyRoutes(t *testing.T) {
+	f := newFixture(t)
+	c := newAPIClient(t, newTestAPI(f.e))
+
+	var post PostResponse
+	rec := c.mustDo("POST", "/api/news/submit", "", `{"title":"Legacy","content":"Body","username":"alice"}`, &post)
+	if post.Title != "Legacy" || post.Subreddit != "news" {
+		t.Errorf("legacy submit: %+v", post)
+	}
+	if rec.Header().Get("Deprecation") != "true" || rec.Header().Get("Link") != `</api/v1/r/{name}/posts>; rel="successor-version"` {
+		t.Errorf("legacy headers: Deprecation %q, Link %q", rec.Header().Get("Deprecation"), rec.Header().Get("Link"))
+	}
+	if rec := c.mustDo("GET", "/api/v1/r/news/posts", "", "", nil); rec.Header().Get("Deprecation") != "" {
+		t.Error("a v1 route is marked deprecated")
+	}
+
+	// join and leave take the username from the body instead of the path.
+	member := func() bool {
+		var joined bool
+		f.e.View(func() { _, joined = f.news.Members[f.alice.ID] })
+		return joined
+	}
+	c.mustDo("POST", "/api/news/join", "", `{"username":"alice"}`, nil)
+	if !member() {
+		t.Error("legacy join did not add alice")
+	}
+	c.mustDo("POST", "/api/news/leave", "", `{"username":"alice"}`, nil)
+	if member() {
+		t.Error("legacy leave did not remove alice")
+	}
+	if rec := c.do("POST", "/api/news/join", "", `{"username":`); rec.Code != http.StatusBadRequest {
+		t.Errorf("legacy join with a malformed body: status %d", rec.Code)
+	}
+
+	if rec := c.do("GET", "/api/nothing/feed", "", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("legacy feed of an unknown subreddit: status %d", rec.Code)
+	}
+}
@@ -0,0 +1,694 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"reddit-clone/logging"
+	"reddit-clone/tracing"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ServerConfig configures the REST API server. Settings are read, in
+// increasing order of precedence, from the defaults, a JSON file, REDDIT_*
+// environment variables and command-line flags.
+type ServerConfig struct {
+	Addr              string   `json:"addr"`
+	ReadTimeout       Duration `json:"readTimeout"`
+	ReadHeaderTimeout Duration `json:"readHeaderTimeout"`
+	WriteTimeout      Duration `json:"writeTimeout"`
+	IdleTimeout       Duration `json:"idleTimeout"`
+	// ShutdownTimeout bounds how long in-flight requests may take to finish
+	// after SIGINT or SIGTERM.
+	ShutdownTimeout Duration `json:"shutdownTimeout"`
+	MaxHeaderBytes  int      `json:"maxHeaderBytes"`
+	// AllowedOrigins lists the origins allowed to make cross-origin
+	// requests. "*" allows any origin.
+	AllowedOrigins    []string `json:"allowedOrigins"`
+	IdempotencyWindow Duration `json:"idempotencyWindow"`
+	// DataFile, if set, is loaded at startup and written on shutdown.
+	DataFile string `json:"dataFile"`
+	// Admins are given the admin role at startup, registering them if they
+	// do not exist yet.
+	Admins []string `json:"admins"`
+	// AdminToken is the secret admins send as a bearer token to the admin
+	// API and give when logging in to the console. A username alone never
+	// grants admin rights, so admins need one.
+	AdminToken string `json:"adminToken"`
+	// AuditFile, if set, receives a copy of every new audit log entry as a
+	// line of JSON. Use it with DataFile so the chain continues across
+	// restarts.
+	AuditFile string `json:"auditFile"`
+	// SessionSecret signs the cookies of the HTML pages. If it is empty a
+	// random key is used and everyone is logged out on restart.
+	SessionSecret string            `json:"sessionSecret"`
+	TLS           TLSConfig         `json:"tls"`
+	Log           LogConfig         `json:"log"`
+	Tracing       TraceConfig       `json:"tracing"`
+	Replication   ReplicationConfig `json:"replication"`
+	Cluster       ClusterConfig     `json:"cluster"`
+	Votes         VoteConfig        `json:"votes"`
+}
+
+// Votes are buffered and applied ten times a second by default.
+const (
+	defaultVoteFlushInterval = 100 * time.Millisecond
+	defaultVoteShards        = 32
+)
+
+// VoteConfig configures buffered vote ingestion. Votes are recorded in a
+// sharded buffer without taking the engine lock and applied to scores and
+// karma every FlushInterval; voters see their own vote at once. Cluster
+// nodes always apply votes as they are cast.
+type VoteConfig struct {
+	// FlushInterval is how often buffered votes are applied. Zero applies
+	// every vote as it is cast.
+	FlushInterval Duration `json:"flushInterval"`
+	// Shards is the number of independently locked parts of the buffer.
+	Shards int `json:"shards"`
+	// Strict applies buffered votes before every read, so that everyone
+	// sees every vote at once.
+	Strict bool `json:"strict"`
+}
+
+// ClusterConfig shards the site across several servers. Subreddits, with
+// their posts, comments and votes, live in one of Partitions partitions
+// chosen by a hash of the subreddit's name, and users and their inboxes in
+// the one their username hashes to. Partitions are spread over the nodes by
+// consistent hashing, and every node forwards API requests to the node that
+// owns the partition they touch.
+type ClusterConfig struct {
+	// Self is the URL the other nodes reach this server at. Setting it
+	// enables clustering.
+	Self string `json:"self"`
+	// Nodes are the URLs of the initial members and must be the same on
+	// every node. A server that is not among them owns nothing until it is
+	// added with POST /cluster/nodes.
+	Nodes []string `json:"nodes"`
+	// Partitions must be the same on every node and can not change once
+	// the cluster holds data.
+	Partitions int `json:"partitions"`
+	// Token must be sent as a bearer token to the /cluster/ endpoints;
+	// nodes also send it with the requests they forward. It is required.
+	Token string `json:"token"`
+}
+
+func (c ClusterConfig) enabled() bool {
+	return c.Self != ""
+}
+
+// ReplicationConfig configures leader-follower replication. A leader
+// records every mutation in a journal and streams it to followers under
+// /replication/; followers apply it and serve reads only.
+type ReplicationConfig struct {
+	// Enabled makes the server a leader followers can connect to.
+	Enabled bool `json:"enabled"`
+	// Follow, if set, is the URL of the leader this server follows. It
+	// implies Enabled, so the follower can be promoted.
+	Follow string `json:"follow"`
+	// Token must be sent as a bearer token to the replication endpoints;
+	// followers send it to their leader. It is required, since the
+	// endpoints hand out the whole site and can promote a follower.
+	Token string `json:"token"`
+	// JournalSize is how many recent mutations are kept for followers that
+	// reconnect; followers further behind catch up from a snapshot.
+	JournalSize int `json:"journalSize"`
+	// MaxStaleness is how far behind its leader a follower may fall before
+	// it stops serving reads.
+	MaxStaleness Duration `json:"maxStaleness"`
+}
+
+func (c ReplicationConfig) enabled() bool {
+	return c.Enabled || c.Follow != ""
+}
+
+// TraceConfig configures request tracing. Recent traces are always kept in
+// memory for /debug/traces; OTLPEndpoint additionally exports them to an
+// OpenTelemetry collector, e.g. http://localhost:4318.
+type TraceConfig struct {
+	SampleRate   float64 `json:"sampleRate"`
+	OTLPEndpoint string  `json:"otlpEndpoint"`
+	ServiceName  string  `json:"serviceName"`
+	// MemoryTraces is how many recent traces /debug/traces keeps.
+	MemoryTraces int `json:"memoryTraces"`
+}
+
+// LogConfig configures structured logging. See logging.Options.
+type LogConfig struct {
+	Level      string   `json:"level"`
+	Format     string   `json:"format"`
+	File       string   `json:"file"`
+	MaxSize    int64    `json:"maxSize"`
+	MaxAge     Duration `json:"maxAge"`
+	MaxBackups int      `json:"maxBackups"`
+}
+
+func (c LogConfig) options() logging.Options {
+	return logging.Options{
+		Level:      c.Level,
+		Format:     c.Format,
+		File:       c.File,
+		MaxSize:    c.MaxSize,
+		MaxAge:     time.Duration(c.MaxAge),
+		MaxBackups: c.MaxBackups,
+	}
+}
+
+// TLSConfig enables HTTPS when a certificate and key are given, or when
+// SelfSigned is set. A self-signed certificate is written to CertFile and
+// KeyFile if they are set and do not exist yet, and is only kept in memory
+// otherwise.
+type TLSConfig struct {
+	CertFile   string   `json:"certFile"`
+	KeyFile    string   `json:"keyFile"`
+	SelfSigned bool     `json:"selfSigned"`
+	Hosts      []string `json:"hosts"`
+}
+
+func (t TLSConfig) Enabled() bool {
+	return t.SelfSigned || t.CertFile != "" || t.KeyFile != ""
+}
+
+// Duration is a time.Duration written as a string such as "30s" in JSON.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\"")
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func defaultServerConfig() ServerConfig {
+	return ServerConfig{
+		Addr:              ":8080",
+		ReadTimeout:       Duration(15 * time.Second),
+		ReadHeaderTimeout: Duration(5 * time.Second),
+		WriteTimeout:      Duration(30 * time.Second),
+		IdleTimeout:       Duration(2 * time.Minute),
+		ShutdownTimeout:   Duration(20 * time.Second),
+		MaxHeaderBytes:    1 << 20,
+		AllowedOrigins:    []string{"*"},
+		IdempotencyWindow: Duration(defaultIdempotencyWindow),
+		TLS:               TLSConfig{Hosts: []string{"localhost", "127.0.0.1", "::1"}},
+		Log:               LogConfig{Level: "info", Format: "text"},
+		Tracing:           TraceConfig{SampleRate: 1, ServiceName: "reddit-clone", MemoryTraces: 100},
+		Replication:       ReplicationConfig{JournalSize: defaultJournalSize, MaxStaleness: Duration(defaultMaxStaleness)},
+		Cluster:           ClusterConfig{Partitions: defaultPartitions},
+		Votes:             VoteConfig{FlushInterval: Duration(defaultVoteFlushInterval), Shards: defaultVoteShards},
+	}
+}
+
+// serverFlags holds the command-line flags that override the configuration.
+type serverFlags struct {
+	set            *flag.FlagSet
+	configFile     string
+	addr           string
+	readTimeout    time.Duration
+	writeTimeout   time.Duration
+	idleTimeout    time.Duration
+	shutdown       time.Duration
+	maxHeaderBytes int
+	origins        string
+	idempotency    time.Duration
+	dataFile       string
+	admins         string
+	adminToken     string
+	auditFile      string
+	sessionSecret  string
+	tlsCert        string
+	tlsKey         string
+	selfSigned     bool
+	logLevel       string
+	logFormat      string
+	logFile        string
+	logMaxSize     int64
+	logMaxAge      time.Duration
+	logMaxBackups  int
+	traceSample    float64
+	otlpEndpoint   string
+	replication    bool
+	follow         string
+	replToken      string
+	journalSize    int
+	maxStaleness   time.Duration
+	clusterSelf    string
+	clusterNodes   string
+	partitions     int
+	clusterToken   string
+	voteFlush      time.Duration
+	voteShards     int
+	voteStrict     bool
+}
+
+func registerServerFlags(set *flag.FlagSet) *serverFlags {
+	d := defaultServerConfig()
+	f := &serverFlags{set: set}
+	set.StringVar(&f.configFile, "config", "", "JSON server configuration file")
+	set.StringVar(&f.addr, "addr", d.Addr, "Address the API server listens on")
+	set.DurationVar(&f.readTimeout, "read-timeout", time.Duration(d.ReadTimeout), "Maximum time to read a request")
+	set.DurationVar(&f.writeTimeout, "write-timeout", time.Duration(d.WriteTimeout), "Maximum time to write a response")
+	set.DurationVar(&f.idleTimeout, "idle-timeout", time.Duration(d.IdleTimeout), "How long idle keep-alive connections are kept open")
+	set.DurationVar(&f.shutdown, "shutdown-timeout", time.Duration(d.ShutdownTimeout), "How long to wait for in-flight requests on shutdown")
+	set.IntVar(&f.maxHeaderBytes, "max-header-bytes", d.MaxHeaderBytes, "Maximum size of request headers")
+	set.StringVar(&f.origins, "allowed-origins", strings.Join(d.AllowedOrigins, ","), "Comma-separated origins allowed to make cross-origin requests")
+	set.DurationVar(&f.idempotency, "idempotency-window", defaultIdempotencyWindow, "How long responses to requests with an Idempotency-Key are replayed")
+	set.StringVar(&f.dataFile, "data-file", "", "File the engine state is loaded from at startup and saved to on shutdown")
+	set.StringVar(&f.admins, "admins", "", "Comma-separated usernames given the admin role at startup")
+	set.StringVar(&f.adminToken, "admin-token", "", "Bearer token admins send to the admin API and give when logging in to the console")
+	set.StringVar(&f.auditFile, "audit-file", "", "File new audit log entries are appended to as NDJSON")
+	set.StringVar(&f.sessionSecret, "session-secret", "", "Key for signing HTML session cookies (random if empty)")
+	set.StringVar(&f.tlsCert, "tls-cert", "", "TLS certificate file")
+	set.StringVar(&f.tlsKey, "tls-key", "", "TLS private key file")
+	set.BoolVar(&f.selfSigned, "tls-self-signed", false, "Serve HTTPS with a generated self-signed certificate (development only)")
+	set.StringVar(&f.logLevel, "log-level", d.Log.Level, "Minimum log level: debug, info, warn, error or off")
+	set.StringVar(&f.logFormat, "log-format", d.Log.Format, "Log format: text or json")
+	set.StringVar(&f.logFile, "log-file", "", "Log file (standard error if empty)")
+	set.Int64Var(&f.logMaxSize, "log-max-size", 0, "Rotate the log file at this many bytes (0 disables)")
+	set.DurationVar(&f.logMaxAge, "log-max-age", 0, "Rotate the log file at this age (0 disables)")
+	set.IntVar(&f.logMaxBackups, "log-max-backups", 0, "Number of rotated log files to keep (0 keeps all)")
+	set.Float64Var(&f.traceSample, "trace-sample-rate", d.Tracing.SampleRate, "Fraction of requests traced (0 disables tracing)")
+	set.StringVar(&f.otlpEndpoint, "otlp-endpoint", "", "OpenTelemetry collector to export traces to, e.g. http://localhost:4318")
+	set.BoolVar(&f.replication, "replication", false, "Record mutations in a journal and serve it to followers")
+	set.StringVar(&f.follow, "follow", "", "Follow the replication leader at this URL and serve reads only")
+	set.StringVar(&f.replToken, "replication-token", "", "Bearer token required by the replication endpoints and sent to the leader")
+	set.IntVar(&f.journalSize, "journal-size", d.Replication.JournalSize, "Number of recent mutations kept for followers")
+	set.DurationVar(&f.maxStaleness, "max-staleness", time.Duration(d.Replication.MaxStaleness), "How far behind its leader a follower may be and still serve reads")
+	set.StringVar(&f.clusterSelf, "cluster-self", "", "URL other cluster nodes reach this server at; enables clustering")
+	set.StringVar(&f.clusterNodes, "cluster-nodes", "", "Comma-separated URLs of the initial cluster members")
+	set.IntVar(&f.partitions, "partitions", d.Cluster.Partitions, "Number of partitions the cluster's data is split into")
+	set.StringVar(&f.clusterToken, "cluster-token", "", "Bearer token required by the cluster endpoints and sent between nodes")
+	set.DurationVar(&f.voteFlush, "vote-flush-interval", time.Duration(d.Votes.FlushInterval), "How often buffered votes are applied (0 applies each vote as it is cast)")
+	set.IntVar(&f.voteShards, "vote-shards", d.Votes.Shards, "Number of independently locked parts of the vote buffer")
+	set.BoolVar(&f.voteStrict, "vote-strict", false, "Apply buffered votes before every read")
+	return f
+}
+
+// loadServerConfig builds the configuration from the defaults, the config
+// file, the environment and the flags that were set explicitly.
+func loadServerConfig(f *serverFlags) (ServerConfig, error) {
+	cfg := defaultServerConfig()
+
+	path := f.configFile
+	if path == "" {
+		path = os.Getenv("REDDIT_CONFIG")
+	}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, fmt.Errorf("reading server config: %w", err)
+		}
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return cfg, fmt.Errorf("parsing server config %s: %w", path, err)
+		}
+	}
+
+	if err := cfg.applyEnv(os.LookupEnv); err != nil {
+		return cfg, err
+	}
+
+	f.set.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "addr":
+			cfg.Addr = f.addr
+		case "read-timeout":
+			cfg.ReadTimeout = Duration(f.readTimeout)
+		case "write-timeout":
+			cfg.WriteTimeout = Duration(f.writeTimeout)
+		case "idle-timeout":
+			cfg.IdleTimeout = Duration(f.idleTimeout)
+		case "shutdown-timeout":
+			cfg.ShutdownTimeout = Duration(f.shutdown)
+		case "max-header-bytes":
+			cfg.MaxHeaderBytes = f.maxHeaderBytes
+		case "allowed-origins":
+			cfg.AllowedOrigins = splitList(f.origins)
+		case "idempotency-window":
+			cfg.IdempotencyWindow = Duration(f.idempotency)
+		case "data-file":
+			cfg.DataFile = f.dataFile
+		case "admins":
+			cfg.Admins = splitList(f.admins)
+		case "admin-token":
+			cfg.AdminToken = f.adminToken
+		case "audit-file":
+			cfg.AuditFile = f.auditFile
+		case "session-secret":
+			cfg.SessionSecret = f.sessionSecret
+		case "tls-cert":
+			cfg.TLS.CertFile = f.tlsCert
+		case "tls-key":
+			cfg.TLS.KeyFile = f.tlsKey
+		case "tls-self-signed":
+			cfg.TLS.SelfSigned = f.selfSigned
+		case "log-level":
+			cfg.Log.Level = f.logLevel
+		case "log-format":
+			cfg.Log.Format = f.logFormat
+		case "log-file":
+			cfg.Log.File = f.logFile
+		case "log-max-size":
+			cfg.Log.MaxSize = f.logMaxSize
+		case "log-max-age":
+			cfg.Log.MaxAge = Duration(f.logMaxAge)
+		case "log-max-backups":
+			cfg.Log.MaxBackups = f.logMaxBackups
+		case "trace-sample-rate":
+			cfg.Tracing.SampleRate = f.traceSample
+		case "otlp-endpoint":
+			cfg.Tracing.OTLPEndpoint = f.otlpEndpoint
+		case "replication":
+			cfg.Replication.Enabled = f.replication
+		case "follow":
+			cfg.Replication.Follow = f.follow
+		case "replication-token":
+			cfg.Replication.Token = f.replToken
+		case "journal-size":
+			cfg.Replication.JournalSize = f.journalSize
+		case "max-staleness":
+			cfg.Replication.MaxStaleness = Duration(f.maxStaleness)
+		case "cluster-self":
+			cfg.Cluster.Self = f.clusterSelf
+		case "cluster-nodes":
+			cfg.Cluster.Nodes = splitList(f.clusterNodes)
+		case "partitions":
+			cfg.Cluster.Partitions = f.partitions
+		case "cluster-token":
+			cfg.Cluster.Token = f.clusterToken
+		case "vote-flush-interval":
+			cfg.Votes.FlushInterval = Duration(f.voteFlush)
+		case "vote-shards":
+			cfg.Votes.Shards = f.voteShards
+		case "vote-strict":
+			cfg.Votes.Strict = f.voteStrict
+		}
+	})
+
+	return cfg, cfg.validate()
+}
+
+// applyEnv overrides settings from REDDIT_* environment variables.
+func (cfg *ServerConfig) applyEnv(lookup func(string) (string, bool)) error {
+	durations := map[string]*Duration{
+		"REDDIT_READ_TIMEOUT":        &cfg.ReadTimeout,
+		"REDDIT_READ_HEADER_TIMEOUT": &cfg.ReadHeaderTimeout,
+		"REDDIT_WRITE_TIMEOUT":       &cfg.WriteTimeout,
+		"REDDIT_IDLE_TIMEOUT":        &cfg.IdleTimeout,
+		"REDDIT_SHUTDOWN_TIMEOUT":    &cfg.ShutdownTimeout,
+		"REDDIT_IDEMPOTENCY_WINDOW":  &cfg.IdempotencyWindow,
+		"REDDIT_LOG_MAX_AGE":         &cfg.Log.MaxAge,
+		"REDDIT_MAX_STALENESS":       &cfg.Replication.MaxStaleness,
+		"REDDIT_VOTE_FLUSH_INTERVAL": &cfg.Votes.FlushInterval,
+	}
+	for name, dst := range durations {
+		if v, ok := lookup(name); ok {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			*dst = Duration(d)
+		}
+	}
+	// The standard OpenTelemetry variables are honoured too, with the
+	// REDDIT_ ones taking precedence.
+	strs := map[string]*string{
+		"OTEL_EXPORTER_OTLP_ENDPOINT": &cfg.Tracing.OTLPEndpoint,
+		"OTEL_SERVICE_NAME":           &cfg.Tracing.ServiceName,
+		"REDDIT_ADDR":                 &cfg.Addr,
+		"REDDIT_DATA_FILE":            &cfg.DataFile,
+		"REDDIT_AUDIT_FILE":           &cfg.AuditFile,
+		"REDDIT_ADMIN_TOKEN":          &cfg.AdminToken,
+		"REDDIT_SESSION_SECRET":       &cfg.SessionSecret,
+		"REDDIT_TLS_CERT":             &cfg.TLS.CertFile,
+		"REDDIT_TLS_KEY":              &cfg.TLS.KeyFile,
+		"REDDIT_LOG_LEVEL":            &cfg.Log.Level,
+		"REDDIT_LOG_FORMAT":           &cfg.Log.Format,
+		"REDDIT_LOG_FILE":             &cfg.Log.File,
+		"REDDIT_FOLLOW":               &cfg.Replication.Follow,
+		"REDDIT_REPLICATION_TOKEN":    &cfg.Replication.Token,
+		"REDDIT_CLUSTER_SELF":         &cfg.Cluster.Self,
+		"REDDIT_CLUSTER_TOKEN":        &cfg.Cluster.Token,
+	}
+	for name, dst := range strs {
+		if v, ok := lookup(name); ok {
+			*dst = v
+		}
+	}
+	if v, ok := lookup("REDDIT_OTLP_ENDPOINT"); ok {
+		cfg.Tracing.OTLPEndpoint = v
+	}
+	if v, ok := lookup("REDDIT_TRACE_SAMPLE_RATE"); ok {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("REDDIT_TRACE_SAMPLE_RATE: %w", err)
+		}
+		cfg.Tracing.SampleRate = rate
+	}
+	if v, ok := lookup("REDDIT_MAX_HEADER_BYTES"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("REDDIT_MAX_HEADER_BYTES: %w", err)
+		}
+		cfg.MaxHeaderBytes = n
+	}
+	if v, ok := lookup("REDDIT_LOG_MAX_SIZE"); ok {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("REDDIT_LOG_MAX_SIZE: %w", err)
+		}
+		cfg.Log.MaxSize = n
+	}
+	if v, ok := lookup("REDDIT_LOG_MAX_BACKUPS"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("REDDIT_LOG_MAX_BACKUPS: %w", err)
+		}
+		cfg.Log.MaxBackups = n
+	}
+	if v, ok := lookup("REDDIT_ALLOWED_ORIGINS"); ok {
+		cfg.AllowedOrigins = splitList(v)
+	}
+	if v, ok := lookup("REDDIT_ADMINS"); ok {
+		cfg.Admins = splitList(v)
+	}
+	if v, ok := lookup("REDDIT_CLUSTER_NODES"); ok {
+		cfg.Cluster.Nodes = splitList(v)
+	}
+	if v, ok := lookup("REDDIT_PARTITIONS"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("REDDIT_PARTITIONS: %w", err)
+		}
+		cfg.Cluster.Partitions = n
+	}
+	if v, ok := lookup("REDDIT_VOTE_SHARDS"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("REDDIT_VOTE_SHARDS: %w", err)
+		}
+		cfg.Votes.Shards = n
+	}
+	if v, ok := lookup("REDDIT_VOTE_STRICT"); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("REDDIT_VOTE_STRICT: %w", err)
+		}
+		cfg.Votes.Strict = b
+	}
+	if v, ok := lookup("REDDIT_REPLICATION"); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("REDDIT_REPLICATION: %w", err)
+		}
+		cfg.Replication.Enabled = b
+	}
+	if v, ok := lookup("REDDIT_TLS_SELF_SIGNED"); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("REDDIT_TLS_SELF_SIGNED: %w", err)
+		}
+		cfg.TLS.SelfSigned = b
+	}
+	return nil
+}
+
+func (cfg ServerConfig) validate() error {
+	if cfg.Addr == "" {
+		return errors.New("server config: addr is required")
+	}
+	if cfg.MaxHeaderBytes <= 0 {
+		return errors.New("server config: maxHeaderBytes must be positive")
+	}
+	if cfg.Tracing.SampleRate < 0 || cfg.Tracing.SampleRate > 1 {
+		return errors.New("server config: tracing.sampleRate must be between 0 and 1")
+	}
+	if !cfg.TLS.SelfSigned && (cfg.TLS.CertFile == "") != (cfg.TLS.KeyFile == "") {
+		return errors.New("server config: tls needs both certFile and keyFile")
+	}
+	if len(cfg.Admins) > 0 && cfg.AdminToken == "" {
+		return errors.New("server config: admins need an adminToken to act as admins")
+	}
+	if cfg.Votes.FlushInterval < 0 {
+		return errors.New("server config: votes.flushInterval must not be negative")
+	}
+	if cfg.Votes.FlushInterval > 0 && cfg.Votes.Shards < 1 {
+		return errors.New("server config: votes.shards must be positive")
+	}
+	if cfg.Replication.enabled() && cfg.Replication.Token == "" {
+		return errors.New("server config: replication needs a token")
+	}
+	if cfg.Replication.Follow != "" {
+		if !isHTTPURL(cfg.Replication.Follow) {
+			return errors.New("server config: replication.follow must be an http or https URL")
+		}
+	}
+	if cfg.Cluster.enabled() {
+		if cfg.Replication.enabled() {
+			return errors.New("server config: cluster nodes can not use replication")
+		}
+		if len(cfg.Admins) > 0 || cfg.AuditFile != "" {
+			return errors.New("server config: admins and auditFile are not supported in a cluster")
+		}
+		if cfg.Cluster.Token == "" {
+			return errors.New("server config: cluster needs a token")
+		}
+		if cfg.Cluster.Partitions < 1 {
+			return errors.New("server config: cluster.partitions must be positive")
+		}
+		for _, node := range append([]string{cfg.Cluster.Self}, cfg.Cluster.Nodes...) {
+			if !isHTTPURL(node) {
+				return fmt.Errorf("server config: cluster node %q must be an http or https URL", node)
+			}
+		}
+	}
+	return nil
+}
+
+func isHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// tlsConfig returns the TLS configuration for the server, or nil if TLS is
+// disabled.
+func (cfg ServerConfig) tlsConfig() (*tls.Config, error) {
+	t := cfg.TLS
+	if !t.Enabled() {
+		return nil, nil
+	}
+	var cert tls.Certificate
+	var err error
+	switch {
+	case !t.SelfSigned:
+		cert, err = tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	case t.CertFile != "" && fileExists(t.CertFile) && fileExists(t.KeyFile):
+		cert, err = tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	default:
+		cert, err = selfSignedCertificate(t.Hosts, t.CertFile, t.KeyFile)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("loading TLS certificate: %w", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
+
+// selfSignedCertificate generates a certificate for hosts valid for a year.
+// If certFile and keyFile are set the PEM files are written there, so that a
+// browser exception for the certificate survives restarts.
+func selfSignedCertificate(hosts []string, certFile, keyFile string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"Community Discussion Platform (development)"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	if certFile != "" && keyFile != "" {
+		if err := os.WriteFile(certFile, certPEM, 0o644); err != nil {
+			return tls.Certificate{}, err
+		}
+		if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// tracer builds the tracer and the in-memory exporter behind /debug/traces.
+func (c TraceConfig) tracer(logger *slog.Logger) (*tracing.Tracer, *tracing.MemoryExporter) {
+	memory := tracing.NewMemoryExporter(c.MemoryTraces)
+	exporters := []tracing.Exporter{memory}
+	if c.OTLPEndpoint != "" {
+		exporters = append(exporters, tracing.NewOTLPExporter(c.OTLPEndpoint, c.ServiceName, logger))
+	}
+	return tracing.NewTracer(c.SampleRate, exporters...), memory
+}
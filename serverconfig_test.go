@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// TestTLSConfig checks that a certificate needs its key, that a generated
+// certificate covers the configured hosts and is kept in the files it was
+// written to, and that missing files are reported.
+func TestTLSConfig(t *testing.T) {
+	for _, tc := range []struct {
+		tls   TLSConfig
+		valid bool
+	}{
+		{TLSConfig{}, true},
+		{TLSConfig{CertFile: "cert.pem"}, false},
+		{TLSConfig{KeyFile: "key.pem"}, false},
+		{TLSConfig{CertFile: "cert.pem", KeyFile: "key.pem"}, true},
+		{TLSConfig{SelfSigned: true}, true},
+		{TLSConfig{SelfSigned: true, CertFile: "cert.pem"}, true},
+	} {
+		cfg := defaultServerConfig()
+		cfg.TLS = tc.tls
+		if err := cfg.validate(); (err == nil) != tc.valid {
+			t.Errorf("%+v: validate returned %v", tc.tls, err)
+		}
+	}
+
+	cfg := defaultServerConfig()
+	if tc, err := cfg.tlsConfig(); tc != nil || err != nil {
+		t.Errorf("TLS without a certificate: %v, %v", tc, err)
+	}
+
+	cfg.TLS.SelfSigned = true
+	tc, err := cfg.tlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tc.MinVersion != tls.VersionTLS12 {
+		t.Errorf("minimum TLS version %x", tc.MinVersion)
+	}
+	leaf, err := x509.ParseCertificate(tc.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(leaf.DNSNames, "localhost") || !slices.ContainsFunc(leaf.IPAddresses, func(ip net.IP) bool { return ip.Equal(net.IPv6loopback) }) {
+		t.Errorf("self-signed certificate for %v %v", leaf.DNSNames, leaf.IPAddresses)
+	}
+
+	dir := t.TempDir()
+	cfg.TLS.CertFile, cfg.TLS.KeyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	first, err := cfg.tlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(cfg.TLS.KeyFile); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("written key file: %v, %v", info, err)
+	}
+	second, err := cfg.tlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first.Certificates[0].Certificate[0], second.Certificates[0].Certificate[0]) {
+		t.Error("a written self-signed certificate was not reused")
+	}
+
+	// Without SelfSigned the files must exist.
+	cfg.TLS.SelfSigned = false
+	cfg.TLS.CertFile = filepath.Join(dir, "missing.pem")
+	if _, err := cfg.tlsConfig(); err == nil {
+		t.Error("a missing certificate file was not reported")
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cookies used by the HTML pages.
+const (
+	sessionCookie = "session"
+	// consoleCookie is the operator console's session, which is kept apart
+	// from the web front end's so that logging in there as an admin's
+	// username grants nothing in the console.
+	consoleCookie = "console_session"
+	csrfCookie    = "csrf"
+)
+
+// sessionLifetime is how long a login lasts.
+const sessionLifetime = 7 * 24 * time.Hour
+
+// sessions signs the cookies the HTML pages use to remember who is logged
+// in, and the tokens that protect their forms against cross-site request
+// forgery. Like the X-Username header, a front end session only names a
+// user; it proves nothing more than that this server issued it. Console
+// sessions are only issued to admins who gave the admin token.
+type sessions struct {
+	key []byte
+}
+
+// newSessions signs with secret, or with a random key if it is empty, in
+// which case sessions do not survive a restart.
+func newSessions(secret string) *sessions {
+	key := []byte(secret)
+	if secret == "" {
+		key = make([]byte, 32)
+		rand.Read(key)
+	}
+	return &sessions{key: key}
+}
+
+// SetSessionSecret sets the key session cookies and CSRF tokens are signed
+// with, so they stay valid across restarts. It must be called before the
+// API serves requests.
+func (api *API) SetSessionSecret(secret string) {
+	if secret != "" {
+		api.sessions = newSessions(secret)
+	}
+}
+
+func (s *sessions) sign(value string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// login sets a session cookie for username.
+func (s *sessions) login(w http.ResponseWriter, r *http.Request, username string) {
+	s.set(w, r, sessionCookie, "/", "", username)
+}
+
+// logout clears the session cookie.
+func (s *sessions) logout(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+}
+
+// user returns the username of the request's session, or "" if there is no
+// valid session.
+func (s *sessions) user(r *http.Request) string {
+	return s.get(r, sessionCookie, "")
+}
+
+// loginConsole sets a console session cookie for an admin who gave
+// adminToken. The token is covered by the signature, so changing it ends
+// every console session.
+func (s *sessions) loginConsole(w http.ResponseWriter, r *http.Request, username, adminToken string) {
+	s.set(w, r, consoleCookie, "/admin", adminToken, username)
+}
+
+// logoutConsole clears the console session cookie.
+func (s *sessions) logoutConsole(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: consoleCookie, Value: "", Path: "/admin", MaxAge: -1, HttpOnly: true})
+}
+
+// consoleUser returns the username of the request's console session, or ""
+// if there is no valid session for adminToken.
+func (s *sessions) consoleUser(r *http.Request, adminToken string) string {
+	return s.get(r, consoleCookie, adminToken)
+}
+
+// set sets the named session cookie for username. The signature covers the
+// cookie's name and secret, so a cookie is only valid where it was issued.
+func (s *sessions) set(w http.ResponseWriter, r *http.Request, name, path, secret, username string) {
+	expires := time.Now().Add(sessionLifetime)
+	value := base64.RawURLEncoding.EncodeToString([]byte(username)) + "." + strconv.FormatInt(expires.Unix(), 10)
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value + "." + s.sign(name+":"+secret+":"+value),
+		Path:     path,
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// get returns the username of the named session cookie, or "" if it is
+// missing, expired or was not signed for secret.
+func (s *sessions) get(r *http.Request, name, secret string) string {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return ""
+	}
+	value, sig, ok := cutLast(cookie.Value, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(s.sign(name+":"+secret+":"+value))) {
+		return ""
+	}
+	encoded, expiry, ok := cutLast(value, ".")
+	if !ok {
+		return ""
+	}
+	if unix, err := strconv.ParseInt(expiry, 10, 64); err != nil || time.Now().Unix() > unix {
+		return ""
+	}
+	username, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return ""
+	}
+	return string(username)
+}
+
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+// csrfToken returns the token forms must include as the "csrf" field,
+// setting the random cookie it is derived from if the browser does not have
+// one yet. The token is the cookie's signature, so a page on another site
+// can neither read nor forge it.
+func (s *sessions) csrfToken(w http.ResponseWriter, r *http.Request) string {
+	if cookie, err := r.Cookie(csrfCookie); err == nil && cookie.Value != "" {
+		return s.sign("csrf:" + cookie.Value)
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	value := base64.RawURLEncoding.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    value,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	// Later requests in this response see the new cookie.
+	r.AddCookie(&http.Cookie{Name: csrfCookie, Value: value})
+	return s.sign("csrf:" + value)
+}
+
+var errCSRF = &apiError{status: http.StatusForbidden, code: codeForbidden, msg: "invalid or missing CSRF token; reload the page and try again"}
+
+// checkCSRF verifies the "csrf" form field of a POST request.
+func (s *sessions) checkCSRF(r *http.Request) error {
+	cookie, err := r.Cookie(csrfCookie)
+	if err != nil || cookie.Value == "" {
+		return errCSRF
+	}
+	token := r.PostFormValue("csrf")
+	if token == "" || !hmac.Equal([]byte(token), []byte(s.sign("csrf:"+cookie.Value))) {
+		return errCSRF
+	}
+	return nil
+}
@@ -0,0 +1,580 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"reddit-clone/cache"
+	"reddit-clone/engine"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed templates/site/*.html
+var siteTemplates embed.FS
+
+// sitePageSize is how many posts a listing page shows.
+const sitePageSize = 25
+
+// Listing pages computed for anonymous visitors are cached for at most
+// listingTTL, since hot ranking changes with age alone.
+const (
+	listingTTL        = 30 * time.Second
+	maxCachedListings = 1024
+)
+
+// site is the server-rendered web front end. Every page works without
+// JavaScript: actions are form posts answered with a redirect, and the
+// small script in the layout only saves the reload when voting.
+type site struct {
+	api    *API
+	router *Router
+	pages  map[string]*template.Template
+}
+
+// sitePage is the data every site template receives.
+type sitePage struct {
+	Title string
+	User  string
+	CSRF  string
+	// Here is the page's own URL, which forms send back as "back" so the
+	// user returns to it after the action.
+	Here  string
+	Flash string
+	Error string
+	Data  any
+}
+
+// Site returns the handler for the web front end. It is meant to be mounted
+// at / alongside the API.
+func (api *API) Site() http.Handler {
+	s := &site{api: api, router: NewRouter(), pages: make(map[string]*template.Template)}
+	for _, page := range []string{"error", "login", "listing", "post", "submit", "inbox"} {
+		s.pages[page] = template.Must(template.New("layout.html").Funcs(templateFuncs).
+			ParseFS(siteTemplates, "templates/site/layout.html", "templates/site/"+page+".html"))
+	}
+	s.router.NotFound = func(w http.ResponseWriter, r *http.Request) {
+		s.render(w, r, http.StatusNotFound, "error", "Not found", nil, "No such page")
+	}
+	s.router.MethodNotAllowed = func(w http.ResponseWriter, r *http.Request) {
+		s.render(w, r, http.StatusMethodNotAllowed, "error", "Method not allowed", nil, "This page cannot be used that way")
+	}
+
+	rt := s.router
+	rt.Handle("GET", "/", "site.home", s.home)
+	rt.Handle("GET", "/login", "site.login", s.loginPage)
+	rt.Handle("POST", "/login", "site.doLogin", s.login)
+	rt.Handle("POST", "/logout", "site.logout", s.form(s.logout))
+	rt.Handle("GET", "/r/{name}", "site.subreddit", s.subreddit)
+	rt.Handle("GET", "/r/{name}/submit", "site.submitPage", s.loggedIn(s.submitPage))
+	rt.Handle("POST", "/r/{name}/submit", "site.submit", s.form(s.submit))
+	rt.Handle("POST", "/r/{name}/join", "site.join", s.form(s.join))
+	rt.Handle("POST", "/r/{name}/leave", "site.leave", s.form(s.leave))
+	rt.Handle("GET", "/posts/{id}", "site.post", s.post)
+	rt.Handle("POST", "/posts/{id}/vote", "site.vote", s.form(s.vote))
+	rt.Handle("POST", "/posts/{id}/comments", "site.comment", s.form(s.comment))
+	rt.Handle("GET", "/inbox", "site.inbox", s.loggedIn(s.inbox))
+	rt.Handle("POST", "/inbox", "site.sendMessage", s.form(s.sendMessage))
+	s.feedRoutes()
+	return s
+}
+
+func (s *site) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+	r = withRouteSlot(r)
+	r = r.WithContext(engine.WithClientIP(r.Context(), remoteIP(r)))
+	api := s.api
+	api.traceRequests(api.metrics.middleware(withRequestID(api.accessLog(s.router)))).ServeHTTP(w, r)
+}
+
+// siteHandler is a site handler for a logged-in user.
+type siteHandler func(w http.ResponseWriter, r *http.Request, user *engine.User)
+
+// user returns the user the request's session belongs to, or nil.
+func (s *site) user(r *http.Request) *engine.User {
+	name := s.api.sessions.user(r)
+	if name == "" {
+		return nil
+	}
+	return s.api.engine.GetUserByUsernameContext(r.Context(), name)
+}
+
+// loggedIn sends visitors without a session to the login page.
+func (s *site) loggedIn(h siteHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := s.user(r)
+		if user == nil {
+			http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+			return
+		}
+		h(w, r, user)
+	}
+}
+
+// form handles a form post by a logged-in user, checking its CSRF token.
+// Visitors without a session are sent to log in and then back to the page
+// the form was on.
+func (s *site) form(h siteHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := s.api.sessions.checkCSRF(r); err != nil {
+			noteError(r, err)
+			s.render(w, r, http.StatusForbidden, "error", "Forbidden", nil, err.Error())
+			return
+		}
+		user := s.user(r)
+		if user == nil {
+			http.Redirect(w, r, "/login?next="+url.QueryEscape(sitePath(r.PostFormValue("back"), "/")), http.StatusSeeOther)
+			return
+		}
+		h(w, r, user)
+	}
+}
+
+// render writes a page inside the site layout.
+func (s *site) render(w http.ResponseWriter, r *http.Request, status int, page, title string, data any, errMsg string) {
+	p := sitePage{
+		Title: title,
+		User:  s.api.sessions.user(r),
+		CSRF:  s.api.sessions.csrfToken(w, r),
+		Here:  here(r),
+		Flash: r.URL.Query().Get("flash"),
+		Error: errMsg,
+		Data:  data,
+	}
+	if p.Error == "" {
+		p.Error = r.URL.Query().Get("error")
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.WriteHeader(status)
+	if err := s.pages[page].Execute(w, p); err != nil {
+		noteError(r, err)
+	}
+}
+
+// here returns the request's path and query without the flash and error
+// parameters set by done.
+func here(r *http.Request) string {
+	q := r.URL.Query()
+	q.Del("flash")
+	q.Del("error")
+	if len(q) == 0 {
+		return r.URL.EscapedPath()
+	}
+	return r.URL.EscapedPath() + "?" + q.Encode()
+}
+
+// done redirects to path after a form post, reporting err or flash there.
+func (s *site) done(w http.ResponseWriter, r *http.Request, path string, err error, flash string) {
+	q := url.Values{}
+	if err != nil {
+		noteError(r, err)
+		q.Set("error", formError(err))
+	} else if flash != "" {
+		q.Set("flash", flash)
+	}
+	if len(q) > 0 {
+		sep := "?"
+		if strings.Contains(path, "?") {
+			sep = "&"
+		}
+		path += sep + q.Encode()
+	}
+	http.Redirect(w, r, path, http.StatusSeeOther)
+}
+
+// sitePath returns path if it is a local path on this site, and fallback
+// otherwise, so that redirects cannot be pointed at another host.
+func sitePath(path, fallback string) string {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.HasPrefix(path, "/\\") {
+		return fallback
+	}
+	return path
+}
+
+func (s *site) loginPage(w http.ResponseWriter, r *http.Request) {
+	s.render(w, r, http.StatusOK, "login", "Log in", sitePath(r.URL.Query().Get("next"), "/"), "")
+}
+
+// login logs in as the named user, registering it first if it is new, as
+// POST /api/v1/users does.
+func (s *site) login(w http.ResponseWriter, r *http.Request) {
+	next := sitePath(r.PostFormValue("next"), "/")
+	if err := s.api.sessions.checkCSRF(r); err != nil {
+		noteError(r, err)
+		s.render(w, r, http.StatusForbidden, "login", "Log in", next, err.Error())
+		return
+	}
+	username := strings.TrimSpace(r.PostFormValue("username"))
+	user := s.api.engine.GetUserByUsernameContext(r.Context(), username)
+	if user != nil {
+		s.api.engine.RecordLogin(r.Context(), user)
+	} else {
+		var err error
+		if user, err = s.api.engine.RegisterAccountContext(r.Context(), username); err != nil {
+			noteError(r, err)
+			s.render(w, r, http.StatusBadRequest, "login", "Log in", next, formError(err))
+			return
+		}
+	}
+	s.api.sessions.login(w, r, user.Username)
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+func (s *site) logout(w http.ResponseWriter, r *http.Request, user *engine.User) {
+	s.api.sessions.logout(w)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// listing is the data of the front page and subreddit pages.
+type listing struct {
+	Subreddit  *SubredditResponse
+	Joined     bool
+	Sort       string
+	Sorts      []string
+	Posts      []*PostResponse
+	Page       int
+	More       bool
+	Subreddits []*SubredditResponse
+}
+
+// listingKey names a page of a listing as anonymous visitors see it. The
+// front page has subredditID 0.
+type listingKey struct {
+	subredditID int
+	sort        string
+	page        int
+}
+
+// listingPage is the part of a listing that does not depend on the viewer.
+type listingPage struct {
+	posts []*PostResponse
+	more  bool
+}
+
+// listingCache holds the sorted pages of the front page and subreddits that
+// anonymous visitors asked for, dropping those of a subreddit and the front
+// page when one of its posts changes.
+type listingCache struct {
+	*cache.Cache[listingKey, *listingPage]
+}
+
+func newListingCache(e *engine.RedditEngine) *listingCache {
+	c := &listingCache{cache.New[listingKey](cache.Options[*listingPage]{Capacity: maxCachedListings, TTL: listingTTL})}
+	e.Subscribe(c.invalidate)
+	return c
+}
+
+func (c *listingCache) invalidate(ev engine.Event) {
+	switch {
+	case ev.Type == engine.EventDataImported || ev.Type == engine.EventStateRestored ||
+		ev.Type == engine.EventUserRenamed || ev.Type == engine.EventSubRedditRenamed:
+		c.Purge()
+	case ev.PostID != 0:
+		c.RemoveFunc(func(key listingKey) bool {
+			return key.subredditID == 0 || key.subredditID == ev.SubRedditID
+		})
+	}
+}
+
+func (s *site) home(w http.ResponseWriter, r *http.Request) {
+	data, err := s.listing(r, nil, func() []*engine.Post { return s.api.engine.GetAllPostsContext(r.Context()) })
+	if err != nil {
+		s.render(w, r, http.StatusBadRequest, "error", "Bad request", nil, err.Error())
+		return
+	}
+	subreddits := s.api.engine.GetAllSubRedditsContext(r.Context())
+	s.api.engine.ViewContext(r.Context(), func() {
+		m := s.api.newMapper(r)
+		for _, sr := range subreddits {
+			data.Subreddits = append(data.Subreddits, m.subreddit(sr))
+		}
+	})
+	s.render(w, r, http.StatusOK, "listing", "Front page", data, "")
+}
+
+func (s *site) subreddit(w http.ResponseWriter, r *http.Request) {
+	sr, err := s.api.engine.LookupSubRedditContext(r.Context(), pathParam(r, "name"))
+	if err != nil {
+		s.render(w, r, http.StatusNotFound, "error", "Not found", nil, err.Error())
+		return
+	}
+	data, err := s.listing(r, sr, func() []*engine.Post { return s.api.engine.GetFeedContext(r.Context(), sr) })
+	if err != nil {
+		s.render(w, r, http.StatusBadRequest, "error", "Bad request", nil, err.Error())
+		return
+	}
+	s.render(w, r, http.StatusOK, "listing", "r/"+data.Subreddit.Name, data, "")
+}
+
+// listing sorts the posts load returns as the ?sort= parameter asks and
+// returns the page named by ?page=. Removed posts are left out. Anonymous
+// visitors are served pages from the listing cache.
+func (s *site) listing(r *http.Request, sr *engine.SubReddit, load func() []*engine.Post) (*listing, error) {
+	order, err := parseSort(r.URL.Query().Get("sort"))
+	if err != nil {
+		return nil, err
+	}
+	pageNum := 1
+	if v := r.URL.Query().Get("page"); v != "" {
+		if pageNum, err = strconv.Atoi(v); err != nil || pageNum < 1 {
+			return nil, badRequest("page must be a positive integer")
+		}
+	}
+	m := s.api.newMapper(r)
+	m.viewer = s.user(r)
+	compute := func() (*listingPage, error) {
+		posts := load()
+		page := &listingPage{}
+		s.api.engine.ViewContext(r.Context(), func() {
+			visible := posts[:0]
+			for _, p := range posts {
+				if !p.Removed {
+					visible = append(visible, p)
+				}
+			}
+			sortPosts(visible, order)
+			start := min((pageNum-1)*sitePageSize, len(visible))
+			end := min(start+sitePageSize, len(visible))
+			for _, p := range visible[start:end] {
+				page.posts = append(page.posts, m.post(p))
+			}
+			page.more = end < len(visible)
+		})
+		return page, nil
+	}
+	var page *listingPage
+	if m.viewer == nil {
+		key := listingKey{sort: order, page: pageNum}
+		if sr != nil {
+			key.subredditID = sr.ID
+		}
+		// Cached pages are shared, so they must not depend on ?expand=.
+		m.expand = nil
+		page, _ = s.api.listings.Load(key, compute)
+	} else {
+		page, _ = compute()
+	}
+
+	data := &listing{Sort: order, Sorts: postSorts, Posts: page.posts, Page: pageNum, More: page.more}
+	if sr != nil {
+		s.api.engine.ViewContext(r.Context(), func() {
+			data.Subreddit = m.subreddit(sr)
+			data.Joined = m.viewer != nil && sr.Members[m.viewer.ID] != nil
+		})
+	}
+	return data, nil
+}
+
+func (s *site) post(w http.ResponseWriter, r *http.Request) {
+	post, err := s.api.postFromPath(r)
+	if err != nil {
+		s.render(w, r, http.StatusNotFound, "error", "Not found", nil, err.Error())
+		return
+	}
+	m := s.api.newMapper(r)
+	m.viewer = s.user(r)
+	m.expand[expandComments] = true
+	m.expand[expandReplies] = true
+	// Earlier posts are listed without their comments.
+	earlier := &mapper{engine: s.api.engine, viewer: m.viewer}
+	reposts := s.api.engine.Reposts(r.Context(), post)
+	resp := mapOne(r.Context(), s.api.engine, post, func(post *engine.Post) *PostResponse {
+		resp := m.post(post)
+		for _, repost := range reposts {
+			resp.PreviouslyPosted = append(resp.PreviouslyPosted, *earlier.repost(repost))
+		}
+		return resp
+	})
+	s.render(w, r, http.StatusOK, "post", resp.Title, resp, "")
+}
+
+// submission is the data of the submit page, holding what was typed in if
+// the post was rejected.
+type submission struct {
+	Subreddit string
+	Title     string
+	Content   string
+}
+
+func (s *site) submitPage(w http.ResponseWriter, r *http.Request, user *engine.User) {
+	sr, err := s.api.engine.LookupSubRedditContext(r.Context(), pathParam(r, "name"))
+	if err != nil {
+		s.render(w, r, http.StatusNotFound, "error", "Not found", nil, err.Error())
+		return
+	}
+	var name string
+	s.api.engine.ViewContext(r.Context(), func() { name = sr.Name })
+	s.render(w, r, http.StatusOK, "submit", "Submit to r/"+name, submission{Subreddit: name}, "")
+}
+
+func (s *site) submit(w http.ResponseWriter, r *http.Request, user *engine.User) {
+	sr, err := s.api.engine.LookupSubRedditContext(r.Context(), pathParam(r, "name"))
+	if err != nil {
+		s.render(w, r, http.StatusNotFound, "error", "Not found", nil, err.Error())
+		return
+	}
+	data := submission{Title: r.PostFormValue("title"), Content: r.PostFormValue("content")}
+	s.api.engine.ViewContext(r.Context(), func() { data.Subreddit = sr.Name })
+	post, err := s.api.engine.CreatePostContext(r.Context(), user, sr, data.Title, data.Content)
+	if err != nil {
+		noteError(r, err)
+		s.render(w, r, errorStatus(err), "submit", "Submit to r/"+data.Subreddit, data, formError(err))
+		return
+	}
+	var flash string
+	if s.held(r, &post.Held) {
+		flash = "Your post is being held for review by the moderators."
+	}
+	for _, repost := range s.api.engine.Reposts(r.Context(), post) {
+		if repost.Flagged {
+			flash = fmt.Sprintf("This looks like a repost of post %d, which is listed below.", repost.Post.ID)
+			break
+		}
+	}
+	s.done(w, r, "/posts/"+strconv.Itoa(post.ID), nil, flash)
+}
+
+func (s *site) join(w http.ResponseWriter, r *http.Request, user *engine.User) {
+	s.membership(w, r, user, "Joined", s.api.engine.JoinSubRedditContext)
+}
+
+func (s *site) leave(w http.ResponseWriter, r *http.Request, user *engine.User) {
+	s.membership(w, r, user, "Left", s.api.engine.LeaveSubRedditContext)
+}
+
+func (s *site) membership(w http.ResponseWriter, r *http.Request, user *engine.User, verb string, fn func(ctx context.Context, user *engine.User, sr *engine.SubReddit) error) {
+	name := pathParam(r, "name")
+	sr, err := s.api.engine.LookupSubRedditContext(r.Context(), name)
+	if err == nil {
+		err = fn(r.Context(), user, sr)
+	}
+	s.done(w, r, sitePath(r.PostFormValue("back"), "/r/"+url.PathEscape(name)), err, verb+" r/"+name)
+}
+
+// vote records the user's vote and returns to the page the form was on.
+// Requests from the layout's script ask for JSON with X-Requested-With and
+// get the updated post back instead of a redirect.
+func (s *site) vote(w http.ResponseWriter, r *http.Request, user *engine.User) {
+	post, err := s.api.postFromPath(r)
+	if err == nil {
+		var direction int
+		if direction, err = strconv.Atoi(r.PostFormValue("direction")); err != nil {
+			err = badRequest("direction must be -1, 0 or 1")
+		} else {
+			ctx := r.Context()
+			if ref := shareRef(r.PostFormValue("back")); ref != "" {
+				ctx = engine.WithVoteRef(ctx, ref)
+			}
+			err = s.api.engine.CastVoteContext(ctx, user, post, direction)
+		}
+	}
+	if r.Header.Get("X-Requested-With") == "fetch" {
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		m := s.api.newMapper(r)
+		m.viewer = user
+		writeJSON(w, r, mapOne(r.Context(), s.api.engine, post, m.post))
+		return
+	}
+	s.done(w, r, sitePath(r.PostFormValue("back"), "/posts/"+pathParam(r, "id")), err, "")
+}
+
+// shareRef returns the share link a vote came through: the ref parameter of
+// the page the vote was cast on.
+func shareRef(back string) string {
+	u, err := url.Parse(back)
+	if err != nil {
+		return ""
+	}
+	return u.Query().Get("ref")
+}
+
+// comment adds a comment to the post, or a reply to the comment named by
+// the parent field.
+func (s *site) comment(w http.ResponseWriter, r *http.Request, user *engine.User) {
+	post, err := s.api.postFromPath(r)
+	if err != nil {
+		s.render(w, r, http.StatusNotFound, "error", "Not found", nil, err.Error())
+		return
+	}
+	content := r.PostFormValue("content")
+	var c *engine.Comment
+	if parent := r.PostFormValue("parent"); parent != "" {
+		var id int
+		if id, err = strconv.Atoi(parent); err != nil {
+			err = badRequest("invalid comment ID")
+		} else if c, err = s.api.engine.LookupComment(r.Context(), post, id); err == nil {
+			c, err = s.api.engine.CreateReply(r.Context(), user, post, c, content)
+		}
+	} else {
+		c, err = s.api.engine.CreateCommentContext(r.Context(), user, post, content)
+	}
+	path := "/posts/" + strconv.Itoa(post.ID)
+	if err != nil {
+		s.done(w, r, path, err, "")
+		return
+	}
+	if s.held(r, &c.Held) {
+		s.done(w, r, path, nil, "Your comment is being held for review by the moderators.")
+		return
+	}
+	http.Redirect(w, r, path+"#c"+strconv.Itoa(c.ID), http.StatusSeeOther)
+}
+
+// inbox is the data of the inbox page, with the message being written.
+type inbox struct {
+	Messages []*MessageResponse
+	To       string
+	Content  string
+}
+
+func (s *site) inbox(w http.ResponseWriter, r *http.Request, user *engine.User) {
+	s.showInbox(w, r, user, http.StatusOK, inbox{To: r.URL.Query().Get("to")}, "")
+}
+
+// showInbox lists the messages sent to user, newest first.
+func (s *site) showInbox(w http.ResponseWriter, r *http.Request, user *engine.User, status int, data inbox, errMsg string) {
+	messages := s.api.engine.GetMessagesContext(r.Context(), user)
+	s.api.engine.ViewContext(r.Context(), func() {
+		m := s.api.newMapper(r)
+		for i := len(messages) - 1; i >= 0; i-- {
+			data.Messages = append(data.Messages, m.message(messages[i]))
+		}
+	})
+	s.render(w, r, status, "inbox", "Inbox", data, errMsg)
+}
+
+func (s *site) sendMessage(w http.ResponseWriter, r *http.Request, user *engine.User) {
+	data := inbox{To: strings.TrimSpace(r.PostFormValue("to")), Content: r.PostFormValue("content")}
+	recipient, err := s.api.engine.LookupUserContext(r.Context(), data.To)
+	var message *engine.Message
+	if err == nil {
+		message, err = s.api.engine.SendMessageContext(r.Context(), user, recipient, data.Content)
+	}
+	if err != nil {
+		noteError(r, err)
+		s.showInbox(w, r, user, errorStatus(err), data, formError(err))
+		return
+	}
+	if s.held(r, &message.Held) {
+		s.done(w, r, "/inbox", nil, "Your message to "+data.To+" is being held for review")
+		return
+	}
+	s.done(w, r, "/inbox", nil, "Message sent to "+data.To)
+}
+
+// held reads a post's, comment's or message's Held flag, which a word
+// filter sets when the item is created.
+func (s *site) held(r *http.Request, flag *bool) bool {
+	var held bool
+	s.api.engine.ViewContext(r.Context(), func() { held = *flag })
+	return held
+}
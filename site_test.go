@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// TestSitePages signs up through the front end, renders every page and
+// uses each form.
+func TestSitePages(t *testing.T) {
+	f := newFixture(t)
+	e, post := f.e, f.post
+	site := newTestAPI(e).Site()
+
+	b := &browser{h: site}
+
+	front := b.do("GET", "/", nil)
+	if front.Code != http.StatusOK || !strings.Contains(front.Body.String(), "Welcome") {
+		t.Fatalf("GET /: status %d\n%s", front.Code, front.Body)
+	}
+	csrf := csrfToken(t, front)
+
+	rec := b.do("POST", "/posts/1/vote", url.Values{"csrf": {csrf}, "direction": {"1"}, "back": {"/"}})
+	if loc := rec.Header().Get("Location"); rec.Code != http.StatusSeeOther || !strings.HasPrefix(loc, "/login?next=") {
+		t.Fatalf("vote without a session: status %d, location %s", rec.Code, loc)
+	}
+	if rec := b.do("POST", "/login", url.Values{"username": {"carol"}}); rec.Code != http.StatusForbidden {
+		t.Fatalf("login without CSRF token: status %d, want 403", rec.Code)
+	}
+	rec = b.do("POST", "/login", url.Values{"username": {"carol"}, "csrf": {csrf}, "next": {"https://evil.example/"}})
+	if loc := rec.Header().Get("Location"); rec.Code != http.StatusSeeOther || loc != "/" {
+		t.Fatalf("login: status %d, location %s\n%s", rec.Code, loc, rec.Body)
+	}
+	carol, err := e.LookupUser("carol")
+	if err != nil {
+		t.Fatal("login did not register carol")
+	}
+
+	for _, path := range []string{"/", "/?sort=top", "/?sort=new&page=2", "/r/news", "/r/news/submit", "/posts/1", "/inbox", "/login"} {
+		rec := b.do("GET", path, nil)
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "</html>") {
+			t.Errorf("GET %s: status %d, incomplete page:\n%s", path, rec.Code, rec.Body)
+		}
+	}
+	if rec := b.do("GET", "/?sort=worst", nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown sort: status %d, want 400", rec.Code)
+	}
+
+	forms := []struct {
+		path string
+		form url.Values
+	}{
+		{"/r/news/join", url.Values{}},
+		{"/r/news/submit", url.Values{"title": {"Hello from the web"}, "content": {"<b>not bold</b>"}}},
+		{"/posts/1/comments", url.Values{"content": {"Top level"}}},
+		{"/posts/1/comments", url.Values{"content": {"A reply"}, "parent": {"1"}}},
+		{"/inbox", url.Values{"to": {"alice"}, "content": {"Hi"}}},
+	}
+	for _, f := range forms {
+		f.form.Set("csrf", csrf)
+		rec := b.do("POST", f.path, f.form)
+		if loc := rec.Header().Get("Location"); rec.Code != http.StatusSeeOther || strings.Contains(loc, "error=") {
+			t.Errorf("POST %s: status %d, location %s\n%s", f.path, rec.Code, loc, rec.Body)
+		}
+	}
+	if rec := b.do("POST", "/posts/1/comments", url.Values{"content": {"No token"}}); rec.Code != http.StatusForbidden {
+		t.Errorf("comment without CSRF token: status %d, want 403", rec.Code)
+	}
+
+	comment, _ := e.LookupComment(context.Background(), post, 1)
+	if len(comment.Replies) != 1 || comment.Replies[0].Author != carol {
+		t.Errorf("reply to comment 1 not stored: %+v", comment.Replies)
+	}
+	if page := b.do("GET", "/posts/2", nil).Body.String(); !strings.Contains(page, "&lt;b&gt;not bold&lt;/b&gt;") {
+		t.Errorf("post content is not escaped:\n%s", page)
+	}
+
+	rec = b.do("POST", "/posts/1/vote", url.Values{"csrf": {csrf}, "direction": {"1"}}, "X-Requested-With", "fetch")
+	var resp PostResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.Score != 1 || resp.ViewerVote == nil || *resp.ViewerVote != 1 {
+		t.Errorf("scripted vote: status %d, body %s", rec.Code, rec.Body)
+	}
+}
+
+// TestFeeds reads each feed in both formats, checking that user content is
+// escaped, entry IDs do not depend on the host and unchanged feeds are not
+// sent again.
+func TestFeeds(t *testing.T) {
+	f := newFixture(t)
+	e := f.e
+	e.CreatePost(f.bob, f.news, "Tags <b>", "<script>alert(1)</script>")
+	site := newTestAPI(e).Site()
+
+	get := func(path, host string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Host = host
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		site.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, path := range []string{"/r/news/feed.rss?sort=new", "/u/bob/submitted.rss", "/u/alice/comments.rss", "/posts/1/comments.rss"} {
+		rec := get(path, "example.com")
+		var doc rss
+		if err := xml.Unmarshal(rec.Body.Bytes(), &doc); rec.Code != http.StatusOK || err != nil {
+			t.Fatalf("GET %s: status %d, %v\n%s", path, rec.Code, err, rec.Body)
+		}
+		if len(doc.Channel.Items) == 0 {
+			t.Errorf("GET %s: no items", path)
+		}
+		if path == "/r/news/feed.rss?sort=new" {
+			item := doc.Channel.Items[0]
+			if item.Title != "Tags <b>" || strings.Contains(item.Description, "<script>") {
+				t.Errorf("post is not escaped: %q, %q", item.Title, item.Description)
+			}
+			other := get(path, "mirror.example.org").Body.Bytes()
+			var mirrored rss
+			xml.Unmarshal(other, &mirrored)
+			if mirrored.Channel.Items[0].GUID.ID != item.GUID.ID {
+				t.Errorf("GUID depends on the host: %s, %s", item.GUID.ID, mirrored.Channel.Items[0].GUID.ID)
+			}
+		}
+
+		atomPath := strings.Replace(path, ".rss", ".atom", 1)
+		rec = get(atomPath, "example.com")
+		var feed atomFeed
+		if err := xml.Unmarshal(rec.Body.Bytes(), &feed); err != nil || len(feed.Entries) == 0 || !strings.HasPrefix(feed.Entries[0].ID, "urn:uuid:") {
+			t.Errorf("GET %s: status %d, %v\n%s", atomPath, rec.Code, err, rec.Body)
+		}
+		if rec := get(atomPath, "example.com", "If-None-Match", rec.Header().Get("ETag")); rec.Code != http.StatusNotModified {
+			t.Errorf("GET %s with its ETag: status %d, want 304", atomPath, rec.Code)
+		}
+	}
+	if rec := get("/r/news/feed.atom?sort=best", "example.com"); rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown sort: status %d, want 400", rec.Code)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reddit-clone/tracing"
+)
+
+// SetTracer enables tracing of API requests. It must be called before the
+// API serves requests.
+func (api *API) SetTracer(t *tracing.Tracer) {
+	api.tracer = t
+}
+
+// traceRequests starts a server span for each request, continuing the trace
+// in the client's traceparent header if there is one. The span is named
+// after the matched route once the router has run.
+func (api *API) traceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parent := tracing.ParseTraceparent(r.Header.Get("traceparent"))
+		ctx, span := api.tracer.StartRoot(r.Context(), r.Method+" "+r.URL.Path, tracing.KindServer, parent)
+		if span == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		defer span.End()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		if slot := routeSlotFrom(r.Context()); slot != nil && slot.route != nil {
+			span.SetName(r.Method + " " + slot.route.Pattern)
+			span.SetAttr("http.route", slot.route.Pattern)
+		}
+		span.SetAttr("http.request.method", r.Method)
+		span.SetAttr("url.path", r.URL.Path)
+		span.SetAttr("http.response.status_code", rec.status)
+		span.SetAttr("request_id", w.Header().Get("X-Request-ID"))
+		if rec.status >= 500 {
+			span.SetError(fmt.Errorf("%d %s", rec.status, http.StatusText(rec.status)))
+		}
+	})
+}
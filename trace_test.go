@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reddit-clone/logging"
+	"reddit-clone/tracing"
+	"sync"
+	"testing"
+)
+
+// TestTraceExport checks that a request continuing a client's trace is
+// exported to an OTLP collector as a server span under the client's span,
+// with the handler and engine spans beneath it, and that unsampled traces
+// are not recorded.
+func TestTraceExport(t *testing.T) {
+	type span struct {
+		TraceID      string `json:"traceId"`
+		SpanID       string `json:"spanId"`
+		ParentSpanID string `json:"parentSpanId"`
+		Name         string `json:"name"`
+		Kind         int    `json:"kind"`
+	}
+	var mu sync.Mutex
+	var spans []span
+	var services []string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ResourceSpans []struct {
+				Resource struct {
+					Attributes []struct {
+						Key   string
+						Value map[string]any
+					}
+				}
+				ScopeSpans []struct{ Spans []span }
+			}
+		}
+		if r.URL.Path != "/v1/traces" || json.NewDecoder(r.Body).Decode(&req) != nil {
+			http.Error(w, "bad export", http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rs := range req.ResourceSpans {
+			for _, a := range rs.Resource.Attributes {
+				if a.Key == "service.name" {
+					services = append(services, a.Value["stringValue"].(string))
+				}
+			}
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}))
+	defer collector.Close()
+
+	memory := tracing.NewMemoryExporter(10)
+	tracer := tracing.NewTracer(1, memory, tracing.NewOTLPExporter(collector.URL, "reddit-test", logging.Discard()))
+	api := newTestAPI(newFixture(t).e)
+	api.SetTracer(tracer)
+	c := newAPIClient(t, api)
+	const traceID, clientSpan = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	c.do("GET", "/api/v1/posts/1", "", "", "traceparent", "00-"+traceID+"-"+clientSpan+"-01")
+	c.do("GET", "/api/v1/posts/1", "", "", "traceparent", "00-"+traceID[:31]+"7-"+clientSpan+"-00")
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(services) == 0 || services[0] != "reddit-test" {
+		t.Errorf("service names %v", services)
+	}
+	byID := make(map[string]span)
+	var server span
+	for _, s := range spans {
+		if s.TraceID != traceID {
+			t.Errorf("span %q in trace %s, want %s", s.Name, s.TraceID, traceID)
+		}
+		byID[s.SpanID] = s
+		if s.Kind == int(tracing.KindServer) {
+			server = s
+		}
+	}
+	if server.Name != "GET /api/v1/posts/{id}" || server.ParentSpanID != clientSpan {
+		t.Fatalf("server span %+v; exported %+v", server, spans)
+	}
+	// Every other span descends from the server span.
+	var names []string
+	for _, s := range spans {
+		if s.SpanID == server.SpanID {
+			continue
+		}
+		names = append(names, s.Name)
+		p := s
+		for p.ParentSpanID != "" && p.SpanID != server.SpanID {
+			p = byID[p.ParentSpanID]
+		}
+		if p.SpanID != server.SpanID {
+			t.Errorf("span %q is not under the server span", s.Name)
+		}
+	}
+	found := false
+	for _, name := range names {
+		found = found || name == "handler getPost"
+	}
+	if !found {
+		t.Errorf("no handler span among %v", names)
+	}
+	if got := len(memory.Traces()); got != 1 {
+		t.Errorf("%d traces in memory, want 1", got)
+	}
+}
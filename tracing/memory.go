@@ -0,0 +1,228 @@
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"html/template"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxSpansPerTrace bounds the memory a single runaway trace can use.
+const maxSpansPerTrace = 2000
+
+// MemoryExporter keeps the most recent traces in memory for the
+// /debug/traces page.
+type MemoryExporter struct {
+	mu        sync.Mutex
+	maxTraces int
+	traces    map[TraceID]*memoryTrace
+	// order lists trace IDs oldest first.
+	order []TraceID
+}
+
+type memoryTrace struct {
+	spans []SpanData
+}
+
+func NewMemoryExporter(maxTraces int) *MemoryExporter {
+	return &MemoryExporter{maxTraces: maxTraces, traces: make(map[TraceID]*memoryTrace)}
+}
+
+func (m *MemoryExporter) ExportSpan(span SpanData) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.traces[span.TraceID]
+	if !ok {
+		t = &memoryTrace{}
+		m.traces[span.TraceID] = t
+		m.order = append(m.order, span.TraceID)
+		for len(m.order) > m.maxTraces {
+			delete(m.traces, m.order[0])
+			m.order = m.order[1:]
+		}
+	}
+	if len(t.spans) < maxSpansPerTrace {
+		t.spans = append(t.spans, span)
+	}
+}
+
+func (m *MemoryExporter) Shutdown(context.Context) error { return nil }
+
+// Trace returns the recorded spans of a trace ordered by start time.
+func (m *MemoryExporter) Trace(id TraceID) []SpanData {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.traces[id]
+	if !ok {
+		return nil
+	}
+	spans := append([]SpanData(nil), t.spans...)
+	sort.Slice(spans, func(i, j int) bool { return spans[i].Start.Before(spans[j].Start) })
+	return spans
+}
+
+// TraceSummary describes a recorded trace.
+type TraceSummary struct {
+	TraceID  TraceID
+	Name     string
+	Start    time.Time
+	Duration time.Duration
+	Spans    int
+	Errors   int
+}
+
+// Traces summarises the recorded traces, newest first.
+func (m *MemoryExporter) Traces() []TraceSummary {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	summaries := make([]TraceSummary, 0, len(m.order))
+	for i := len(m.order) - 1; i >= 0; i-- {
+		id := m.order[i]
+		summary := TraceSummary{TraceID: id, Spans: len(m.traces[id].spans)}
+		var end time.Time
+		for _, s := range m.traces[id].spans {
+			if summary.Start.IsZero() || s.Start.Before(summary.Start) {
+				summary.Start, summary.Name = s.Start, s.Name
+			}
+			if s.End.After(end) {
+				end = s.End
+			}
+			if s.Err != "" {
+				summary.Errors++
+			}
+		}
+		summary.Duration = end.Sub(summary.Start)
+		summaries = append(summaries, summary)
+	}
+	return summaries
+}
+
+// Handler serves an HTML list of recent traces, and a waterfall of one trace
+// when called with ?trace=<id>.
+func (m *MemoryExporter) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		traceParam := r.URL.Query().Get("trace")
+		if traceParam == "" {
+			tracesPage.Execute(w, m.Traces())
+			return
+		}
+		var id TraceID
+		if b, err := hex.DecodeString(traceParam); err != nil || len(b) != len(id) {
+			http.Error(w, "invalid trace ID", http.StatusBadRequest)
+			return
+		} else {
+			copy(id[:], b)
+		}
+		spans := m.Trace(id)
+		if spans == nil {
+			http.Error(w, "trace not found; it may have been evicted", http.StatusNotFound)
+			return
+		}
+		tracePage.Execute(w, waterfall(id, spans))
+	})
+}
+
+type waterfallView struct {
+	TraceID  TraceID
+	Duration time.Duration
+	Rows     []waterfallRow
+}
+
+type waterfallRow struct {
+	Span   SpanData
+	Depth  int
+	Offset float64 // percent of the trace duration
+	Width  float64
+}
+
+// waterfall orders spans depth first under their parents and positions
+// each as a bar relative to the whole trace.
+func waterfall(id TraceID, spans []SpanData) waterfallView {
+	start, end := spans[0].Start, spans[0].End
+	known := make(map[SpanID]bool)
+	children := make(map[SpanID][]SpanData)
+	for _, s := range spans {
+		known[s.SpanID] = true
+		if s.End.After(end) {
+			end = s.End
+		}
+	}
+	var roots []SpanData
+	for _, s := range spans {
+		if known[s.ParentID] {
+			children[s.ParentID] = append(children[s.ParentID], s)
+		} else {
+			roots = append(roots, s)
+		}
+	}
+	view := waterfallView{TraceID: id, Duration: end.Sub(start)}
+	total := float64(view.Duration)
+	if total <= 0 {
+		total = 1
+	}
+	var walk func(s SpanData, depth int)
+	walk = func(s SpanData, depth int) {
+		view.Rows = append(view.Rows, waterfallRow{
+			Span:   s,
+			Depth:  depth,
+			Offset: float64(s.Start.Sub(start)) / total * 100,
+			Width:  max(float64(s.Duration())/total*100, 0.2),
+		})
+		for _, c := range children[s.SpanID] {
+			walk(c, depth+1)
+		}
+	}
+	for _, s := range roots {
+		walk(s, 0)
+	}
+	return view
+}
+
+const pageStyle = `<style>
+body { font-family: system-ui, sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; width: 100%; }
+td, th { padding: 4px 8px; border-bottom: 1px solid #eee; text-align: left; font-size: 14px; }
+.bar { position: relative; height: 14px; background: #f4f4f4; }
+.bar span { position: absolute; height: 14px; background: #4a90d9; }
+.bar span.err { background: #d9534f; }
+.err { color: #d9534f; }
+code { font-size: 12px; }
+</style>`
+
+var tracesPage = template.Must(template.New("traces").Parse(`<!doctype html>
+<title>Traces</title>` + pageStyle + `
+<h1>Recent traces</h1>
+{{if not .}}<p>No traces recorded yet.</p>{{else}}
+<table>
+<tr><th>Operation</th><th>Started</th><th>Duration</th><th>Spans</th><th>Errors</th><th>Trace ID</th></tr>
+{{range .}}<tr>
+<td><a href="?trace={{.TraceID}}">{{.Name}}</a></td>
+<td>{{.Start.Format "15:04:05.000"}}</td>
+<td>{{.Duration}}</td>
+<td>{{.Spans}}</td>
+<td{{if .Errors}} class="err"{{end}}>{{.Errors}}</td>
+<td><code>{{.TraceID}}</code></td>
+</tr>{{end}}
+</table>{{end}}
+`))
+
+var tracePage = template.Must(template.New("trace").Parse(`<!doctype html>
+<title>Trace {{.TraceID}}</title>` + pageStyle + `
+<p><a href="?">&larr; all traces</a></p>
+<h1>Trace <code>{{.TraceID}}</code></h1>
+<p>Total {{.Duration}}</p>
+<table>
+<tr><th>Span</th><th>Duration</th><th style="width:50%">Timeline</th><th>Attributes</th></tr>
+{{range .Rows}}<tr>
+<td style="padding-left:{{.Depth}}em">{{.Span.Name}}{{if .Span.Err}} <span class="err">({{.Span.Err}})</span>{{end}}</td>
+<td>{{.Span.Duration}}</td>
+<td><div class="bar"><span{{if .Span.Err}} class="err"{{end}} style="left:{{printf "%.2f" .Offset}}%;width:{{printf "%.2f" .Width}}%"></span></div></td>
+<td><code>{{range .Span.Attrs}}{{.Key}}={{.Value}} {{end}}</code></td>
+</tr>{{end}}
+</table>
+`))
@@ -0,0 +1,286 @@
+// Package tracing records spans for requests as they pass through the API,
+// the engine and storage. Spans are propagated in context.Context and across
+// processes with the W3C traceparent header, and finished spans are handed
+// to exporters: an OTLP/HTTP exporter for a collector and an in-memory one
+// that backs the /debug/traces page.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+func (id SpanID) String() string  { return hex.EncodeToString(id[:]) }
+func (id TraceID) IsValid() bool  { return id != TraceID{} }
+func (id SpanID) IsValid() bool   { return id != SpanID{} }
+
+// Kind is the OTLP span kind.
+type Kind int
+
+const (
+	KindInternal Kind = 1
+	KindServer   Kind = 2
+	KindClient   Kind = 3
+)
+
+// Attr is a span attribute. Values are strings, ints, floats or bools.
+type Attr struct {
+	Key   string
+	Value any
+}
+
+// SpanData is the immutable record of a finished span.
+type SpanData struct {
+	TraceID  TraceID
+	SpanID   SpanID
+	ParentID SpanID
+	Name     string
+	Kind     Kind
+	Start    time.Time
+	End      time.Time
+	Attrs    []Attr
+	// Err is the error message if the span failed.
+	Err string
+}
+
+func (s SpanData) Duration() time.Duration { return s.End.Sub(s.Start) }
+
+// Exporter receives finished spans. ExportSpan must not block.
+type Exporter interface {
+	ExportSpan(SpanData)
+	Shutdown(context.Context) error
+}
+
+// Tracer starts root spans and sends finished spans to its exporters.
+type Tracer struct {
+	exporters []Exporter
+	// sampleRate is the fraction of new traces recorded. Traces continued
+	// from a traceparent header follow the caller's sampling decision.
+	sampleRate float64
+}
+
+// NewTracer returns a tracer that records sampleRate of new traces.
+func NewTracer(sampleRate float64, exporters ...Exporter) *Tracer {
+	return &Tracer{exporters: exporters, sampleRate: sampleRate}
+}
+
+// Shutdown flushes and stops every exporter.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	var errs []string
+	for _, exp := range t.exporters {
+		if err := exp.Shutdown(ctx); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("tracing: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Span is a span in progress. A nil *Span is valid and records nothing, so
+// callers never need to check whether tracing is on.
+type Span struct {
+	tracer *Tracer
+	mu     sync.Mutex
+	data   SpanData
+	ended  bool
+}
+
+type spanKey struct{}
+
+// FromContext returns the span carried by ctx, or nil.
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// ContextWith returns ctx carrying span.
+func ContextWith(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// StartRoot starts a span with no parent in this process. If remote is a
+// valid parent from a traceparent header the span joins that trace.
+func (t *Tracer) StartRoot(ctx context.Context, name string, kind Kind, remote Parent) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	data := SpanData{Name: name, Kind: kind, Start: time.Now(), SpanID: newSpanID()}
+	if remote.TraceID.IsValid() {
+		if !remote.Sampled {
+			return ctx, nil
+		}
+		data.TraceID, data.ParentID = remote.TraceID, remote.SpanID
+	} else {
+		data.TraceID = newTraceID()
+		if !t.sample(data.TraceID) {
+			return ctx, nil
+		}
+	}
+	span := &Span{tracer: t, data: data}
+	return ContextWith(ctx, span), span
+}
+
+// sample decides from the trace ID, so every process makes the same
+// decision for a trace.
+func (t *Tracer) sample(id TraceID) bool {
+	if t.sampleRate >= 1 {
+		return true
+	}
+	if t.sampleRate <= 0 {
+		return false
+	}
+	return float64(binary.BigEndian.Uint64(id[8:])>>11)/(1<<53) < t.sampleRate
+}
+
+// Start starts a child of the span in ctx. Without one it records nothing
+// and returns ctx unchanged.
+func Start(ctx context.Context, name string, attrs ...Attr) (context.Context, *Span) {
+	parent := FromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	span := &Span{tracer: parent.tracer, data: SpanData{
+		TraceID:  parent.data.TraceID,
+		SpanID:   newSpanID(),
+		ParentID: parent.data.SpanID,
+		Name:     name,
+		Kind:     KindInternal,
+		Start:    time.Now(),
+		Attrs:    attrs,
+	}}
+	return ContextWith(ctx, span), span
+}
+
+// SetName renames the span, e.g. once the route of a request is known.
+func (s *Span) SetName(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.data.Name = name
+	s.mu.Unlock()
+}
+
+// SetAttr sets an attribute, replacing any earlier value for key.
+func (s *Span) SetAttr(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.data.Attrs {
+		if s.data.Attrs[i].Key == key {
+			s.data.Attrs[i].Value = value
+			return
+		}
+	}
+	s.data.Attrs = append(s.data.Attrs, Attr{key, value})
+}
+
+// SetError marks the span as failed. A nil err is ignored.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.data.Err = err.Error()
+	s.mu.Unlock()
+}
+
+// End finishes the span and exports it. Later calls do nothing.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	data.Attrs = append([]Attr(nil), s.data.Attrs...)
+	s.mu.Unlock()
+	for _, exp := range s.tracer.exporters {
+		exp.ExportSpan(data)
+	}
+}
+
+// TraceID returns the span's trace ID, or the zero ID for a nil span.
+func (s *Span) TraceID() TraceID {
+	if s == nil {
+		return TraceID{}
+	}
+	return s.data.TraceID
+}
+
+// Parent identifies a span in another process.
+type Parent struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// ParseTraceparent parses a W3C traceparent header value. It returns the
+// zero Parent if the value is missing or malformed, which starts a new
+// trace.
+func ParseTraceparent(header string) Parent {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return Parent{}
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return Parent{}
+	}
+	var p Parent
+	var flags [1]byte
+	if _, err := hex.Decode(p.TraceID[:], []byte(parts[1])); err != nil {
+		return Parent{}
+	}
+	if _, err := hex.Decode(p.SpanID[:], []byte(parts[2])); err != nil {
+		return Parent{}
+	}
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return Parent{}
+	}
+	if !p.TraceID.IsValid() || !p.SpanID.IsValid() {
+		return Parent{}
+	}
+	p.Sampled = flags[0]&1 == 1
+	return p
+}
+
+// Traceparent formats the W3C traceparent header for the span, or "" for a
+// nil span.
+func (s *Span) Traceparent() string {
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-01", s.data.TraceID, s.data.SpanID)
+}
+
+func newTraceID() TraceID {
+	var id TraceID
+	rand.Read(id[:])
+	return id
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	rand.Read(id[:])
+	return id
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reddit-clone/engine"
+	"strings"
+	"testing"
+)
+
+// TestValidation checks the limits on names and content, that every invalid
+// field is reported at once, and that lengths count characters, not bytes.
+func TestValidation(t *testing.T) {
+	f := newFixture(t)
+	e := f.e
+	fieldsOf := func(err error) []string {
+		t.Helper()
+		var verr *engine.ValidationError
+		if !errors.As(err, &verr) || !errors.Is(err, engine.ErrInvalid) {
+			t.Fatalf("want a validation error, got %v", err)
+		}
+		var fields []string
+		for _, fe := range verr.Fields {
+			fields = append(fields, fe.Field)
+		}
+		return fields
+	}
+
+	for _, name := range []string{"ab", strings.Repeat("a", engine.MaxUsernameLength+1), "two words", "slash/name"} {
+		if _, err := e.RegisterAccount(name); strings.Join(fieldsOf(err), ",") != "username" {
+			t.Errorf("username %q: %v", name, err)
+		}
+	}
+	if _, err := e.RegisterAccount(strings.Repeat("a", engine.MaxUsernameLength)); err != nil {
+		t.Errorf("username of the maximum length: %v", err)
+	}
+	if _, err := e.CreateSubReddit("no-dashes"); strings.Join(fieldsOf(err), ",") != "name" {
+		t.Errorf("subreddit name with a dash: %v", err)
+	}
+	if _, err := e.CreateSubReddit("NEWS"); !errors.Is(err, engine.ErrConflict) {
+		t.Errorf("subreddit names differing in case: %v", err)
+	}
+
+	_, err := e.CreatePost(f.bob, f.news, "  ", strings.Repeat("x", engine.MaxPostLength+1))
+	if got := strings.Join(fieldsOf(err), ","); got != "title,content" {
+		t.Errorf("invalid post fields: %s", got)
+	}
+	if _, err := e.CreatePost(f.bob, f.news, strings.Repeat("é", engine.MaxTitleLength), ""); err != nil {
+		t.Errorf("title of the maximum length in two-byte characters: %v", err)
+	}
+	if _, err := e.CreateComment(f.alice, f.post, "bad \xff"); len(fieldsOf(err)) != 1 {
+		t.Errorf("comment with invalid UTF-8: %v", err)
+	}
+	if _, err := e.SendMessage(f.bob, f.alice, strings.Repeat("x", engine.MaxMessageLength+1)); len(fieldsOf(err)) != 1 {
+		t.Errorf("message over the limit: %v", err)
+	}
+
+	c := newAPIClient(t, newTestAPI(e))
+	rec := c.do("POST", "/api/v1/r/news/posts", "", `{"title":"","content":"`+strings.Repeat("x", engine.MaxPostLength+1)+`","username":"bob"}`)
+	var resp ErrorResponse
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if rec.Code != http.StatusBadRequest || len(resp.Error.Details) != 2 {
+		t.Errorf("invalid post through the API: status %d, %s", rec.Code, rec.Body)
+	}
+}
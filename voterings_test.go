@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reddit-clone/client"
+	"reddit-clone/engine"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestVoteRings checks that injected vote rings are found among ordinary
+// simulated activity, and that discounting a ring takes its votes out of
+// scores and karma until it is restored.
+func TestVoteRings(t *testing.T) {
+	sim := client.NewSimulator(nil)
+	sim.Run(50, 5, 100, 0, 10, 0)
+	injected := sim.InjectVoteRings(2, 4)
+	if found, falsePositives := sim.CheckVoteRings(injected); found != 2 || falsePositives != 0 {
+		t.Fatalf("found %d of 2 injected rings, %d other accounts flagged", found, falsePositives)
+	}
+
+	e := sim.Engine
+	e.GrantAdmin(context.Background(), nil, e.GetUserByUsername("user0"))
+	c := newAPIClient(t, newTestAPI(e))
+	var report VoteRingReportResponse
+	c.mustDo("GET", "/api/v1/admin/vote-rings", "user0", "", &report)
+	if len(report.Rings) != 2 {
+		t.Fatalf("report has %d rings, want 2", len(report.Rings))
+	}
+	ring := report.Rings[0]
+	if want := []string{engine.SignalCoVoting, engine.SignalNewAccountBurst, engine.SignalSharedLink}; !slices.Equal(ring.Signals, want) {
+		t.Errorf("signals %v, want %v", ring.Signals, want)
+	}
+	if len(ring.Members) != 4 || len(ring.Posts) != 5 || ring.Votes != 20 || len(ring.Refs) != 1 {
+		t.Errorf("ring: %d members, %d posts, %d votes, refs %v", len(ring.Members), len(ring.Posts), ring.Votes, ring.Refs)
+	}
+
+	post, _ := e.LookupPost(ring.Posts[0].ID)
+	author := post.Author
+	score, karma := post.Votes, author.Karma
+	path := "/api/v1/admin/vote-rings/" + ring.ID + "/discount"
+	if rec := c.do("PUT", path, "user0", ""); rec.Code != http.StatusOK {
+		t.Fatalf("discount: status %d\n%s", rec.Code, rec.Body)
+	}
+	if post.Votes != score-4 || author.Karma != karma-20 {
+		t.Errorf("after discounting: score %d, karma %d; want %d, %d", post.Votes, author.Karma, score-4, karma-20)
+	}
+	if rec := c.do("PUT", path, "user0", ""); rec.Code != http.StatusConflict {
+		t.Errorf("discounting twice: status %d", rec.Code)
+	}
+	// Members' later votes on the boosted posts stay discounted.
+	member := e.GetUserByUsername(ring.Members[0].User.Username)
+	e.CastVote(member, post, -1)
+	if post.Votes != score-4 {
+		t.Errorf("score after a discounted vote changed: %d", post.Votes)
+	}
+
+	// Discounts survive a snapshot.
+	var buf bytes.Buffer
+	e.WriteSnapshot(&buf)
+	restored := engine.NewRedditEngine()
+	if err := restored.ReadSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := restored.LookupPost(post.ID); len(p.Discounted) != 4 {
+		t.Errorf("restored post has %d discounted voters, want 4", len(p.Discounted))
+	}
+
+	if rec := c.do("DELETE", path, "user0", ""); rec.Code != http.StatusOK {
+		t.Fatalf("restore: status %d\n%s", rec.Code, rec.Body)
+	}
+	if post.Votes != score-2 || author.Karma != karma-2 {
+		t.Errorf("after restoring: score %d, karma %d; want %d, %d", post.Votes, author.Karma, score-2, karma-2)
+	}
+	var actions []string
+	for _, entry := range e.AuditLog(context.Background(), engine.AuditFilter{}) {
+		if entry.TargetType == engine.TargetVoteRing {
+			actions = append(actions, fmt.Sprintf("%s %s", entry.Action, entry.Target))
+		}
+	}
+	if want := []string{"votering.discount " + ring.ID, "votering.restore " + ring.ID}; !slices.Equal(actions, want) {
+		t.Errorf("audit log: %v, want %v", actions, want)
+	}
+}
+
+// TestVoteRefs checks that votes cast through the API record the share link
+// they came through.
+func TestVoteRefs(t *testing.T) {
+	f := newFixture(t)
+	e := f.e
+	api := newTestAPI(e)
+	for i := 0; i < 3; i++ {
+		e.RegisterAccount(fmt.Sprintf("voter%d", i))
+	}
+	for i := 0; i < 3; i++ {
+		post, _ := e.CreatePost(f.alice, f.news, fmt.Sprintf("Post %d", i), "")
+		for j := 0; j < 3; j++ {
+			body := fmt.Sprintf(`{"direction":1,"username":"voter%d","ref":"alice"}`, j)
+			rec := httptest.NewRecorder()
+			api.ServeHTTP(rec, httptest.NewRequest("POST", fmt.Sprintf("/api/v1/posts/%d/votes", post.ID), strings.NewReader(body)))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("vote: status %d\n%s", rec.Code, rec.Body)
+			}
+		}
+	}
+	report := e.DetectVoteRings(context.Background(), engine.DefaultVoteRingOptions())
+	if len(report.Rings) != 1 || !slices.Equal(report.Rings[0].Refs, []string{"alice"}) || !slices.Contains(report.Rings[0].Signals, engine.SignalSharedLink) {
+		t.Fatalf("rings: %+v", report.Rings)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reddit-clone/engine"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestBufferedVotes checks that buffered votes are seen by their voter at
+// once and by everyone else after a flush, or at once in strict mode.
+func TestBufferedVotes(t *testing.T) {
+	f := newFixture(t)
+	e := f.e
+	e.BufferVotes(engine.VoteBuffering{Shards: 4})
+	c := newAPIClient(t, newTestAPI(e))
+	var events atomic.Int32
+	e.Subscribe(func(ev engine.Event) {
+		if ev.Type == engine.EventVoteCast {
+			events.Add(1)
+		}
+	})
+	post := func(method, body string, header ...string) PostResponse {
+		t.Helper()
+		path := "/api/v1/posts/1"
+		if method == "POST" {
+			path += "/votes"
+		}
+		rec := c.do(method, path, "", body, header...)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s %s: status %d\n%s", method, path, rec.Code, rec.Body)
+		}
+		var resp PostResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return resp
+	}
+
+	voted := post("POST", `{"direction":-1,"username":"alice"}`)
+	voted = post("POST", `{"direction":1,"username":"alice"}`)
+	if voted.Score != 1 || voted.ViewerVote == nil || *voted.ViewerVote != 1 {
+		t.Errorf("vote response: score %d, viewer vote %v", voted.Score, voted.ViewerVote)
+	}
+	if got := post("GET", "", "X-Username", "alice"); got.Score != 1 {
+		t.Errorf("voter's score before the flush: %d, want 1", got.Score)
+	}
+	if got := post("GET", ""); got.Score != 0 {
+		t.Errorf("anonymous score before the flush: %d, want 0", got.Score)
+	}
+	if n := e.FlushVotes(); n != 1 {
+		t.Errorf("flush applied %d votes, want 1", n)
+	}
+	if got := post("GET", ""); got.Score != 1 {
+		t.Errorf("anonymous score after the flush: %d, want 1", got.Score)
+	}
+	bob := f.bob
+	if bob.Karma != 1 || events.Load() != 1 {
+		t.Errorf("after the flush: bob's karma %d, %d vote events", bob.Karma, events.Load())
+	}
+
+	// Votes of users suspended before the flush are dropped.
+	post("POST", `{"direction":-1,"username":"alice"}`)
+	e.SuspendUser(context.Background(), bob, f.alice, "Spam", time.Time{})
+	e.FlushVotes()
+	if got := post("GET", ""); got.Score != 1 {
+		t.Errorf("score after a suspended user's vote: %d, want 1", got.Score)
+	}
+	// Votes of users who are already suspended are refused, not buffered.
+	if rec := c.do("POST", "/api/v1/posts/1/votes", "", `{"direction":1,"username":"alice"}`); rec.Code != http.StatusForbidden {
+		t.Errorf("buffered vote by a suspended user: status %d", rec.Code)
+	}
+	if stats := e.VoteStats(); stats.Buffered != 3 || stats.Applied != 1 || stats.Dropped != 1 || stats.Pending != 0 {
+		t.Errorf("vote stats: %+v", stats)
+	}
+	e.UnsuspendUser(context.Background(), bob, f.alice)
+	if rec := c.do("POST", "/api/v1/posts/1/votes", "", `{"direction":1,"username":"alice"}`); rec.Code != http.StatusOK {
+		t.Errorf("buffered vote after the suspension was lifted: status %d", rec.Code)
+	}
+
+	e.BufferVotes(engine.VoteBuffering{Shards: 4, Strict: true})
+	post("POST", `{"direction":0,"username":"bob"}`)
+	post("POST", `{"upvote":true}`)
+	if got := post("GET", ""); got.Score != 2 {
+		t.Errorf("anonymous score in strict mode: %d, want 2", got.Score)
+	}
+}
+
+// BenchmarkVotes compares applying votes under the engine lock with
+// buffering them, with one read of a post for every ten votes. The API is
+// created so that its caches and metrics listen to the engine, as in the
+// server.
+func BenchmarkVotes(b *testing.B) {
+	for _, mode := range []struct {
+		name   string
+		buffer *engine.VoteBuffering
+	}{
+		{"direct", nil},
+		{"buffered", &engine.VoteBuffering{Shards: 32}},
+		{"strict", &engine.VoteBuffering{Shards: 32, Strict: true}},
+	} {
+		b.Run(mode.name, func(b *testing.B) {
+			e := engine.NewRedditEngine()
+			newTestAPI(e)
+			author, _ := e.RegisterAccount("author")
+			sr, _ := e.CreateSubReddit("bench")
+			users := make([]*engine.User, 1000)
+			for i := range users {
+				users[i], _ = e.RegisterAccount(fmt.Sprintf("voter%d", i))
+			}
+			posts := make([]*engine.Post, 100)
+			for i := range posts {
+				posts[i], _ = e.CreatePost(author, sr, fmt.Sprintf("Post %d", i), "")
+			}
+			if mode.buffer != nil {
+				e.BufferVotes(*mode.buffer)
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				go e.RunVoteFlusher(ctx, 10*time.Millisecond)
+			}
+			var seq atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					n := int(seq.Add(1))
+					post := posts[n%len(posts)]
+					if n%10 == 0 {
+						e.View(func() { _ = post.Votes })
+						continue
+					}
+					e.CastVote(users[n/len(posts)%len(users)], post, 1-2*(n/7%2))
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reddit-clone/engine"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestWordFilters checks that a subreddit's filters mask, reject and hold
+// posts and comments however the words are disguised, that the site's
+// filters also cover messages, and that held items wait in the moderation
+// queue until they are approved.
+func TestWordFilters(t *testing.T) {
+	e := newFixture(t).e
+	c := newAPIClient(t, newTestAPI(e))
+	submit := func(title, content string) *httptest.ResponseRecorder {
+		t.Helper()
+		body, _ := json.Marshal(SubmitPostRequest{Title: title, Content: content, Username: "alice"})
+		return c.do("POST", "/api/v1/r/news/posts", "alice", string(body))
+	}
+
+	for _, f := range []string{
+		`{"kind":"word","pattern":"darn","action":"mask"}`,
+		`{"kind":"wildcard","pattern":"spam*","action":"review"}`,
+		`{"kind":"regex","pattern":"free\\s+money","action":"reject"}`,
+	} {
+		c.mustDo("POST", "/api/v1/r/news/filters", "bob", f, nil)
+	}
+	if rec := c.do("POST", "/api/v1/r/news/filters", "alice", `{"kind":"word","pattern":"heck","action":"mask"}`); rec.Code != http.StatusForbidden {
+		t.Errorf("non-moderator added a filter: status %d", rec.Code)
+	}
+	for _, f := range []string{
+		`{"kind":"word","pattern":"darn","action":"reject"}`,
+		`{"kind":"phrase","pattern":"heck","action":"mask"}`,
+		`{"kind":"regex","pattern":"(unclosed","action":"mask"}`,
+		`{"kind":"regex","pattern":"a*","action":"mask"}`,
+		`{"kind":"word","pattern":"heck","action":"delete"}`,
+	} {
+		if rec := c.do("POST", "/api/v1/r/news/filters", "bob", f); rec.Code != http.StatusBadRequest && rec.Code != http.StatusConflict {
+			t.Errorf("filter %s: status %d", f, rec.Code)
+		}
+	}
+
+	var post PostResponse
+	for content, want := range map[string]string{
+		"Well darn it":                  "Well **** it",
+		"Well d\u200barn it":            "Well **** it", // zero-width space
+		"Well d\u0430rn it":             "Well **** it", // Cyrillic a
+		"Well \uff24\uff21\uff32\uff2e": "Well ****",    // fullwidth
+		"Well d4rn it":                  "Well **** it",
+		"Well da\u0301rn it":            "Well **** it", // combining accent
+		"Darned if I know":              "Darned if I know",
+	} {
+		rec := submit("A title", content)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("submit %q: status %d\n%s", content, rec.Code, rec.Body)
+		}
+		json.Unmarshal(rec.Body.Bytes(), &post)
+		if post.Content != want {
+			t.Errorf("submit %q: content %q, want %q", content, post.Content, want)
+		}
+	}
+	for _, content := range []string{"Get free money now", "Get FR33   m0ney now", "Get fr\u200bee mon\u0435y"} {
+		if rec := submit("A title", content); rec.Code != http.StatusBadRequest {
+			t.Errorf("submit %q: status %d, want 400", content, rec.Code)
+		}
+	}
+
+	var comment CommentResponse
+	c.mustDo("POST", "/api/v1/posts/1/comments", "alice", `{"content":"Buy my spammy links","username":"alice"}`, &comment)
+	if !comment.Held || !comment.Removed {
+		t.Fatalf("comment not held: %+v", comment)
+	}
+	if rec := c.do("GET", "/api/v1/r/news/modqueue", "alice", ""); rec.Code != http.StatusForbidden {
+		t.Errorf("non-moderator read the queue: status %d", rec.Code)
+	}
+	var queue ModQueueResponse
+	c.mustDo("GET", "/api/v1/r/news/modqueue", "bob", "", &queue)
+	if len(queue.Items) != 1 || queue.Items[0].CommentID != comment.ID || queue.Items[0].Content != "Buy my spammy links" {
+		t.Fatalf("queue: %+v", queue.Items)
+	}
+	c.mustDo("DELETE", "/api/v1/posts/1/comments/"+strconv.Itoa(comment.ID)+"/removal", "bob", "", nil)
+	c.mustDo("GET", "/api/v1/r/news/modqueue", "bob", "", &queue)
+	if len(queue.Items) != 0 {
+		t.Errorf("queue after approving: %+v", queue.Items)
+	}
+	p, _ := e.LookupPost(1)
+	approved, _ := e.LookupComment(context.Background(), p, comment.ID)
+	if approved.Removed || approved.Held {
+		t.Errorf("approved comment: removed %v, held %v", approved.Removed, approved.Held)
+	}
+
+	// Site filters cover messages, which admins review.
+	c.mustDo("POST", "/api/v1/admin/filters", "bob", `{"kind":"word","pattern":"meet up","action":"review"}`, nil)
+	c.mustDo("POST", "/api/v1/admin/filters", "bob", `{"kind":"word","pattern":"jerk","action":"reject"}`, nil)
+	if rec := c.do("POST", "/api/v1/admin/filters", "alice", `{"kind":"word","pattern":"heck","action":"mask"}`); rec.Code != http.StatusForbidden {
+		t.Errorf("non-admin added a site filter: status %d", rec.Code)
+	}
+	if rec := c.do("POST", "/api/v1/users/bob/messages", "alice", `{"from":"alice","content":"You j\u0435rk"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("rejected message: status %d", rec.Code)
+	}
+	var message MessageResponse
+	c.mustDo("POST", "/api/v1/users/bob/messages", "alice", `{"from":"alice","content":"Want to MEET-UP later?"}`, &message)
+	if !message.Held {
+		t.Fatalf("message not held: %+v", message)
+	}
+	var inbox []MessageResponse
+	c.mustDo("GET", "/api/v1/users/bob/messages", "bob", "", &inbox)
+	if len(inbox) != 0 {
+		t.Errorf("held message delivered: %+v", inbox)
+	}
+	c.mustDo("GET", "/api/v1/admin/modqueue", "bob", "", &queue)
+	if len(queue.Items) != 1 || queue.Items[0].MessageID != message.ID {
+		t.Fatalf("site queue: %+v", queue.Items)
+	}
+	c.mustDo("DELETE", "/api/v1/admin/messages/"+strconv.Itoa(message.ID)+"/removal", "bob", "", nil)
+	c.mustDo("GET", "/api/v1/users/bob/messages", "bob", "", &inbox)
+	if len(inbox) != 1 || inbox[0].Content != "Want to MEET-UP later?" {
+		t.Errorf("inbox after approving: %+v", inbox)
+	}
+
+	var filters []WordFilterResponse
+	c.mustDo("GET", "/api/v1/r/news/filters", "bob", "", &filters)
+	if len(filters) != 3 || filters[2].Kind != engine.FilterRegex {
+		t.Fatalf("filters: %+v", filters)
+	}
+	c.mustDo("DELETE", "/api/v1/r/news/filters/1", "bob", "", nil)
+	if rec := c.do("DELETE", "/api/v1/r/news/filters/1", "bob", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("removing a filter twice: status %d", rec.Code)
+	}
+	if rec := submit("A title", "Well darn it"); !strings.Contains(rec.Body.String(), "Well darn it") {
+		t.Errorf("removed filter still masks: %s", rec.Body)
+	}
+
+	// Filters survive a snapshot.
+	var buf bytes.Buffer
+	e.WriteSnapshot(&buf)
+	restored := engine.NewRedditEngine()
+	if err := restored.ReadSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	news := restored.GetSubRedditByName("news")
+	alice := restored.GetUserByUsername("alice")
+	if len(news.WordFilters) != 2 {
+		t.Errorf("restored subreddit has %d filters, want 2", len(news.WordFilters))
+	}
+	if _, err := restored.CreatePost(alice, news, "Free money", "free money"); err == nil {
+		t.Error("restored engine accepted a rejected post")
+	}
+	if _, err := restored.SendMessage(alice, restored.GetUserByUsername("bob"), "jerk"); err == nil {
+		t.Error("restored engine accepted a rejected message")
+	}
+}